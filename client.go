@@ -0,0 +1,661 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+type (
+	// Client a high-level client sharing one session of the address across goroutines,
+	// whose calls support the per-call options, e.g.
+	//  cli := tp.NewClient(peer, "127.0.0.1:9090")
+	//  rerr := cli.Pull("/home/test", args, &reply, tp.CallTimeout(time.Second), tp.CallRetry(2))
+	// Note: It is concurrent safe.
+	Client struct {
+		peer       Peer
+		addr       string
+		protoFuncs []socket.ProtoFunc
+		sess       Session
+		mu         sync.Mutex
+	}
+	// CallOption the option of a client call.
+	CallOption  func(*callOptions)
+	callOptions struct {
+		timeout     time.Duration
+		retry       int
+		settings    []socket.PacketSetting
+		mirror      Session
+		mirrorRatio float64
+	}
+)
+
+// NewClient creates a client of the address, which dials when calling first.
+func NewClient(peer Peer, addr string, protoFunc ...socket.ProtoFunc) *Client {
+	return &Client{
+		peer:       peer,
+		addr:       addr,
+		protoFuncs: protoFunc,
+	}
+}
+
+// CallTimeout sets the timeout of the call,
+// after which the PULL fails with CodePullTimeout.
+func CallTimeout(timeout time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = timeout
+	}
+}
+
+// CallRetry sets the maximum times of retries,
+// when the call fails with the connection error or CodePullTimeout.
+// Note:
+//  The handler of the remote peer may be called more than once;
+//  The retries are also bounded by the retry budget of the peer, see Peer.SetRetryBudget.
+func CallRetry(retry int) CallOption {
+	return func(o *callOptions) {
+		o.retry = retry
+	}
+}
+
+// CallBodyCodec sets the body codec of the call.
+func CallBodyCodec(bodyCodec byte) CallOption {
+	return CallSetting(socket.WithBodyCodec(bodyCodec))
+}
+
+// CallMeta sets the 'key=value' metadata of the call.
+func CallMeta(key, value string) CallOption {
+	return CallSetting(socket.WithSetMeta(key, value))
+}
+
+// CallSetting appends the packet settings to the call.
+func CallSetting(setting ...socket.PacketSetting) CallOption {
+	return func(o *callOptions) {
+		o.settings = append(o.settings, setting...)
+	}
+}
+
+// CallMirror mirrors the ratio (0~1) of the PULLs to the secondary session,
+// ignoring its replies and errors, e.g. for dark-launch testing of a new backend.
+// Note:
+//  The mirrored PULL is marked with the MetaMirror metadata;
+//  It is written asynchronously, so the stalled secondary session never delays the production PULL,
+//  and it is dropped if there are no concurrent resources;
+//  The args must not be modified after the call, since it may be encoded after the production PULL.
+func CallMirror(mirror Session, ratio float64) CallOption {
+	return func(o *callOptions) {
+		o.mirror = mirror
+		o.mirrorRatio = ratio
+	}
+}
+
+func newCallOptions(option []CallOption) *callOptions {
+	o := new(callOptions)
+	for _, fn := range option {
+		if fn != nil {
+			fn(o)
+		}
+	}
+	return o
+}
+
+// mirrorPull mirrors the sampled PULL to the secondary session in another goroutine without waiting for the reply.
+func (o *callOptions) mirrorPull(uri string, args interface{}) {
+	if o.mirror == nil || o.mirrorRatio <= 0 || !o.mirror.Health() {
+		return
+	}
+	if o.mirrorRatio < 1 && rand.Float64() >= o.mirrorRatio {
+		return
+	}
+	settings := make([]socket.PacketSetting, 0, len(o.settings)+1)
+	settings = append(settings, o.settings...)
+	settings = append(settings, socket.WithSetMeta(MetaMirror, "1"))
+	mirror := o.mirror
+	Go(func() {
+		mirror.AsyncPull(uri, args, nil, make(chan PullCmd, 1), settings...)
+	})
+}
+
+func (o *callOptions) needRetry(rerr *Rerror) bool {
+	return IsConnRerror(rerr) || (rerr != nil && rerr.Code == CodePullTimeout)
+}
+
+// Session returns the shared session, and dials if it is not usable.
+func (c *Client) Session() (Session, *Rerror) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil && c.sess.Health() {
+		return c.sess, nil
+	}
+	sess, rerr := c.peer.Dial(c.addr, c.protoFuncs...)
+	if rerr != nil {
+		return nil, rerr
+	}
+	c.sess = sess
+	return sess, nil
+}
+
+// Pull sends a packet and receives the reply into the reply argument.
+func (c *Client) Pull(uri string, args interface{}, reply interface{}, option ...CallOption) *Rerror {
+	o := newCallOptions(option)
+	o.mirrorPull(uri, args)
+	budget := c.peer.RetryBudget()
+	budget.Deposit()
+	var rerr *Rerror
+	for i := 0; i <= o.retry; i++ {
+		if rerr = c.pull(uri, args, reply, o); i == o.retry || !o.needRetry(rerr) || !budget.Withdraw() {
+			break
+		}
+	}
+	return rerr
+}
+
+func (c *Client) pull(uri string, args interface{}, reply interface{}, o *callOptions) *Rerror {
+	sess, rerr := c.Session()
+	if rerr != nil {
+		return rerr
+	}
+	return o.pull(sess, uri, args, reply)
+}
+
+// pull pulls by the session once with the call options.
+func (o *callOptions) pull(sess Session, uri string, args interface{}, reply interface{}) *Rerror {
+	if o.timeout <= 0 {
+		return sess.Pull(uri, args, reply, o.settings...).Rerror()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	cmd := sess.AsyncPull(uri, args, reply, make(chan PullCmd, 1), append(o.settings, socket.WithContext(ctx))...)
+	select {
+	case <-cmd.Done():
+	case <-ctx.Done():
+		if p, ok := cmd.(*pullCmd); ok {
+			p.mu.Lock()
+			if p.isPending() {
+				p.abort(rerrPullTimeout.Copy().SetDetail(fmt.Sprintf("no reply after %v", o.timeout)))
+			}
+			p.mu.Unlock()
+		}
+		<-cmd.Done()
+	}
+	return cmd.Rerror()
+}
+
+// Push sends a packet, but do not receives reply.
+func (c *Client) Push(uri string, args interface{}, option ...CallOption) *Rerror {
+	o := newCallOptions(option)
+	budget := c.peer.RetryBudget()
+	budget.Deposit()
+	var rerr *Rerror
+	for i := 0; i <= o.retry; i++ {
+		if rerr = c.push(uri, args, o); i == o.retry || !o.needRetry(rerr) || !budget.Withdraw() {
+			break
+		}
+	}
+	return rerr
+}
+
+func (c *Client) push(uri string, args interface{}, o *callOptions) *Rerror {
+	sess, rerr := c.Session()
+	if rerr != nil {
+		return rerr
+	}
+	return o.push(sess, uri, args)
+}
+
+// push pushes by the session once with the call options.
+func (o *callOptions) push(sess Session, uri string, args interface{}) *Rerror {
+	if o.timeout <= 0 {
+		return sess.Push(uri, args, o.settings...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	return sess.Push(uri, args, append(o.settings, socket.WithContext(ctx))...)
+}
+
+// Close closes the shared session.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess == nil {
+		return nil
+	}
+	err := c.sess.Close()
+	c.sess = nil
+	return err
+}
+
+type (
+	// SessionPool a pool maintaining the sessions to the addresses,
+	// whose calls pick a session by the balance strategy, and fail over automatically, e.g.
+	//  pool := tp.NewSessionPool(peer, tp.SessionPoolConfig{Addrs: []string{"127.0.0.1:9090", "127.0.0.1:9091"}, SizePerAddr: 2})
+	//  rerr := pool.Pull("/home/test", args, &reply, tp.CallTimeout(time.Second))
+	// Note: It is concurrent safe.
+	SessionPool struct {
+		peer       Peer
+		cfg        SessionPoolConfig
+		protoFuncs []socket.ProtoFunc
+		members    []*poolMember
+		counter    uint32
+		closeCh    chan struct{}
+		closeOnce  sync.Once
+		started    bool // the initial dialing is done
+	}
+	// SessionPoolConfig the config of the session pool.
+	SessionPoolConfig struct {
+		// Addrs the addresses of the peers
+		Addrs []string
+		// SizePerAddr the number of sessions per address, 1 by default
+		SizePerAddr int
+		// Strategy the balance strategy, BalanceRoundRobin by default
+		Strategy BalanceStrategy
+		// HealthCheckInterval the interval of redialing the broken sessions,
+		// if less than or equal to 0, they are redialed only when no session is available
+		HealthCheckInterval time.Duration
+		// SlowStart the window of ramping the traffic share of a newly connected session up gradually,
+		// so that the cold caches of the backend do not cause a latency spike;
+		// if less than or equal to 0, no slow start
+		// Note: the sessions dialed when the pool is created start with the full share
+		SlowStart time.Duration
+	}
+	// BalanceStrategy the strategy of picking a session from the pool.
+	BalanceStrategy int
+	poolMember      struct {
+		addr    string
+		sess    Session   // nil means broken
+		since   time.Time // when the session is connected, zero means the full share
+		pending int32
+		mu      sync.RWMutex
+	}
+)
+
+// Balance strategies
+const (
+	// BalanceRoundRobin picks the available sessions in turn
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceLeastPending picks the available session with the least pending calls,
+	// and the one with the lowest smoothed RTT of Session.Stats() among the ties,
+	// where the one without RTT sample is preferred so that it gets measured
+	BalanceLeastPending
+)
+
+// slowStartMinShare the minimum traffic share of a session in slow start.
+const slowStartMinShare = 0.01
+
+// NewSessionPool creates a session pool, and dials all the sessions.
+// Note: the failed ones are logged and redialed later, and so are the draining ones, see DrainUri.
+func NewSessionPool(peer Peer, cfg SessionPoolConfig, protoFunc ...socket.ProtoFunc) *SessionPool {
+	if len(cfg.Addrs) == 0 {
+		Fatalf("session pool: addrs can not be empty")
+	}
+	if cfg.SizePerAddr <= 0 {
+		cfg.SizePerAddr = 1
+	}
+	p := &SessionPool{
+		peer:       peer,
+		cfg:        cfg,
+		protoFuncs: protoFunc,
+		closeCh:    make(chan struct{}),
+	}
+	for _, addr := range cfg.Addrs {
+		for i := 0; i < cfg.SizePerAddr; i++ {
+			p.members = append(p.members, &poolMember{addr: addr})
+		}
+	}
+	p.redialBroken()
+	p.started = true
+	if cfg.HealthCheckInterval > 0 {
+		go p.healthCheck()
+	}
+	return p
+}
+
+// Pull sends a packet by a picked session, and receives the reply into the reply argument.
+// Note: if the session is broken, fails over to another one.
+func (p *SessionPool) Pull(uri string, args interface{}, reply interface{}, option ...CallOption) *Rerror {
+	o := newCallOptions(option)
+	o.mirrorPull(uri, args)
+	return p.call(o, func(sess Session) *Rerror {
+		return o.pull(sess, uri, args, reply)
+	})
+}
+
+// Push sends a packet by a picked session, but do not receives reply.
+// Note: if the session is broken, fails over to another one.
+func (p *SessionPool) Push(uri string, args interface{}, option ...CallOption) *Rerror {
+	o := newCallOptions(option)
+	return p.call(o, func(sess Session) *Rerror {
+		return o.push(sess, uri, args)
+	})
+}
+
+// Available returns the number of the available sessions.
+func (p *SessionPool) Available() int {
+	var n int
+	for _, m := range p.members {
+		if m.session() != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the health check, and closes all the sessions.
+func (p *SessionPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+		for _, m := range p.members {
+			m.mu.Lock()
+			if m.sess != nil {
+				m.sess.Close()
+				m.sess = nil
+			}
+			m.mu.Unlock()
+		}
+	})
+}
+
+// call calls by the picked sessions, until it is not a connection error or all the sessions are tried.
+func (p *SessionPool) call(o *callOptions, fn func(Session) *Rerror) *Rerror {
+	var (
+		rerr   *Rerror
+		retry  = o.retry
+		tried  int
+		budget = p.peer.RetryBudget()
+	)
+	budget.Deposit()
+	for tried < len(p.members) {
+		m, sess := p.pick()
+		if sess == nil {
+			if rerr == nil {
+				rerr = rerrDialFailed.Copy().SetDetail("no available session in the pool")
+			}
+			return rerr
+		}
+		atomic.AddInt32(&m.pending, 1)
+		rerr = fn(sess)
+		atomic.AddInt32(&m.pending, -1)
+		if IsConnRerror(rerr) {
+			m.broken(sess)
+			tried++
+			continue
+		}
+		if rerr != nil && rerr.Code == CodePullTimeout && retry > 0 && budget.Withdraw() {
+			retry--
+			continue
+		}
+		return rerr
+	}
+	return rerr
+}
+
+// pick picks an available session by the balance strategy,
+// and redials the broken ones if there is no available session.
+func (p *SessionPool) pick() (*poolMember, Session) {
+	m, sess := p.pickAvailable()
+	if sess == nil {
+		p.redialBroken()
+		m, sess = p.pickAvailable()
+	}
+	return m, sess
+}
+
+func (p *SessionPool) pickAvailable() (*poolMember, Session) {
+	// starts from the next one in turn, so that the ties are spread
+	n := uint32(len(p.members))
+	start := atomic.AddUint32(&p.counter, 1)
+	now := time.Now()
+	switch p.cfg.Strategy {
+	case BalanceLeastPending:
+		var (
+			picked     *poolMember
+			pickedSess Session
+			pickedRTT  time.Duration
+			least      float64
+		)
+		for i := uint32(0); i < n; i++ {
+			m := p.members[(start+i)%n]
+			sess := m.session()
+			if sess == nil {
+				continue
+			}
+			// the pending calls are scaled up by the share of slow start
+			load := float64(atomic.LoadInt32(&m.pending) + 1)
+			if share := m.share(now, p.cfg.SlowStart); share < 1 {
+				load /= share
+			}
+			rtt := sess.Stats().RTT()
+			if picked == nil || load < least || (load == least && rtt < pickedRTT) {
+				picked, pickedSess, pickedRTT, least = m, sess, rtt, load
+			}
+		}
+		return picked, pickedSess
+	default:
+		var (
+			skipped     *poolMember
+			skippedSess Session
+		)
+		for i := uint32(0); i < n; i++ {
+			m := p.members[(start+i)%n]
+			sess := m.session()
+			if sess == nil {
+				continue
+			}
+			// the session in slow start is skipped by the probability of its share
+			if share := m.share(now, p.cfg.SlowStart); share < 1 && rand.Float64() >= share {
+				if skipped == nil {
+					skipped, skippedSess = m, sess
+				}
+				continue
+			}
+			return m, sess
+		}
+		return skipped, skippedSess
+	}
+}
+
+// redialBroken redials the broken sessions.
+func (p *SessionPool) redialBroken() {
+	for _, m := range p.members {
+		select {
+		case <-p.closeCh:
+			return
+		default:
+		}
+		if m.session() != nil {
+			continue
+		}
+		sess, rerr := p.peer.Dial(m.addr, p.protoFuncs...)
+		if rerr != nil {
+			Warnf("session pool: dial %s fail: %s", m.addr, rerr.String())
+			continue
+		}
+		var draining Session
+		m.mu.Lock()
+		if m.sess == nil || m.sess.Draining() {
+			draining = m.sess
+			m.sess = sess
+			sess = nil
+			if p.started && p.cfg.SlowStart > 0 {
+				m.since = time.Now()
+			}
+		}
+		m.mu.Unlock()
+		if sess != nil {
+			sess.Close()
+		}
+		if draining != nil {
+			// closes after the in-flight calls are done
+			go draining.Close()
+		}
+	}
+}
+
+func (p *SessionPool) healthCheck() {
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case <-ticker.C:
+			p.redialBroken()
+		}
+	}
+}
+
+// session returns the available session, or nil.
+func (m *poolMember) session() Session {
+	m.mu.RLock()
+	sess := m.sess
+	m.mu.RUnlock()
+	if sess == nil {
+		return nil
+	}
+	if !sess.Health() {
+		m.broken(sess)
+		return nil
+	}
+	if sess.Draining() {
+		// replaced by redialBroken
+		return nil
+	}
+	return sess
+}
+
+// share returns the traffic share of the session in (0,1] during slow start.
+func (m *poolMember) share(now time.Time, slowStart time.Duration) float64 {
+	m.mu.RLock()
+	since := m.since
+	m.mu.RUnlock()
+	if since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= slowStart {
+		return 1
+	}
+	// keeps a little share, so that the new session is warmed up by the real traffic
+	return math.Max(float64(elapsed)/float64(slowStart), slowStartMinShare)
+}
+
+// broken removes the broken session.
+func (m *poolMember) broken(sess Session) {
+	m.mu.Lock()
+	if m.sess != sess {
+		m.mu.Unlock()
+		return
+	}
+	m.sess = nil
+	m.mu.Unlock()
+	sess.Close()
+}
+
+// RetryBudget the budget of retries shared by the calls, e.g.
+//  peer.SetRetryBudget(tp.NewRetryBudget(0.1, 10*time.Second, 10))
+// which allows the retries of at most 10% of the calls in the last 10 seconds, but at least 10 retries.
+// Note: It is concurrent safe, and the nil budget allows all retries.
+type RetryBudget struct {
+	ratio      float64
+	minRetries int
+	slot       time.Duration
+	buckets    [retryBudgetBuckets]retryBucket
+	mu         sync.Mutex
+}
+
+type retryBucket struct {
+	index   int64 // the index of the time slot, which is reset when reused
+	calls   int
+	retries int
+}
+
+// retryBudgetBuckets the number of the buckets of the sliding window.
+const retryBudgetBuckets = 10
+
+// NewRetryBudget creates a retry budget, which allows the retries of at most ratio of the calls
+// in the sliding window, but at least minRetries retries in the window,
+// so that the rarely called peer can still retry.
+func NewRetryBudget(ratio float64, window time.Duration, minRetries int) *RetryBudget {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if window < retryBudgetBuckets {
+		window = retryBudgetBuckets
+	}
+	if minRetries < 0 {
+		minRetries = 0
+	}
+	return &RetryBudget{
+		ratio:      ratio,
+		minRetries: minRetries,
+		slot:       window / retryBudgetBuckets,
+	}
+}
+
+// Deposit records a call, which earns the budget by the ratio.
+func (b *RetryBudget) Deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.bucket(time.Now()).calls++
+	b.mu.Unlock()
+}
+
+// Withdraw reports whether a retry is allowed, and records it if allowed.
+func (b *RetryBudget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	calls, retries := b.sum(now)
+	if retries >= b.minRetries && float64(retries+1) > b.ratio*float64(calls) {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket of the current time slot.
+func (b *RetryBudget) bucket(now time.Time) *retryBucket {
+	index := now.UnixNano() / int64(b.slot)
+	bkt := &b.buckets[index%retryBudgetBuckets]
+	if bkt.index != index {
+		*bkt = retryBucket{index: index}
+	}
+	return bkt
+}
+
+// sum returns the numbers of the calls and retries in the window.
+func (b *RetryBudget) sum(now time.Time) (calls, retries int) {
+	index := now.UnixNano() / int64(b.slot)
+	for i := range b.buckets {
+		if bkt := &b.buckets[i]; index-bkt.index < retryBudgetBuckets {
+			calls += bkt.calls
+			retries += bkt.retries
+		}
+	}
+	return
+}
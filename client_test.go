@@ -0,0 +1,463 @@
+package tp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	var nilBudget *RetryBudget
+	nilBudget.Deposit()
+	if !nilBudget.Withdraw() {
+		t.Fatal("nil budget: expect retry allowed")
+	}
+
+	b := NewRetryBudget(0.1, time.Minute, 2)
+	// the min retries are allowed without calls
+	for i := 0; i < 2; i++ {
+		if !b.Withdraw() {
+			t.Fatalf("min retry %d: expect allowed", i)
+		}
+	}
+	if b.Withdraw() {
+		t.Fatal("expect the budget exhausted")
+	}
+	// 100 calls earn 10 retries in total
+	for i := 0; i < 100; i++ {
+		b.Deposit()
+	}
+	var allowed int
+	for i := 0; i < 20; i++ {
+		if b.Withdraw() {
+			allowed++
+		}
+	}
+	if allowed != 8 {
+		t.Fatalf("expect 8 more retries, got %d", allowed)
+	}
+}
+
+func TestClientRetryBudget(t *testing.T) {
+	// nothing is listening on the address, so every call fails to dial
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	peer := NewPeer(PeerConfig{})
+	defer peer.Close()
+	budget := NewRetryBudget(0, time.Minute, 10)
+	peer.SetRetryBudget(budget)
+	cli := NewClient(peer, addr)
+	defer cli.Close()
+	var reply string
+	// the calls without retry do not withdraw
+	for i := 0; i < 3; i++ {
+		if rerr := cli.Pull("/echo", "a", &reply); rerr == nil || rerr.Code != CodeDialFailed {
+			t.Fatalf("expect CodeDialFailed, got %v", rerr)
+		}
+		if rerr := cli.Push("/echo", "a"); rerr == nil || rerr.Code != CodeDialFailed {
+			t.Fatalf("expect CodeDialFailed, got %v", rerr)
+		}
+	}
+	if calls, retries := budget.sum(time.Now()); calls != 6 || retries != 0 {
+		t.Fatalf("expect 6 calls and no retry, got %d and %d", calls, retries)
+	}
+	// nor does the last attempt, so CallRetry(2) withdraws twice
+	if rerr := cli.Pull("/echo", "a", &reply, CallRetry(2)); rerr == nil || rerr.Code != CodeDialFailed {
+		t.Fatalf("expect CodeDialFailed, got %v", rerr)
+	}
+	if _, retries := budget.sum(time.Now()); retries != 2 {
+		t.Fatalf("expect 2 retries, got %d", retries)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var calls int32
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg + string(ctx.PeekMeta("k")), nil
+	})
+	srv.RoutePullFuncAt("/slow", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(200 * time.Millisecond)
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	peer := NewPeer(PeerConfig{})
+	defer peer.Close()
+	cli := NewClient(peer, addr)
+	defer cli.Close()
+	// the session is shared across goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply string
+			if rerr := cli.Pull("/echo", "a", &reply, CallMeta("k", "v")); rerr != nil || reply != "av" {
+				t.Errorf("expect av, got %q, %v", reply, rerr)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := peer.CountSession(); n != 1 {
+		t.Fatalf("expect 1 shared session, got %d", n)
+	}
+
+	// the timed out PULL is retried
+	var reply string
+	rerr := cli.Pull("/slow", "b", &reply, CallTimeout(50*time.Millisecond), CallRetry(2))
+	if rerr == nil || rerr.Code != CodePullTimeout {
+		t.Fatalf("expect CodePullTimeout, got %v", rerr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expect 3 calls with 2 retries, got %d", n)
+	}
+	// redials after closing
+	cli.Close()
+	if rerr = cli.Pull("/echo", "c", &reply); rerr != nil || reply != "c" {
+		t.Fatalf("expect c, got %q, %v", reply, rerr)
+	}
+	if rerr = cli.Push("/unknown", "d", CallTimeout(time.Second)); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	if rerr = NewClient(peer, "127.0.0.1:1").Pull("/echo", "e", &reply, CallRetry(1)); rerr == nil || rerr.Code != CodeDialFailed {
+		t.Fatalf("expect CodeDialFailed, got %v", rerr)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	newServer := func(name string) (Peer, *connsListener) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := NewPeer(PeerConfig{})
+		srv.RoutePullFuncAt("/who", func(ctx PullCtx, arg *int) (string, *Rerror) {
+			return name, nil
+		})
+		srv.RoutePullFuncAt("/slow", func(ctx PullCtx, arg *int) (string, *Rerror) {
+			entered <- struct{}{}
+			<-release
+			return name, nil
+		})
+		cl := &connsListener{Listener: lis}
+		go srv.ServeListener(cl)
+		return srv, cl
+	}
+	srvA, lisA := newServer("a")
+	defer srvA.Close()
+	srvB, lisB := newServer("b")
+	defer srvB.Close()
+	addrs := []string{lisA.Addr().String(), lisB.Addr().String()}
+	peer := NewPeer(PeerConfig{})
+	defer peer.Close()
+	who := func(pool *SessionPool) string {
+		var reply string
+		if rerr := pool.Pull("/who", 0, &reply); rerr != nil {
+			t.Fatal(rerr)
+		}
+		return reply
+	}
+
+	// picks the sessions in turn
+	pool := NewSessionPool(peer, SessionPoolConfig{Addrs: addrs, SizePerAddr: 2})
+	if n := pool.Available(); n != 4 {
+		t.Fatalf("expect 4 available sessions, got %d", n)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[who(pool)]++
+	}
+	if counts["a"] != 4 || counts["b"] != 4 {
+		t.Fatalf("expect the calls balanced, got %v", counts)
+	}
+	pool.Close()
+
+	// picks the session with the least pending calls
+	pool = NewSessionPool(peer, SessionPoolConfig{Addrs: addrs, Strategy: BalanceLeastPending})
+	slow := make(chan string, 1)
+	go func() {
+		var reply string
+		pool.Pull("/slow", 0, &reply)
+		slow <- reply
+	}()
+	<-entered
+	var idle string
+	for i := 0; i < 3; i++ {
+		if s := who(pool); idle == "" {
+			idle = s
+		} else if s != idle {
+			t.Fatalf("expect the idle session picked, got %s and %s", idle, s)
+		}
+	}
+	close(release)
+	if busy := <-slow; busy == idle {
+		t.Fatalf("expect the busy session not picked, got %s", busy)
+	}
+	pool.Close()
+
+	// picks the session with the lowest RTT among the ties, but the unmeasured one first
+	pool = NewSessionPool(peer, SessionPoolConfig{Addrs: addrs, Strategy: BalanceLeastPending})
+	pool.members[0].session().Stats().ObserveRTT(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if s := who(pool); s != "b" {
+			t.Fatalf("expect the unmeasured b picked, got %s", s)
+		}
+	}
+	pool.members[1].session().Stats().ObserveRTT(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if s := who(pool); s != "b" {
+			t.Fatalf("expect the faster b picked, got %s", s)
+		}
+	}
+	pool.members[1].session().Stats().ObserveRTT(500 * time.Millisecond)
+	if s := who(pool); s != "a" {
+		t.Fatalf("expect the faster a picked, got %s", s)
+	}
+	pool.Close()
+
+	// fails over to the others, when the sessions of B are broken
+	pool = NewSessionPool(peer, SessionPoolConfig{Addrs: addrs, SizePerAddr: 2})
+	defer pool.Close()
+	lisB.Close()
+	lisB.closeConns()
+	for i := 0; i < 8; i++ {
+		if s := who(pool); s != "a" {
+			t.Fatalf("expect failed over to a, got %s", s)
+		}
+	}
+	if n := pool.Available(); n != 2 {
+		t.Fatalf("expect 2 available sessions, got %d", n)
+	}
+	lisA.Close()
+	lisA.closeConns()
+	var reply string
+	if rerr := pool.Pull("/who", 0, &reply); !IsConnRerror(rerr) {
+		t.Fatalf("expect the connection error without available session, got %v", rerr)
+	}
+	if rerr := pool.Pull("/who", 0, &reply); rerr == nil || rerr.Code != CodeDialFailed {
+		t.Fatalf("expect CodeDialFailed without available session, got %v", rerr)
+	}
+}
+
+func TestSessionPoolHealthCheck(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	peer := NewPeer(PeerConfig{})
+	defer peer.Close()
+	pool := NewSessionPool(peer, SessionPoolConfig{Addrs: []string{addr}, HealthCheckInterval: 20 * time.Millisecond})
+	defer pool.Close()
+	if n := pool.Available(); n != 0 {
+		t.Fatalf("expect no available session, got %d", n)
+	}
+	// the broken session is redialed by the health check
+	if lis, err = net.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	go srv.ServeListener(lis)
+	for i := 0; i < 100 && pool.Available() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := pool.Available(); n != 1 {
+		t.Fatalf("expect the session redialed, got %d", n)
+	}
+}
+
+func TestSessionPoolSlowStart(t *testing.T) {
+	since := time.Now()
+	m := &poolMember{}
+	if share := m.share(since, time.Second); share != 1 {
+		t.Fatalf("expect the full share without slow start, got %v", share)
+	}
+	m.since = since
+	for _, c := range []struct {
+		elapsed time.Duration
+		share   float64
+	}{
+		{0, slowStartMinShare},
+		{500 * time.Millisecond, 0.5},
+		{time.Second, 1},
+		{time.Hour, 1},
+	} {
+		if share := m.share(since.Add(c.elapsed), time.Second); share != c.share {
+			t.Fatalf("elapsed %v: expect share %v, got %v", c.elapsed, c.share, share)
+		}
+	}
+
+	var (
+		addrs []string
+		lises []*connsListener
+	)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := NewPeer(PeerConfig{})
+		defer srv.Close()
+		srv.RoutePullFuncAt("/who", func(ctx PullCtx, arg *int) (string, *Rerror) {
+			return name, nil
+		})
+		cl := &connsListener{Listener: lis}
+		go srv.ServeListener(cl)
+		addrs = append(addrs, lis.Addr().String())
+		lises = append(lises, cl)
+	}
+	peer := NewPeer(PeerConfig{})
+	defer peer.Close()
+	pool := NewSessionPool(peer, SessionPoolConfig{
+		Addrs:               addrs,
+		HealthCheckInterval: 20 * time.Millisecond,
+		SlowStart:           time.Hour,
+	})
+	defer pool.Close()
+	// the sessions dialed when the pool is created start with the full share
+	for _, m := range pool.members {
+		if !m.since.IsZero() {
+			t.Fatal("expect the initial sessions with the full share")
+		}
+	}
+	// the redialed session of b starts slowly
+	lises[1].closeConns()
+	redialed := func() bool {
+		pool.members[1].mu.RLock()
+		defer pool.members[1].mu.RUnlock()
+		return !pool.members[1].since.IsZero()
+	}
+	for i := 0; i < 100 && !redialed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !redialed() {
+		t.Fatal("expect b redialed by the health check")
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		var reply string
+		if rerr := pool.Pull("/who", 0, &reply); rerr != nil {
+			t.Fatal(rerr)
+		}
+		counts[reply]++
+	}
+	if counts["b"] > 10 {
+		t.Fatalf("expect b in slow start picked rarely, got %v", counts)
+	}
+	// the session in slow start is still picked, if it is the only one
+	lises[0].Close()
+	lises[0].closeConns()
+	var reply string
+	for i := 0; i < 3; i++ {
+		if rerr := pool.Pull("/who", 0, &reply); rerr != nil || reply != "b" {
+			t.Fatalf("expect b, got %q, %v", reply, rerr)
+		}
+	}
+}
+
+func TestCallMirrorStalled(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/len", func(ctx PullCtx, arg *string) (int, *Rerror) {
+		return len(*arg), nil
+	})
+	addr := serveTest(t, srv)
+
+	// the secondary backend accepts, but never reads
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	shadow := dialTest(t, cli, lis.Addr().String())
+	defer func() { (<-accepted).Close() }()
+	c := NewClient(cli, addr)
+	defer c.Close()
+
+	// far more than the socket buffers, so the mirrored writes stall
+	body := strings.Repeat("a", 1<<20)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		var reply int
+		if rerr := c.Pull("/len", body, &reply, CallMirror(shadow, 1)); rerr != nil || reply != len(body) {
+			t.Fatalf("expect %d, got %d, %v", len(body), reply, rerr)
+		}
+	}
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("expect the production pulls not delayed by the stalled mirror, got %v", cost)
+	}
+}
+
+func TestCallMirror(t *testing.T) {
+	newServer := func(reply string, calls chan<- string) (Peer, string) {
+		srv := NewPeer(PeerConfig{})
+		srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+			if calls != nil {
+				calls <- *arg + ":" + string(ctx.PeekMeta(MetaMirror))
+			}
+			return reply, nil
+		})
+		addr := serveTest(t, srv)
+		return srv, addr
+	}
+	mirrored := make(chan string, 10)
+	prod, prodAddr := newServer("prod", nil)
+	defer prod.Close()
+	shadowSrv, shadowAddr := newServer("shadow", mirrored)
+	defer shadowSrv.Close()
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	shadow := dialTest(t, cli, shadowAddr)
+	c := NewClient(cli, prodAddr)
+	var reply string
+	if rerr := c.Pull("/echo", "a", &reply, CallMirror(shadow, 1)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply != "prod" {
+		t.Fatalf("reply: expect prod, got %q", reply)
+	}
+	select {
+	case s := <-mirrored:
+		if s != "a:1" {
+			t.Fatalf("mirrored: expect a:1, got %q", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect the pull mirrored")
+	}
+	if rerr := c.Pull("/echo", "b", &reply, CallMirror(shadow, 0)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	select {
+	case s := <-mirrored:
+		t.Fatalf("expect not mirrored, got %q", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -18,8 +18,10 @@ import (
 	"context"
 	"crypto/tls"
 	"os"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/henrylee2cn/goutil"
@@ -35,6 +37,10 @@ const (
 	TypePull      byte = 1
 	TypeReply     byte = 2 // reply to pull
 	TypePush      byte = 3
+	TypeReject    byte = 4 // reject the connection, carrying the reason
+	TypePushAck   byte = 5 // acknowledge the push, carrying only the status
+	TypePing      byte = 6 // ping the remote peer, which replies TypePong without any handler
+	TypePong      byte = 7 // reply to ping
 )
 
 // TypeText returns the packet type text.
@@ -47,6 +53,14 @@ func TypeText(typ byte) string {
 		return "REPLY"
 	case TypePush:
 		return "PUSH"
+	case TypeReject:
+		return "REJECT"
+	case TypePushAck:
+		return "PUSHACK"
+	case TypePing:
+		return "PING"
+	case TypePong:
+		return "PONG"
 	default:
 		return "Undefined"
 	}
@@ -55,22 +69,27 @@ func TypeText(typ byte) string {
 // Internal Framework Rerror code.
 // Note: Recommended custom code is greater than 1000.
 const (
-	CodeUnknownError        = -1
-	CodeConnClosed          = 102
-	CodeWriteFailed         = 104
-	CodeDialFailed          = 105
-	CodeBadPacket           = 400
-	CodeUnauthorized        = 401
-	CodeNotFound            = 404
-	CodePtypeNotAllowed     = 405
-	CodeHandleTimeout       = 408
-	CodeInternalServerError = 500
-	CodeBadGateway          = 502
+	CodeUnknownError         = -1
+	CodeConnClosed           = 102
+	CodePullTimeout          = 103
+	CodeWriteFailed          = 104
+	CodeDialFailed           = 105
+	CodeWriteRejected        = 106 // the recommended code for vetoing the outgoing packet in PreWrite plugins
+	CodeAckTimeout           = 107
+	CodeQueueTimeout         = 108 // timeout waiting for PeerConfig.MaxInflight
+	CodeBadPacket            = 400
+	CodeUnauthorized         = 401
+	CodeNotFound             = 404
+	CodePtypeNotAllowed      = 405
+	CodeHandleTimeout        = 408
+	CodeUnsupportedCodecType = 415
+	CodeTooManyRequests      = 429
+	CodeInternalServerError  = 500
+	CodeBadGateway           = 502
+	CodeServiceUnavailable   = 503
 
 	// CodeConflict                      = 409
 	// CodeUnsupportedTx                 = 410
-	// CodeUnsupportedCodecType          = 415
-	// CodeServiceUnavailable            = 503
 	// CodeGatewayTimeout                = 504
 	// CodeVariantAlsoNegotiates         = 506
 	// CodeInsufficientStorage           = 507
@@ -89,20 +108,34 @@ func CodeText(rerrCode int32) string {
 		return "Unauthorized"
 	case CodeDialFailed:
 		return "Dial Failed"
+	case CodeWriteRejected:
+		return "Write Rejected"
+	case CodeAckTimeout:
+		return "Ack Timeout"
+	case CodeQueueTimeout:
+		return "Queue Timeout"
 	case CodeConnClosed:
 		return "Connection Closed"
+	case CodePullTimeout:
+		return "Pull Timeout"
 	case CodeWriteFailed:
 		return "Write Failed"
 	case CodeNotFound:
 		return "Not Found"
 	case CodeHandleTimeout:
 		return "Handle Timeout"
+	case CodeUnsupportedCodecType:
+		return "Unsupported Codec Type"
+	case CodeTooManyRequests:
+		return "Too Many Requests"
 	case CodePtypeNotAllowed:
 		return "Packet Type Not Allowed"
 	case CodeInternalServerError:
 		return "Internal Server Error"
 	case CodeBadGateway:
 		return "Bad Gateway"
+	case CodeServiceUnavailable:
+		return "Service Unavailable"
 	case CodeUnknownError:
 		fallthrough
 	default:
@@ -112,15 +145,19 @@ func CodeText(rerrCode int32) string {
 
 // Internal Framework Rerror string.
 var (
-	rerrUnknownError        = NewRerror(CodeUnknownError, CodeText(CodeUnknownError), "")
-	rerrDialFailed          = NewRerror(CodeDialFailed, CodeText(CodeDialFailed), "")
-	rerrConnClosed          = NewRerror(CodeConnClosed, CodeText(CodeConnClosed), "")
-	rerrWriteFailed         = NewRerror(CodeWriteFailed, CodeText(CodeWriteFailed), "")
-	rerrBadPacket           = NewRerror(CodeBadPacket, CodeText(CodeBadPacket), "")
-	rerrNotFound            = NewRerror(CodeNotFound, CodeText(CodeNotFound), "")
-	rerrCodePtypeNotAllowed = NewRerror(CodePtypeNotAllowed, CodeText(CodePtypeNotAllowed), "")
-	rerrHandleTimeout       = NewRerror(CodeHandleTimeout, CodeText(CodeHandleTimeout), "")
-	rerrInternalServerError = NewRerror(CodeInternalServerError, CodeText(CodeInternalServerError), "")
+	rerrUnknownError         = NewRerror(CodeUnknownError, CodeText(CodeUnknownError), "")
+	rerrDialFailed           = NewRerror(CodeDialFailed, CodeText(CodeDialFailed), "")
+	rerrConnClosed           = NewRerror(CodeConnClosed, CodeText(CodeConnClosed), "")
+	rerrPullTimeout          = NewRerror(CodePullTimeout, CodeText(CodePullTimeout), "")
+	rerrAckTimeout           = NewRerror(CodeAckTimeout, CodeText(CodeAckTimeout), "")
+	rerrQueueTimeout         = NewRerror(CodeQueueTimeout, CodeText(CodeQueueTimeout), "")
+	rerrWriteFailed          = NewRerror(CodeWriteFailed, CodeText(CodeWriteFailed), "")
+	rerrBadPacket            = NewRerror(CodeBadPacket, CodeText(CodeBadPacket), "")
+	rerrNotFound             = NewRerror(CodeNotFound, CodeText(CodeNotFound), "")
+	rerrCodePtypeNotAllowed  = NewRerror(CodePtypeNotAllowed, CodeText(CodePtypeNotAllowed), "")
+	rerrHandleTimeout        = NewRerror(CodeHandleTimeout, CodeText(CodeHandleTimeout), "")
+	rerrUnsupportedCodecType = NewRerror(CodeUnsupportedCodecType, CodeText(CodeUnsupportedCodecType), "")
+	rerrInternalServerError  = NewRerror(CodeInternalServerError, CodeText(CodeInternalServerError), "")
 )
 
 // IsConnRerror determines whether the error is a connection error
@@ -141,8 +178,111 @@ const (
 	MetaRealIp = "X-Real-IP"
 	// MetaAcceptBodyCodec the key of body codec that the sender wishes to accept
 	MetaAcceptBodyCodec = "X-Accept-Body-Codec"
+	// MetaPushAck the key of the push that the sender wishes to be acknowledged
+	MetaPushAck = "X-Push-Ack"
+	// MetaRetryable the key of the idempotent PULL that the sender may re-pull after redialing
+	MetaRetryable = "X-Retryable"
+	// MetaMirror the key of the PULL mirrored to the secondary session, whose reply is ignored
+	MetaMirror = "X-Mirror"
+	// MetaOrdered the key of the packet delivered and handled in FIFO order relative to the other ordered packets of the session
+	MetaOrdered = "X-Ordered"
+	// MetaPushErrorUri the key of the URI to which the receiver pushes the PushError back if the push fails
+	MetaPushErrorUri = "X-Push-Error-Uri"
+	// MetaDeprecated the key of the reply of the deprecated route, whose value is the sunset date in RFC3339 or "true"
+	MetaDeprecated = "X-Deprecated"
 )
 
+// metaKeyReservedPrefix the prefix of the reserved metadata keys, which are the header extensions
+// of the framework and plugins.
+const metaKeyReservedPrefix = "X-"
+
+var metaKeys = struct {
+	m  map[string]struct{}
+	mu sync.RWMutex
+}{
+	m: map[string]struct{}{
+		MetaRerror:          {},
+		MetaRealIp:          {},
+		MetaAcceptBodyCodec: {},
+		MetaPushAck:         {},
+		MetaRetryable:       {},
+		MetaMirror:          {},
+		MetaOrdered:         {},
+		MetaPushErrorUri:    {},
+		MetaDeprecated:      {},
+	},
+}
+
+// RegisterMetaKey registers the reserved metadata keys, i.e. the ones prefixed with "X-",
+// which are known and accepted by the peer of PeerConfig.StrictMeta, e.g.
+//  tp.RegisterMetaKey("X-Tenant-Region")
+// Note:
+//  The keys are matched case-sensitively;
+//  The Meta* keys of this package are registered by default, and so are the ones of the official plugins.
+func RegisterMetaKey(keys ...string) {
+	metaKeys.mu.Lock()
+	for _, k := range keys {
+		metaKeys.m[k] = struct{}{}
+	}
+	metaKeys.mu.Unlock()
+}
+
+// checkMetaKeys returns CodeBadPacket error if the metadata carries the unregistered reserved key.
+func checkMetaKeys(meta *utils.Args) *Rerror {
+	var unknown string
+	metaKeys.mu.RLock()
+	meta.VisitAll(func(k, _ []byte) {
+		if len(unknown) > 0 || len(k) < len(metaKeyReservedPrefix) ||
+			string(k[:len(metaKeyReservedPrefix)]) != metaKeyReservedPrefix {
+			return
+		}
+		if _, ok := metaKeys.m[string(k)]; !ok {
+			unknown = string(k)
+		}
+	})
+	metaKeys.mu.RUnlock()
+	if len(unknown) > 0 {
+		return rerrBadPacket.Copy().SetDetail("unknown metadata key: " + unknown)
+	}
+	return nil
+}
+
+const (
+	// DrainUri the reserved PUSH URI notifying that the remote peer is draining,
+	// pushed to all sessions with *DrainNotice body before closing them, see PeerConfig.DrainNoticeAge.
+	// Note: It is accepted without any handler, and the receiving session reports Draining() true.
+	DrainUri = "/_tp/drain"
+	// DrainReason the reason of the draining notification
+	DrainReason = "server draining, reconnect elsewhere"
+)
+
+// DrainNotice the body of the draining notification pushed to DrainUri.
+type DrainNotice struct {
+	// Reason the reason of draining, DrainReason by default
+	Reason string `json:"reason"`
+	// Deadline the time after which the session is closed
+	Deadline time.Time `json:"deadline"`
+}
+
+// PushError the standard envelope of the error notification pushed back to the sender,
+// when the push handler fails, see WithPushErrorUri.
+type PushError struct {
+	// Uri the URI of the failed push
+	Uri string `json:"uri"`
+	// Seq the sequence of the failed push
+	Seq     string `json:"seq"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+// WithPushErrorUri requires the receiver to push the PushError back to the uri,
+// if the push handler fails, e.g. returns error or panics,
+// so that the fire-and-forget sender can still learn about the systematic failures.
+func WithPushErrorUri(uri string) socket.PacketSetting {
+	return socket.WithSetMeta(MetaPushErrorUri, uri)
+}
+
 // WithRerror sets the real IP to metadata.
 func WithRerror(rerr *Rerror) socket.PacketSetting {
 	b, _ := rerr.MarshalJSON()
@@ -157,6 +297,17 @@ func WithRealIp(ip string) socket.PacketSetting {
 	return socket.WithAddMeta(MetaRealIp, ip)
 }
 
+// GetDeprecatedSunset checks whether the reply is of a deprecated route,
+// and returns its sunset date, which is zero if unknown.
+func GetDeprecatedSunset(meta *utils.Args) (sunset time.Time, deprecated bool) {
+	s := meta.Peek(MetaDeprecated)
+	if len(s) == 0 {
+		return time.Time{}, false
+	}
+	sunset, _ = time.Parse(time.RFC3339, goutil.BytesToString(s))
+	return sunset, true
+}
+
 // WithAcceptBodyCodec sets the body codec that the sender wishes to accept.
 // Note: If the specified codec is invalid, the receiver will ignore the mate data.
 func WithAcceptBodyCodec(bodyCodec byte) socket.PacketSetting {
@@ -181,85 +332,141 @@ func GetAcceptBodyCodec(meta *utils.Args) (byte, bool) {
 	return c, c != codec.NilCodecId
 }
 
+// WithPushAck requires the receiver to acknowledge the push after its handler returns.
+// Note: Session.PushAck sets it automatically.
+func WithPushAck() socket.PacketSetting {
+	return socket.WithSetMeta(MetaPushAck, "1")
+}
+
+// WithRetryable marks the PULL as idempotent, so that it is re-pulled on the new connection
+// instead of failing, if the session redials while waiting for the reply.
+// Note: the remote peer may handle it more than once.
+func WithRetryable() socket.PacketSetting {
+	return socket.WithSetMeta(MetaRetryable, "1")
+}
+
+// WithOrdered guarantees the FIFO delivery of the PULL or PUSH relative to the other ordered packets
+// of the session, for the state-machine protocols that require strict ordering.
+// Note:
+//  The ordered packets are written in the order of the calls, and never dropped by the write queue policies;
+//  The remote peer handles them one by one in the order of arrival, instead of concurrently.
+func WithOrdered(ordered bool) socket.PacketSetting {
+	if !ordered {
+		return func(p *socket.Packet) {
+			p.Meta().Del(MetaOrdered)
+		}
+	}
+	return socket.WithSetMeta(MetaOrdered, "1")
+}
+
+func isOrdered(p *socket.Packet) bool {
+	return len(p.Meta().Peek(MetaOrdered)) > 0
+}
+
 // WithContext sets the packet handling context.
-//  func WithContext(ctx context.Context) socket.PacketSetting
+//
+//	func WithContext(ctx context.Context) socket.PacketSetting
 var WithContext = socket.WithContext
 
 // WithSeq sets the packet sequence.
-//  func WithSeq(seq uint64) socket.PacketSetting
+//
+//	func WithSeq(seq uint64) socket.PacketSetting
 var WithSeq = socket.WithSeq
 
 // WithPtype sets the packet type.
-//  func WithPtype(ptype byte) socket.PacketSetting
+//
+//	func WithPtype(ptype byte) socket.PacketSetting
 var WithPtype = socket.WithPtype
 
 // WithUri sets the packet URI string.
-//  func WithUri(uri string) socket.PacketSetting
+//
+//	func WithUri(uri string) socket.PacketSetting
 var WithUri = socket.WithUri
 
 // WithUriObject sets the packet URI object.
-//  func WithUriObject(uriObject *url.URL) socket.PacketSetting
+//
+//	func WithUriObject(uriObject *url.URL) socket.PacketSetting
 var WithUriObject = socket.WithUriObject
 
 // WithQuery sets the packet URI query parameter.
-//  func WithQuery(key, value string) socket.PacketSetting
+//
+//	func WithQuery(key, value string) socket.PacketSetting
 var WithQuery = socket.WithQuery
 
 // WithAddMeta adds 'key=value' metadata argument.
 // Multiple values for the same key may be added.
-//  func WithAddMeta(key, value string) socket.PacketSetting
+//
+//	func WithAddMeta(key, value string) socket.PacketSetting
 var WithAddMeta = socket.WithAddMeta
 
 // WithSetMeta sets 'key=value' metadata argument.
-//  func WithSetMeta(key, value string) socket.PacketSetting
+//
+//	func WithSetMeta(key, value string) socket.PacketSetting
 var WithSetMeta = socket.WithSetMeta
 
 // WithBodyCodec sets the body codec.
-//  func WithBodyCodec(bodyCodec byte) socket.PacketSetting
+//
+//	func WithBodyCodec(bodyCodec byte) socket.PacketSetting
 var WithBodyCodec = socket.WithBodyCodec
 
 // WithBody sets the body object.
-//  func WithBody(body interface{}) socket.PacketSetting
+//
+//	func WithBody(body interface{}) socket.PacketSetting
 var WithBody = socket.WithBody
 
 // WithNewBody resets the function of geting body.
-//  func WithNewBody(newBodyFunc socket.NewBodyFunc) socket.PacketSetting
+//
+//	func WithNewBody(newBodyFunc socket.NewBodyFunc) socket.PacketSetting
 var WithNewBody = socket.WithNewBody
 
 // WithXferPipe sets transfer filter pipe.
-//  func WithXferPipe(filterId ...byte) socket.PacketSetting
+//
+//	func WithXferPipe(filterId ...byte) socket.PacketSetting
 var WithXferPipe = socket.WithXferPipe
 
 // GetPacket gets a *Packet form packet stack.
 // Note:
-//  newBodyFunc is only for reading form connection;
-//  settings are only for writing to connection.
-//  func GetPacket(settings ...socket.PacketSetting) *socket.Packet
+//
+//	newBodyFunc is only for reading form connection;
+//	settings are only for writing to connection.
+//	func GetPacket(settings ...socket.PacketSetting) *socket.Packet
 var GetPacket = socket.GetPacket
 
 // PutPacket puts a *socket.Packet to packet stack.
-//  func PutPacket(p *socket.Packet)
+//
+//	func PutPacket(p *socket.Packet)
 var PutPacket = socket.PutPacket
 
 var (
 	_maxGoroutinesAmount      = (1024 * 1024 * 8) / 8 // max memory 8GB (8KB/goroutine)
 	_maxGoroutineIdleDuration time.Duration
 	_gopool                   = pool.NewGoPool(_maxGoroutinesAmount, _maxGoroutineIdleDuration)
+	_runningGoroutines        int32
 )
 
 // SetGopool set or reset go pool config.
 // Note: Make sure to call it before calling NewPeer() and Go()
 func SetGopool(maxGoroutinesAmount int, maxGoroutineIdleDuration time.Duration) {
-	_maxGoroutinesAmount, _maxGoroutineIdleDuration := maxGoroutinesAmount, maxGoroutineIdleDuration
+	_maxGoroutinesAmount, _maxGoroutineIdleDuration = maxGoroutinesAmount, maxGoroutineIdleDuration
 	if _gopool != nil {
 		_gopool.Stop()
 	}
 	_gopool = pool.NewGoPool(_maxGoroutinesAmount, _maxGoroutineIdleDuration)
 }
 
+// GopoolUsage returns the number of goroutines running in the go pool,
+// and the maximum amount of the go pool.
+func GopoolUsage() (running int, max int) {
+	return int(atomic.LoadInt32(&_runningGoroutines)), _maxGoroutinesAmount
+}
+
 // Go similar to go func, but return false if insufficient resources.
 func Go(fn func()) bool {
-	if err := _gopool.Go(fn); err != nil {
+	if err := _gopool.Go(func() {
+		atomic.AddInt32(&_runningGoroutines, 1)
+		defer atomic.AddInt32(&_runningGoroutines, -1)
+		fn()
+	}); err != nil {
 		Warnf("%s", err.Error())
 		return false
 	}
@@ -281,6 +488,114 @@ func TryGo(fn func()) {
 	_gopool.TryGo(fn)
 }
 
+// WorkerPool a dedicated goroutine pool executing the handlers of some routes, see SubRouter.RunOn.
+type WorkerPool struct {
+	gopool  *pool.GoPool
+	max     int
+	running int32
+}
+
+// NewWorkerPool creates a dedicated goroutine pool executing the handlers of some routes.
+func NewWorkerPool(maxGoroutinesAmount int, maxGoroutineIdleDuration time.Duration) *WorkerPool {
+	return &WorkerPool{
+		gopool: pool.NewGoPool(maxGoroutinesAmount, maxGoroutineIdleDuration),
+		max:    maxGoroutinesAmount,
+	}
+}
+
+// Go similar to go func, but return false if insufficient resources.
+func (w *WorkerPool) Go(fn func()) bool {
+	if err := w.gopool.Go(func() {
+		atomic.AddInt32(&w.running, 1)
+		defer atomic.AddInt32(&w.running, -1)
+		fn()
+	}); err != nil {
+		Warnf("worker pool: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// Usage returns the number of goroutines running in the pool, and the maximum amount of the pool.
+func (w *WorkerPool) Usage() (running int, max int) {
+	return int(atomic.LoadInt32(&w.running)), w.max
+}
+
+// Stop stops the pool.
+func (w *WorkerPool) Stop() {
+	w.gopool.Stop()
+}
+
+// dispatchShardQueue the capacity of the queue per dispatch shard,
+// beyond which the handler is executed by a new goroutine.
+const dispatchShardQueue = 1024
+
+// dispatchShards a fixed set of dispatch goroutines sized to GOMAXPROCS,
+// each of which executes the handlers of the sessions sharded to it in turn,
+// for the cache locality and the less scheduler churn with a large number of connections.
+// Note:
+//  Only the PULL and PUSH handlers are sharded, and the replies are processed in their own goroutines;
+//  The blocking handler stalls all the sessions of its shard, until the queue is full and the new ones overflow to Go.
+type dispatchShards struct {
+	shards []chan func()
+	next   uint32
+	stopCh chan struct{}
+}
+
+func newDispatchShards() *dispatchShards {
+	d := &dispatchShards{
+		shards: make([]chan func(), runtime.GOMAXPROCS(0)),
+		stopCh: make(chan struct{}),
+	}
+	for i := range d.shards {
+		d.shards[i] = make(chan func(), dispatchShardQueue)
+		go d.run(d.shards[i])
+	}
+	return d
+}
+
+// shard returns the Go function of the next shard, round-robin.
+func (d *dispatchShards) shard() func(func()) bool {
+	queue := d.shards[atomic.AddUint32(&d.next, 1)%uint32(len(d.shards))]
+	return func(fn func()) bool {
+		select {
+		case <-d.stopCh:
+			return Go(fn)
+		default:
+		}
+		select {
+		case queue <- fn:
+			return true
+		default:
+			// the shard is busy
+			return Go(fn)
+		}
+	}
+}
+
+func (d *dispatchShards) run(queue chan func()) {
+	for {
+		select {
+		case fn := <-queue:
+			fn()
+		case <-d.stopCh:
+			for {
+				select {
+				case fn := <-queue:
+					fn()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop stops the dispatch goroutines after the queued handlers are executed.
+func (d *dispatchShards) stop() {
+	close(d.stopCh)
+}
+
 var printPidOnce sync.Once
 
 func doPrintPid() {
@@ -358,6 +673,12 @@ func (f *fakePullCmd) CostTime() time.Duration {
 	return 0
 }
 
+// Timing returns the timing breakdown of the pull.
+// If PeerConfig.CountTime=false, always returns zero.
+func (f *fakePullCmd) Timing() PullTiming {
+	return PullTiming{}
+}
+
 // NewTlsConfigFromFile creates a new TLS config.
 func NewTlsConfigFromFile(tlsCertFile, tlsKeyFile string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
@@ -21,6 +21,7 @@ import (
 
 	"github.com/henrylee2cn/cfgo"
 	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/xfer"
 )
 
 // PeerConfig peer config
@@ -28,16 +29,33 @@ import (
 //  yaml tag is used for github.com/henrylee2cn/cfgo
 //  ini tag is used for github.com/henrylee2cn/ini
 type PeerConfig struct {
-	Network            string        `yaml:"network"              ini:"network"              comment:"Network; tcp, tcp4, tcp6, unix or unixpacket"`
-	ListenAddress      string        `yaml:"listen_address"       ini:"listen_address"       comment:"Listen address; for server role"`
-	DefaultDialTimeout time.Duration `yaml:"default_dial_timeout" ini:"default_dial_timeout" comment:"Default maximum duration for dialing; for client role; ns,µs,ms,s,m,h"`
-	RedialTimes        int32         `yaml:"redial_times"         ini:"redial_times"         comment:"The maximum times of attempts to redial, after the connection has been unexpectedly broken; for client role"`
-	DefaultBodyCodec   string        `yaml:"default_body_codec"   ini:"default_body_codec"   comment:"Default body codec type id"`
-	DefaultSessionAge  time.Duration `yaml:"default_session_age"  ini:"default_session_age"  comment:"Default session max age, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
-	DefaultContextAge  time.Duration `yaml:"default_context_age"  ini:"default_context_age"  comment:"Default PULL or PUSH context max age, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
-	SlowCometDuration  time.Duration `yaml:"slow_comet_duration"  ini:"slow_comet_duration"  comment:"Slow operation alarm threshold; ns,µs,ms,s ..."`
-	PrintBody          bool          `yaml:"print_body"           ini:"print_body"           comment:"Is print body or not"`
-	CountTime          bool          `yaml:"count_time"           ini:"count_time"           comment:"Is count cost time or not"`
+	Network             string        `yaml:"network"              ini:"network"              comment:"Network; tcp, tcp4, tcp6, unix, unixpacket or kcp"`
+	ListenAddress       string        `yaml:"listen_address"       ini:"listen_address"       comment:"Listen address; for server role"`
+	PlaintextAddress    string        `yaml:"plaintext_address"    ini:"plaintext_address"    comment:"Listen address of the plaintext port served alongside the TLS one, if empty or no TLS config, not served; for server role"`
+	MaxConnections      int           `yaml:"max_connections"      ini:"max_connections"      comment:"Max number of the accepted connections, beyond which the new ones are rejected, if less than or equal to 0, no limit; for server role"`
+	DefaultDialTimeout  time.Duration `yaml:"default_dial_timeout" ini:"default_dial_timeout" comment:"Default maximum duration for dialing; for client role; ns,µs,ms,s,m,h"`
+	RedialTimes         int32         `yaml:"redial_times"         ini:"redial_times"         comment:"The maximum times of attempts to redial, after the connection has been unexpectedly broken; for client role"`
+	DefaultBodyCodec    string        `yaml:"default_body_codec"   ini:"default_body_codec"   comment:"Default body codec type id"`
+	DefaultSessionAge   time.Duration `yaml:"default_session_age"  ini:"default_session_age"  comment:"Default session max age, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
+	DefaultContextAge   time.Duration `yaml:"default_context_age"  ini:"default_context_age"  comment:"Default PULL or PUSH context max age, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
+	MaxPullAge          time.Duration `yaml:"max_pull_age"         ini:"max_pull_age"         comment:"Max age of a PULL waiting for its reply, after which it fails with timeout, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
+	SlowCometDuration   time.Duration `yaml:"slow_comet_duration"  ini:"slow_comet_duration"  comment:"Slow operation alarm threshold; ns,µs,ms,s ..."`
+	RunLogSampleRate    float64       `yaml:"run_log_sample_rate"  ini:"run_log_sample_rate"  comment:"Sampling rate of the run logs except the slow ones, in (0,1); otherwise, logs all"`
+	MaxPacketSize       uint32        `yaml:"max_packet_size"      ini:"max_packet_size"      comment:"Max size of the packet to read, beyond which the session is rejected with CodeBadPacket and closed, if 0, only the global limit of SetReadLimit is checked"`
+	MaxWriteQueue       int           `yaml:"max_write_queue"      ini:"max_write_queue"      comment:"Max number of the pending writes per session, if less than or equal to 0, no limit"`
+	WriteQueuePolicy    string        `yaml:"write_queue_policy"   ini:"write_queue_policy"   comment:"Policy when the write queue is full; block, drop_push or close_session"`
+	SlowConsumerAge     time.Duration `yaml:"slow_consumer_age"    ini:"slow_consumer_age"    comment:"Max age of the full write queue of a session, beyond which the session is regarded as a slow consumer and handled by SlowConsumerPolicy, if less than or equal to 0 or MaxWriteQueue<=0, not detected; ns,µs,ms,s,m,h"`
+	SlowConsumerPolicy  string        `yaml:"slow_consumer_policy" ini:"slow_consumer_policy" comment:"Policy for the slow consumer, besides calling the PostSlowConsumer plugins; notify, drop_oldest_push or close_session"`
+	MaxInflight         int           `yaml:"max_inflight"         ini:"max_inflight"         comment:"Max number of the PULL and PUSH handlers executing concurrently in the peer, if less than or equal to 0, no limit"`
+	MaxInflightQueue    int           `yaml:"max_inflight_queue"   ini:"max_inflight_queue"   comment:"Max number of the requests waiting for MaxInflight, beyond which they are rejected with CodeServiceUnavailable"`
+	MaxQueueWait        time.Duration `yaml:"max_queue_wait"       ini:"max_queue_wait"       comment:"Max wait time for MaxInflight, after which the request fails with CodeQueueTimeout, if less than or equal to 0, no time limit; ns,µs,ms,s,m,h"`
+	PrintBody           bool          `yaml:"print_body"           ini:"print_body"           comment:"Is print body or not"`
+	CountTime           bool          `yaml:"count_time"           ini:"count_time"           comment:"Is count cost time or not"`
+	EnableIntrospection bool          `yaml:"enable_introspection" ini:"enable_introspection" comment:"Register the reserved PULL routes /_tp/routes, /_tp/sessions and /_tp/stats to inspect the peer or not"`
+	DrainNoticeAge      time.Duration `yaml:"drain_notice_age"     ini:"drain_notice_age"     comment:"Max time between pushing the draining notification /_tp/drain to all sessions and closing them when the peer is closed, if less than or equal to 0, not notified; ns,µs,ms,s,m,h"`
+	ShardDispatch       bool          `yaml:"shard_dispatch"       ini:"shard_dispatch"       comment:"Execute the handlers on a fixed set of dispatch goroutines sized to GOMAXPROCS, sharding the sessions among them, instead of a goroutine per packet, or not; suits the short handlers of a large number of connections, since a blocking handler stalls every session on its shard"`
+	MaxPausedPackets    int           `yaml:"max_paused_packets"   ini:"max_paused_packets"   comment:"Max number of the inbound PULL and PUSH buffered per paused session, beyond which the reading blocks until resumed, if less than or equal to 0, 1024"`
+	StrictMeta          bool          `yaml:"strict_meta"          ini:"strict_meta"          comment:"Reject the inbound PULL and PUSH carrying the reserved metadata key (prefixed with X-) not registered by RegisterMetaKey with CodeBadPacket, instead of ignoring it, or not; catches the incompatible client versions early"`
 
 	slowCometDuration time.Duration
 }
@@ -56,10 +74,10 @@ func (p *PeerConfig) Reload(bind cfgo.BindFunc) error {
 func (p *PeerConfig) check() error {
 	switch p.Network {
 	default:
-		return errors.New("Invalid network config, refer to the following: tcp, tcp4, tcp6, unix or unixpacket.")
+		return errors.New("Invalid network config, refer to the following: tcp, tcp4, tcp6, unix, unixpacket or kcp.")
 	case "":
 		p.Network = "tcp"
-	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
+	case "tcp", "tcp4", "tcp6", "unix", "unixpacket", NetworkKcp:
 	}
 	p.slowCometDuration = math.MaxInt64
 	if p.SlowCometDuration > 0 {
@@ -68,9 +86,43 @@ func (p *PeerConfig) check() error {
 	if len(p.DefaultBodyCodec) == 0 {
 		p.DefaultBodyCodec = "json"
 	}
+	switch p.WriteQueuePolicy {
+	default:
+		return errors.New("Invalid write_queue_policy config, refer to the following: block, drop_push or close_session.")
+	case "":
+		p.WriteQueuePolicy = WriteQueueBlock
+	case WriteQueueBlock, WriteQueueDropPush, WriteQueueCloseSession:
+	}
+	switch p.SlowConsumerPolicy {
+	default:
+		return errors.New("Invalid slow_consumer_policy config, refer to the following: notify, drop_oldest_push or close_session.")
+	case "":
+		p.SlowConsumerPolicy = SlowConsumerNotify
+	case SlowConsumerNotify, SlowConsumerDropOldestPush, SlowConsumerCloseSession:
+	}
 	return nil
 }
 
+// Policies when the write queue of the session is full.
+const (
+	// WriteQueueBlock blocks the writer until the queue is not full
+	WriteQueueBlock = "block"
+	// WriteQueueDropPush fails the PUSH immediately, and blocks the other writers
+	WriteQueueDropPush = "drop_push"
+	// WriteQueueCloseSession closes the connection of the session, regarding it as a bad consumer
+	WriteQueueCloseSession = "close_session"
+)
+
+// Policies for the slow consumer, whose write queue stays full longer than PeerConfig.SlowConsumerAge.
+const (
+	// SlowConsumerNotify only calls the PostSlowConsumer plugins
+	SlowConsumerNotify = "notify"
+	// SlowConsumerDropOldestPush fails the oldest PUSH waiting in the queue to make room for the new write
+	SlowConsumerDropOldestPush = "drop_oldest_push"
+	// SlowConsumerCloseSession closes the connection of the session
+	SlowConsumerCloseSession = "close_session"
+)
+
 // DefaultProtoFunc gets the default builder of socket communication protocol
 //  func DefaultProtoFunc() socket.ProtoFunc
 var DefaultProtoFunc = socket.DefaultProtoFunc
@@ -88,6 +140,28 @@ var GetReadLimit = socket.PacketSizeLimit
 //  func SetReadLimit(maxPacketSize uint32)
 var SetReadLimit = socket.SetPacketSizeLimit
 
+// SetBodyCodecFallback sets the body codecs tried in order when unmarshalling the body fails,
+// e.g. SetBodyCodecFallback(codec.ID_PROTOBUF, codec.ID_JSON) during the migration period
+// when the mixed-version peers coexist.
+// Note: It should be called before serving; the reply is encoded by the succeeded codec.
+//  func SetBodyCodecFallback(codecIds ...byte)
+var SetBodyCodecFallback = socket.SetBodyCodecFallback
+
+// SetBodyAllocator sets the allocator of the raw bytes bodies, if nil, uses the default one allocating on the heap,
+// e.g. an arena or off-heap allocator for the extremely high-throughput relays.
+// Note:
+//  It should be called before serving;
+//  Only the input bodies of the unknown handlers are allocated by it,
+//  which are freed after the handler context is recycled, so they must not be retained.
+//  func SetBodyAllocator(allocator socket.BodyAllocator)
+var SetBodyAllocator = socket.SetBodyAllocator
+
+// SetGzipUnpackLimit sets the limit of the decompressed size of the gzip transfer filter,
+// which is the smaller one of maxSize and maxRatio times of the compressed size.
+// Note: If maxSize<=0, set it to max uint32; if maxRatio<=0, there is no ratio limit.
+//  func SetGzipUnpackLimit(maxSize int64, maxRatio float64)
+var SetGzipUnpackLimit = xfer.SetGzipUnpackLimit
+
 // SetSocketKeepAlive sets whether the operating system should send
 // keepalive messages on the connection.
 // Note: If have not called the function, the system defaults are used.
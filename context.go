@@ -15,7 +15,9 @@
 package tp
 
 import (
+	"compress/gzip"
 	"context"
+	"fmt"
 	"net/url"
 	"reflect"
 	"sync"
@@ -25,6 +27,7 @@ import (
 	"github.com/henrylee2cn/teleport/codec"
 	"github.com/henrylee2cn/teleport/socket"
 	"github.com/henrylee2cn/teleport/utils"
+	"github.com/henrylee2cn/teleport/xfer"
 )
 
 type (
@@ -40,6 +43,9 @@ type (
 		RealIp() string
 		// Swap returns custom data swap of context.
 		Swap() goutil.Map
+		// Values returns the per-packet custom data of context, which is not backed by the session swap,
+		// so that storing into it never copies the session swap, e.g. for passing data between plugin hooks.
+		Values() goutil.Map
 		// Context carries a deadline, a cancelation signal, and other values across
 		// API boundaries.
 		Context() context.Context
@@ -76,6 +82,11 @@ type (
 		Path() string
 		// Query returns the input packet uri query object.
 		Query() url.Values
+		// Param returns the path parameter of the matched route pattern, e.g. "id" of "/user/:id/profile".
+		Param(key string) string
+		// Route returns the URI path of the matched handler, which is the pattern of the param route,
+		// e.g. "/user/:id/profile", or empty string if no handler is matched, e.g. for the reply.
+		Route() string
 	}
 	// ReadCtx context method set for reading packet.
 	ReadCtx interface {
@@ -113,13 +124,33 @@ type (
 		SetMeta(key, value string)
 		// AddXferPipe appends transfer filter pipe of reply packet.
 		AddXferPipe(filterId ...byte)
+		// SetGzipLevel sets the gzip compression level of reply packet, overriding the one inherited from the pull,
+		// e.g. gzip.NoCompression for the already compressed blobs like images.
+		SetGzipLevel(level int)
+		// Reply sends the reply later, when the handler returned DeferReply.
+		// Note: it can be called from another goroutine, exactly once.
+		Reply(body interface{}, rerr *Rerror)
+	}
+	// HandleCtx context method set for the middleware wrapping the handler invocation.
+	HandleCtx interface {
+		inputCtx
+		// Input returns readed packet.
+		Input() *socket.Packet
+		// GetBodyCodec gets the body codec type of the input packet.
+		GetBodyCodec() byte
+		// Output returns the reply packet, only for PULL.
+		Output() *socket.Packet
 	}
 	// UnknownPushCtx context method set for handling the unknown pushed packet.
 	UnknownPushCtx interface {
 		inputCtx
+		// Input returns readed packet, whose body is the raw bytes.
+		// Note: it is useful for gateways and proxies forwarding the whole packet.
+		Input() *socket.Packet
 		// GetBodyCodec gets the body codec type of the input packet.
 		GetBodyCodec() byte
 		// InputBodyBytes if the input body binder is []byte type, returns it, else returns nil.
+		// Note: it is allocated by the BodyAllocator, so it must not be retained after the handler returns.
 		InputBodyBytes() []byte
 		// Bind when the raw body binder is []byte type, now binds the input body to v.
 		Bind(v interface{}) (bodyCodec byte, err error)
@@ -127,9 +158,13 @@ type (
 	// UnknownPullCtx context method set for handling the unknown pulled packet.
 	UnknownPullCtx interface {
 		inputCtx
+		// Input returns readed packet, whose body is the raw bytes.
+		// Note: it is useful for gateways and proxies forwarding the whole packet.
+		Input() *socket.Packet
 		// GetBodyCodec gets the body codec type of the input packet.
 		GetBodyCodec() byte
 		// InputBodyBytes if the input body binder is []byte type, returns it, else returns nil.
+		// Note: it is allocated by the BodyAllocator, so it must not be retained after the handler returns.
 		InputBodyBytes() []byte
 		// Bind when the raw body binder is []byte type, now binds the input body to v.
 		Bind(v interface{}) (bodyCodec byte, err error)
@@ -142,6 +177,9 @@ type (
 		SetMeta(key, value string)
 		// AddXferPipe appends transfer filter pipe of reply packet.
 		AddXferPipe(filterId ...byte)
+		// SetGzipLevel sets the gzip compression level of reply packet, overriding the one inherited from the pull,
+		// e.g. gzip.NoCompression for the already compressed blobs like images.
+		SetGzipLevel(level int)
 	}
 )
 
@@ -152,6 +190,7 @@ var (
 	_ ReadCtx        = new(handlerCtx)
 	_ PushCtx        = new(handlerCtx)
 	_ PullCtx        = new(handlerCtx)
+	_ HandleCtx      = new(handlerCtx)
 	_ UnknownPushCtx = new(handlerCtx)
 	_ UnknownPullCtx = new(handlerCtx)
 )
@@ -162,15 +201,29 @@ type handlerCtx struct {
 	input           *socket.Packet
 	output          *socket.Packet
 	handler         *Handler
+	params          []routeParam
 	arg             reflect.Value
 	pullCmd         *pullCmd
 	swap            goutil.Map
+	swapCow         cowSwap
+	values          goutil.Map
 	start           time.Time
 	cost            time.Duration
 	pluginContainer *PluginContainer
 	handleErr       *Rerror
 	context         context.Context
 	next            *handlerCtx
+	// only for deferred reply
+	deferred        bool
+	deferMu         sync.Mutex
+	deferHandleDone bool
+	deferReplied    bool
+	deferredBody    interface{}
+	deferredRerr    *Rerror
+	// the handler is abandoned due to HandleTimeout, and the timeout has been replied
+	abandoned bool
+	// cancels the context of HandleTimeout, when the context is released
+	cancel context.CancelFunc
 }
 
 var (
@@ -189,26 +242,31 @@ func newReadHandleCtx() *handlerCtx {
 
 func (c *handlerCtx) reInit(s *session) {
 	c.sess = s
-	count := s.socket.SwapLen()
-	c.swap = goutil.RwMap(count)
-	if count > 0 {
-		s.socket.Swap().Range(func(key, value interface{}) bool {
-			c.swap.Store(key, value)
-			return true
-		})
-	}
 }
 
 func (c *handlerCtx) clean() {
 	c.sess = nil
 	c.handler = nil
+	c.params = c.params[:0]
 	c.arg = emptyValue
 	c.pullCmd = nil
 	c.swap = nil
+	c.swapCow.reset(nil)
+	c.values = nil
 	c.cost = 0
 	c.pluginContainer = nil
 	c.handleErr = nil
 	c.context = nil
+	c.deferred = false
+	c.deferHandleDone = false
+	c.deferReplied = false
+	c.deferredBody = nil
+	c.deferredRerr = nil
+	c.abandoned = false
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
 	c.input.Reset(socket.WithNewBody(c.binding))
 	c.output.Reset()
 }
@@ -234,10 +292,109 @@ func (c *handlerCtx) Output() *socket.Packet {
 }
 
 // Swap returns custom data swap of context.
+// Note: it shares the session swap until the first write, then is copied from it.
 func (c *handlerCtx) Swap() goutil.Map {
+	if c.swap == nil {
+		c.swapCow.reset(c.sess.socket.Swap())
+		c.swap = &c.swapCow
+	}
 	return c.swap
 }
 
+// Values returns the per-packet custom data of context.
+// Note: it is shared with the PULL for the reply.
+func (c *handlerCtx) Values() goutil.Map {
+	if c.values == nil {
+		c.values = goutil.RwMap(2)
+	}
+	return c.values
+}
+
+// cowSwap the copy-on-write custom data swap of a context,
+// which shares the session swap until the first write,
+// so that the large session swap is not copied per packet.
+type cowSwap struct {
+	goutil.Map            // the shared session swap, read only
+	own        goutil.Map // the private copy after the first write
+	mu         sync.RWMutex
+}
+
+var _ goutil.Map = new(cowSwap)
+
+func (c *cowSwap) reset(shared goutil.Map) {
+	c.Map = shared
+	c.own = nil
+}
+
+func (c *cowSwap) read() goutil.Map {
+	c.mu.RLock()
+	m := c.own
+	c.mu.RUnlock()
+	if m != nil {
+		return m
+	}
+	return c.Map
+}
+
+func (c *cowSwap) write() goutil.Map {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.own == nil {
+		c.own = goutil.RwMap(c.Map.Len())
+		c.Map.Range(func(key, value interface{}) bool {
+			c.own.Store(key, value)
+			return true
+		})
+	}
+	return c.own
+}
+
+// Load returns the value stored in the map for a key.
+func (c *cowSwap) Load(key interface{}) (interface{}, bool) {
+	return c.read().Load(key)
+}
+
+// Range calls f sequentially for each key and value present in the map.
+func (c *cowSwap) Range(f func(key, value interface{}) bool) {
+	c.read().Range(f)
+}
+
+// Random returns a pair kv randomly.
+func (c *cowSwap) Random() (interface{}, interface{}, bool) {
+	return c.read().Random()
+}
+
+// Len returns the length of the map.
+func (c *cowSwap) Len() int {
+	return c.read().Len()
+}
+
+// Store sets the value for a key, after copying the shared swap.
+func (c *cowSwap) Store(key, value interface{}) {
+	c.write().Store(key, value)
+}
+
+// LoadOrStore returns the existing value for the key if present,
+// otherwise stores the given value after copying the shared swap.
+func (c *cowSwap) LoadOrStore(key, value interface{}) (interface{}, bool) {
+	if actual, ok := c.read().Load(key); ok {
+		return actual, true
+	}
+	return c.write().LoadOrStore(key, value)
+}
+
+// Delete deletes the value for a key, after copying the shared swap.
+func (c *cowSwap) Delete(key interface{}) {
+	c.write().Delete(key)
+}
+
+// Clear clears all current data in the map, without touching the shared swap.
+func (c *cowSwap) Clear() {
+	c.mu.Lock()
+	c.own = goutil.RwMap()
+	c.mu.Unlock()
+}
+
 // Seq returns the input packet sequence.
 func (c *handlerCtx) Seq() string {
 	return c.input.Seq()
@@ -268,6 +425,28 @@ func (c *handlerCtx) Query() url.Values {
 	return c.input.UriObject().Query()
 }
 
+// Param returns the path parameter of the matched route pattern,
+// e.g. "id" of "/user/:id/profile".
+// Note: returns empty string if there is no such parameter.
+func (c *handlerCtx) Param(key string) string {
+	for _, p := range c.params {
+		if p.key == key {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// Route returns the URI path of the matched handler, which is the pattern of the param route,
+// e.g. "/user/:id/profile", or empty string if no handler is matched, e.g. for the reply.
+// Note: It bounds the cardinality of the per-route statistics, unlike the URI path carrying the ids.
+func (c *handlerCtx) Route() string {
+	if c.handler == nil {
+		return ""
+	}
+	return c.handler.Name()
+}
+
 // PeekMeta peeks the header metadata for the input packet.
 func (c *handlerCtx) PeekMeta(key string) []byte {
 	return c.input.Meta().Peek(key)
@@ -314,6 +493,19 @@ func (c *handlerCtx) AddXferPipe(filterId ...byte) {
 	c.output.XferPipe().Append(filterId...)
 }
 
+// SetGzipLevel sets the gzip compression level of reply packet, overriding the one inherited from the pull,
+// e.g. gzip.NoCompression for the already compressed blobs like images.
+// Note:
+//  gzip.NoCompression removes the gzip filter from the transfer filter pipe;
+//  the other levels replace the gzip filter, or append it if the pull is not gzipped.
+func (c *handlerCtx) SetGzipLevel(level int) {
+	if level == gzip.NoCompression {
+		c.output.XferPipe().Remove(xfer.GzipLevel(level).Id())
+		return
+	}
+	c.output.XferPipe().Put(xfer.GzipLevel(level))
+}
+
 // Ip returns the remote addr.
 func (c *handlerCtx) Ip() string {
 	return c.sess.RemoteAddr().String()
@@ -353,7 +545,20 @@ func (c *handlerCtx) binding(header socket.Header) (body interface{}) {
 		return c.bindPush(header)
 	case TypePull:
 		return c.bindPull(header)
+	case TypeReject:
+		return c.bindReject(header)
+	case TypePushAck:
+		c.sess.receivePushAck(header.Seq(), NewRerrorFromMeta(c.input.Meta()))
+		return nil
+	case TypePing:
+		return nil
+	case TypePong:
+		c.sess.receivePong(header.Seq(), nil)
+		return nil
 	default:
+		c.sess.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.UnknownTypes })
+		Warnf("protocol error (addr:%s, id:%s, type:%d, seq:%s, uri:%s): unknown packet type",
+			c.sess.RemoteAddr().String(), c.sess.Id(), header.Ptype(), header.Seq(), header.Uri())
 		c.handleErr = rerrCodePtypeNotAllowed
 		return nil
 	}
@@ -380,6 +585,20 @@ func (c *handlerCtx) handle() {
 		c.handlePull()
 		return
 
+	case TypeReject:
+		// handles the rejection of the connection
+		c.handleReject()
+		return
+
+	case TypePushAck, TypePong:
+		// the acknowledgement has been passed to PushAck or Ping when binding
+		return
+
+	case TypePing:
+		// replies the ping
+		c.sess.pong(c.input.Seq())
+		return
+
 	default:
 	}
 E:
@@ -387,7 +606,7 @@ E:
 	rerrCodePtypeNotAllowed.SetToMeta(c.output.Meta())
 	if c.sess.peer.printBody {
 		logformat := "disconnect(%s) due to unsupported packet type: %d |\nseq: %d |uri: %-30s |\nRECV:\n size: %d\n body[-json]: %s\n"
-		Errorf(logformat, c.Ip(), c.input.Ptype(), c.input.Seq(), c.input.Uri(), c.input.Size(), bodyLogBytes(c.input))
+		Errorf(logformat, c.Ip(), c.input.Ptype(), c.input.Seq(), c.input.Uri(), c.input.Size(), c.sess.peer.getBodyLogRenderer()(c.input))
 	} else {
 		logformat := "disconnect(%s) due to unsupported packet type: %d |\nseq: %d |uri: %-30s |\nRECV:\n size: %d\n"
 		Errorf(logformat, c.Ip(), c.input.Ptype(), c.input.Seq(), c.input.Uri(), c.input.Size())
@@ -395,7 +614,45 @@ E:
 	go c.sess.Close()
 }
 
+// bindReject records the reason why the remote peer rejects the connection,
+// before the remote peer closes it.
+func (c *handlerCtx) bindReject(header socket.Header) interface{} {
+	rerr := NewRerrorFromMeta(c.input.Meta())
+	if rerr == nil {
+		rerr = rerrConnClosed.Copy().SetDetail("rejected by the remote peer")
+	}
+	c.sess.setRejected(rerr)
+	return nil
+}
+
+// checkStrictMeta rejects the packet carrying the unregistered reserved metadata key,
+// for PeerConfig.StrictMeta.
+func (c *handlerCtx) checkStrictMeta() *Rerror {
+	rerr := checkMetaKeys(c.input.Meta())
+	if rerr != nil {
+		c.sess.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.UnknownMeta })
+	}
+	return rerr
+}
+
+// handleReject handles the rejection of the connection.
+func (c *handlerCtx) handleReject() {
+	Warnf("rejected by %s: %s", c.Ip(), c.sess.rejectedRerror().String())
+}
+
 func (c *handlerCtx) bindPush(header socket.Header) interface{} {
+	if !c.sess.peer.uriFilter.Allow(header.UriObject().Path) {
+		c.handleErr = rerrNotFound
+		return nil
+	}
+
+	if c.sess.peer.strictMeta {
+		c.handleErr = c.checkStrictMeta()
+		if c.handleErr != nil {
+			return nil
+		}
+	}
+
 	c.handleErr = c.pluginContainer.postReadPushHeader(c)
 	if c.handleErr != nil {
 		return nil
@@ -407,9 +664,17 @@ func (c *handlerCtx) bindPush(header socket.Header) interface{} {
 		return nil
 	}
 
+	if u.Path == DrainUri {
+		c.sess.setDraining()
+	}
+
 	var ok bool
-	c.handler, ok = c.sess.getPushHandler(u.Path)
+	c.handler, c.params, ok = c.sess.getPushHandler(u.Path, c.params[:0])
 	if !ok {
+		if u.Path == DrainUri {
+			// the draining notification is accepted without any handler
+			return nil
+		}
 		c.handleErr = rerrNotFound
 		return nil
 	}
@@ -417,8 +682,26 @@ func (c *handlerCtx) bindPush(header socket.Header) interface{} {
 	// reset plugin container
 	c.pluginContainer = c.handler.pluginContainer
 
+	if d := c.handler.deprecation; d != nil {
+		d.observe(c.RealIp())
+	}
+
+	c.handleErr = c.handler.checkPacketSize(c.input.Size())
+	if c.handleErr == nil {
+		c.handleErr = c.handler.checkBodyCodec(c.input.BodyCodec())
+		if c.handleErr != nil {
+			c.sess.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.CodecMismatches })
+		}
+	}
+	if c.handleErr != nil {
+		return nil
+	}
+
 	c.arg = c.handler.NewArgValue()
 	c.input.SetBody(c.arg.Interface())
+	if c.handler.isUnknown {
+		c.input.UseBodyAllocator()
+	}
 	c.handleErr = c.pluginContainer.preReadPushBody(c)
 	if c.handleErr != nil {
 		return nil
@@ -437,23 +720,67 @@ func (c *handlerCtx) handlePush() {
 	defer func() {
 		c.cost = c.sess.timeSince(c.start)
 		c.sess.runlog(c.RealIp(), c.cost, c.input, nil, typePushHandle)
+		c.sess.peer.counters.observePush(c.handleErr)
 	}()
 
 	if c.handleErr == nil && c.handler != nil {
 		if c.pluginContainer.postReadPushBody(c) == nil {
-			if c.handler.isUnknown {
-				c.handler.unknownHandleFunc(c)
-			} else {
-				c.handler.handleFunc(c, c.arg)
-			}
+			c.invokePush()
 		}
 	}
 	if c.handleErr != nil {
 		Warnf("%s", c.handleErr.String())
 	}
+	if len(c.input.Meta().Peek(MetaPushAck)) > 0 {
+		c.sess.ackPush(c.input.Seq(), c.handleErr)
+	}
+	if c.handleErr != nil {
+		if uri := c.input.Meta().Peek(MetaPushErrorUri); len(uri) > 0 {
+			c.pushError(string(uri))
+		}
+	}
+}
+
+// invokePush invokes the push handler, and regards the panic as CodeInternalServerError.
+func (c *handlerCtx) invokePush() {
+	defer func() {
+		if p := recover(); p != nil {
+			Errorf("panic:\n%v\n%s", p, goutil.PanicTrace(2))
+			c.handleErr = rerrInternalServerError
+		}
+	}()
+	c.invokeLimited()
+}
+
+// pushError pushes the PushError of the failed push back to the sender.
+func (c *handlerCtx) pushError(uri string) {
+	rerr := c.sess.Push(uri, &PushError{
+		Uri:     c.input.Uri(),
+		Seq:     c.input.Seq(),
+		Code:    c.handleErr.Code,
+		Message: c.handleErr.Message,
+		Detail:  c.handleErr.Detail,
+	})
+	if rerr != nil {
+		Debugf("push error(%s, uri:%s) fail: %s", c.sess.RemoteAddr().String(), uri, rerr.String())
+	}
 }
 
 func (c *handlerCtx) bindPull(header socket.Header) interface{} {
+	if !c.sess.peer.uriFilter.Allow(header.UriObject().Path) {
+		c.handleErr = rerrNotFound
+		c.handleErr.SetToMeta(c.output.Meta())
+		return nil
+	}
+
+	if c.sess.peer.strictMeta {
+		c.handleErr = c.checkStrictMeta()
+		if c.handleErr != nil {
+			c.handleErr.SetToMeta(c.output.Meta())
+			return nil
+		}
+	}
+
 	c.handleErr = c.pluginContainer.postReadPullHeader(c)
 	if c.handleErr != nil {
 		c.handleErr.SetToMeta(c.output.Meta())
@@ -468,7 +795,7 @@ func (c *handlerCtx) bindPull(header socket.Header) interface{} {
 	}
 
 	var ok bool
-	c.handler, ok = c.sess.getPullHandler(u.Path)
+	c.handler, c.params, ok = c.sess.getPullHandler(u.Path, c.params[:0])
 	if !ok {
 		c.handleErr = rerrNotFound
 		c.handleErr.SetToMeta(c.output.Meta())
@@ -478,8 +805,26 @@ func (c *handlerCtx) bindPull(header socket.Header) interface{} {
 	// reset plugin container
 	c.pluginContainer = c.handler.pluginContainer
 
+	if d := c.handler.deprecation; d != nil {
+		d.observe(c.RealIp())
+		c.output.Meta().Set(MetaDeprecated, d.meta())
+	}
+
+	c.handleErr = c.handler.checkPacketSize(c.input.Size())
+	if c.handleErr == nil {
+		c.handleErr = c.handler.checkBodyCodec(c.input.BodyCodec())
+		if c.handleErr != nil {
+			c.sess.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.CodecMismatches })
+		}
+	}
+	if c.handleErr != nil {
+		c.handleErr.SetToMeta(c.output.Meta())
+		return nil
+	}
+
 	if c.handler.isUnknown {
 		c.input.SetBody(new([]byte))
+		c.input.UseBodyAllocator()
 	} else {
 		c.arg = c.handler.NewArgValue()
 		c.input.SetBody(c.arg.Interface())
@@ -496,11 +841,6 @@ func (c *handlerCtx) bindPull(header socket.Header) interface{} {
 
 // handlePull handles and replies pull.
 func (c *handlerCtx) handlePull() {
-	defer func() {
-		c.cost = c.sess.timeSince(c.start)
-		c.sess.runlog(c.RealIp(), c.cost, c.input, c.output, typePullHandle)
-	}()
-
 	c.output.SetPtype(TypeReply)
 	c.output.SetSeq(c.input.Seq())
 	c.output.SetUriObject(c.input.UriObject())
@@ -522,16 +862,54 @@ func (c *handlerCtx) handlePull() {
 		if c.handleErr != nil {
 			c.handleErr.SetToMeta(c.output.Meta())
 		} else {
-			if c.handler.isUnknown {
-				c.handler.unknownHandleFunc(c)
-			} else {
-				c.handler.handleFunc(c, c.arg)
+			c.invokeLimited()
+		}
+	}
+
+	if c.abandoned {
+		return
+	}
+
+	if c.handleErr == DeferReply {
+		c.handleErr = nil
+		c.output.Meta().Del(MetaRerror)
+		c.deferred = true
+		return
+	}
+
+	c.writeReply()
+}
+
+// invokeLimited invokes the handler within PeerConfig.MaxInflight.
+// Note: the slot is released when the handler returns, even if it defers the reply.
+func (c *handlerCtx) invokeLimited() {
+	if l := c.sess.peer.inflight; l != nil {
+		if rerr := l.acquire(c.Context()); rerr != nil {
+			c.handleErr = rerr
+			if c.input.Ptype() == TypePull {
+				rerr.SetToMeta(c.output.Meta())
 			}
+			return
 		}
+		defer l.release()
 	}
+	c.handler.invoke(c)
+}
 
-	// reply pull
-	c.pluginContainer.preWriteReply(c)
+// writeReply writes the reply of PULL.
+func (c *handlerCtx) writeReply() {
+	defer func() {
+		c.cost = c.sess.timeSince(c.start)
+		c.sess.runlog(c.RealIp(), c.cost, c.input, c.output, typePullHandle)
+		c.sess.peer.counters.observePull(c.handleErr)
+	}()
+
+	if rerr := c.pluginContainer.preWriteReply(c); rerr != nil {
+		// vetoed, replies the error instead
+		c.handleErr = rerr
+		c.output.SetBody(nil)
+		rerr.SetToMeta(c.output.Meta())
+	}
 	_, rerr := c.sess.write(c.output)
 	if rerr != nil {
 		if c.handleErr == nil {
@@ -551,6 +929,115 @@ func (c *handlerCtx) handlePull() {
 	c.pluginContainer.postWriteReply(c)
 }
 
+// DeferReply the sentinel returned by the PULL handler as *Rerror,
+// indicating that the reply will be sent later by ctx.Reply, e.g.
+//  func (x *Aaa) XxZz(args *<T>) (<T>, *tp.Rerror) {
+//      ctx := x.PullCtx
+//      go func() {
+//          ...
+//          ctx.Reply(r, nil)
+//      }()
+//      return nil, tp.DeferReply
+//  }
+var DeferReply = NewRerror(CodeUnknownError, "Defer Reply", "")
+
+// Reply sends the reply of the PULL whose handler returned DeferReply,
+// and it can be called from another goroutine.
+// Note:
+//  Must be called exactly once, and the context must not be used after calling;
+//  Before replying, the session can not be closed gracefully.
+func (c *handlerCtx) Reply(body interface{}, rerr *Rerror) {
+	c.deferMu.Lock()
+	if c.abandoned {
+		c.deferMu.Unlock()
+		Warnf("reply to PULL after handle timeout: %s", c.Uri())
+		return
+	}
+	if c.deferReplied {
+		c.deferMu.Unlock()
+		Warnf("repeated reply to PULL: %s", c.Uri())
+		return
+	}
+	c.deferReplied = true
+	c.deferredBody = body
+	c.deferredRerr = rerr
+	release := c.deferHandleDone
+	c.deferMu.Unlock()
+	if !release {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			Errorf("panic when replying:\n%v\n%s", p, goutil.PanicTrace(1))
+		}
+		c.sess.peer.putContext(c, true)
+	}()
+	c.writeDeferredReply()
+}
+
+// handleDone is called when the handling goroutine finishes,
+// and returns whether the context can be released now.
+func (c *handlerCtx) handleDone() bool {
+	if !c.deferred {
+		return true
+	}
+	c.deferMu.Lock()
+	c.deferHandleDone = true
+	release := c.deferReplied
+	abandoned := c.abandoned
+	c.deferMu.Unlock()
+	if release && !abandoned {
+		defer func() {
+			if p := recover(); p != nil {
+				Errorf("panic when replying:\n%v\n%s", p, goutil.PanicTrace(1))
+			}
+		}()
+		c.writeDeferredReply()
+	}
+	return release
+}
+
+// abandon replies the PULL with the timeout error by a separate packet,
+// and keeps the context until the abandoned handler returns, see abandonedReturned.
+func (c *handlerCtx) abandon(rerr *Rerror) {
+	c.deferMu.Lock()
+	c.deferred = true
+	c.abandoned = true
+	c.deferMu.Unlock()
+
+	output := socket.GetPacket(
+		socket.WithPtype(TypeReply),
+		socket.WithSeq(c.input.Seq()),
+		socket.WithUriObject(c.input.UriObject()),
+	)
+	defer socket.PutPacket(output)
+	output.XferPipe().AppendFrom(c.input.XferPipe())
+	rerr.SetToMeta(output.Meta())
+	c.sess.write(output)
+	c.sess.runlog(c.RealIp(), c.sess.timeSince(c.start), c.input, output, typePullHandle)
+}
+
+// abandonedReturned is called when the abandoned handler returns.
+func (c *handlerCtx) abandonedReturned() {
+	c.deferMu.Lock()
+	c.deferReplied = true
+	release := c.deferHandleDone
+	c.deferMu.Unlock()
+	if release {
+		c.sess.peer.putContext(c, true)
+	}
+}
+
+func (c *handlerCtx) writeDeferredReply() {
+	if c.deferredRerr != nil {
+		c.handleErr = c.deferredRerr
+		c.handleErr.SetToMeta(c.output.Meta())
+	} else {
+		c.setReplyBody(c.deferredBody)
+	}
+	c.writeReply()
+}
+
 func (c *handlerCtx) setReplyBody(body interface{}) {
 	c.output.SetBody(body)
 	if c.output.BodyCodec() != codec.NilCodecId {
@@ -577,9 +1064,19 @@ func (c *handlerCtx) bindReply(header socket.Header) interface{} {
 	// unlock: handleReply
 	c.pullCmd.mu.Lock()
 
+	if !c.pullCmd.isPending() {
+		// the pull has been swept due to timeout
+		c.pullCmd.mu.Unlock()
+		c.pullCmd = nil
+		Warnf("pull cmd has been finished: %v", c.input)
+		return nil
+	}
+
+	c.pullCmd.replyRead = c.sess.timeNow()
+
 	c.swap = c.pullCmd.swap
+	c.values = c.pullCmd.Values()
 	c.pullCmd.inputBodyCodec = c.GetBodyCodec()
-	// if c.pullCmd.inputMeta!=nil, means the pullCmd is replyed.
 	c.input.Meta().CopyTo(c.pullCmd.inputMeta)
 	c.setContext(c.pullCmd.output.Context())
 	c.input.SetBody(c.pullCmd.reply)
@@ -681,6 +1178,26 @@ type (
 		//  Inside, <-Done() is automatically called and blocked,
 		//  until the pull is completed!
 		CostTime() time.Duration
+		// Timing returns the timing breakdown of the pull.
+		// If PeerConfig.CountTime=false, always returns zero.
+		// Notes:
+		//  Inside, <-Done() is automatically called and blocked,
+		//  until the pull is completed!
+		Timing() PullTiming
+	}
+	// PullTiming the timing breakdown of a pull, to distinguish the server slowness from the local write contention.
+	// Note: the phase that is not reached, e.g. due to a write error, is 0.
+	PullTiming struct {
+		// Queue the time waiting for the write queue and the write lock, i.e. the local write contention
+		Queue time.Duration
+		// Write the time of encoding and writing the packet
+		Write time.Duration
+		// Wait the time from written to the reply header read, i.e. the server handling plus the network round trip
+		Wait time.Duration
+		// Decode the time of decoding the reply body
+		Decode time.Duration
+		// RTT the smoothed network round-trip time of the session, 0 if not measured, see SessionStats.RTT
+		RTT time.Duration
 	}
 	pullCmd struct {
 		sess           *session
@@ -690,8 +1207,16 @@ type (
 		inputBodyCodec byte
 		inputMeta      *utils.Args
 		start          time.Time
+		deadline       time.Time
 		cost           time.Duration
+		writeLocked    time.Time // when the write lock is acquired
+		written        time.Time
+		replyRead      time.Time // when the reply header is read
+		decoded        time.Time // when the reply body is decoded
+		timing         PullTiming
 		swap           goutil.Map
+		swapCow        cowSwap
+		values         goutil.Map
 		mu             sync.Mutex
 
 		// Send itself to the public channel when pull is complete.
@@ -732,6 +1257,14 @@ func (p *pullCmd) Swap() goutil.Map {
 	return p.swap
 }
 
+// Values returns the per-packet custom data of context.
+func (p *pullCmd) Values() goutil.Map {
+	if p.values == nil {
+		p.values = goutil.RwMap(2)
+	}
+	return p.values
+}
+
 // SwapLen returns the amount of recorded custom data of context.
 func (p *pullCmd) SwapLen() int {
 	return p.swap.Len()
@@ -795,7 +1328,38 @@ func (p *pullCmd) CostTime() time.Duration {
 	return p.cost
 }
 
+// Timing returns the timing breakdown of the pull.
+// If PeerConfig.CountTime=false, always returns zero.
+// Notes:
+//  Inside, <-Done() is automatically called and blocked,
+//  until the pull is completed!
+func (p *pullCmd) Timing() PullTiming {
+	<-p.Done()
+	return p.timing
+}
+
+// computeTiming computes the timing breakdown before done.
+func (p *pullCmd) computeTiming() {
+	if !p.sess.peer.countTime {
+		return
+	}
+	since := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	p.timing = PullTiming{
+		Queue:  since(p.start, p.writeLocked),
+		Write:  since(p.writeLocked, p.written),
+		Wait:   since(p.written, p.replyRead),
+		Decode: since(p.replyRead, p.decoded),
+		RTT:    p.sess.stats.RTT(),
+	}
+}
+
 func (p *pullCmd) done() {
+	p.computeTiming()
 	p.sess.pullCmdMap.Delete(p.output.Seq())
 	p.pullCmdChan <- p
 	close(p.doneChan)
@@ -804,15 +1368,36 @@ func (p *pullCmd) done() {
 }
 
 func (p *pullCmd) cancel() {
+	if rerr := p.sess.rejectedRerror(); rerr != nil {
+		p.abort(rerr)
+	} else {
+		p.abort(rerrConnClosed)
+	}
+}
+
+func (p *pullCmd) timeout() {
+	p.abort(rerrPullTimeout.Copy().SetDetail(fmt.Sprintf("no reply after %v", p.sess.peer.maxPullAge)))
+}
+
+func (p *pullCmd) abort(rerr *Rerror) {
 	p.sess.pullCmdMap.Delete(p.output.Seq())
-	p.rerr = rerrConnClosed
+	p.sess.stats.ObserveError()
+	p.rerr = rerr
 	p.pullCmdChan <- p
 	close(p.doneChan)
 	// free count pull-launch
 	p.sess.gracePullCmdWaitGroup.Done()
 }
 
-// if pullCmd.inputMeta!=nil, means the pullCmd is replyed.
-func (p *pullCmd) hasReply() bool {
-	return p.inputMeta != nil
+// retryable returns whether the PULL can be re-pulled after redialing, see WithRetryable.
+func (p *pullCmd) retryable() bool {
+	return len(p.output.Meta().Peek(MetaRetryable)) > 0
+}
+
+// isPending returns whether the pullCmd is still waiting in the pullCmdMap.
+// Note:
+//  Must be called with p.mu held.
+func (p *pullCmd) isPending() bool {
+	v, ok := p.sess.pullCmdMap.Load(p.output.Seq())
+	return ok && v == p
 }
@@ -0,0 +1,218 @@
+package tp
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/codec"
+)
+
+func TestDeferReply(t *testing.T) {
+	pending := make(chan PullCtx, 1)
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/later", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		pending <- ctx
+		return 0, DeferReply
+	})
+	srv.RoutePullFuncAt("/at_once", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		// replied before the handler returns
+		ctx.Reply(*arg, nil)
+		ctx.Reply(-1, nil)
+		return 0, DeferReply
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	pullLater := func(arg int) chan PullCmd {
+		done := make(chan PullCmd, 1)
+		go func() {
+			done <- sess.Pull("/later", arg, new(int))
+		}()
+		return done
+	}
+
+	done := pullLater(1)
+	ctx := <-pending
+	go ctx.Reply(10, nil)
+	result, rerr := (<-done).Result()
+	if rerr != nil || *result.(*int) != 10 {
+		t.Fatalf("expect 10, got %v, %v", result, rerr)
+	}
+
+	done = pullLater(2)
+	(<-pending).Reply(nil, NewRerror(100, "later error", ""))
+	if rerr := (<-done).Rerror(); rerr == nil || rerr.Code != 100 {
+		t.Fatalf("expect the deferred error, got %v", rerr)
+	}
+
+	// the repeated reply is ignored
+	var reply int
+	if rerr := sess.Pull("/at_once", 3, &reply).Rerror(); rerr != nil || reply != 3 {
+		t.Fatalf("expect 3, got %d, %v", reply, rerr)
+	}
+
+	// the graceful closing waits for the deferred reply
+	done = pullLater(4)
+	ctx = <-pending
+	srvSess := waitSession(t, srv)
+	closed := make(chan struct{})
+	go func() {
+		srvSess.Close()
+		close(closed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("expect the closing waiting for the deferred reply")
+	default:
+	}
+	ctx.Reply(40, nil)
+	result, rerr = (<-done).Result()
+	if rerr != nil || *result.(*int) != 40 {
+		t.Fatalf("expect 40, got %v, %v", result, rerr)
+	}
+	<-closed
+}
+
+func TestUnknownInput(t *testing.T) {
+	pushed := make(chan string, 1)
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.SetUnknownPull(func(ctx UnknownPullCtx) (interface{}, *Rerror) {
+		input := ctx.Input()
+		if input.Ptype() != TypePull || input.BodyCodec() != codec.ID_JSON {
+			return nil, NewRerror(100, "unexpected input", input.String())
+		}
+		// forwards the raw body of the arbitrary URI
+		return input.Uri() + " " + string(ctx.InputBodyBytes()) + " " + string(input.Meta().Peek("k")), nil
+	})
+	srv.SetUnknownPush(func(ctx UnknownPushCtx) *Rerror {
+		pushed <- ctx.Input().Uri() + " " + string(*ctx.Input().Body().(*[]byte))
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	if rerr := sess.Pull("/any/pull?x=1", []int{1, 2}, &reply, WithAddMeta("k", "v")).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply != "/any/pull?x=1 [1,2] v" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if rerr := sess.Push("/any/push", "a"); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if s := <-pushed; s != `/any/push "a"` {
+		t.Fatalf("unexpected pushed: %q", s)
+	}
+}
+
+func TestContextSwapCopyOnWrite(t *testing.T) {
+	srv := NewPeer(PeerConfig{}, sessionSwapPlugin{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/swap", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		v, _ := ctx.Swap().Load("shared")
+		ctx.Swap().Store("shared", *arg)
+		ctx.Swap().Store("private", *arg)
+		if v2, _ := ctx.Swap().Load("shared"); v2 != *arg {
+			return "", NewRerror(CodeInternalServerError, "write not visible", "")
+		}
+		if _, ok := ctx.Session().Swap().Load("private"); ok {
+			return "", NewRerror(CodeInternalServerError, "write leaked into the session swap", "")
+		}
+		s, _ := v.(string)
+		return s, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	cliSess := dialTest(t, cli, addr)
+	for _, arg := range []string{"a", "b"} {
+		var reply string
+		if rerr := cliSess.Pull("/swap", arg, &reply).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+		if reply != "session" {
+			t.Fatalf("expect the session value, got %q", reply)
+		}
+	}
+}
+
+func TestContextValues(t *testing.T) {
+	srv := NewPeer(PeerConfig{}, sessionSwapPlugin{}, new(valuesPlugin))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/values", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		v, _ := ctx.Values().Load("value")
+		if _, ok := ctx.Swap().Load("value"); ok {
+			return "", NewRerror(CodeInternalServerError, "value leaked into the swap", "")
+		}
+		if ctx.(*handlerCtx).swapCow.own != nil {
+			return "", NewRerror(CodeInternalServerError, "session swap copied", "")
+		}
+		return v.(string), nil
+	})
+	addr := serveTest(t, srv)
+
+	plugin := new(valuesPlugin)
+	cli := NewPeer(PeerConfig{}, plugin)
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	for _, arg := range []string{"a", "b"} {
+		var reply string
+		if rerr := sess.Pull("/values", arg, &reply).Rerror(); rerr != nil || reply != arg {
+			t.Fatalf("expect %s, got %q, %v", arg, reply, rerr)
+		}
+	}
+	// the values of the PULL are visible when reading its reply
+	if n := atomic.LoadInt32(&plugin.replies); n != 2 {
+		t.Fatalf("expect 2 replies seeing the pull values, got %d", n)
+	}
+}
+
+// valuesPlugin passes the values between the hooks of one packet.
+type valuesPlugin struct {
+	replies int32
+}
+
+func (*valuesPlugin) Name() string {
+	return "values"
+}
+
+func (*valuesPlugin) PostReadPullBody(ctx ReadCtx) *Rerror {
+	if _, ok := ctx.Values().Load("value"); ok {
+		return NewRerror(CodeInternalServerError, "value leaked from the previous packet", "")
+	}
+	ctx.Values().Store("value", *ctx.Input().Body().(*string))
+	return nil
+}
+
+func (*valuesPlugin) PreWritePull(ctx WriteCtx) *Rerror {
+	ctx.Values().Store("pulled", ctx.Output().Uri())
+	return nil
+}
+
+func (p *valuesPlugin) PostReadReplyHeader(ctx ReadCtx) *Rerror {
+	if v, _ := ctx.Values().Load("pulled"); v == "/values" {
+		atomic.AddInt32(&p.replies, 1)
+	}
+	return nil
+}
+
+type sessionSwapPlugin struct{}
+
+func (sessionSwapPlugin) Name() string {
+	return "session_swap"
+}
+
+func (sessionSwapPlugin) PostAccept(sess PreSession) *Rerror {
+	sess.Swap().Store("shared", "session")
+	return nil
+}
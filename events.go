@@ -0,0 +1,151 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType the type of the peer event.
+type EventType uint8
+
+// The types of the peer events.
+const (
+	// EventSessionOpened a session is accepted or dialed, not published after redialing.
+	EventSessionOpened EventType = iota + 1
+	// EventSessionClosed a session is closed, and will not be redialed.
+	EventSessionClosed
+	// EventRouteRegistered a handler is registered.
+	EventRouteRegistered
+	// EventOverloadEntered no idle handler slot for PeerConfig.MaxInflight, so the requests start queueing.
+	EventOverloadEntered
+	// EventOverloadExited the queue of the requests waiting for PeerConfig.MaxInflight is drained.
+	EventOverloadExited
+	// EventRegistryChanged the live addresses of a service are changed in the registry, e.g. etcd.
+	EventRegistryChanged
+)
+
+var eventTypeTexts = [...]string{
+	EventSessionOpened:   "session_opened",
+	EventSessionClosed:   "session_closed",
+	EventRouteRegistered: "route_registered",
+	EventOverloadEntered: "overload_entered",
+	EventOverloadExited:  "overload_exited",
+	EventRegistryChanged: "registry_changed",
+}
+
+// String returns the text of the event type.
+func (t EventType) String() string {
+	if int(t) < len(eventTypeTexts) && eventTypeTexts[t] != "" {
+		return eventTypeTexts[t]
+	}
+	return "unknown"
+}
+
+// Event the typed event published on the EventBus.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Session the opened or closed session
+	Session BaseSession
+	// Handler the registered handler
+	Handler *Handler
+	// Detail the extra information, e.g. the changed service of EventRegistryChanged
+	Detail string
+}
+
+// EventBus the bus of the peer events, which the applications and plugins subscribe to,
+// instead of hooking into the core code paths.
+// Note:
+//  The events are delivered asynchronously through the buffered channel of every subscription,
+//  and dropped if the buffer is full, so that the publisher is never blocked;
+//  It is concurrent safe.
+type EventBus struct {
+	subs []*EventSubscription
+	mu   sync.RWMutex
+}
+
+// EventSubscription the subscription to the EventBus.
+type EventSubscription struct {
+	// C the channel delivering the events, which is closed by Close
+	C       <-chan *Event
+	c       chan *Event
+	types   uint64 // the bitmask of the subscribed types, 0 means all
+	dropped uint64
+	bus     *EventBus
+}
+
+// NewEventBus creates an event bus.
+func NewEventBus() *EventBus {
+	return new(EventBus)
+}
+
+// Subscribe subscribes the events of the types, or all if no type is specified,
+// buffering up to bufferSize events.
+func (b *EventBus) Subscribe(bufferSize int, types ...EventType) *EventSubscription {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	c := make(chan *Event, bufferSize)
+	s := &EventSubscription{C: c, c: c, bus: b}
+	for _, t := range types {
+		s.types |= 1 << t
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+	return s
+}
+
+// Publish delivers the event to the subscriptions of its type, without blocking.
+// Note: The Time is set to now if zero.
+func (b *EventBus) Publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		if s.types != 0 && s.types&(1<<e.Type) == 0 {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of the events dropped due to the full buffer.
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unsubscribes, and closes the channel C.
+func (s *EventSubscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
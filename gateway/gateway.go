@@ -0,0 +1,166 @@
+// Package gateway is an HTTP gateway that translates the REST requests into teleport pulls,
+// so that the existing HTTP/JSON clients can reach the teleport services.
+//
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gateway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+type (
+	// Caller the object used to pull, e.g. tp.Session.
+	Caller interface {
+		Pull(uri string, args interface{}, reply interface{}, setting ...socket.PacketSetting) tp.PullCmd
+	}
+	// Config the config of the gateway.
+	Config struct {
+		// ForwardHeaders the HTTP headers forwarded as the packet metadata, e.g. "Authorization";
+		// the ones in the reply metadata are also set to the HTTP response
+		ForwardHeaders []string
+		// MaxBodySize the max size of the request body, 4MB by default
+		MaxBodySize int64
+	}
+	// Gateway the HTTP handler translating `POST /some/uri` with the JSON body into `Pull("/some/uri", ...)`.
+	Gateway struct {
+		caller         Caller
+		forwardHeaders []string
+		maxBodySize    int64
+	}
+)
+
+const defaultMaxBodySize = 4 << 20
+
+var _ http.Handler = new(Gateway)
+
+// New creates an HTTP gateway pulling by the caller, e.g.
+//  sess, _ := peer.Dial("127.0.0.1:9090")
+//  http.ListenAndServe(":8080", gateway.New(sess, gateway.Config{ForwardHeaders: []string{"Authorization"}}))
+// Note:
+//  The URI path and query of the HTTP request are used as the URI of the pull;
+//  The JSON body is forwarded as is, and the reply is accepted in JSON.
+func New(caller Caller, cfg Config) *Gateway {
+	if caller == nil {
+		tp.Fatalf("gateway: caller can not be nil")
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultMaxBodySize
+	}
+	forwardHeaders := make([]string, len(cfg.ForwardHeaders))
+	for i, h := range cfg.ForwardHeaders {
+		forwardHeaders[i] = http.CanonicalHeaderKey(h)
+	}
+	return &Gateway{
+		caller:         caller,
+		forwardHeaders: forwardHeaders,
+		maxBodySize:    cfg.MaxBodySize,
+	}
+}
+
+// ServeHTTP translates the HTTP request into a pull, and writes the reply back.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeRerror(w, tp.NewRerror(tp.CodePtypeNotAllowed, http.StatusText(http.StatusMethodNotAllowed), "only POST is allowed"))
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, g.maxBodySize+1))
+	if err != nil {
+		writeRerror(w, tp.NewRerror(tp.CodeBadPacket, tp.CodeText(tp.CodeBadPacket), err.Error()))
+		return
+	}
+	if int64(len(body)) > g.maxBodySize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var settings = make([]socket.PacketSetting, 0, 4+len(g.forwardHeaders))
+	settings = append(settings,
+		socket.WithBodyCodec(codec.ID_JSON),
+		tp.WithAcceptBodyCodec(codec.ID_JSON),
+		tp.WithRealIp(realIp(r)),
+	)
+	for _, key := range g.forwardHeaders {
+		for _, value := range r.Header[key] {
+			settings = append(settings, tp.WithAddMeta(key, value))
+		}
+	}
+	var reply []byte
+	pullcmd := g.caller.Pull(r.URL.RequestURI(), body, &reply, settings...)
+	inputMeta := pullcmd.InputMeta()
+	for _, key := range g.forwardHeaders {
+		if value := inputMeta.Peek(key); len(value) > 0 {
+			w.Header().Set(key, string(value))
+		}
+	}
+	if rerr := pullcmd.Rerror(); rerr != nil {
+		writeRerror(w, rerr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply)
+}
+
+// writeRerror writes the error as the JSON body with the mapped HTTP status.
+func writeRerror(w http.ResponseWriter, rerr *tp.Rerror) {
+	b, _ := rerr.MarshalJSON()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(HttpStatus(rerr.Code))
+	w.Write(b)
+}
+
+// HttpStatus maps the teleport status code to the HTTP status.
+// Note:
+//  The codes in [200,600) are the same as HTTP, e.g. CodeNotFound;
+//  The internal codes of the connection are mapped to 502, 503 or 504;
+//  The other ones, e.g. the custom business codes, are mapped to 500.
+func HttpStatus(code int32) int {
+	switch code {
+	case tp.CodePullTimeout, tp.CodeAckTimeout:
+		return http.StatusGatewayTimeout
+	case tp.CodeQueueTimeout:
+		return http.StatusServiceUnavailable
+	case tp.CodeConnClosed, tp.CodeWriteFailed, tp.CodeDialFailed, tp.CodeWriteRejected:
+		return http.StatusBadGateway
+	}
+	if code >= 200 && code < 600 {
+		return int(code)
+	}
+	return http.StatusInternalServerError
+}
+
+// realIp returns the real IP of the HTTP client.
+func realIp(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); len(xff) > 0 {
+		return strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+	}
+	if ip := r.Header.Get("X-Real-Ip"); len(ip) > 0 {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestHttpStatus(t *testing.T) {
+	var cases = []struct {
+		code   int32
+		status int
+	}{
+		{tp.CodeNotFound, http.StatusNotFound},
+		{tp.CodeTooManyRequests, http.StatusTooManyRequests},
+		{tp.CodePullTimeout, http.StatusGatewayTimeout},
+		{tp.CodeQueueTimeout, http.StatusServiceUnavailable},
+		{tp.CodeConnClosed, http.StatusBadGateway},
+		{tp.CodeUnknownError, http.StatusInternalServerError},
+		{10001, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if status := HttpStatus(c.code); status != c.status {
+			t.Errorf("code %d: expect %d, but got %d", c.code, c.status, status)
+		}
+	}
+}
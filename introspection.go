@@ -0,0 +1,174 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The reserved PULL routes registered when PeerConfig.EnableIntrospection is true,
+// so that a generic CLI or dashboard can inspect any teleport peer.
+const (
+	// IntrospectRoutesUri replies []*RouteInfo
+	IntrospectRoutesUri = "/_tp/routes"
+	// IntrospectSessionsUri replies []*SessionInfo
+	IntrospectSessionsUri = "/_tp/sessions"
+	// IntrospectStatsUri replies *PeerStats
+	IntrospectStatsUri = "/_tp/stats"
+)
+
+type (
+	// RouteInfo the registered handler info replied by IntrospectRoutesUri.
+	RouteInfo struct {
+		Uri   string `json:"uri"`
+		Type  string `json:"type"` // pull, push, unknown_pull or unknown_push
+		Arg   string `json:"arg"`
+		Reply string `json:"reply,omitempty"` // only for PULL
+		// Deprecation the deprecation with the remaining callers, nil if not deprecated
+		Deprecation *RouteDeprecation `json:"deprecation,omitempty"`
+	}
+	// SessionInfo the connected session info replied by IntrospectSessionsUri.
+	SessionInfo struct {
+		Id            string        `json:"id"`
+		RemoteAddr    string        `json:"remote_addr"`
+		Tenant        string        `json:"tenant,omitempty"`
+		Uptime        time.Duration `json:"uptime"`
+		Health        bool          `json:"health"`
+		RTT           time.Duration `json:"rtt"`
+		RecentErrors  int           `json:"recent_errors"`
+		WriteQueueLen int           `json:"write_queue_len"`
+	}
+	// PeerStats the runtime counters replied by IntrospectStatsUri.
+	PeerStats struct {
+		Uptime         time.Duration `json:"uptime"`
+		Sessions       int           `json:"sessions"`
+		Inflight       int           `json:"inflight"`
+		InflightQueued int           `json:"inflight_queued"`
+		Pulls          uint64        `json:"pulls"`
+		PullErrors     uint64        `json:"pull_errors"`
+		Pushes         uint64        `json:"pushes"`
+		PushErrors     uint64        `json:"push_errors"`
+		Goroutines     int           `json:"goroutines"`
+		Protocol       ProtocolStats `json:"protocol"`
+	}
+)
+
+// peerCounters counts the handled PULLs and PUSHs of the peer.
+type peerCounters struct {
+	pulls      uint64
+	pullErrors uint64
+	pushes     uint64
+	pushErrors uint64
+}
+
+func (c *peerCounters) observePull(rerr *Rerror) {
+	atomic.AddUint64(&c.pulls, 1)
+	if rerr != nil {
+		atomic.AddUint64(&c.pullErrors, 1)
+	}
+}
+
+func (c *peerCounters) observePush(rerr *Rerror) {
+	atomic.AddUint64(&c.pushes, 1)
+	if rerr != nil {
+		atomic.AddUint64(&c.pushErrors, 1)
+	}
+}
+
+// routeIntrospection registers the reserved introspection routes into the root router.
+func (p *peer) routeIntrospection(r *Router) {
+	r.RoutePullFuncAt(IntrospectRoutesUri, p.introspectRoutes)
+	r.RoutePullFuncAt(IntrospectSessionsUri, p.introspectSessions)
+	r.RoutePullFuncAt(IntrospectStatsUri, p.introspectStats)
+}
+
+func (p *peer) introspectRoutes(PullCtx, *struct{}) ([]*RouteInfo, *Rerror) {
+	r := p.Router().subRouter
+	var infos []*RouteInfo
+	for _, h := range r.handlers {
+		infos = append(infos, newRouteInfo(h))
+	}
+	for _, q := range r.patterns.list {
+		infos = append(infos, newRouteInfo(q.handler))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Uri < infos[j].Uri
+	})
+	for _, h := range []*Handler{*r.unknownPull, *r.unknownPush} {
+		if h != nil {
+			infos = append(infos, newRouteInfo(h))
+		}
+	}
+	return infos, nil
+}
+
+func newRouteInfo(h *Handler) *RouteInfo {
+	info := &RouteInfo{
+		Uri:  h.name,
+		Type: h.routerTypeName,
+		Arg:  h.argElem.String(),
+	}
+	if h.isUnknown {
+		info.Uri = ""
+		info.Type = h.name
+	}
+	if h.reply != nil {
+		info.Reply = h.reply.String()
+	}
+	info.Deprecation = h.Deprecation()
+	return info
+}
+
+func (p *peer) introspectSessions(PullCtx, *struct{}) ([]*SessionInfo, *Rerror) {
+	infos := make([]*SessionInfo, 0, p.sessHub.Len())
+	p.sessHub.Range(func(sess *session) bool {
+		infos = append(infos, &SessionInfo{
+			Id:            sess.Id(),
+			RemoteAddr:    sess.RemoteAddr().String(),
+			Tenant:        sess.Tenant(),
+			Uptime:        time.Since(sess.startTime),
+			Health:        sess.Health(),
+			RTT:           sess.stats.RTT(),
+			RecentErrors:  sess.stats.RecentErrors(),
+			WriteQueueLen: sess.WriteQueueLen(),
+		})
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos, nil
+}
+
+func (p *peer) introspectStats(PullCtx, *struct{}) (*PeerStats, *Rerror) {
+	stats := &PeerStats{
+		Uptime:     time.Since(p.startTime),
+		Sessions:   p.sessHub.Len(),
+		Pulls:      atomic.LoadUint64(&p.counters.pulls),
+		PullErrors: atomic.LoadUint64(&p.counters.pullErrors),
+		Pushes:     atomic.LoadUint64(&p.counters.pushes),
+		PushErrors: atomic.LoadUint64(&p.counters.pushErrors),
+		Goroutines: runtime.NumGoroutine(),
+		Protocol:   p.ProtocolStats(),
+	}
+	if l := p.inflight; l != nil {
+		stats.Inflight = len(l.slots)
+		stats.InflightQueued = int(atomic.LoadInt32(&l.queued))
+	}
+	return stats, nil
+}
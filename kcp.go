@@ -0,0 +1,83 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// The KCP transport, a reliable UDP for the lossy networks such as mobile,
+// which avoids the head-of-line blocking of TCP, selected by PeerConfig.Network="kcp".
+// Note:
+//  The packet framing and session semantics are the same as TCP,
+//  and the packets of a session are multiplexed by Seq, since KCP has no streams;
+//  The KCP listener can not be inherited on reboot.
+
+// NetworkKcp the network name of the KCP transport.
+const NetworkKcp = "kcp"
+
+// listenKcp announces on the local UDP address for KCP.
+func listenKcp(laddr string, tlsConfig *tls.Config) (net.Listener, error) {
+	lis, err := kcp.ListenWithOptions(laddr, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var l net.Listener = &kcpListener{Listener: lis}
+	if tlsConfig != nil {
+		if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil {
+			lis.Close()
+			return nil, errors.New("tls: neither Certificates nor GetCertificate set in Config")
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// dialKcp connects to the KCP peer of the address.
+func dialKcp(addr string) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	setupKcp(sess)
+	return sess, nil
+}
+
+type kcpListener struct {
+	*kcp.Listener
+}
+
+// Accept waits for and returns the next KCP session.
+func (l *kcpListener) Accept() (net.Conn, error) {
+	sess, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	setupKcp(sess)
+	return sess, nil
+}
+
+// setupKcp tunes the KCP session for low latency.
+func setupKcp(sess *kcp.UDPSession) {
+	// the packet framing requires the byte stream
+	sess.SetStreamMode(true)
+	sess.SetNoDelay(1, 10, 2, 1)
+	sess.SetWindowSize(1024, 1024)
+	sess.SetACKNoDelay(true)
+}
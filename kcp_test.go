@@ -0,0 +1,41 @@
+package tp
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestKcp(t *testing.T) {
+	if err := (&PeerConfig{Network: NetworkKcp}).check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&PeerConfig{Network: "udp"}).check(); err == nil {
+		t.Fatal("expect the invalid network rejected")
+	}
+	if _, err := listenKcp("127.0.0.1:0", new(tls.Config)); err == nil {
+		t.Fatal("expect the TLS config without certificates rejected")
+	}
+
+	lis, err := listenKcp("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewPeer(PeerConfig{Network: NetworkKcp})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	go srv.ServeListener(lis)
+
+	cli := NewPeer(PeerConfig{Network: NetworkKcp})
+	defer cli.Close()
+	sess := dialTest(t, cli, lis.Addr().String())
+	// the large packet is framed over the byte stream
+	for _, arg := range []string{"a", strings.Repeat("b", 1<<20)} {
+		var reply string
+		if rerr := sess.Pull("/echo", arg, &reply).Rerror(); rerr != nil || reply != arg {
+			t.Fatalf("expect the echo of %d bytes, got %d bytes, %v", len(arg), len(reply), rerr)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package tp
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"sync"
@@ -188,3 +189,141 @@ func Debugf(format string, args ...interface{}) {
 func Tracef(format string, args ...interface{}) {
 	globalLogger.Tracef(format, args...)
 }
+
+// logLevels the teleport logger's level list, from the lowest to the highest verbosity.
+var logLevels = map[string]int{
+	"PRINT":    0,
+	"CRITICAL": 1,
+	"ERROR":    2,
+	"WARNING":  3,
+	"NOTICE":   4,
+	"INFO":     5,
+	"DEBUG":    6,
+	"TRACE":    7,
+}
+
+// logEnabled reports whether the logger prints the messages of the level,
+// so that the formatting of the skipped ones can be avoided.
+func logEnabled(logger Logger, level string) bool {
+	rank, ok := logLevels[logger.Level()]
+	return !ok || logLevels[level] <= rank
+}
+
+// LogFunc writes a formatted message of the level,
+// which is one of: PRINT CRITICAL ERROR WARNING NOTICE INFO DEBUG TRACE.
+type LogFunc func(level, msg string)
+
+// NewFuncLogger creates a logger that writes the messages enabled by the level to fn,
+// e.g. for bridging structured loggers into the teleport logs:
+//  tp.SetLogger(tp.NewFuncLogger("INFO", func(level, msg string) {
+//      switch level {
+//      case "CRITICAL", "ERROR":
+//          zapLogger.Error(msg)
+//      case "WARNING":
+//          zapLogger.Warn(msg)
+//      case "DEBUG", "TRACE":
+//          zapLogger.Debug(msg)
+//      default:
+//          zapLogger.Info(msg)
+//      }
+//  }))
+func NewFuncLogger(level string, fn LogFunc) Logger {
+	l := &funcLogger{fn: fn}
+	l.SetLevel(level)
+	return l
+}
+
+// NewStdLogger creates a logger that writes the messages enabled by the level to the standard logger,
+// e.g. NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), "INFO").
+func NewStdLogger(logger *log.Logger, level string) Logger {
+	return NewFuncLogger(level, func(level, msg string) {
+		logger.Printf("[%.4s] %s", level, msg)
+	})
+}
+
+type funcLogger struct {
+	fn    LogFunc
+	level string
+	rank  int
+	mu    sync.RWMutex
+}
+
+// Level returns the logger's level.
+func (l *funcLogger) Level() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.level
+}
+
+// SetLevel sets the logger's level, panics if the level is invalid.
+func (l *funcLogger) SetLevel(level string) {
+	rank, ok := logLevels[level]
+	if !ok {
+		panic("invalid logger level: " + level)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+	l.rank = rank
+}
+
+func (l *funcLogger) logf(level string, format string, args ...interface{}) {
+	l.mu.RLock()
+	enabled := logLevels[level] <= l.rank
+	l.mu.RUnlock()
+	if enabled {
+		l.fn(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// Printf formats according to a format specifier and writes to the logger.
+func (l *funcLogger) Printf(format string, args ...interface{}) {
+	l.logf("PRINT", format, args...)
+}
+
+// Fatalf is equivalent to Criticalf followed by a call to os.Exit(1).
+func (l *funcLogger) Fatalf(format string, args ...interface{}) {
+	l.logf("CRITICAL", format, args...)
+	os.Exit(1)
+}
+
+// Panicf is equivalent to Criticalf followed by a call to panic().
+func (l *funcLogger) Panicf(format string, args ...interface{}) {
+	l.logf("CRITICAL", format, args...)
+	panic(fmt.Sprintf(format, args...))
+}
+
+// Criticalf logs a message using CRITICAL as log level.
+func (l *funcLogger) Criticalf(format string, args ...interface{}) {
+	l.logf("CRITICAL", format, args...)
+}
+
+// Errorf logs a message using ERROR as log level.
+func (l *funcLogger) Errorf(format string, args ...interface{}) {
+	l.logf("ERROR", format, args...)
+}
+
+// Warnf logs a message using WARNING as log level.
+func (l *funcLogger) Warnf(format string, args ...interface{}) {
+	l.logf("WARNING", format, args...)
+}
+
+// Noticef logs a message using NOTICE as log level.
+func (l *funcLogger) Noticef(format string, args ...interface{}) {
+	l.logf("NOTICE", format, args...)
+}
+
+// Infof logs a message using INFO as log level.
+func (l *funcLogger) Infof(format string, args ...interface{}) {
+	l.logf("INFO", format, args...)
+}
+
+// Debugf logs a message using DEBUG as log level.
+func (l *funcLogger) Debugf(format string, args ...interface{}) {
+	l.logf("DEBUG", format, args...)
+}
+
+// Tracef logs a message using TRACE as log level.
+func (l *funcLogger) Tracef(format string, args ...interface{}) {
+	l.logf("TRACE", format, args...)
+}
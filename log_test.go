@@ -2,6 +2,9 @@ package tp
 
 import (
 	"testing"
+
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/socket"
 )
 
 func TestLog(t *testing.T) {
@@ -14,3 +17,46 @@ func TestLog(t *testing.T) {
 	Debugf("test: %s", "Debugf()")
 	Tracef("test: %s", "Tracef()")
 }
+
+func TestFuncLogger(t *testing.T) {
+	var levels []string
+	logger := NewFuncLogger("WARNING", func(level, msg string) {
+		levels = append(levels, level)
+	})
+	logger.Printf("test: %s", "Printf()")
+	logger.Errorf("test: %s", "Errorf()")
+	logger.Warnf("test: %s", "Warnf()")
+	logger.Infof("test: %s", "Infof()")
+	logger.Tracef("test: %s", "Tracef()")
+	if len(levels) != 3 || levels[0] != "PRINT" || levels[1] != "ERROR" || levels[2] != "WARNING" {
+		t.Fatalf("logged levels: %v", levels)
+	}
+	logger.SetLevel("TRACE")
+	logger.Tracef("test: %s", "Tracef()")
+	if len(levels) != 4 {
+		t.Fatalf("logged levels: %v", levels)
+	}
+}
+
+func TestBodyLogRenderer(t *testing.T) {
+	render := NewBodyLogRenderer(0, "password")
+	packet := socket.GetPacket(socket.WithBody(map[string]interface{}{
+		"user":  "henry",
+		"extra": map[string]string{"Password": "123"},
+	}))
+	if b := string(render(packet)); b != `{"extra":{"Password":"***"},"user":"henry"}` {
+		t.Fatalf("redacted body: %s", b)
+	}
+	packet = socket.GetPacket(socket.WithBody([]byte(`{"password":"123"}`)), socket.WithBodyCodec(codec.ID_JSON))
+	if b := string(render(packet)); b != `{"password":"***"}` {
+		t.Fatalf("redacted raw body: %s", b)
+	}
+	packet = socket.GetPacket(socket.WithBody([]byte{0xff, 0xfe, 0x01}))
+	if b := string(render(packet)); b != "<binary 3 bytes>" {
+		t.Fatalf("binary body: %s", b)
+	}
+	packet = socket.GetPacket(socket.WithBody("0123456789"))
+	if b := string(NewBodyLogRenderer(4)(packet)); b != `"012...` {
+		t.Fatalf("truncated body: %s", b)
+	}
+}
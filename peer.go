@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"math/rand"
 	"net"
 	"strings"
 	"sync"
@@ -38,10 +39,22 @@ type (
 		Close() (err error)
 		// CountSession returns the number of sessions.
 		CountSession() int
+		// ProtocolStats returns the counts of the protocol errors of all the sessions, including the closed ones.
+		ProtocolStats() ProtocolStats
 		// GetSession gets the session by id.
 		GetSession(sessionId string) (Session, bool)
 		// RangeSession ranges all sessions. If fn returns false, stop traversing.
 		RangeSession(fn func(sess Session) bool)
+		// Broadcast pushes the same message to the sessions accepted by filter, or all if filter is nil,
+		// encoding the body only once, and returns the errors of the failed sessions by session id.
+		// Note: The frame is still packed and compressed per session.
+		Broadcast(uri string, args interface{}, filter func(Session) bool, setting ...socket.PacketSetting) (failed map[string]*Rerror, rerr *Rerror)
+		// PullAll pulls the same message from the sessions concurrently within the timeout,
+		// and returns the per-session results in the order of sessions, for the scatter-gather aggregation.
+		PullAll(sessions []Session, uri string, args interface{}, newReply func() interface{}, timeout time.Duration, setting ...socket.PacketSetting) []*PullResult
+		// CloseSessions gracefully closes the sessions accepted by filter, or all if filter is nil,
+		// at most rate sessions per second, and returns the number of the closed sessions.
+		CloseSessions(filter func(Session) bool, reason string, rate int) int
 		// SetTlsConfig sets the TLS config.
 		SetTlsConfig(tlsConfig *tls.Config)
 		// SetTlsConfigFromFile sets the TLS config from file.
@@ -50,22 +63,54 @@ type (
 		TlsConfig() *tls.Config
 		// PluginContainer returns the global plugin container.
 		PluginContainer() *PluginContainer
+		// SetLogger sets the logger of the peer, if nil, uses the global logger.
+		SetLogger(logger Logger)
+		// Logger returns the logger of the peer, which is the global logger by default.
+		Logger() Logger
+		// SetRunLogger sets the logger of the PULL and PUSH records, if nil, prints them by Logger().
+		SetRunLogger(runLogger RunLogger)
+		// SetBodyLogRenderer sets the renderer of the body in the run logs, if nil, uses the default one.
+		// Note: the body is printed only if PeerConfig.PrintBody=true.
+		SetBodyLogRenderer(renderer BodyLogRenderer)
+		// SetResolver sets the resolver of the service names passed to Dial, if nil, only the addresses are dialed.
+		SetResolver(resolver Resolver)
+		// Events returns the event bus of the peer, publishing the session, route, overload and registry events.
+		Events() *EventBus
+		// SetProtoFunc sets the default wire protocol of the sessions, if nil, uses socket.DefaultProtoFunc().
+		// Note: the protoFunc passed to Dial, ListenAndServe, etc. takes precedence.
+		SetProtoFunc(protoFunc socket.ProtoFunc)
+		// SetUriFilter sets the filter of the inbound PULL and PUSH by URI path patterns, if nil, all are allowed.
+		SetUriFilter(filter *UriFilter)
+		// SetRetryBudget sets the retry budget shared by the calls of Client and SessionPool, if nil, no budget.
+		SetRetryBudget(budget *RetryBudget)
+		// RetryBudget returns the retry budget, nil means no budget.
+		RetryBudget() *RetryBudget
 	}
 	// EarlyPeer the communication peer that has just been created
 	EarlyPeer interface {
 		BasePeer
 		// Router returns the root router of pull or push handlers.
 		Router() *Router
+		// NewRouter creates an empty root router sharing the plugins of the peer,
+		// which is built and then swapped in by SwapRouter.
+		NewRouter() *Router
+		// SwapRouter atomically replaces the root router, and returns the old one.
+		// Note: The in-flight requests finish on the handlers of the old router.
+		SwapRouter(router *Router) *Router
 		// SubRoute adds handler group.
 		SubRoute(pathPrefix string, plugin ...Plugin) *SubRouter
 		// RoutePull registers PULL handlers, and returns the paths.
 		RoutePull(ctrlStruct interface{}, plugin ...Plugin) []string
 		// RoutePullFunc registers PULL handler, and returns the path.
 		RoutePullFunc(pullHandleFunc interface{}, plugin ...Plugin) string
+		// RoutePullFuncAt registers PULL handler by the specified URI path, and returns the path.
+		RoutePullFuncAt(uriPath string, pullHandleFunc interface{}, plugin ...Plugin) string
 		// RoutePush registers PUSH handlers, and returns the paths.
 		RoutePush(ctrlStruct interface{}, plugin ...Plugin) []string
 		// RoutePushFunc registers PUSH handler, and returns the path.
 		RoutePushFunc(pushHandleFunc interface{}, plugin ...Plugin) string
+		// RoutePushFuncAt registers PUSH handler by the specified URI path, and returns the path.
+		RoutePushFuncAt(uriPath string, pushHandleFunc interface{}, plugin ...Plugin) string
 		// SetUnknownPull sets the default handler, which is called when no handler for PULL is found.
 		SetUnknownPull(fn func(UnknownPullCtx) (interface{}, *Rerror), plugin ...Plugin)
 		// SetUnknownPush sets the default handler, which is called when no handler for PUSH is found.
@@ -86,6 +131,16 @@ type (
 		// ServeListener serves the listener.
 		// Note: The caller ensures that the listener supports graceful shutdown.
 		ServeListener(lis net.Listener, protoFunc ...socket.ProtoFunc) error
+		// ListenAndServeWebsocket turns on the websocket listening service at the path, e.g. (":8080", "/ws").
+		ListenAndServeWebsocket(addr, path string, protoFunc ...socket.ProtoFunc) error
+		// DialWebsocket connects with the websocket peer of the url, e.g. "ws://127.0.0.1:8080/ws".
+		DialWebsocket(url string, protoFunc ...socket.ProtoFunc) (Session, *Rerror)
+	}
+	// Resolver resolves the service name to the live addresses, e.g. the registry client.
+	Resolver interface {
+		// Resolve returns the live addresses of the service.
+		// Note: It is called on every dial and redial, so it should be served from the cache.
+		Resolve(service string) ([]string, error)
 	}
 )
 
@@ -96,22 +151,48 @@ var (
 )
 
 type peer struct {
-	router            *Router
-	pluginContainer   *PluginContainer
-	sessHub           *SessionHub
-	closeCh           chan struct{}
-	freeContext       *handlerCtx
-	ctxLock           sync.Mutex
-	defaultSessionAge time.Duration // Default session max age, if less than or equal to 0, no time limit
-	defaultContextAge time.Duration // Default PULL or PUSH context max age, if less than or equal to 0, no time limit
-	tlsConfig         *tls.Config
-	slowCometDuration time.Duration
-	defaultBodyCodec  byte
-	printBody         bool
-	countTime         bool
-	timeNow           func() time.Time
-	timeSince         func(time.Time) time.Duration
-	mu                sync.Mutex
+	counters           peerCounters // the first field for the 64-bit atomic alignment
+	router             atomic.Value // *Router
+	pluginContainer    *PluginContainer
+	sessHub            *SessionHub
+	closeCh            chan struct{}
+	freeContext        *handlerCtx
+	ctxLock            sync.Mutex
+	defaultSessionAge  time.Duration // Default session max age, if less than or equal to 0, no time limit
+	defaultContextAge  time.Duration // Default PULL or PUSH context max age, if less than or equal to 0, no time limit
+	maxPullAge         time.Duration // Max age of a PULL waiting for its reply, if less than or equal to 0, no time limit
+	tlsConfig          *tls.Config
+	logger             Logger
+	runLogger          RunLogger
+	bodyLogRenderer    BodyLogRenderer
+	resolver           Resolver
+	retryBudget        *RetryBudget
+	uriFilter          *UriFilter
+	protoFunc          socket.ProtoFunc
+	runLogSampleRate   float64
+	maxPacketSize      uint32        // Max size of the packet to read, if 0, only the global limit is checked
+	maxConnections     int           // Max number of the accepted connections, if less than or equal to 0, no limit
+	maxWriteQueue      int           // Max number of the pending writes per session, if less than or equal to 0, no limit
+	writeQueuePolicy   string        // Policy when the write queue is full
+	slowConsumerAge    time.Duration // Max age of the full write queue of a session, if less than or equal to 0, not detected
+	slowConsumerPolicy string        // Policy for the slow consumer
+	drainNoticeAge     time.Duration // Max time between pushing DrainUri and closing the sessions, if less than or equal to 0, not notified
+	maxPausedPackets   int           // Max number of the PULL and PUSH buffered per paused session
+	strictMeta         bool          // Reject the PULL and PUSH carrying the unregistered reserved metadata key
+	inflight           *inflightLimiter
+	events             *EventBus
+	protocol           ProtocolStats // the protocol errors of all the sessions, including the closed ones
+	protocolLock       sync.Mutex
+	dispatch           *dispatchShards // nil means a goroutine per packet
+	slowCometDuration  time.Duration
+	defaultBodyCodec   byte
+	printBody          bool
+	countTime          bool
+	introspection      bool // PeerConfig.EnableIntrospection
+	timeNow            func() time.Time
+	timeSince          func(time.Time) time.Duration
+	startTime          time.Time
+	mu                 sync.Mutex
 
 	network string
 
@@ -120,7 +201,8 @@ type peer struct {
 	redialTimes        int32
 
 	// only for server role
-	listenAddr string
+	listenAddr    string
+	plaintextAddr string
 }
 
 // NewPeer creates a new peer.
@@ -133,19 +215,46 @@ func NewPeer(cfg PeerConfig, globalLeftPlugin ...Plugin) Peer {
 		Fatalf("%v", err)
 	}
 	var p = &peer{
-		router:             newRouter("/", pluginContainer),
 		pluginContainer:    pluginContainer,
 		sessHub:            newSessionHub(),
 		defaultSessionAge:  cfg.DefaultSessionAge,
 		defaultContextAge:  cfg.DefaultContextAge,
+		maxPullAge:         cfg.MaxPullAge,
 		closeCh:            make(chan struct{}),
 		slowCometDuration:  cfg.slowCometDuration,
 		defaultDialTimeout: cfg.DefaultDialTimeout,
 		network:            cfg.Network,
 		listenAddr:         cfg.ListenAddress,
+		plaintextAddr:      cfg.PlaintextAddress,
 		printBody:          cfg.PrintBody,
 		countTime:          cfg.CountTime,
+		runLogSampleRate:   cfg.RunLogSampleRate,
+		maxPacketSize:      cfg.MaxPacketSize,
+		maxConnections:     cfg.MaxConnections,
+		maxWriteQueue:      cfg.MaxWriteQueue,
+		writeQueuePolicy:   cfg.WriteQueuePolicy,
+		slowConsumerAge:    cfg.SlowConsumerAge,
+		slowConsumerPolicy: cfg.SlowConsumerPolicy,
+		drainNoticeAge:     cfg.DrainNoticeAge,
+		maxPausedPackets:   cfg.MaxPausedPackets,
+		strictMeta:         cfg.StrictMeta,
 		redialTimes:        cfg.RedialTimes,
+		startTime:          time.Now(),
+		introspection:      cfg.EnableIntrospection,
+		events:             NewEventBus(),
+	}
+	root := newRouter("/", pluginContainer)
+	root.events = p.events
+	p.router.Store(root)
+	if cfg.ShardDispatch {
+		p.dispatch = newDispatchShards()
+	}
+	if p.maxPausedPackets <= 0 {
+		p.maxPausedPackets = defaultMaxPausedPackets
+	}
+	if cfg.MaxInflight > 0 {
+		p.inflight = newInflightLimiter(cfg.MaxInflight, cfg.MaxInflightQueue, cfg.MaxQueueWait)
+		p.inflight.events = p.events
 	}
 	if c, err := codec.GetByName(cfg.DefaultBodyCodec); err != nil {
 		Fatalf("%v", err)
@@ -160,11 +269,35 @@ func NewPeer(cfg PeerConfig, globalLeftPlugin ...Plugin) Peer {
 		p.timeNow = func() time.Time { return t0 }
 		p.timeSince = func(time.Time) time.Duration { return 0 }
 	}
+	if cfg.EnableIntrospection {
+		p.routeIntrospection(p.Router())
+	}
 	addPeer(p)
+	if p.maxPullAge > 0 {
+		go p.sweepPullCmds()
+	}
 	p.pluginContainer.postNewPeer(p)
 	return p
 }
 
+// sweepPullCmds periodically fails the PULLs that have waited for the reply longer than maxPullAge,
+// so that the lost replies never leak memory or hang the callers.
+func (p *peer) sweepPullCmds() {
+	ticker := time.NewTicker(p.maxPullAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case now := <-ticker.C:
+			p.sessHub.Range(func(sess *session) bool {
+				sess.sweepPullCmds(now)
+				return true
+			})
+		}
+	}
+}
+
 // PluginContainer returns the global plugin container.
 func (p *peer) PluginContainer() *PluginContainer {
 	return p.pluginContainer
@@ -180,6 +313,111 @@ func (p *peer) SetTlsConfig(tlsConfig *tls.Config) {
 	p.tlsConfig = tlsConfig
 }
 
+// SetLogger sets the logger of the peer, if nil, uses the global logger.
+// Note: Concurrent is not safe!
+func (p *peer) SetLogger(logger Logger) {
+	p.logger = logger
+}
+
+// Logger returns the logger of the peer, which is the global logger by default.
+func (p *peer) Logger() Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return globalLogger
+}
+
+// SetRunLogger sets the logger of the PULL and PUSH records, if nil, prints them by Logger().
+// Note: Concurrent is not safe!
+func (p *peer) SetRunLogger(runLogger RunLogger) {
+	p.runLogger = runLogger
+}
+
+// SetBodyLogRenderer sets the renderer of the body in the run logs, if nil, uses the default one.
+// Note:
+//
+//	The body is printed only if PeerConfig.PrintBody=true;
+//	Concurrent is not safe!
+func (p *peer) SetBodyLogRenderer(renderer BodyLogRenderer) {
+	p.bodyLogRenderer = renderer
+}
+
+// SetResolver sets the resolver of the service names passed to Dial, if nil, only the addresses are dialed.
+// Note: Concurrent is not safe!
+func (p *peer) SetResolver(resolver Resolver) {
+	p.resolver = resolver
+}
+
+// Events returns the event bus of the peer, publishing the session, route, overload and registry events,
+// which the applications and plugins subscribe to, e.g.
+//  sub := peer.Events().Subscribe(64, tp.EventSessionOpened, tp.EventSessionClosed)
+//  for e := range sub.C {
+//  	...
+//  }
+func (p *peer) Events() *EventBus {
+	return p.events
+}
+
+// SetUriFilter sets the filter of the inbound PULL and PUSH by URI path patterns, if nil, all are allowed,
+// e.g. dropping the scanners or the deprecated endpoints before plugins, routing and body decoding.
+// Note:
+//
+//	The dropped PULL is replied with CodeNotFound, and the dropped PUSH is ignored as not found;
+//	Concurrent is not safe!
+func (p *peer) SetUriFilter(filter *UriFilter) {
+	p.uriFilter = filter
+}
+
+// SetRetryBudget sets the retry budget shared by the calls of Client and SessionPool, if nil, no budget,
+// so that the per-call retries can not amplify an outage into a retry storm.
+// Note: Concurrent is not safe!
+func (p *peer) SetRetryBudget(budget *RetryBudget) {
+	p.retryBudget = budget
+}
+
+// RetryBudget returns the retry budget, nil means no budget.
+func (p *peer) RetryBudget() *RetryBudget {
+	return p.retryBudget
+}
+
+// SetProtoFunc sets the default wire protocol of the sessions, if nil, uses socket.DefaultProtoFunc(),
+// e.g. the custom framing for interoperating with the existing services.
+// Note:
+//
+//	The protoFunc passed to Dial, ListenAndServe, etc. takes precedence;
+//	Concurrent is not safe!
+func (p *peer) SetProtoFunc(protoFunc socket.ProtoFunc) {
+	p.protoFunc = protoFunc
+}
+
+// withDefaultProtoFunc returns the protoFuncs, or the default one of the peer if not specified.
+func (p *peer) withDefaultProtoFunc(protoFuncs []socket.ProtoFunc) []socket.ProtoFunc {
+	if (len(protoFuncs) == 0 || protoFuncs[0] == nil) && p.protoFunc != nil {
+		return []socket.ProtoFunc{p.protoFunc}
+	}
+	return protoFuncs
+}
+
+// getBodyLogRenderer returns the renderer of the body in the run logs,
+// or nil if PeerConfig.PrintBody=false.
+func (p *peer) getBodyLogRenderer() BodyLogRenderer {
+	if !p.printBody {
+		return nil
+	}
+	if p.bodyLogRenderer != nil {
+		return p.bodyLogRenderer
+	}
+	return defaultBodyLogRenderer
+}
+
+// sampleRunLog reports whether to log the record that is not slow.
+func (p *peer) sampleRunLog() bool {
+	if p.runLogSampleRate <= 0 || p.runLogSampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < p.runLogSampleRate
+}
+
 // SetTlsConfigFromFile sets the TLS config from file.
 func (p *peer) SetTlsConfigFromFile(tlsCertFile, tlsKeyFile string) error {
 	var err error
@@ -205,31 +443,254 @@ func (p *peer) CountSession() int {
 	return p.sessHub.sessions.Len()
 }
 
+// ProtocolStats returns the counts of the protocol errors of all the sessions, including the closed ones.
+func (p *peer) ProtocolStats() ProtocolStats {
+	p.protocolLock.Lock()
+	defer p.protocolLock.Unlock()
+	return p.protocol
+}
+
+func (p *peer) observeProtocol(field func(*ProtocolStats) *uint64) {
+	p.protocolLock.Lock()
+	*field(&p.protocol)++
+	p.protocolLock.Unlock()
+}
+
+// Broadcast pushes the same message to the sessions accepted by filter, or all if filter is nil,
+// encoding the body only once, and returns the errors of the failed sessions by session id.
+// Note:
+//  Only the encoded body is shared by the sessions, instead of being marshalled per session;
+//  The frame is still packed and compressed by the transfer filters per session, not cached,
+//  since the filters cover the header carrying the per-session seq and the metadata set by the
+//  PreWritePush plugins, and the sessions may use different protocols;
+//  If failed to encode the body, nothing is pushed and rerr is returned.
+func (p *peer) Broadcast(uri string, args interface{}, filter func(Session) bool, setting ...socket.PacketSetting) (failed map[string]*Rerror, rerr *Rerror) {
+	bodyBytes, setting, rerr := p.marshalOnce(args, setting)
+	if rerr != nil {
+		return nil, rerr
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	push := func(sess Session) {
+		defer wg.Done()
+		if rerr := sess.Push(uri, bodyBytes, setting...); rerr != nil {
+			mu.Lock()
+			if failed == nil {
+				failed = make(map[string]*Rerror)
+			}
+			failed[sess.Id()] = rerr
+			mu.Unlock()
+		}
+	}
+	p.RangeSession(func(sess Session) bool {
+		if filter != nil && !filter(sess) {
+			return true
+		}
+		wg.Add(1)
+		if !Go(func() { push(sess) }) {
+			push(sess)
+		}
+		return true
+	})
+	wg.Wait()
+	return failed, nil
+}
+
+// PullResult the result of a session pulled by PullAll.
+type PullResult struct {
+	Session Session
+	// Reply the reply created by newReply, valid only if Rerror is nil
+	Reply  interface{}
+	Rerror *Rerror
+}
+
+// PullAll pulls the same message from the sessions concurrently within the timeout,
+// and returns the per-session results in the order of sessions, for the scatter-gather aggregation.
+// Note:
+//  The body is encoded only once, the same as Broadcast;
+//  newReply creates the reply of each session, e.g. func() interface{} { return new(Stats) };
+//  The session without reply in time fails with CodePullTimeout, and the others are still returned;
+//  If timeout<=0, no time limit other than PeerConfig.MaxPullAge.
+func (p *peer) PullAll(sessions []Session, uri string, args interface{}, newReply func() interface{}, timeout time.Duration, setting ...socket.PacketSetting) []*PullResult {
+	results := make([]*PullResult, len(sessions))
+	bodyBytes, setting, rerr := p.marshalOnce(args, setting)
+	if rerr != nil {
+		for i, sess := range sessions {
+			results[i] = &PullResult{Session: sess, Rerror: rerr}
+		}
+		return results
+	}
+	o := &callOptions{timeout: timeout, settings: setting}
+	var wg sync.WaitGroup
+	pull := func(i int) {
+		defer wg.Done()
+		r := &PullResult{Session: sessions[i], Reply: newReply()}
+		r.Rerror = o.pull(r.Session, uri, bodyBytes, r.Reply)
+		results[i] = r
+	}
+	for i := range sessions {
+		wg.Add(1)
+		i := i
+		if !Go(func() { pull(i) }) {
+			pull(i)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// marshalOnce encodes the body to be shared by the sessions,
+// and returns the settings with the body codec.
+func (p *peer) marshalOnce(args interface{}, setting []socket.PacketSetting) ([]byte, []socket.PacketSetting, *Rerror) {
+	output := socket.GetPacket(setting...)
+	output.SetBody(args)
+	if output.BodyCodec() == codec.NilCodecId {
+		output.SetBodyCodec(p.defaultBodyCodec)
+	}
+	bodyBytes, err := output.MarshalBody()
+	bodyCodec := output.BodyCodec()
+	socket.PutPacket(output)
+	if err != nil {
+		return nil, nil, rerrWriteFailed.Copy().SetDetail(err.Error())
+	}
+	return bodyBytes, append(setting[:len(setting):len(setting)], socket.WithBodyCodec(bodyCodec)), nil
+}
+
+// CloseSessions gracefully closes the sessions accepted by filter, or all if filter is nil,
+// at most rate sessions per second, and returns the number of the closed sessions.
+// Note:
+//  Every session is notified by pushing DrainUri with the reason, or DrainReason if empty, before closing;
+//  The closed sessions are redialed as usual, so the rate limit avoids the reconnect stampede
+//  when evicting a large cohort, e.g. during the capacity changes;
+//  If rate<=0 or rate>1e9, no rate limit;
+//  It blocks until all the matched sessions are closed, or the peer is closed.
+func (p *peer) CloseSessions(filter func(Session) bool, reason string, rate int) int {
+	var sessions []*session
+	p.sessHub.Range(func(sess *session) bool {
+		if filter == nil || filter(sess) {
+			sessions = append(sessions, sess)
+		}
+		return true
+	})
+	if len(reason) == 0 {
+		reason = DrainReason
+	}
+	var tick <-chan time.Time
+	// the rate beyond one per nanosecond is regarded as no limit
+	if rate > 0 && rate <= int(time.Second) {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var (
+		wg    sync.WaitGroup
+		count int
+	)
+	for i, sess := range sessions {
+		if i > 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-p.closeCh:
+				wg.Wait()
+				return count
+			}
+		}
+		count++
+		wg.Add(1)
+		sess := sess
+		closeOne := func() {
+			defer wg.Done()
+			sess.closeWithNotice(reason)
+		}
+		if !Go(closeOne) {
+			closeOne()
+		}
+	}
+	wg.Wait()
+	return count
+}
+
 // Dial connects with the peer of the destination address.
+// Note:
+//
+//	The host name of addr is resolved again on every redial,
+//	so the client follows DNS-based failover without restart;
+//	If the resolver is set, addr can also be a service name without port, see SetResolver.
 func (p *peer) Dial(addr string, protoFunc ...socket.ProtoFunc) (Session, *Rerror) {
 	return p.newSessionForClient(func() (net.Conn, error) {
-		return net.DialTimeout(p.network, addr, p.defaultDialTimeout)
+		addr, err := p.resolveAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		if p.network == NetworkKcp {
+			conn, err = dialKcp(addr)
+		} else {
+			conn, err = net.DialTimeout(p.network, addr, p.defaultDialTimeout)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.tlsConfig != nil {
+			conn = tls.Client(conn, p.tlsConfig)
+		}
+		return conn, nil
 	}, addr, protoFunc)
 }
 
 // DialContext connects with the peer of the destination address,
 // using the provided context.
+// Note: The host name or service name of addr is resolved again on every redial.
 func (p *peer) DialContext(ctx context.Context, addr string, protoFunc ...socket.ProtoFunc) (Session, *Rerror) {
 	return p.newSessionForClient(func() (net.Conn, error) {
-		var d net.Dialer
-		return d.DialContext(ctx, p.network, addr)
+		addr, err := p.resolveAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		if p.network == NetworkKcp {
+			conn, err = dialKcp(addr)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, p.network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.tlsConfig != nil {
+			conn = tls.Client(conn, p.tlsConfig)
+		}
+		return conn, nil
 	}, addr, protoFunc)
 }
 
+// resolveAddr returns the address to dial,
+// which is a random live address of the service if addr is a service name.
+func (p *peer) resolveAddr(addr string) (string, error) {
+	if p.resolver == nil {
+		return addr, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	addrs, err := p.resolver.Resolve(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no live address of the service: %s", addr)
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
 func (p *peer) newSessionForClient(dialFunc func() (net.Conn, error), addr string, protoFuncs []socket.ProtoFunc) (*session, *Rerror) {
 	var conn, dialErr = dialFunc()
 	if dialErr != nil {
 		rerr := rerrDialFailed.Copy().SetDetail(dialErr.Error())
 		return nil, rerr
 	}
-	if p.tlsConfig != nil {
-		conn = tls.Client(conn, p.tlsConfig)
-	}
 	var sess = newSession(p, conn, protoFuncs)
 
 	// create redial func
@@ -263,7 +724,7 @@ func (p *peer) newSessionForClient(dialFunc func() (net.Conn, error), addr strin
 		return nil, rerr
 	}
 	AnywayGo(sess.startReadAndHandle)
-	p.sessHub.Set(sess)
+	p.addSession(sess)
 	Infof("dial ok (network:%s, addr:%s, id:%s)", p.network, sess.RemoteAddr().String(), sess.Id())
 	return sess, nil
 }
@@ -273,13 +734,12 @@ func (p *peer) renewSessionForClient(sess *session, dialFunc func() (net.Conn, e
 	if dialErr != nil {
 		return dialErr
 	}
-	if p.tlsConfig != nil {
-		conn = tls.Client(conn, p.tlsConfig)
-	}
 	oldIp := sess.LocalAddr().String()
+	oldRemoteAddr := sess.RemoteAddr().String()
 	oldId := sess.Id()
 	sess.conn = conn
-	sess.socket.Reset(conn, protoFuncs...)
+	sess.socket.Reset(conn, p.withDefaultProtoFunc(protoFuncs)...)
+	atomic.StoreInt32(&sess.draining, 0)
 	if oldIp == oldId {
 		sess.socket.SetId(sess.LocalAddr().String())
 	} else {
@@ -292,7 +752,11 @@ func (p *peer) renewSessionForClient(sess *session, dialFunc func() (net.Conn, e
 	atomic.StoreInt32(&sess.status, statusOk)
 	AnywayGo(sess.startReadAndHandle)
 	p.sessHub.Set(sess)
-	Infof("redial ok (network:%s, addr:%s, id:%s)", p.network, sess.RemoteAddr().String(), sess.Id())
+	if remoteAddr := sess.RemoteAddr().String(); remoteAddr != oldRemoteAddr {
+		Infof("redial ok (network:%s, addr:%s, id:%s), remote address changed from %s", p.network, remoteAddr, sess.Id(), oldRemoteAddr)
+	} else {
+		Infof("redial ok (network:%s, addr:%s, id:%s)", p.network, remoteAddr, sess.Id())
+	}
 	return nil
 }
 
@@ -305,7 +769,7 @@ func (p *peer) ServeConn(conn net.Conn, protoFunc ...socket.ProtoFunc) (Session,
 	}
 	var sess = newSession(p, conn, protoFunc)
 	Tracef("serve ok (network:%s, addr:%s, id:%s)", network, sess.RemoteAddr().String(), sess.Id())
-	p.sessHub.Set(sess)
+	p.addSession(sess)
 	AnywayGo(sess.startReadAndHandle)
 	return sess, nil
 }
@@ -368,27 +832,73 @@ func (p *peer) ServeListener(lis net.Listener, protoFunc ...socket.ProtoFunc) er
 				}
 			}
 			var sess = newSession(p, conn, protoFunc)
-			if rerr := p.pluginContainer.postAccept(sess); rerr != nil {
-				sess.Close()
+			if rerr := p.checkAccept(sess); rerr != nil {
+				sess.reject(rerr)
 				return
 			}
 			Tracef("accept ok (network:%s, addr:%s, id:%s)", network, sess.RemoteAddr().String(), sess.Id())
-			p.sessHub.Set(sess)
+			p.addSession(sess)
 			sess.startReadAndHandle()
 		})
 	}
 }
 
+// addSession registers the new session, and publishes EventSessionOpened.
+func (p *peer) addSession(sess *session) {
+	p.sessHub.Set(sess)
+	p.events.Publish(&Event{Type: EventSessionOpened, Session: sess})
+}
+
+// checkAccept checks whether the accepted session can be served.
+// Note: the number of connections is checked approximately, since the sessions are accepted concurrently.
+func (p *peer) checkAccept(sess *session) *Rerror {
+	if p.maxConnections > 0 && p.sessHub.Len() >= p.maxConnections {
+		return NewRerror(CodeServiceUnavailable, CodeText(CodeServiceUnavailable), "too many connections")
+	}
+	return p.pluginContainer.postAccept(sess)
+}
+
 // ListenAndServe turns on the listening service.
+// Note:
+//
+//	If the TLS config and PeerConfig.PlaintextAddress are set, the plaintext port is also served,
+//	with the same routers and plugins, so that the clients can move to TLS gradually;
+//	If either listener fails, the other one is closed, and the first error is returned.
 func (p *peer) ListenAndServe(protoFunc ...socket.ProtoFunc) error {
 	if len(p.listenAddr) == 0 {
 		Fatalf("listenAddress can not be empty")
 	}
-	lis, err := NewInheritListener(p.network, p.listenAddr, p.tlsConfig)
+	lis, err := p.listen(p.listenAddr, p.tlsConfig)
 	if err != nil {
 		Fatalf("%v", err)
 	}
-	return p.ServeListener(lis, protoFunc...)
+	if p.tlsConfig == nil || len(p.plaintextAddr) == 0 {
+		return p.ServeListener(lis, protoFunc...)
+	}
+	plainLis, err := p.listen(p.plaintextAddr, nil)
+	if err != nil {
+		lis.Close()
+		Fatalf("%v", err)
+	}
+	errCh := make(chan error, 2)
+	for _, l := range []net.Listener{lis, plainLis} {
+		go func(l net.Listener) {
+			errCh <- p.ServeListener(l, protoFunc...)
+		}(l)
+	}
+	err = <-errCh
+	lis.Close()
+	plainLis.Close()
+	<-errCh
+	return err
+}
+
+// listen announces on the local address, with TLS if tlsConfig is not nil.
+func (p *peer) listen(laddr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if p.network == NetworkKcp {
+		return listenKcp(laddr, tlsConfig)
+	}
+	return NewInheritListener(p.network, laddr, tlsConfig)
 }
 
 // Close closes peer.
@@ -400,6 +910,8 @@ func (p *peer) Close() (err error) {
 	}()
 	close(p.closeCh)
 	deletePeer(p)
+	p.pluginContainer.preClose()
+	p.drain()
 	var (
 		count int
 		errCh = make(chan error, 10)
@@ -417,9 +929,45 @@ func (p *peer) Close() (err error) {
 		err = errors.Merge(err, <-errCh)
 	}
 	close(errCh)
+	if p.dispatch != nil {
+		p.dispatch.stop()
+	}
 	return err
 }
 
+// drain pushes the DrainUri notification to all sessions,
+// and waits for the remote peers to close them until PeerConfig.DrainNoticeAge elapses.
+func (p *peer) drain() {
+	if p.drainNoticeAge <= 0 || p.CountSession() == 0 {
+		return
+	}
+	deadline := time.Now().Add(p.drainNoticeAge)
+	notice := &DrainNotice{
+		Reason:   DrainReason,
+		Deadline: deadline,
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	p.sessHub.Range(func(sess *session) bool {
+		Go(func() {
+			sess.Push(DrainUri, notice, socket.WithContext(ctx))
+		})
+		return true
+	})
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for p.CountSession() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainCheckInterval the interval for checking whether all sessions are closed during draining.
+const drainCheckInterval = 50 * time.Millisecond
+
 func (p *peer) getContext(s *session, withWg bool) *handlerCtx {
 	p.ctxLock.Lock()
 	if withWg {
@@ -451,52 +999,161 @@ func (p *peer) putContext(ctx *handlerCtx, withWg bool) {
 
 // Router returns the root router of pull or push handlers.
 func (p *peer) Router() *Router {
-	return p.router
+	return p.router.Load().(*Router)
+}
+
+// NewRouter creates an empty root router sharing the plugins of the peer,
+// which is built and then swapped in by SwapRouter, e.g. after reloading the configuration.
+// Note: The reserved introspection routes are registered if PeerConfig.EnableIntrospection.
+func (p *peer) NewRouter() *Router {
+	r := newRouter("/", p.pluginContainer)
+	r.events = p.events
+	if p.introspection {
+		p.routeIntrospection(r)
+	}
+	return r
+}
+
+// SwapRouter atomically replaces the root router, and returns the old one.
+// Note:
+//
+//	The router must be created by NewRouter of the same peer;
+//	The in-flight requests finish on the handlers of the old router,
+//	while the new requests are routed by the new one.
+func (p *peer) SwapRouter(router *Router) *Router {
+	if router == nil {
+		Panicf("SwapRouter(): the router can not be nil")
+	}
+	if router.subRouter.pluginContainer != p.pluginContainer {
+		Panicf("SwapRouter(): the router is not created by the peer")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.Router()
+	p.router.Store(router)
+	return old
 }
 
 // SubRoute adds handler group.
 func (p *peer) SubRoute(pathPrefix string, plugin ...Plugin) *SubRouter {
-	return p.router.SubRoute(pathPrefix, plugin...)
+	return p.Router().SubRoute(pathPrefix, plugin...)
 }
 
 // RoutePull registers PULL handlers, and returns the paths.
 func (p *peer) RoutePull(pullCtrlStruct interface{}, plugin ...Plugin) []string {
-	return p.router.RoutePull(pullCtrlStruct, plugin...)
+	return p.Router().RoutePull(pullCtrlStruct, plugin...)
 }
 
 // RoutePullFunc registers PULL handler, and returns the path.
 func (p *peer) RoutePullFunc(pullHandleFunc interface{}, plugin ...Plugin) string {
-	return p.router.RoutePullFunc(pullHandleFunc, plugin...)
+	return p.Router().RoutePullFunc(pullHandleFunc, plugin...)
+}
+
+// RoutePullFuncAt registers PULL handler by the specified URI path, and returns the path.
+func (p *peer) RoutePullFuncAt(uriPath string, pullHandleFunc interface{}, plugin ...Plugin) string {
+	return p.Router().RoutePullFuncAt(uriPath, pullHandleFunc, plugin...)
 }
 
 // RoutePush registers PUSH handlers, and returns the paths.
 func (p *peer) RoutePush(pushCtrlStruct interface{}, plugin ...Plugin) []string {
-	return p.router.RoutePush(pushCtrlStruct, plugin...)
+	return p.Router().RoutePush(pushCtrlStruct, plugin...)
 }
 
 // RoutePushFunc registers PUSH handler, and returns the path.
 func (p *peer) RoutePushFunc(pushHandleFunc interface{}, plugin ...Plugin) string {
-	return p.router.RoutePushFunc(pushHandleFunc, plugin...)
+	return p.Router().RoutePushFunc(pushHandleFunc, plugin...)
+}
+
+// RoutePushFuncAt registers PUSH handler by the specified URI path, and returns the path.
+func (p *peer) RoutePushFuncAt(uriPath string, pushHandleFunc interface{}, plugin ...Plugin) string {
+	return p.Router().RoutePushFuncAt(uriPath, pushHandleFunc, plugin...)
 }
 
 // SetUnknownPull sets the default handler,
 // which is called when no handler for PULL is found.
 func (p *peer) SetUnknownPull(fn func(UnknownPullCtx) (interface{}, *Rerror), plugin ...Plugin) {
-	p.router.SetUnknownPull(fn, plugin...)
+	p.Router().SetUnknownPull(fn, plugin...)
 }
 
 // SetUnknownPush sets the default handler,
 // which is called when no handler for PUSH is found.
 func (p *peer) SetUnknownPush(fn func(UnknownPushCtx) *Rerror, plugin ...Plugin) {
-	p.router.SetUnknownPush(fn, plugin...)
+	p.Router().SetUnknownPush(fn, plugin...)
 }
 
 // maybe useful
 
 func (p *peer) getPullHandler(uriPath string) (*Handler, bool) {
-	return p.router.subRouter.getPull(uriPath)
+	h, _, ok := p.Router().subRouter.getPull(uriPath, nil)
+	return h, ok
+}
+
+func (p *peer) getPull(uriPath string, params []routeParam) (*Handler, []routeParam, bool) {
+	return p.Router().subRouter.getPull(uriPath, params)
+}
+
+func (p *peer) getPush(uriPath string, params []routeParam) (*Handler, []routeParam, bool) {
+	return p.Router().subRouter.getPush(uriPath, params)
 }
 
 func (p *peer) getPushHandler(uriPath string) (*Handler, bool) {
-	return p.router.subRouter.getPush(uriPath)
+	h, _, ok := p.Router().subRouter.getPush(uriPath, nil)
+	return h, ok
+}
+
+// inflightLimiter caps the handlers executing concurrently in the peer,
+// with a bounded wait queue.
+type inflightLimiter struct {
+	slots      chan struct{}
+	maxQueue   int32
+	queued     int32
+	overloaded int32 // 1 since no idle slot is found, until the queue is drained
+	maxWait    time.Duration
+	events     *EventBus
+}
+
+func newInflightLimiter(maxInflight, maxQueue int, maxWait time.Duration) *inflightLimiter {
+	return &inflightLimiter{
+		slots:    make(chan struct{}, maxInflight),
+		maxQueue: int32(maxQueue),
+		maxWait:  maxWait,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is no idle one.
+func (l *inflightLimiter) acquire(ctx context.Context) *Rerror {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.CompareAndSwapInt32(&l.overloaded, 0, 1) && l.events != nil {
+		l.events.Publish(&Event{Type: EventOverloadEntered})
+	}
+	if atomic.AddInt32(&l.queued, 1) > l.maxQueue {
+		atomic.AddInt32(&l.queued, -1)
+		return NewRerror(CodeServiceUnavailable, CodeText(CodeServiceUnavailable), "too many requests queued")
+	}
+	defer atomic.AddInt32(&l.queued, -1)
+	var timeoutChan <-chan time.Time
+	if l.maxWait > 0 {
+		timer := time.NewTimer(l.maxWait)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeoutChan:
+		return rerrQueueTimeout.Copy().SetDetail(fmt.Sprintf("no idle handler after %v", l.maxWait))
+	case <-ctx.Done():
+		return rerrQueueTimeout.Copy().SetDetail(ctx.Err().Error())
+	}
+}
+
+func (l *inflightLimiter) release() {
+	<-l.slots
+	if atomic.LoadInt32(&l.queued) == 0 && atomic.CompareAndSwapInt32(&l.overloaded, 1, 0) && l.events != nil {
+		l.events.Publish(&Event{Type: EventOverloadExited})
+	}
 }
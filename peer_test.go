@@ -0,0 +1,1344 @@
+package tp
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// serveTest serves the peer on a random local port, and returns the address.
+func serveTest(t *testing.T, srv Peer) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(lis)
+	return lis.Addr().String()
+}
+
+// dialTest dials the address by the peer, or fails the test.
+func dialTest(t *testing.T, cli Peer, addr string) Session {
+	sess, rerr := cli.Dial(addr)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return sess
+}
+
+// waitSession waits for the first session accepted by the peer, or fails the test.
+func waitSession(t *testing.T, srv Peer) Session {
+	var sess Session
+	for i := 0; i < 100; i++ {
+		srv.RangeSession(func(s Session) bool {
+			sess = s
+			return false
+		})
+		if sess != nil {
+			return sess
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no session accepted")
+	return nil
+}
+
+type BenchArg struct {
+	A, B int
+}
+
+// BenchmarkPull measures the round trip of PULL over an in-memory connection,
+// with the logger level above INFO, so that the run logs are skipped.
+func BenchmarkPull(b *testing.B) {
+	level := GetLoggerLevel()
+	SetLoggerLevel("WARNING")
+	defer SetLoggerLevel(level)
+
+	srv := NewPeer(PeerConfig{CountTime: true})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/add", func(ctx PullCtx, arg *BenchArg) (int, *Rerror) {
+		return arg.A + arg.B, nil
+	})
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+
+	c1, c2 := net.Pipe()
+	if _, err := srv.ServeConn(c1); err != nil {
+		b.Fatal(err)
+	}
+	sess, err := cli.ServeConn(c2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	arg := &BenchArg{A: 1, B: 2}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var reply int
+		if rerr := sess.Pull("/add", arg, &reply).Rerror(); rerr != nil {
+			b.Fatal(rerr)
+		}
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	srv := NewPeer(PeerConfig{MaxPacketSize: 1024})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	srv.Router().LimitPacketSize(256).RoutePullFuncAt("/small", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	// the route limit is replied, and the session is kept
+	if rerr := sess.Pull("/small", strings.Repeat("a", 512), &reply).Rerror(); rerr == nil || rerr.Code != CodeBadPacket {
+		t.Fatalf("route limit: expect CodeBadPacket, got %v", rerr)
+	}
+	if rerr := sess.Pull("/echo", strings.Repeat("a", 512), &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the peer limit rejects and closes the session
+	if rerr := sess.Pull("/echo", strings.Repeat("a", 2048), &reply).Rerror(); rerr == nil || rerr.Code != CodeBadPacket {
+		t.Fatalf("peer limit: expect CodeBadPacket, got %v", rerr)
+	}
+	for i := 0; srv.CountSession() > 0; i++ {
+		if i == 100 {
+			t.Fatal("the session is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	srv := NewPeer(PeerConfig{EnableIntrospection: true})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	srv.RoutePushFuncAt("/notify/:id", func(ctx PushCtx, arg *string) *Rerror {
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	if rerr := sess.Pull("/echo", "a", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	var routes []*RouteInfo
+	if rerr := sess.Pull(IntrospectRoutesUri, nil, &routes).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	var found int
+	for _, r := range routes {
+		switch *r {
+		case RouteInfo{Uri: "/echo", Type: "pull", Arg: "string", Reply: "string"},
+			RouteInfo{Uri: "/notify/:id", Type: "push", Arg: "string"}:
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("routes: %v", routes)
+	}
+	var sessions []*SessionInfo
+	if rerr := sess.Pull(IntrospectSessionsUri, nil, &sessions).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if len(sessions) != 1 || sessions[0].RemoteAddr != sess.LocalAddr().String() {
+		t.Fatalf("sessions: %v", sessions)
+	}
+	var stats PeerStats
+	if rerr := sess.Pull(IntrospectStatsUri, nil, &stats).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if stats.Sessions != 1 || stats.Pulls != 3 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+type slowConsumerPlugin struct {
+	count int32
+}
+
+func (p *slowConsumerPlugin) Name() string {
+	return "slow_consumer"
+}
+
+func (p *slowConsumerPlugin) PostSlowConsumer(BaseSession) *Rerror {
+	atomic.AddInt32(&p.count, 1)
+	return nil
+}
+
+func TestSlowConsumer(t *testing.T) {
+	plugin := new(slowConsumerPlugin)
+	srv := NewPeer(PeerConfig{
+		MaxWriteQueue:      2,
+		SlowConsumerAge:    100 * time.Millisecond,
+		SlowConsumerPolicy: SlowConsumerCloseSession,
+	}, plugin)
+	defer srv.Close()
+	addr := serveTest(t, srv)
+
+	// the client never reads
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sess := waitSession(t, srv)
+	body := strings.Repeat("a", 1<<20)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.Push("/notify", body)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&plugin.count); n != 1 {
+		t.Fatalf("expect the PostSlowConsumer plugin executed once, got %d", n)
+	}
+	if sess.Health() {
+		t.Fatal("the slow consumer is not closed")
+	}
+}
+
+func TestPing(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, rerr := sess.Ping(ctx)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if rtt <= 0 || sess.Stats().LastRTT() != rtt {
+		t.Fatalf("rtt: %v, stats: %v", rtt, sess.Stats().LastRTT())
+	}
+	// the server pings the client too
+	srv.RangeSession(func(s Session) bool {
+		_, rerr = s.Ping(ctx)
+		return false
+	})
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	sess.Close()
+	if _, rerr = sess.Ping(ctx); rerr == nil || rerr.Code != CodeConnClosed {
+		t.Fatalf("expect CodeConnClosed, got %v", rerr)
+	}
+}
+
+// connsListener records the accepted connections.
+type connsListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *connsListener) closeConns() {
+	l.mu.Lock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+	l.mu.Unlock()
+}
+
+func TestRetryablePull(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &connsListener{Listener: lis}
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	var calls int32
+	srv.RoutePullFuncAt("/blip", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		// breaks the connection without replying at every first call
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			cl.closeConns()
+		}
+		return *arg, nil
+	})
+	go srv.ServeListener(cl)
+
+	cli := NewPeer(PeerConfig{RedialTimes: 3})
+	defer cli.Close()
+	sess := dialTest(t, cli, lis.Addr().String())
+	var reply string
+	if rerr := sess.Pull("/blip", "a", &reply, WithRetryable()).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply != "a" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("reply: %q, calls: %d", reply, calls)
+	}
+	// not retryable
+	if rerr := sess.Pull("/blip", "b", &reply).Rerror(); rerr == nil || rerr.Code != CodeConnClosed {
+		t.Fatalf("expect CodeConnClosed, got %v", rerr)
+	}
+}
+
+type tenantPlugin struct{}
+
+func (tenantPlugin) Name() string {
+	return "tenant"
+}
+
+func (tenantPlugin) PostAccept(sess PreSession) *Rerror {
+	sess.SetTenant("acme")
+	return nil
+}
+
+func TestTenant(t *testing.T) {
+	srv := NewPeer(PeerConfig{EnableIntrospection: true}, tenantPlugin{})
+	defer srv.Close()
+	logs := make(chan *RunLog, 1)
+	srv.SetRunLogger(func(r *RunLog) {
+		select {
+		case logs <- r:
+		default:
+		}
+	})
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	if tenant := sess.Tenant(); tenant != "" {
+		t.Fatalf("client tenant: expect empty, got %q", tenant)
+	}
+	var reply string
+	if rerr := sess.Pull("/echo", "a", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if r := <-logs; r.Tenant != "acme" {
+		t.Fatalf("run log tenant: expect acme, got %q", r.Tenant)
+	}
+	var sessions []*SessionInfo
+	if rerr := sess.Pull(IntrospectSessionsUri, nil, &sessions).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if len(sessions) != 1 || sessions[0].Tenant != "acme" {
+		t.Fatalf("sessions: %v", sessions)
+	}
+}
+
+func TestDrainNotice(t *testing.T) {
+	srv := NewPeer(PeerConfig{DrainNoticeAge: 5 * time.Second})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	notices := make(chan *DrainNotice, 1)
+	cli.RoutePushFuncAt(DrainUri, func(ctx PushCtx, notice *DrainNotice) *Rerror {
+		notices <- notice
+		return nil
+	})
+	sess := dialTest(t, cli, addr)
+	start := time.Now()
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case notice := <-notices:
+		if notice.Reason != DrainReason || notice.Deadline.Before(start) {
+			t.Fatalf("notice: %+v", notice)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the draining notification is not received")
+	}
+	if !sess.Draining() {
+		t.Fatal("the session is not draining")
+	}
+	// the well-behaved client migrates, then the server closes without waiting for the deadline
+	sess.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the server is not closed after the sessions are closed")
+	}
+}
+
+// countingCodec counts the marshalling of the JSON codec.
+type countingCodec struct {
+	codec.JsonCodec
+	marshals *int32
+}
+
+func (c countingCodec) Id() byte {
+	return 'c'
+}
+
+func (c countingCodec) Name() string {
+	return "counting"
+}
+
+func (c countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(c.marshals, 1)
+	return c.JsonCodec.Marshal(v)
+}
+
+func TestBroadcast(t *testing.T) {
+	var marshals int32
+	codec.Reg(countingCodec{marshals: &marshals})
+
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	addr := serveTest(t, srv)
+
+	const n = 3
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		cli := NewPeer(PeerConfig{})
+		defer cli.Close()
+		cli.RoutePushFuncAt("/notify", func(ctx PushCtx, arg *map[string]int) *Rerror {
+			if (*arg)["a"] != 1 || ctx.GetBodyCodec() != 'c' {
+				t.Errorf("arg: %v, codec: %c", *arg, ctx.GetBodyCodec())
+			}
+			wg.Done()
+			return nil
+		})
+		if _, rerr := cli.Dial(addr); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	for i := 0; srv.CountSession() < n; i++ {
+		if i == 100 {
+			t.Fatal("the sessions are not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	failed, rerr := srv.Broadcast("/notify", map[string]int{"a": 1}, nil, socket.WithBodyCodec('c'))
+	if rerr != nil || failed != nil {
+		t.Fatalf("rerr: %v, failed: %v", rerr, failed)
+	}
+	wg.Wait()
+	if marshals := atomic.LoadInt32(&marshals); marshals != 1 {
+		t.Fatalf("expect the body marshalled once, got %d", marshals)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	block := make(chan struct{})
+	srv.RoutePullFuncAt("/block", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		<-block
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{CountTime: true, DefaultSessionAge: time.Minute})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	cmd := sess.AsyncPull("/block", "a", new(string), make(chan PullCmd, 1))
+	time.Sleep(50 * time.Millisecond)
+	d := sess.DebugDump()
+	close(block)
+	<-cmd.Done()
+	if d.Status != "ok" || d.SessionAge != time.Minute || d.ReadDeadline.IsZero() {
+		t.Fatalf("dump: %+v", d)
+	}
+	if len(d.PendingPulls) != 1 || d.PendingPulls[0].Uri != "/block" || d.PendingPulls[0].Age <= 0 {
+		t.Fatalf("pending pulls: %+v", d.PendingPulls)
+	}
+	if n := len(d.RecentPackets); n == 0 || !d.RecentPackets[n-1].Outbound || d.RecentPackets[n-1].Uri != "/block" {
+		t.Fatalf("recent packets: %+v", d.RecentPackets)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	workerPool := NewWorkerPool(8, time.Minute)
+	defer workerPool.Stop()
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.Router().RunOn(workerPool).RoutePullFuncAt("/report", func(ctx PullCtx, arg *string) (int, *Rerror) {
+		running, _ := workerPool.Usage()
+		return running, nil
+	})
+	srv.RoutePullFuncAt("/lookup", func(ctx PullCtx, arg *string) (int, *Rerror) {
+		running, _ := workerPool.Usage()
+		return running, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var running int
+	if rerr := sess.Pull("/report", "a", &running).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if running != 1 {
+		t.Fatalf("/report: expect executed on the worker pool, running: %d", running)
+	}
+	if rerr := sess.Pull("/lookup", "a", &running).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if running != 0 {
+		t.Fatalf("/lookup: expect executed on the shared pool, running: %d", running)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	const n = 10
+	var (
+		mu       sync.Mutex
+		received []int
+		done     = make(chan struct{})
+	)
+	srv.RoutePushFuncAt("/step", func(ctx PushCtx, arg *int) *Rerror {
+		// the earlier, the slower
+		time.Sleep(time.Duration(n-*arg) * 5 * time.Millisecond)
+		mu.Lock()
+		received = append(received, *arg)
+		if len(received) == n {
+			close(done)
+		}
+		mu.Unlock()
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	for i := 0; i < n; i++ {
+		if rerr := sess.Push("/step", i, WithOrdered(true)); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	for i, v := range received {
+		if v != i {
+			t.Fatalf("expect handled in order, got %v", received)
+		}
+	}
+}
+
+func TestSwapRouter(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	release := make(chan struct{})
+	srv.RoutePullFuncAt("/version", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		if *arg == "slow" {
+			<-release
+		}
+		return "v1", nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var slowReply string
+	inflight := sess.AsyncPull("/version", "slow", &slowReply, make(chan PullCmd, 1))
+	time.Sleep(100 * time.Millisecond)
+
+	r := srv.NewRouter()
+	r.RoutePullFuncAt("/version", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return "v2", nil
+	})
+	if old := srv.SwapRouter(r); old == r || srv.Router() != r {
+		t.Fatal("expect the router swapped")
+	}
+	var reply string
+	if rerr := sess.Pull("/version", "fast", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply != "v2" {
+		t.Fatalf("expect v2 from the new router, got %q", reply)
+	}
+	close(release)
+	<-inflight.Done()
+	if rerr := inflight.Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if slowReply != "v1" {
+		t.Fatalf("expect the in-flight pull finished on the old router, got %q", slowReply)
+	}
+}
+
+func TestShardDispatch(t *testing.T) {
+	srv := NewPeer(PeerConfig{ShardDispatch: true})
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		sess := dialTest(t, cli, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var reply string
+				if rerr := sess.Pull("/echo", "a", &reply).Rerror(); rerr != nil || reply != "a" {
+					t.Errorf("reply: %q, rerr: %v", reply, rerr)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardDispatchNestedPull(t *testing.T) {
+	// a single shard, which the nested reply must not be queued behind
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	backend := NewPeer(PeerConfig{})
+	defer backend.Close()
+	backend.RoutePullFuncAt("/inner", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	backendAddr := serveTest(t, backend)
+
+	srv := NewPeer(PeerConfig{ShardDispatch: true})
+	defer srv.Close()
+	inner := dialTest(t, srv, backendAddr)
+	srv.RoutePullFuncAt("/outer", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		var reply string
+		rerr := inner.Pull("/inner", *arg, &reply).Rerror()
+		return reply, rerr
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if rerr := sess.Pull("/outer", "a", &reply, WithContext(ctx)).Rerror(); rerr != nil || reply != "a" {
+		t.Fatalf("reply: %q, rerr: %v", reply, rerr)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/len", func(ctx PullCtx, arg *string) (int, *Rerror) {
+		return len(*arg), nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var n int
+	if rerr := sess.Pull("/len", "plain", &n).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if c := sess.Stats().Compression(); c.OutPackets != 0 {
+		t.Fatalf("expect no compressed packet, got %+v", c)
+	}
+	big := strings.Repeat("teleport", 1024)
+	if rerr := sess.Pull("/len", big, &n, socket.WithXferPipe('g')).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	c := sess.Stats().Compression()
+	if c.OutPackets != 1 || c.OutBytes >= c.OutUncompressedBytes || c.OutUncompressedBytes < uint64(len(big)) {
+		t.Fatalf("unexpected compression stats: %+v", c)
+	}
+	if r := c.OutRatio(); r <= 0 || r >= 0.1 {
+		t.Fatalf("expect the ratio of the repeated text < 0.1, got %f", r)
+	}
+}
+
+func TestPushErrorUri(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePushFuncAt("/event", func(ctx PushCtx, arg *string) *Rerror {
+		switch *arg {
+		case "bad":
+			return NewRerror(400, "Bad Event", "unknown kind")
+		case "panic":
+			panic("boom")
+		}
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	pushErrors := make(chan *PushError, 3)
+	cli.RoutePushFuncAt("/push_error", func(ctx PushCtx, arg *PushError) *Rerror {
+		pushErrors <- arg
+		return nil
+	})
+	sess := dialTest(t, cli, addr)
+	for _, arg := range []string{"ok", "bad", "panic"} {
+		if rerr := sess.Push("/event", arg, WithPushErrorUri("/push_error")); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	codes := make(map[int32]*PushError)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-pushErrors:
+			codes[e.Code] = e
+		case <-time.After(3 * time.Second):
+			t.Fatal("expect the push errors")
+		}
+	}
+	if e := codes[400]; e == nil || e.Uri != "/event" || e.Message != "Bad Event" {
+		t.Fatalf("expect the push error of 400, got %v", codes)
+	}
+	if codes[CodeInternalServerError] == nil {
+		t.Fatalf("expect the push error of the panic, got %v", codes)
+	}
+	select {
+	case e := <-pushErrors:
+		t.Fatalf("expect no push error for the successful push, got %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeprecate(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	sunset := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	srv.Router().Deprecate(sunset).RoutePullFuncAt("/old", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	srv.RoutePullFuncAt("/new", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	for i := 0; i < 2; i++ {
+		cmd := sess.Pull("/old", "a", &reply)
+		if rerr := cmd.Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+		if s, ok := GetDeprecatedSunset(cmd.InputMeta()); !ok || !s.Equal(sunset) {
+			t.Fatalf("expect deprecated with sunset %v, got %v, %v", sunset, s, ok)
+		}
+	}
+	cmd := sess.Pull("/new", "a", &reply)
+	if _, ok := GetDeprecatedSunset(cmd.InputMeta()); ok {
+		t.Fatal("expect /new not deprecated")
+	}
+	h, _ := srv.(*peer).getPullHandler("/old")
+	d := h.Deprecation()
+	if d == nil || d.Calls != 2 || len(d.Callers) != 1 {
+		t.Fatalf("unexpected deprecation: %+v", d)
+	}
+}
+
+func TestPullAll(t *testing.T) {
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	var sessions []Session
+	for i, delay := range []time.Duration{0, 0, time.Second} {
+		srv := NewPeer(PeerConfig{})
+		defer srv.Close()
+		shard := i
+		srv.RoutePullFuncAt("/count", func(ctx PullCtx, arg *string) (int, *Rerror) {
+			time.Sleep(delay)
+			return shard * 10, nil
+		})
+		addr := serveTest(t, srv)
+		sess := dialTest(t, cli, addr)
+		sessions = append(sessions, sess)
+	}
+	results := cli.PullAll(sessions, "/count", "a", func() interface{} { return new(int) }, 300*time.Millisecond)
+	if len(results) != 3 {
+		t.Fatalf("expect 3 results, got %d", len(results))
+	}
+	for i, r := range results[:2] {
+		if r.Rerror != nil || r.Session != sessions[i] || *r.Reply.(*int) != i*10 {
+			t.Fatalf("result %d: %+v", i, r)
+		}
+	}
+	if rerr := results[2].Rerror; rerr == nil || rerr.Code != CodePullTimeout {
+		t.Fatalf("expect CodePullTimeout from the slow session, got %v", rerr)
+	}
+}
+
+func TestPullTiming(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/slow", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		time.Sleep(100 * time.Millisecond)
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{CountTime: true})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	cmd := sess.Pull("/slow", "a", &reply)
+	if rerr := cmd.Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	timing := cmd.Timing()
+	if timing.Wait < 100*time.Millisecond {
+		t.Fatalf("expect the wait covers the server handling, got %+v", timing)
+	}
+	if timing.Queue < 0 || timing.Write < 0 || timing.Decode < 0 {
+		t.Fatalf("unexpected timing: %+v", timing)
+	}
+}
+
+func TestProtocolStats(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.Router().RequireBodyCodec(codec.ID_PROTOBUF).RoutePullFuncAt("/pb", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	if rerr := sess.Pull("/pb", "a", &reply, WithBodyCodec(codec.ID_JSON)).Rerror(); rerr == nil {
+		t.Fatal("expect the body codec to be rejected")
+	}
+	if rerr := sess.Push("/unknown_type", "a", socket.WithPtype(99)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the session is closed for the unknown packet type, but the peer keeps counting
+	var stats ProtocolStats
+	for i := 0; i < 100; i++ {
+		if stats = srv.ProtocolStats(); stats.UnknownTypes == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.CodecMismatches != 1 || stats.UnknownTypes != 1 || stats.MalformedFrames != 0 || stats.ChecksumFailures != 0 {
+		t.Fatalf("unexpected protocol stats: %+v", stats)
+	}
+}
+
+func TestSetGzipLevel(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		if ctx.Query().Get("gzip") == "off" {
+			ctx.SetGzipLevel(gzip.NoCompression)
+		} else {
+			ctx.SetGzipLevel(gzip.BestCompression)
+		}
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	big := strings.Repeat("teleport", 1024)
+	var reply string
+	if rerr := sess.Pull("/echo?gzip=off", big, &reply, socket.WithXferPipe('g')).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if c := sess.Stats().Compression(); reply != big || c.InPackets != 0 {
+		t.Fatalf("expect the reply not compressed, got %+v", c)
+	}
+	if rerr := sess.Pull("/echo", big, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if c := sess.Stats().Compression(); reply != big || c.InPackets != 1 || c.InBytes >= c.InUncompressedBytes {
+		t.Fatalf("expect the reply compressed, got %+v", c)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	srv := NewPeer(PeerConfig{MaxPausedPackets: 2})
+	defer srv.Close()
+	var handled int32
+	srv.RoutePushFuncAt("/event", func(ctx PushCtx, arg *int) *Rerror {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	srvSess := waitSession(t, srv)
+	srvSess.Pause()
+	// beyond the buffer, the reading blocks until resumed
+	for i := 0; i < 4; i++ {
+		if rerr := sess.Push("/event", i); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&handled); n != 0 || !srvSess.Paused() {
+		t.Fatalf("expect no push handled while paused, got %d", n)
+	}
+	srvSess.Resume()
+	for i := 0; atomic.LoadInt32(&handled) != 4; i++ {
+		if i == 100 {
+			t.Fatalf("expect all pushes handled after resumed, got %d", atomic.LoadInt32(&handled))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// closing the paused session replies the buffered pulls, instead of deadlocking
+	srvSess.Pause()
+	replies := make(chan *Rerror, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var reply int
+			replies <- sess.Pull("/echo", 1, &reply).Rerror()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		srvSess.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("closing the paused session is blocked")
+	}
+	for i := 0; i < 2; i++ {
+		if rerr := <-replies; rerr != nil {
+			t.Fatalf("expect the buffered pull replied before closing, got %v", rerr)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srvSub := srv.Events().Subscribe(16, EventRouteRegistered, EventSessionOpened, EventSessionClosed)
+	defer srvSub.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	sess.Close()
+
+	want := []EventType{EventRouteRegistered, EventSessionOpened, EventSessionClosed}
+	for _, typ := range want {
+		select {
+		case e := <-srvSub.C:
+			if e.Type != typ {
+				t.Fatalf("expect %s, got %s", typ, e.Type)
+			}
+			if typ == EventRouteRegistered && e.Handler.Name() != "/echo" {
+				t.Fatalf("expect the registered /echo, got %s", e.Handler.Name())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s, got nothing", typ)
+		}
+	}
+}
+
+func TestStrictMeta(t *testing.T) {
+	RegisterMetaKey("X-Strict-Known")
+	srv := NewPeer(PeerConfig{StrictMeta: true})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/test_strict_meta", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	rerr := sess.Pull("/test_strict_meta", "a", &reply,
+		WithAddMeta("X-Strict-Known", "1"), WithAddMeta("x-lowercase", "1"), WithAddMeta("Custom", "1"),
+	).Rerror()
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	rerr = sess.Pull("/test_strict_meta", "a", &reply, WithAddMeta("X-Strict-Unknown", "1")).Rerror()
+	if rerr == nil || rerr.Code != CodeBadPacket || !strings.Contains(rerr.Detail, "X-Strict-Unknown") {
+		t.Fatalf("expect the unknown metadata key to be rejected, got %v", rerr)
+	}
+	srv.RangeSession(func(s Session) bool {
+		if n := s.Stats().Protocol().UnknownMeta; n != 1 {
+			t.Fatalf("expect 1 unknown metadata packet, got %d", n)
+		}
+		return false
+	})
+}
+
+func TestCloseSessions(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	addr := serveTest(t, srv)
+
+	var notices int32
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	cli.RoutePushFuncAt(DrainUri, func(ctx PushCtx, notice *DrainNotice) *Rerror {
+		if notice.Reason == "evicted" {
+			atomic.AddInt32(&notices, 1)
+		}
+		return nil
+	})
+	for i := 0; i < 4; i++ {
+		if _, rerr := cli.Dial(addr); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	for i := 0; i < 100 && srv.CountSession() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var kept string
+	srv.RangeSession(func(s Session) bool {
+		kept = s.Id()
+		return false
+	})
+
+	start := time.Now()
+	n := srv.CloseSessions(func(s Session) bool { return s.Id() != kept }, "evicted", 10)
+	if n != 3 {
+		t.Fatalf("expect 3 closed sessions, got %d", n)
+	}
+	if cost := time.Since(start); cost < 150*time.Millisecond {
+		t.Fatalf("expect the closing to be rate limited, cost %s", cost)
+	}
+	if _, ok := srv.GetSession(kept); !ok {
+		t.Fatal("expect the unmatched session to be kept")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&notices) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&notices); n != 3 {
+		t.Fatalf("expect 3 close notices, got %d", n)
+	}
+
+	// the rate beyond one per nanosecond is no limit, instead of panicking
+	if n = srv.CloseSessions(nil, "", 1<<31-1); n != 1 {
+		t.Fatalf("expect 1 closed session, got %d", n)
+	}
+}
+
+type listenPlugin struct {
+	listened int32
+	addr     chan net.Addr
+}
+
+func (p *listenPlugin) Name() string {
+	return "listen"
+}
+
+func (p *listenPlugin) PostListen() error {
+	atomic.AddInt32(&p.listened, 1)
+	return nil
+}
+
+func (p *listenPlugin) PostListenAddr(addr net.Addr) error {
+	p.addr <- addr
+	return nil
+}
+
+func TestPostListenPlugin(t *testing.T) {
+	plugin := &listenPlugin{addr: make(chan net.Addr, 1)}
+	srv := NewPeer(PeerConfig{}, plugin)
+	defer srv.Close()
+	addr := serveTest(t, srv)
+	select {
+	case listened := <-plugin.addr:
+		if listened.String() != addr {
+			t.Fatalf("expect the listen address %s, got %s", addr, listened)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect PostListenAddr called")
+	}
+	// the plugins of the address-less signature are still called
+	if n := atomic.LoadInt32(&plugin.listened); n != 1 {
+		t.Fatalf("expect PostListen called once, got %d", n)
+	}
+}
+
+func TestRunLogger(t *testing.T) {
+	var srvLogs, cliLogs = make(chan RunLog, 10), make(chan RunLog, 10)
+	srv := NewPeer(PeerConfig{
+		CountTime:         true,
+		SlowCometDuration: 50 * time.Millisecond,
+		RunLogSampleRate:  1e-9,
+	})
+	defer srv.Close()
+	srv.SetRunLogger(func(r *RunLog) {
+		srvLogs <- *r
+	})
+	srv.RoutePullFuncAt("/fast", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	srv.RoutePullFuncAt("/slow", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		time.Sleep(60 * time.Millisecond)
+		return "", NewRerror(100, "slow", "")
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	cli.SetRunLogger(func(r *RunLog) {
+		cliLogs <- *r
+	})
+	sess := dialTest(t, cli, addr)
+	var reply string
+	if rerr := sess.Pull("/fast", "a", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	sess.Pull("/slow", "b", &reply)
+	if rerr := sess.Push("/fast", "c"); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	// all are logged without sampling, in any order
+	have := make(map[string]RunLog)
+	for i := 0; i < 3; i++ {
+		r := <-cliLogs
+		have[TypeText(r.Ptype)+" "+r.Uri] = r
+	}
+	for _, want := range []RunLog{
+		{Ptype: TypePull, Uri: "/fast"},
+		{Ptype: TypePull, Uri: "/slow", Code: 100},
+		{Ptype: TypePush, Uri: "/fast"},
+	} {
+		r := have[TypeText(want.Ptype)+" "+want.Uri]
+		if !r.Outbound || r.Ptype != want.Ptype || r.Code != want.Code || r.Addr != addr || r.OutputSize == 0 {
+			t.Fatalf("client run log: want %+v, have %+v", want, r)
+		}
+		// no input for the launched PUSH
+		if (r.Ptype == TypePull) != (r.InputSize > 0) {
+			t.Fatalf("client run log: unexpected input size %d of %s", r.InputSize, TypeText(r.Ptype))
+		}
+	}
+	// only the slow one is logged, since the others are sampled out
+	r := <-srvLogs
+	if r.Outbound || r.Uri != "/slow" || r.Code != 100 || !r.Slow || r.Cost < 50*time.Millisecond {
+		t.Fatalf("server run log: unexpected %+v", r)
+	}
+	select {
+	case r = <-srvLogs:
+		t.Fatalf("server run log: expect sampled out, have %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv := NewPeer(PeerConfig{MaxConnections: 1})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	waitSession(t, srv)
+	var reply int
+	if rerr := sess.Pull("/echo", 1, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the excess connection is rejected
+	rejected := dialTest(t, cli, addr)
+	for i := 0; i < 100 && rejected.Health(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rerr := rejected.Pull("/echo", 2, &reply).Rerror()
+	if rerr == nil || rerr.Code != CodeServiceUnavailable || rerr.Detail != "too many connections" {
+		t.Fatalf("expect CodeServiceUnavailable, got %v", rerr)
+	}
+	// accepted again after the session is closed
+	sess.Close()
+	for i := 0; i < 100 && srv.CountSession() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rerr = dialTest(t, cli, addr).Pull("/echo", 3, &reply).Rerror(); rerr != nil || reply != 3 {
+		t.Fatalf("expect 3, got %d, %v", reply, rerr)
+	}
+}
+
+func TestInflightLimiter(t *testing.T) {
+	l := newInflightLimiter(1, 1, 50*time.Millisecond)
+	if rerr := l.acquire(context.Background()); rerr != nil {
+		t.Fatal(rerr)
+	}
+	queued := make(chan *Rerror, 1)
+	go func() {
+		queued <- l.acquire(context.Background())
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&l.queued) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	// beyond the wait queue
+	if rerr := l.acquire(context.Background()); rerr == nil || rerr.Code != CodeServiceUnavailable {
+		t.Fatalf("expect CodeServiceUnavailable, got %v", rerr)
+	}
+	if rerr := <-queued; rerr == nil || rerr.Code != CodeQueueTimeout {
+		t.Fatalf("expect CodeQueueTimeout, got %v", rerr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if rerr := l.acquire(ctx); rerr == nil || rerr.Code != CodeQueueTimeout || rerr.Detail != context.Canceled.Error() {
+		t.Fatalf("expect CodeQueueTimeout by the context, got %v", rerr)
+	}
+	// the queued one takes the released slot
+	go func() {
+		queued <- l.acquire(context.Background())
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&l.queued) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	l.release()
+	if rerr := <-queued; rerr != nil {
+		t.Fatal(rerr)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	srv := NewPeer(PeerConfig{MaxInflight: 1, MaxInflightQueue: 1})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/block", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		entered <- struct{}{}
+		<-release
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	done := make(chan *Rerror, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- sess.Pull("/block", 1, new(int)).Rerror()
+		}()
+	}
+	<-entered
+	// one executing and one queued
+	for i := 0; i < 100 && atomic.LoadInt32(&srv.(*peer).inflight.queued) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rerr := sess.Pull("/block", 2, new(int)).Rerror(); rerr == nil || rerr.Code != CodeServiceUnavailable {
+		t.Fatalf("expect CodeServiceUnavailable, got %v", rerr)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if rerr := <-done; rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+}
+
+// countingProto counts the packets packed by the default protocol.
+type countingProto struct {
+	socket.Proto
+	packed *int32
+}
+
+func (c countingProto) Pack(p *socket.Packet) error {
+	atomic.AddInt32(c.packed, 1)
+	return c.Proto.Pack(p)
+}
+
+func countingProtoFunc(packed *int32) socket.ProtoFunc {
+	return func(rw io.ReadWriter) socket.Proto {
+		return countingProto{Proto: socket.DefaultProtoFunc()(rw), packed: packed}
+	}
+}
+
+func TestSetProtoFunc(t *testing.T) {
+	var srvPacked, cliPacked, explicitPacked int32
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.SetProtoFunc(countingProtoFunc(&srvPacked))
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	cli.SetProtoFunc(countingProtoFunc(&cliPacked))
+	var reply int
+	if rerr := dialTest(t, cli, addr).Pull("/echo", 1, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	packed := atomic.LoadInt32(&cliPacked)
+	if atomic.LoadInt32(&srvPacked) == 0 || packed == 0 {
+		t.Fatalf("expect the default protocols used, got %d and %d", srvPacked, packed)
+	}
+	// the protoFunc passed to Dial takes precedence
+	sess, rerr := cli.Dial(addr, countingProtoFunc(&explicitPacked))
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if rerr = sess.Pull("/echo", 2, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if atomic.LoadInt32(&explicitPacked) == 0 || atomic.LoadInt32(&cliPacked) != packed {
+		t.Fatalf("expect the passed protocol used, got %d and %d", explicitPacked, cliPacked)
+	}
+}
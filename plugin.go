@@ -43,15 +43,22 @@ type (
 	PostListenPlugin interface {
 		PostListen() error
 	}
+	// PostListenAddrPlugin is executed between listening and accepting, with the listen address.
+	PostListenAddrPlugin interface {
+		PostListenAddr(net.Addr) error
+	}
 	// PostDialPlugin is executed after dialing.
 	PostDialPlugin interface {
 		PostDial(PreSession) *Rerror
 	}
 	// PostAcceptPlugin is executed after accepting connection.
+	// If it returns error, the error is sent to the remote peer as the rejection reason before closing.
 	PostAcceptPlugin interface {
 		PostAccept(PreSession) *Rerror
 	}
 	// PreWritePullPlugin is executed before writing PULL packet.
+	// It can mutate the output packet, or veto it by returning error,
+	// which is returned to the caller as the pull result, see CodeWriteRejected.
 	PreWritePullPlugin interface {
 		PreWritePull(WriteCtx) *Rerror
 	}
@@ -60,6 +67,8 @@ type (
 		PostWritePull(WriteCtx) *Rerror
 	}
 	// PreWriteReplyPlugin is executed before writing REPLY packet.
+	// It can mutate the output packet, or veto it by returning error,
+	// then the body is dropped and the error is replied instead.
 	PreWriteReplyPlugin interface {
 		PreWriteReply(WriteCtx) *Rerror
 	}
@@ -68,6 +77,8 @@ type (
 		PostWriteReply(WriteCtx) *Rerror
 	}
 	// PreWritePushPlugin is executed before writing PUSH packet.
+	// It can mutate the output packet, or veto it by returning error,
+	// which is returned to the caller of Push, see CodeWriteRejected.
 	PreWritePushPlugin interface {
 		PreWritePush(WriteCtx) *Rerror
 	}
@@ -115,10 +126,24 @@ type (
 	PostReadReplyBodyPlugin interface {
 		PostReadReplyBody(ReadCtx) *Rerror
 	}
+	// PostChangeIdPlugin is executed after changing the session id.
+	PostChangeIdPlugin interface {
+		PostChangeId(sess BaseSession, oldId string) *Rerror
+	}
 	// PostDisconnectPlugin is executed after disconnection.
 	PostDisconnectPlugin interface {
 		PostDisconnect(BaseSession) *Rerror
 	}
+	// PostSlowConsumerPlugin is executed when the write queue of the session stays full longer than PeerConfig.SlowConsumerAge,
+	// before handling by PeerConfig.SlowConsumerPolicy.
+	// Note: it is executed once until the write queue is not full again.
+	PostSlowConsumerPlugin interface {
+		PostSlowConsumer(BaseSession) *Rerror
+	}
+	// PreClosePlugin is executed before closing the peer, e.g. for deregistering from the service discovery.
+	PreClosePlugin interface {
+		PreClose() error
+	}
 )
 
 type PluginContainer struct {
@@ -323,6 +348,12 @@ func (p *pluginSingleContainer) postListen(addr net.Addr) {
 				return
 			}
 		}
+		if _plugin, ok := plugin.(PostListenAddrPlugin); ok {
+			if err = _plugin.PostListenAddr(addr); err != nil {
+				Fatalf("[network:%s, addr:%s] %s-PostListenAddrPlugin(%s)", addr.Network(), addr.String(), plugin.Name(), err.Error())
+				return
+			}
+		}
 	}
 	return
 }
@@ -384,16 +415,17 @@ func (p *pluginSingleContainer) postWritePull(ctx WriteCtx) *Rerror {
 }
 
 // PreWriteReply executes the defined plugins before writing REPLY packet.
-func (p *pluginSingleContainer) preWriteReply(ctx WriteCtx) {
+func (p *pluginSingleContainer) preWriteReply(ctx WriteCtx) *Rerror {
 	var rerr *Rerror
 	for _, plugin := range p.plugins {
 		if _plugin, ok := plugin.(PreWriteReplyPlugin); ok {
 			if rerr = _plugin.PreWriteReply(ctx); rerr != nil {
 				Errorf("%s-PreWriteReplyPlugin(%s)", plugin.Name(), rerr.String())
-				return
+				return rerr
 			}
 		}
 	}
+	return nil
 }
 
 // PostWriteReply executes the defined plugins after successful writing REPLY packet.
@@ -577,6 +609,20 @@ func (p *pluginSingleContainer) postReadReplyBody(ctx ReadCtx) *Rerror {
 	return nil
 }
 
+// PostChangeId executes the defined plugins after changing the session id.
+func (p *pluginSingleContainer) postChangeId(sess BaseSession, oldId string) *Rerror {
+	var rerr *Rerror
+	for _, plugin := range p.plugins {
+		if _plugin, ok := plugin.(PostChangeIdPlugin); ok {
+			if rerr = _plugin.PostChangeId(sess, oldId); rerr != nil {
+				Errorf("%s-PostChangeIdPlugin(%s)", plugin.Name(), rerr.String())
+				return rerr
+			}
+		}
+	}
+	return nil
+}
+
 // PostDisconnect executes the defined plugins after disconnection.
 func (p *pluginSingleContainer) postDisconnect(sess BaseSession) *Rerror {
 	var rerr *Rerror
@@ -591,6 +637,31 @@ func (p *pluginSingleContainer) postDisconnect(sess BaseSession) *Rerror {
 	return nil
 }
 
+// PostSlowConsumer executes the defined plugins when the session is detected as a slow consumer.
+func (p *pluginSingleContainer) postSlowConsumer(sess BaseSession) *Rerror {
+	var rerr *Rerror
+	for _, plugin := range p.plugins {
+		if _plugin, ok := plugin.(PostSlowConsumerPlugin); ok {
+			if rerr = _plugin.PostSlowConsumer(sess); rerr != nil {
+				Errorf("%s-PostSlowConsumerPlugin(%s)", plugin.Name(), rerr.String())
+				return rerr
+			}
+		}
+	}
+	return nil
+}
+
+// PreClose executes the defined plugins before closing the peer.
+func (p *pluginSingleContainer) preClose() {
+	for _, plugin := range p.plugins {
+		if _plugin, ok := plugin.(PreClosePlugin); ok {
+			if err := _plugin.PreClose(); err != nil {
+				Errorf("%s-PreClosePlugin(%s)", plugin.Name(), err.Error())
+			}
+		}
+	}
+}
+
 func warnInvaildHandlerHooks(plugin []Plugin) {
 	for _, p := range plugin {
 		switch p.(type) {
@@ -602,6 +673,8 @@ func warnInvaildHandlerHooks(plugin []Plugin) {
 			Debugf("invalid PostDialPlugin in router: %s", p.Name())
 		case PostAcceptPlugin:
 			Debugf("invalid PostAcceptPlugin in router: %s", p.Name())
+		case PreClosePlugin:
+			Debugf("invalid PreClosePlugin in router: %s", p.Name())
 		case PreWritePullPlugin:
 			Debugf("invalid PreWritePullPlugin in router: %s", p.Name())
 		case PostWritePullPlugin:
@@ -0,0 +1,147 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// An audit plugin for recording who invoked which URI with what status and when.
+
+// Audit creates a plugin that records every handled PULL and PUSH to the sink.
+// If uriPrefix is not empty, only records the URIs with one of the prefixes, e.g. "/admin/".
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin,
+//  since the records are made by the router middleware added in PostNewPeer;
+//  The identity of the invoker is the session id, which can be set by the auth plugin;
+//  The sink is called synchronously in the handling goroutine.
+func Audit(sink AuditSink, uriPrefix ...string) tp.Plugin {
+	if sink == nil {
+		tp.Fatalf("audit: sink can not be nil")
+	}
+	return &audit{sink: sink, uriPrefixes: uriPrefix}
+}
+
+type (
+	// AuditRecord the record of an invocation.
+	AuditRecord struct {
+		Time time.Time `json:"time"`
+		// SessionId the identity of the invoker
+		SessionId string `json:"session_id"`
+		// RealIp the real IP of the invoker
+		RealIp string `json:"real_ip"`
+		// Ptype "PULL" or "PUSH"
+		Ptype string `json:"ptype"`
+		Uri   string `json:"uri"`
+		// Code the code of the reply error, 0 means OK
+		Code    int32         `json:"code"`
+		Message string        `json:"message,omitempty"`
+		Cost    time.Duration `json:"cost"`
+	}
+	// AuditSink the append-only sink of the records.
+	AuditSink func(*AuditRecord)
+	audit     struct {
+		sink        AuditSink
+		uriPrefixes []string
+	}
+)
+
+var (
+	_ tp.PostNewPeerPlugin = new(audit)
+)
+
+func (a *audit) Name() string {
+	return "audit"
+}
+
+func (a *audit) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.Router().Use(a.record)
+	return nil
+}
+
+// record is the middleware recording the invocation.
+func (a *audit) record(ctx tp.HandleCtx, next func() *tp.Rerror) *tp.Rerror {
+	input := ctx.Input()
+	if !a.match(input.Uri()) {
+		return next()
+	}
+	start := time.Now()
+	rerr := next()
+	r := &AuditRecord{
+		Time:      start,
+		SessionId: ctx.Session().Id(),
+		RealIp:    ctx.RealIp(),
+		Ptype:     tp.TypeText(input.Ptype()),
+		Uri:       input.Uri(),
+		Cost:      time.Since(start),
+	}
+	if rerr != nil {
+		r.Code, r.Message = rerr.Code, rerr.Message
+	}
+	a.sink(r)
+	return rerr
+}
+
+func (a *audit) match(uri string) bool {
+	if len(a.uriPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range a.uriPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditFile the append-only file of the audit records, one JSON per line.
+// Note: It is concurrent safe.
+type AuditFile struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// OpenAuditFile opens the audit file for appending, and creates it if it does not exist.
+func OpenAuditFile(name string) (*AuditFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFile{file: f}, nil
+}
+
+// Sink appends the record to the file, e.g. plugin.Audit(auditFile.Sink).
+func (f *AuditFile) Sink(r *AuditRecord) {
+	b, _ := json.Marshal(r)
+	b = append(b, '\n')
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(b); err != nil {
+		tp.Errorf("audit: %s", err.Error())
+	}
+}
+
+// Close closes the audit file.
+func (f *AuditFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = OpenAuditFile(dir); err == nil {
+		t.Fatal("expect failing to open the directory")
+	}
+	name := filepath.Join(dir, "audit.log")
+	// the records are appended to the existing ones
+	if err = ioutil.WriteFile(name, []byte("{\"uri\":\"/old\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := OpenAuditFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := make(chan struct{}, 10)
+	srv := tp.NewPeer(tp.PeerConfig{}, Audit(func(r *AuditRecord) {
+		file.Sink(r)
+		recorded <- struct{}{}
+	}, "/admin/"))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/admin/ok", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return *arg, nil
+	})
+	srv.RoutePullFuncAt("/admin/fail", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return "", tp.NewRerror(100, "fail", "")
+	})
+	srv.RoutePullFuncAt("/public", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return *arg, nil
+	})
+	srv.RoutePushFuncAt("/admin/push", func(ctx tp.PushCtx, arg *string) *tp.Rerror {
+		return nil
+	})
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+	var reply string
+	sess.Pull("/admin/ok", "a", &reply)
+	sess.Pull("/admin/fail", "a", &reply)
+	sess.Pull("/public", "a", &reply)
+	sess.Push("/admin/push", "a")
+	for i := 0; i < 3; i++ {
+		<-recorded
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	want := []AuditRecord{
+		{Uri: "/old"},
+		{Ptype: "PULL", Uri: "/admin/ok"},
+		{Ptype: "PULL", Uri: "/admin/fail", Code: 100, Message: "fail"},
+		{Ptype: "PUSH", Uri: "/admin/push"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expect %d records, got %+v", len(want), records)
+	}
+	for i, r := range records[1:] {
+		w := want[i+1]
+		if r.Ptype != w.Ptype || r.Uri != w.Uri || r.Code != w.Code || r.Message != w.Message ||
+			r.SessionId != sess.LocalAddr().String() || r.Time.IsZero() {
+			t.Fatalf("record %d: want %+v, have %+v", i+1, w, r)
+		}
+	}
+}
@@ -36,10 +36,12 @@ func VerifyAuth(fn VerifyAuthInfoFunc) tp.Plugin {
 }
 
 type (
-	// AuthSession auth session provides SetId, RemoteAddr and Swap methods in base session
+	// AuthSession auth session provides SetId, SetTenant, RemoteAddr and Swap methods in base session
 	AuthSession interface {
 		// SetId sets the session id.
 		SetId(newId string)
+		// SetTenant sets the tenant identity, which tags the run logs, metrics and stats of the session.
+		SetTenant(tenant string)
 		// RemoteAddr returns the remote network address.
 		RemoteAddr() net.Addr
 		// Swap returns custom data swap of the session(socket).
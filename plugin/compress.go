@@ -0,0 +1,146 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+// A compression plugin for negotiating the transfer filter of sessions at connect time.
+
+// NegotiateCompression creates a plugin that negotiates the compression at connect time,
+// xferFilterIds are the supported transfer filter ids in order of preference, e.g. 'g' for gzip.
+// Note:
+//  The dialer sends its list, and the acceptor chooses the first one it also supports;
+//  If no one is supported by both, or the remote peer does not have this plugin, no compression is used;
+//  Packets that have set the transfer pipe are not changed;
+//  If used together with the auth plugin, it should be added after that.
+func NegotiateCompression(xferFilterIds ...byte) tp.Plugin {
+	for _, id := range xferFilterIds {
+		if _, err := xfer.Get(id); err != nil {
+			tp.Fatalf("compression: %v", err)
+		}
+	}
+	return &compression{xferFilterIds: xferFilterIds}
+}
+
+// NegotiatedCompression returns the transfer filter id negotiated by the session.
+func NegotiatedCompression(sess interface{ Swap() goutil.Map }) (byte, bool) {
+	id, ok := sess.Swap().Load(compressionKey)
+	if !ok {
+		return 0, false
+	}
+	return id.(byte), true
+}
+
+type compression struct {
+	xferFilterIds []byte
+}
+
+var (
+	_ tp.PostNewPeerPlugin   = new(compression)
+	_ tp.PostDialPlugin      = new(compression)
+	_ tp.PreWritePullPlugin  = new(compression)
+	_ tp.PreWritePushPlugin  = new(compression)
+	_ tp.PreWriteReplyPlugin = new(compression)
+)
+
+const (
+	compressionURI = "/compression/negotiate"
+	compressionKey = "_plugin_compression"
+)
+
+func (c *compression) Name() string {
+	return "compression"
+}
+
+func (c *compression) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.RoutePullFuncAt(compressionURI, c.negotiate)
+	return nil
+}
+
+// negotiate chooses the first transfer filter id of the dialer's list that is also supported.
+func (c *compression) negotiate(ctx tp.PullCtx, xferFilterIds *string) (string, *tp.Rerror) {
+	for _, id := range []byte(*xferFilterIds) {
+		if bytes.IndexByte(c.xferFilterIds, id) != -1 {
+			ctx.Session().Swap().Store(compressionKey, id)
+			return string(id), nil
+		}
+	}
+	ctx.Session().Swap().Delete(compressionKey)
+	return "", nil
+}
+
+func (c *compression) PostDial(sess tp.PreSession) *tp.Rerror {
+	sess.Swap().Delete(compressionKey)
+	rerr := sess.Send(
+		compressionURI,
+		string(c.xferFilterIds),
+		nil,
+		socket.WithPtype(tp.TypePull),
+		socket.WithBodyCodec('s'),
+	)
+	if rerr != nil {
+		return rerr
+	}
+	input, rerr := sess.Receive(func(header socket.Header) interface{} {
+		return new(string)
+	})
+	if tp.IsConnRerror(rerr) {
+		return rerr
+	}
+	if rerr != nil {
+		tp.Debugf("compression(%s) fall back to none: %s", sess.RemoteAddr().String(), rerr.String())
+		return nil
+	}
+	chosen := *input.Body().(*string)
+	if len(chosen) == 1 && bytes.IndexByte(c.xferFilterIds, chosen[0]) != -1 {
+		sess.Swap().Store(compressionKey, chosen[0])
+	}
+	return nil
+}
+
+func (c *compression) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	return c.apply(ctx)
+}
+
+func (c *compression) PreWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	return c.apply(ctx)
+}
+
+func (c *compression) PreWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	return c.apply(ctx)
+}
+
+// apply appends the negotiated transfer filter to the output packet.
+func (c *compression) apply(ctx tp.WriteCtx) *tp.Rerror {
+	output := ctx.Output()
+	if output.XferPipe().Len() > 0 {
+		return nil
+	}
+	id, ok := NegotiatedCompression(ctx.Session())
+	if !ok {
+		return nil
+	}
+	if err := output.XferPipe().Append(id); err != nil {
+		return tp.NewRerror(tp.CodeInternalServerError, tp.CodeText(tp.CodeInternalServerError), err.Error())
+	}
+	return nil
+}
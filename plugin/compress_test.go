@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	cases := []struct {
+		srv, cli []byte
+		want     string
+	}{
+		// the acceptor chooses the first one of the dialer's list
+		{[]byte{'g', 'a'}, []byte{'a', 'g'}, "a"},
+		{[]byte{'g'}, []byte{'a', 'g'}, "g"},
+		// no one is supported by both
+		{[]byte{'g'}, []byte{'a'}, ""},
+		// the remote peer does not have the plugin
+		{nil, []byte{'g'}, ""},
+	}
+	for _, c := range cases {
+		var plugins []tp.Plugin
+		if c.srv != nil {
+			plugins = append(plugins, NegotiateCompression(c.srv...))
+		}
+		srv := tp.NewPeer(tp.PeerConfig{}, plugins...)
+		defer srv.Close()
+		srv.RoutePullFuncAt("/xfer", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+			// replies the transfer pipe of the input packet
+			return *arg + string(ctx.Input().XferPipe().Ids()), nil
+		})
+		cli := tp.NewPeer(tp.PeerConfig{}, NegotiateCompression(c.cli...))
+		defer cli.Close()
+		sess := dial(t, cli, serve(t, srv))
+
+		id, ok := NegotiatedCompression(sess)
+		if (len(c.want) == 0 && ok) || (len(c.want) > 0 && (!ok || id != c.want[0])) {
+			t.Fatalf("%q-%q: expect negotiated %q, got %q, %v", c.srv, c.cli, c.want, id, ok)
+		}
+		var reply string
+		if rerr := sess.Pull("/xfer", "x", &reply).Rerror(); rerr != nil || reply != "x"+c.want {
+			t.Fatalf("%q-%q: expect the transfer pipe %q, got %q, %v", c.srv, c.cli, c.want, reply, rerr)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A concurrency limit plugin for capping the in-flight PULL handler executions per URI.
+
+// ConcurrencyLimit creates a plugin for capping the concurrent PULL handler executions of every URI path.
+// Note:
+//  If maxWait>0, the excess waits for an idle slot at most maxWait, otherwise it is rejected immediately;
+//  the rejected PULL is replied with tp.CodeServiceUnavailable;
+//  register it with the routes that need to be limited, e.g.
+//  peer.RoutePull(new(Report), plugin.ConcurrencyLimit(2, time.Second))
+func ConcurrencyLimit(maxConcurrency int, maxWait time.Duration) tp.Plugin {
+	if maxConcurrency <= 0 {
+		tp.Fatalf("concurrency_limit: maxConcurrency must be greater than 0, but have %d", maxConcurrency)
+	}
+	return &concurrencyLimit{
+		maxConcurrency: maxConcurrency,
+		maxWait:        maxWait,
+		slots:          goutil.AtomicMap(),
+	}
+}
+
+type concurrencyLimit struct {
+	maxConcurrency int
+	maxWait        time.Duration
+	// key: URI path
+	// value: chan struct{}
+	slots goutil.Map
+}
+
+var (
+	_ tp.PostReadPullBodyPlugin = new(concurrencyLimit)
+	_ tp.PreWriteReplyPlugin    = new(concurrencyLimit)
+)
+
+const concurrencyLimitSlotKey = "_plugin_concurrency_limit_slot"
+
+func (c *concurrencyLimit) Name() string {
+	return "concurrency_limit"
+}
+
+func (c *concurrencyLimit) getSlots(uriPath string) chan struct{} {
+	slots, ok := c.slots.Load(uriPath)
+	if !ok {
+		slots, _ = c.slots.LoadOrStore(uriPath, make(chan struct{}, c.maxConcurrency))
+	}
+	return slots.(chan struct{})
+}
+
+func (c *concurrencyLimit) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	slots := c.getSlots(ctx.Path())
+	select {
+	case slots <- struct{}{}:
+		ctx.Values().Store(concurrencyLimitSlotKey, slots)
+		return nil
+	default:
+	}
+	if c.maxWait > 0 {
+		timer := time.NewTimer(c.maxWait)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+			ctx.Values().Store(concurrencyLimitSlotKey, slots)
+			return nil
+		case <-timer.C:
+		case <-ctx.Context().Done():
+		}
+	}
+	return tp.NewRerror(
+		tp.CodeServiceUnavailable,
+		tp.CodeText(tp.CodeServiceUnavailable),
+		"too many concurrent requests: "+ctx.Path(),
+	)
+}
+
+// PreWriteReply frees the slot occupied by the handler.
+// Note: it is always executed after handling, even if the handler returns error.
+func (c *concurrencyLimit) PreWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	slots, ok := ctx.Values().Load(concurrencyLimitSlotKey)
+	if ok {
+		ctx.Values().Delete(concurrencyLimitSlotKey)
+		<-slots.(chan struct{})
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	blocking := func(release chan struct{}) interface{} {
+		return func(ctx tp.PullCtx, arg *int) (int, *tp.Rerror) {
+			entered <- struct{}{}
+			<-release
+			return *arg, nil
+		}
+	}
+	releaseReject, releaseWait := make(chan struct{}), make(chan struct{})
+	srv := tp.NewPeer(tp.PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/reject", blocking(releaseReject), ConcurrencyLimit(1, 0))
+	srv.RoutePullFuncAt("/wait", blocking(releaseWait), ConcurrencyLimit(1, 3*time.Second))
+	srv.RoutePullFuncAt("/fail", func(ctx tp.PullCtx, arg *int) (int, *tp.Rerror) {
+		return 0, tp.NewRerror(100, "fail", "")
+	}, ConcurrencyLimit(1, 0))
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+
+	occupy := func(uri string) chan *tp.Rerror {
+		done := make(chan *tp.Rerror, 1)
+		go func() {
+			var reply int
+			done <- sess.Pull(uri, 1, &reply).Rerror()
+		}()
+		<-entered
+		return done
+	}
+	releaseLater := func(release chan struct{}) {
+		go func() {
+			<-entered
+			release <- struct{}{}
+		}()
+	}
+
+	// the excess is rejected immediately without maxWait
+	done := occupy("/reject")
+	var reply int
+	rerr := sess.Pull("/reject", 2, &reply).Rerror()
+	if rerr == nil || rerr.Code != tp.CodeServiceUnavailable {
+		t.Fatalf("expect CodeServiceUnavailable, got %v", rerr)
+	}
+	// the other URI is not limited by the occupied one
+	releaseLater(releaseWait)
+	if rerr = sess.Pull("/wait", 3, &reply).Rerror(); rerr != nil || reply != 3 {
+		t.Fatalf("expect 3, got %d, %v", reply, rerr)
+	}
+	releaseReject <- struct{}{}
+	if rerr = <-done; rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the slot is freed after replying
+	releaseLater(releaseReject)
+	if rerr = sess.Pull("/reject", 4, &reply).Rerror(); rerr != nil || reply != 4 {
+		t.Fatalf("expect 4 after the slot freed, got %d, %v", reply, rerr)
+	}
+
+	// the excess waits for the idle slot with maxWait
+	done = occupy("/wait")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		releaseWait <- struct{}{}
+	}()
+	releaseLater(releaseWait)
+	if rerr = sess.Pull("/wait", 5, &reply).Rerror(); rerr != nil || reply != 5 {
+		t.Fatalf("expect 5 after waiting, got %d, %v", reply, rerr)
+	}
+	if rerr = <-done; rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	// the slot is freed even if the handler returns error
+	for i := 0; i < 2; i++ {
+		if rerr = sess.Pull("/fail", i, &reply).Rerror(); rerr == nil || rerr.Code != 100 {
+			t.Fatalf("expect the handler error, got %v", rerr)
+		}
+	}
+}
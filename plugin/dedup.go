@@ -0,0 +1,163 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/utils"
+)
+
+// A dedup plugin for replying the repeated PULL with the original reply instead of re-dispatching it.
+
+// MetaIdempotencyKey the key of the idempotency key metadata,
+// the PULLs with the same URI path and idempotency key are the repeated ones.
+const MetaIdempotencyKey = "X-Idempotency-Key"
+
+func init() {
+	tp.RegisterMetaKey(MetaIdempotencyKey)
+}
+
+// Dedup creates a plugin that replies the repeated PULL within the window with the original reply,
+// which guards against the client retry storms.
+// The repeated PULL is the one with the same URI path and MetaIdempotencyKey metadata,
+// or the one with the same session and sequence if the metadata is not set.
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin,
+//  since the dedup is done by the router middleware added in PostNewPeer;
+//  The repeated PULL arriving before the original one is handled waits for it;
+//  The PULL whose handler returns tp.DeferReply is not recorded, so the repeated one is handled again;
+//  The PUSH is not deduplicated.
+func Dedup(window time.Duration) tp.Plugin {
+	if window <= 0 {
+		tp.Fatalf("dedup: window must be greater than 0, but have %v", window)
+	}
+	return &dedup{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+type (
+	dedup struct {
+		window    time.Duration
+		entries   map[string]*dedupEntry
+		lastSweep time.Time
+		mu        sync.Mutex
+	}
+	// dedupEntry the reply of the original PULL.
+	dedupEntry struct {
+		done      chan struct{}
+		expire    time.Time // zero means the original PULL is being handled
+		ok        bool      // false means the original PULL panicked
+		body      interface{}
+		bodyCodec byte
+		meta      *utils.Args
+		rerr      *tp.Rerror
+	}
+)
+
+var (
+	_ tp.PostNewPeerPlugin = new(dedup)
+)
+
+func (d *dedup) Name() string {
+	return "dedup"
+}
+
+func (d *dedup) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.Router().Use(d.handle)
+	return nil
+}
+
+// handle is the middleware replying the repeated PULL.
+func (d *dedup) handle(ctx tp.HandleCtx, next func() *tp.Rerror) *tp.Rerror {
+	if ctx.Input().Ptype() != tp.TypePull {
+		return next()
+	}
+	var key string
+	if ikey := ctx.PeekMeta(MetaIdempotencyKey); len(ikey) > 0 {
+		key = ctx.Path() + "#" + string(ikey)
+	} else {
+		key = ctx.Session().Id() + "@" + ctx.Seq()
+	}
+	now := time.Now()
+	d.mu.Lock()
+	if now.Sub(d.lastSweep) >= d.window {
+		d.sweep(now)
+	}
+	e, ok := d.entries[key]
+	if !ok || (!e.expire.IsZero() && now.After(e.expire)) {
+		e = &dedupEntry{done: make(chan struct{})}
+		d.entries[key] = e
+		d.mu.Unlock()
+		return d.handleOriginal(ctx, next, key, e)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-e.done:
+	case <-ctx.Context().Done():
+		return tp.NewRerror(tp.CodeHandleTimeout, tp.CodeText(tp.CodeHandleTimeout), "waiting for the original pull")
+	}
+	if !e.ok {
+		return next()
+	}
+	output := ctx.Output()
+	output.SetBody(e.body)
+	output.SetBodyCodec(e.bodyCodec)
+	e.meta.VisitAll(func(k, v []byte) {
+		output.Meta().AddBytesKV(k, v)
+	})
+	return e.rerr
+}
+
+// handleOriginal handles the original PULL, and records its reply.
+func (d *dedup) handleOriginal(ctx tp.HandleCtx, next func() *tp.Rerror, key string, e *dedupEntry) (rerr *tp.Rerror) {
+	defer func() {
+		d.mu.Lock()
+		if e.ok {
+			e.expire = time.Now().Add(d.window)
+		} else {
+			delete(d.entries, key)
+		}
+		d.mu.Unlock()
+		close(e.done)
+	}()
+	rerr = next()
+	if rerr == tp.DeferReply {
+		// the reply is unknown until ctx.Reply, so the waiting ones are handled by themselves
+		return rerr
+	}
+	output := ctx.Output()
+	e.body, e.bodyCodec, e.rerr = output.Body(), output.BodyCodec(), rerr
+	e.meta = new(utils.Args)
+	output.Meta().CopyTo(e.meta)
+	e.meta.Del(tp.MetaRerror)
+	e.ok = true
+	return rerr
+}
+
+// sweep removes the expired entries.
+func (d *dedup) sweep(now time.Time) {
+	d.lastSweep = now
+	for key, e := range d.entries {
+		if !e.expire.IsZero() && now.After(e.expire) {
+			delete(d.entries, key)
+		}
+	}
+}
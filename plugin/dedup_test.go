@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+func TestDedup(t *testing.T) {
+	var calls int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := tp.NewPeer(tp.PeerConfig{}, Dedup(200*time.Millisecond))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/count", func(ctx tp.PullCtx, arg *int) (int32, *tp.Rerror) {
+		n := atomic.AddInt32(&calls, 1)
+		if *arg < 0 {
+			return 0, tp.NewRerror(100, "fail", "")
+		}
+		return n, nil
+	})
+	srv.RoutePullFuncAt("/block", func(ctx tp.PullCtx, arg *int) (int32, *tp.Rerror) {
+		entered <- struct{}{}
+		<-release
+		return atomic.AddInt32(&calls, 1), nil
+	})
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+	pull := func(uri string, arg int, key string) (int32, *tp.Rerror) {
+		var reply int32
+		var setting []socket.PacketSetting
+		if key != "" {
+			setting = append(setting, tp.WithSetMeta(MetaIdempotencyKey, key))
+		}
+		rerr := sess.Pull(uri, arg, &reply, setting...).Rerror()
+		return reply, rerr
+	}
+
+	// the repeated PULL is replied with the original reply
+	for i := 0; i < 2; i++ {
+		if n, rerr := pull("/count", 0, "k1"); rerr != nil || n != 1 {
+			t.Fatalf("expect the original reply 1, got %d, %v", n, rerr)
+		}
+	}
+	if n, _ := pull("/count", 0, "k2"); n != 2 {
+		t.Fatalf("expect the other key handled, got %d", n)
+	}
+	// so is the error reply
+	for i := 0; i < 2; i++ {
+		if _, rerr := pull("/count", -1, "k3"); rerr == nil || rerr.Code != 100 {
+			t.Fatalf("expect the original error, got %v", rerr)
+		}
+	}
+	// never deduplicated without the key, since the sequences differ
+	if n, _ := pull("/count", 0, ""); n != 4 {
+		t.Fatalf("expect handled without the key, got %d", n)
+	}
+	// handled again after the window
+	time.Sleep(250 * time.Millisecond)
+	if n, _ := pull("/count", 0, "k1"); n != 5 {
+		t.Fatalf("expect handled again after the window, got %d", n)
+	}
+
+	// the repeated PULL waits for the original one being handled
+	replies := make(chan int32, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			n, _ := pull("/block", 0, "k4")
+			replies <- n
+		}()
+	}
+	<-entered
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if a, b := <-replies, <-replies; a != 6 || b != 6 {
+		t.Fatalf("expect both replied with 6, got %d and %d", a, b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 6 {
+		t.Fatalf("expect 6 calls, got %d", n)
+	}
+}
+
+func TestDedupDeferReply(t *testing.T) {
+	var calls int32
+	srv := tp.NewPeer(tp.PeerConfig{}, Dedup(time.Second))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/defer", func(ctx tp.PullCtx, arg *int) (int32, *tp.Rerror) {
+		n := atomic.AddInt32(&calls, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			ctx.Reply(n, nil)
+		}()
+		return 0, tp.DeferReply
+	})
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+
+	// the deferred reply is not recorded, so each repeated PULL is replied by its own handling
+	replies := make(chan tp.PullCmd, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var reply int32
+			replies <- sess.Pull("/defer", 0, &reply, tp.WithSetMeta(MetaIdempotencyKey, "k"), tp.WithContext(ctx))
+		}()
+	}
+	seen := make(map[int32]bool)
+	for i := 0; i < 3; i++ {
+		cmd := <-replies
+		result, rerr := cmd.Result()
+		if rerr != nil {
+			t.Fatalf("expect replied, got %v", rerr)
+		}
+		seen[*result.(*int32)] = true
+	}
+	if n := atomic.LoadInt32(&calls); len(seen) != 3 || n != 3 {
+		t.Fatalf("expect 3 handled, got replies %v and %d calls", seen, n)
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A service discovery based on etcd:
+// the servers register the listen address and the routed URIs with a TTL lease,
+// and the clients resolve the service name to the live addresses when dialing.
+// Key layout: /teleport/services/<service>/<addr>, value: JSON of ServiceInfo.
+
+const (
+	etcdKeyPrefix       = "/teleport/services/"
+	etcdDefaultLeaseTTL = 10 * time.Second
+	etcdDefaultTimeout  = 5 * time.Second
+	etcdRetryInterval   = time.Second
+)
+
+type (
+	// EtcdConfig the config of the etcd client.
+	EtcdConfig struct {
+		Endpoints   []string
+		DialTimeout time.Duration
+		Username    string
+		Password    string
+		// LeaseTTL the TTL of the registration, after which a crashed server is removed, default 10s
+		LeaseTTL time.Duration
+		// Plaintext whether the resolver resolves the plaintext ports served alongside the TLS ones,
+		// see tp.PeerConfig.PlaintextAddress, instead of the others
+		Plaintext bool
+	}
+	// ServiceInfo the registration of a server.
+	ServiceInfo struct {
+		Addr string   `json:"addr"`
+		Uris []string `json:"uris"`
+		// Plaintext whether it is the plaintext port served alongside the TLS one
+		Plaintext bool `json:"plaintext,omitempty"`
+	}
+)
+
+func (c *EtcdConfig) newClient() (*clientv3.Client, error) {
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = etcdDefaultTimeout
+	}
+	if c.LeaseTTL < time.Second {
+		c.LeaseTTL = etcdDefaultLeaseTTL
+	}
+	return clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: c.DialTimeout,
+		Username:    c.Username,
+		Password:    c.Password,
+	})
+}
+
+func etcdServicePrefix(service string) string {
+	return etcdKeyPrefix + service + "/"
+}
+
+// Register creates a plugin that registers the server into etcd as the service,
+// and keeps the registration alive by the lease.
+// If advertiseAddr is empty, the listen addresses are used, whose unspecified IP is replaced by the intranet one.
+// Note:
+//  Each listener is registered, and the plaintext port served alongside the TLS one is marked by ServiceInfo.Plaintext;
+//  If advertiseAddr is specified, only it is registered;
+//  The registration is removed when the peer is closed, or by etcd when the lease expires, e.g. after the server crashes.
+func Register(etcdCfg EtcdConfig, service string, advertiseAddr ...string) tp.Plugin {
+	if len(service) == 0 || strings.Contains(service, "/") {
+		tp.Fatalf("etcd_register: invalid service name: %q", service)
+	}
+	r := &etcdRegister{etcdCfg: etcdCfg, service: service}
+	if len(advertiseAddr) > 0 {
+		r.advertise = advertiseAddr[0]
+	}
+	return r
+}
+
+type etcdRegister struct {
+	etcdCfg       EtcdConfig
+	service       string
+	advertise     string
+	plaintextAddr string
+	nodes         []*ServiceInfo
+	client        *clientv3.Client
+	leaseId       clientv3.LeaseID
+	uris          []string
+	closed        bool
+	mu            sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+var (
+	_ tp.PreNewPeerPlugin     = new(etcdRegister)
+	_ tp.PostRegPlugin        = new(etcdRegister)
+	_ tp.PostListenAddrPlugin = new(etcdRegister)
+	_ tp.PreClosePlugin       = new(etcdRegister)
+)
+
+func (r *etcdRegister) Name() string {
+	return "etcd_register"
+}
+
+func (r *etcdRegister) PreNewPeer(cfg *tp.PeerConfig, _ *tp.PluginContainer) error {
+	r.plaintextAddr = cfg.PlaintextAddress
+	return nil
+}
+
+func (r *etcdRegister) PostReg(h *tp.Handler) error {
+	if h.IsUnknown() {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uris = append(r.uris, h.Name())
+	if r.leaseId != 0 && !r.closed {
+		if err := r.put(); err != nil {
+			tp.Warnf("etcd_register: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *etcdRegister) PostListenAddr(addr net.Addr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || (len(r.advertise) > 0 && len(r.nodes) > 0) {
+		return nil
+	}
+	node := &ServiceInfo{Addr: r.advertise}
+	if len(node.Addr) == 0 {
+		var err error
+		if node.Addr, err = advertiseAddr(addr); err != nil {
+			return err
+		}
+		node.Plaintext = len(r.plaintextAddr) > 0 && sameListenAddr(r.plaintextAddr, addr)
+	}
+	r.nodes = append(r.nodes, node)
+	if r.client != nil {
+		return r.put()
+	}
+	client, err := r.etcdCfg.newClient()
+	if err != nil {
+		return err
+	}
+	r.client = client
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if err = r.register(); err != nil {
+		return err
+	}
+	go r.keepAlive()
+	return nil
+}
+
+// PreClose stops keeping alive, and revokes the lease, which removes the registration.
+func (r *etcdRegister) PreClose() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.client == nil {
+		return nil
+	}
+	r.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), r.etcdCfg.DialTimeout)
+	defer cancel()
+	_, err := r.client.Revoke(ctx, r.leaseId)
+	if cerr := r.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// register grants a new lease and puts the registration with it.
+func (r *etcdRegister) register() error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.etcdCfg.DialTimeout)
+	defer cancel()
+	lease, err := r.client.Grant(ctx, int64(r.etcdCfg.LeaseTTL/time.Second))
+	if err != nil {
+		return err
+	}
+	r.leaseId = lease.ID
+	return r.put()
+}
+
+// put puts the registrations of all the listeners.
+func (r *etcdRegister) put() error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.etcdCfg.DialTimeout)
+	defer cancel()
+	for _, node := range r.nodes {
+		node.Uris = r.uris
+		b, _ := json.Marshal(node)
+		if _, err := r.client.Put(ctx, etcdServicePrefix(r.service)+node.Addr, string(b), clientv3.WithLease(r.leaseId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAlive keeps the lease alive, and registers again if it is lost, until the peer is closed.
+func (r *etcdRegister) keepAlive() {
+	for {
+		r.mu.Lock()
+		leaseId := r.leaseId
+		r.mu.Unlock()
+		ch, err := r.client.KeepAlive(r.ctx, leaseId)
+		if err == nil {
+			for range ch {
+			}
+			err = errors.New("lease is lost")
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		tp.Warnf("etcd_register: keep alive %s: %s", r.service, err.Error())
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(etcdRetryInterval):
+			}
+			r.mu.Lock()
+			err = r.register()
+			r.mu.Unlock()
+			if err == nil {
+				break
+			}
+			if r.ctx.Err() != nil {
+				return
+			}
+			tp.Warnf("etcd_register: register %s: %s", r.service, err.Error())
+		}
+	}
+}
+
+// sameListenAddr reports whether the listen address is the configured one,
+// which matches any IP if the configured host is empty or unspecified.
+func sameListenAddr(laddr string, addr net.Addr) bool {
+	want, err := net.ResolveTCPAddr("tcp", laddr)
+	if err != nil {
+		return false
+	}
+	got, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil || want.Port != got.Port {
+		return false
+	}
+	return want.IP == nil || want.IP.IsUnspecified() || want.IP.Equal(got.IP)
+}
+
+// advertiseAddr returns the address for the remote peers,
+// replacing the unspecified IP with the intranet one.
+func advertiseAddr(addr net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return addr.String(), nil
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return net.JoinHostPort(ipnet.IP.String(), port), nil
+		}
+	}
+	return "", errors.New("no intranet IP to advertise, please specify the address")
+}
+
+// EtcdResolver the resolver of the services registered by Register,
+// which caches the live addresses and watches for changes.
+// Note: It is concurrent safe.
+type EtcdResolver struct {
+	etcdCfg  EtcdConfig
+	client   *clientv3.Client
+	services map[string]*etcdService
+	buses    []*tp.EventBus
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type etcdService struct {
+	nodes map[string]string // key -> addr
+	addrs []string
+	mu    sync.RWMutex
+}
+
+var _ tp.Resolver = new(EtcdResolver)
+
+// NewEtcdResolver creates a resolver of the services in etcd, e.g.
+//  resolver, err := plugin.NewEtcdResolver(etcdCfg)
+//  peer.SetResolver(resolver)
+//  sess, rerr := peer.Dial("user")
+func NewEtcdResolver(etcdCfg EtcdConfig) (*EtcdResolver, error) {
+	client, err := etcdCfg.newClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdResolver{
+		etcdCfg:  etcdCfg,
+		client:   client,
+		services: make(map[string]*etcdService),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Resolve returns the live addresses of the service.
+// Note: The service is loaded and watched on the first call.
+func (r *EtcdResolver) Resolve(service string) ([]string, error) {
+	r.mu.Lock()
+	s, ok := r.services[service]
+	if !ok {
+		s = new(etcdService)
+		rev, err := r.load(service, s)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		r.services[service] = s
+		go r.watch(service, s, rev)
+	}
+	r.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addrs, nil
+}
+
+// PublishTo publishes tp.EventRegistryChanged with the service as the detail to the event buses,
+// when the live addresses of a resolved service are changed, e.g.
+//  resolver.PublishTo(peer.Events())
+func (r *EtcdResolver) PublishTo(buses ...*tp.EventBus) {
+	r.mu.Lock()
+	r.buses = append(r.buses, buses...)
+	r.mu.Unlock()
+}
+
+func (r *EtcdResolver) publish(service string) {
+	r.mu.Lock()
+	buses := r.buses
+	r.mu.Unlock()
+	for _, bus := range buses {
+		bus.Publish(&tp.Event{Type: tp.EventRegistryChanged, Detail: service})
+	}
+}
+
+// Close stops watching and closes the etcd client.
+func (r *EtcdResolver) Close() error {
+	r.cancel()
+	return r.client.Close()
+}
+
+// load gets all the registrations of the service, and returns the revision.
+func (r *EtcdResolver) load(service string, s *etcdService) (int64, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.etcdCfg.DialTimeout)
+	defer cancel()
+	resp, err := r.client.Get(ctx, etcdServicePrefix(service), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	nodes := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if addr, ok := parseServiceAddr(kv.Value, r.etcdCfg.Plaintext); ok {
+			nodes[string(kv.Key)] = addr
+		}
+	}
+	s.mu.Lock()
+	s.nodes = nodes
+	s.update()
+	s.mu.Unlock()
+	return resp.Header.Revision, nil
+}
+
+// watch applies the changes of the service, and reloads it after the watch is broken.
+func (r *EtcdResolver) watch(service string, s *etcdService, rev int64) {
+	for {
+		ctx, cancel := context.WithCancel(r.ctx)
+		for wr := range r.client.Watch(ctx, etcdServicePrefix(service), clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+			if err := wr.Err(); err != nil {
+				tp.Warnf("etcd_resolver: watch %s: %s", service, err.Error())
+				break
+			}
+			s.mu.Lock()
+			for _, e := range wr.Events {
+				if e.Type == clientv3.EventTypeDelete {
+					delete(s.nodes, string(e.Kv.Key))
+				} else if addr, ok := parseServiceAddr(e.Kv.Value, r.etcdCfg.Plaintext); ok {
+					s.nodes[string(e.Kv.Key)] = addr
+				}
+			}
+			s.update()
+			s.mu.Unlock()
+			r.publish(service)
+		}
+		cancel()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(etcdRetryInterval):
+			}
+			var err error
+			if rev, err = r.load(service, s); err == nil {
+				r.publish(service)
+				break
+			}
+			tp.Warnf("etcd_resolver: load %s: %s", service, err.Error())
+		}
+	}
+}
+
+// update rebuilds the address list, which is replaced rather than modified,
+// so the returned ones are safe to read.
+func (s *etcdService) update() {
+	addrs := make([]string, 0, len(s.nodes))
+	for _, addr := range s.nodes {
+		addrs = append(addrs, addr)
+	}
+	s.addrs = addrs
+}
+
+// parseServiceAddr returns the address of the registration, if it is the plaintext port or not as required.
+func parseServiceAddr(value []byte, plaintext bool) (string, bool) {
+	var info ServiceInfo
+	if err := json.Unmarshal(value, &info); err != nil || len(info.Addr) == 0 || info.Plaintext != plaintext {
+		return "", false
+	}
+	return info.Addr, true
+}
@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// startEtcd starts an embedded etcd server, and returns the config of the clients.
+func startEtcd(t *testing.T) (*embed.Etcd, EtcdConfig) {
+	dir, err := ioutil.TempDir("", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientUrl, _ := url.Parse("http://" + localAddr(t))
+	peerUrl, _ := url.Parse("http://" + localAddr(t))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientUrl}, []url.URL{*clientUrl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerUrl}, []url.URL{*peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("etcd is not ready")
+	}
+	return e, EtcdConfig{Endpoints: []string{clientUrl.String()}}
+}
+
+// localAddr returns a free local address.
+func localAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// waitResolved waits until the service is resolved to the addresses.
+func waitResolved(t *testing.T, r *EtcdResolver, service string, want ...string) {
+	var got []string
+	for i := 0; i < 300; i++ {
+		var err error
+		if got, err = r.Resolve(service); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == len(want) && (len(want) == 0 || reflect.DeepEqual(got, want)) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: expect resolved to %v, got %v", service, want, got)
+}
+
+func TestEtcdRegister(t *testing.T) {
+	e, etcdCfg := startEtcd(t)
+	defer os.RemoveAll(e.Config().Dir)
+	defer e.Close()
+
+	resolver, err := NewEtcdResolver(etcdCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	plainCfg := etcdCfg
+	plainCfg.Plaintext = true
+	plainResolver, err := NewEtcdResolver(plainCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainResolver.Close()
+	waitResolved(t, resolver, "echo")
+
+	// both listeners are registered, and the plaintext one is marked
+	mainLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainAddr, plainAddr := mainLis.Addr().String(), plainLis.Addr().String()
+	srv := tp.NewPeer(tp.PeerConfig{PlaintextAddress: plainAddr}, Register(etcdCfg, "echo"))
+	srv.RoutePullFuncAt("/echo", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return *arg, nil
+	})
+	go srv.ServeListener(mainLis)
+	go srv.ServeListener(plainLis)
+	waitResolved(t, resolver, "echo", mainAddr)
+	waitResolved(t, plainResolver, "echo", plainAddr)
+
+	client, err := etcdCfg.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Get(ctx, etcdServicePrefix("echo")+mainAddr)
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("expect the registration, got %v, %v", resp, err)
+	}
+	var info ServiceInfo
+	if err = json.Unmarshal(resp.Kvs[0].Value, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Addr != mainAddr || info.Plaintext || !reflect.DeepEqual(info.Uris, []string{"/echo"}) {
+		t.Fatalf("unexpected registration: %+v", info)
+	}
+	if resp.Kvs[0].Lease == 0 {
+		t.Fatal("expect registered with the lease")
+	}
+
+	// the service name is dialed by the resolver
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	cli.SetResolver(resolver)
+	var reply string
+	if rerr := dial(t, cli, "echo").Pull("/echo", "a", &reply).Rerror(); rerr != nil || reply != "a" {
+		t.Fatalf("expect a, got %q, %v", reply, rerr)
+	}
+
+	// deregistered on closing, long before the lease expires
+	start := time.Now()
+	srv.Close()
+	waitResolved(t, resolver, "echo")
+	waitResolved(t, plainResolver, "echo")
+	if cost := time.Since(start); cost >= etcdDefaultLeaseTTL {
+		t.Fatalf("expect deregistered before the lease expires, got %v", cost)
+	}
+	resp, err = client.Get(ctx, etcdServicePrefix("echo"), clientv3.WithPrefix())
+	if err != nil || len(resp.Kvs) != 0 {
+		t.Fatalf("expect no registration, got %v, %v", resp, err)
+	}
+}
+
+func TestSameListenAddr(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9091}
+	for laddr, want := range map[string]bool{
+		"127.0.0.1:9091": true,
+		":9091":          true,
+		"0.0.0.0:9091":   true,
+		"10.0.0.1:9091":  false,
+		"127.0.0.1:9090": false,
+		"bad":            false,
+	} {
+		if got := sameListenAddr(laddr, addr); got != want {
+			t.Fatalf("%s: expect %v, got %v", laddr, want, got)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// A handshake plugin for the multi-round challenge-response authorization,
+// e.g. SRP or nonce-based schemes, at the first time.
+//
+// The dialer sends the response of round 0 to start, then the listener
+// replies the next challenge or the end of the handshake, round by round:
+//  dialer                          listener
+//    | ---- response(round 0) ------> |
+//    | <--- challenge(round 1) ------ |
+//    | ---- response(round 1) ------> |
+//    | <--- done or error ----------- |
+
+// LaunchHandshake creates a plugin for answering the challenges of the handshake.
+func LaunchHandshake(fn HandshakeResponseFunc) tp.Plugin {
+	return &handshake{responseFunc: fn}
+}
+
+// VerifyHandshake creates a plugin for challenging the handshake,
+// which fails if it is not done after maxRounds rounds.
+func VerifyHandshake(fn HandshakeChallengeFunc, maxRounds int) tp.Plugin {
+	if maxRounds <= 0 {
+		maxRounds = 1
+	}
+	return &handshake{challengeFunc: fn, maxRounds: maxRounds}
+}
+
+type (
+	// HandshakeResponseFunc the function used by the dialer to answer the challenge of the round,
+	// where the challenge of round 0 is empty.
+	HandshakeResponseFunc func(round int, challenge string, sess AuthSession) (response string, rerr *tp.Rerror)
+	// HandshakeChallengeFunc the function used by the listener to verify the response of the round,
+	// and to issue the next challenge, or to end the handshake by done=true.
+	HandshakeChallengeFunc func(round int, response string, sess AuthSession) (challenge string, done bool, rerr *tp.Rerror)
+	handshake              struct {
+		responseFunc  HandshakeResponseFunc
+		challengeFunc HandshakeChallengeFunc
+		maxRounds     int
+	}
+)
+
+var (
+	_ tp.PostDialPlugin   = new(handshake)
+	_ tp.PostAcceptPlugin = new(handshake)
+)
+
+const (
+	handshakeResponseURI  = "/handshake/response"
+	handshakeChallengeURI = "/handshake/challenge"
+	handshakeDoneURI      = "/handshake/done"
+)
+
+func (h *handshake) Name() string {
+	return "handshake"
+}
+
+func (h *handshake) PostDial(sess tp.PreSession) *tp.Rerror {
+	if h.responseFunc == nil {
+		return nil
+	}
+	var challenge string
+	for round := 0; ; round++ {
+		response, rerr := h.responseFunc(round, challenge, sess)
+		if rerr != nil {
+			return rerr
+		}
+		rerr = sess.Send(handshakeResponseURI, response, nil, socket.WithBodyCodec('s'))
+		if rerr != nil {
+			return rerr
+		}
+		input, rerr := sess.Receive(func(header socket.Header) interface{} {
+			return new(string)
+		})
+		if rerr != nil {
+			return rerr
+		}
+		switch input.Uri() {
+		case handshakeDoneURI:
+			return nil
+		case handshakeChallengeURI:
+			challenge = *input.Body().(*string)
+		default:
+			return tp.NewRerror(
+				tp.CodeUnauthorized,
+				tp.CodeText(tp.CodeUnauthorized),
+				fmt.Sprintf("the handshake package want: %s, but have: %s %s", handshakeChallengeURI, tp.TypeText(input.Ptype()), input.Uri()),
+			)
+		}
+	}
+}
+
+func (h *handshake) PostAccept(sess tp.PreSession) *tp.Rerror {
+	if h.challengeFunc == nil {
+		return nil
+	}
+	for round := 0; round < h.maxRounds; round++ {
+		input, rerr := sess.Receive(func(header socket.Header) interface{} {
+			if header.Uri() == handshakeResponseURI {
+				return new(string)
+			}
+			return nil
+		})
+		if rerr != nil {
+			return rerr
+		}
+		if input.Uri() != handshakeResponseURI {
+			rerr = tp.NewRerror(
+				tp.CodeUnauthorized,
+				tp.CodeText(tp.CodeUnauthorized),
+				fmt.Sprintf("the handshake package want: %s, but have: %s %s", handshakeResponseURI, tp.TypeText(input.Ptype()), input.Uri()),
+			)
+			sess.Send(handshakeDoneURI, nil, rerr)
+			return rerr
+		}
+		challenge, done, rerr := h.challengeFunc(round, *input.Body().(*string), sess)
+		if rerr != nil || done {
+			rerr2 := sess.Send(handshakeDoneURI, nil, rerr)
+			if rerr == nil {
+				rerr = rerr2
+			}
+			return rerr
+		}
+		rerr = sess.Send(handshakeChallengeURI, challenge, nil, socket.WithBodyCodec('s'))
+		if rerr != nil {
+			return rerr
+		}
+	}
+	rerr := tp.NewRerror(
+		tp.CodeUnauthorized,
+		tp.CodeText(tp.CodeUnauthorized),
+		fmt.Sprintf("the handshake is not done in %d rounds", h.maxRounds),
+	)
+	sess.Send(handshakeDoneURI, nil, rerr)
+	return rerr
+}
@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestHandshake(t *testing.T) {
+	const secret = "s3cret"
+	// round 0: the dialer says hello; round 1: the dialer answers the nonce with the secret
+	srv := tp.NewPeer(tp.PeerConfig{}, VerifyHandshake(func(round int, response string, sess AuthSession) (string, bool, *tp.Rerror) {
+		switch round {
+		case 0:
+			if response != "hello" {
+				return "", false, tp.NewRerror(tp.CodeUnauthorized, "bad hello", "")
+			}
+			return "nonce-1", false, nil
+		default:
+			if response != "nonce-1:"+secret {
+				return "", false, tp.NewRerror(tp.CodeUnauthorized, "bad answer", "")
+			}
+			sess.SetId("alice")
+			return "", true, nil
+		}
+	}, 3))
+	defer srv.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(lis)
+
+	answer := func(secret string) HandshakeResponseFunc {
+		return func(round int, challenge string, sess AuthSession) (string, *tp.Rerror) {
+			if round == 0 {
+				return "hello", nil
+			}
+			return challenge + ":" + secret, nil
+		}
+	}
+	cli := tp.NewPeer(tp.PeerConfig{}, LaunchHandshake(answer(secret)))
+	defer cli.Close()
+	if _, rerr := cli.Dial(lis.Addr().String()); rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the listener registers the session after the handshake is done
+	for i := 0; ; i++ {
+		if _, ok := srv.GetSession("alice"); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expect the session id set by the handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	badCli := tp.NewPeer(tp.PeerConfig{}, LaunchHandshake(answer("guess")))
+	defer badCli.Close()
+	if _, rerr := badCli.Dial(lis.Addr().String()); rerr == nil || rerr.Message != "bad answer" {
+		t.Fatalf("expect bad answer, got %v", rerr)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// A heartbeat plugin for measuring the RTT of sessions.
+
+// HeartbeatUri the URI of heartbeat PULL.
+const HeartbeatUri = "/heartbeat"
+
+// HeartbeatPing creates a plugin that pulls HeartbeatUri of every session periodically,
+// and records the RTT into Session.Stats().
+// Note:
+//  The remote peer needs the HeartbeatPong plugin;
+//  The heartbeat stops when the session is disconnected, and restarts after redialing.
+func HeartbeatPing(interval time.Duration) tp.Plugin {
+	if interval <= 0 {
+		tp.Fatalf("heartbeat_ping: interval must be greater than 0, but have %v", interval)
+	}
+	return &heartbeatPing{interval: interval}
+}
+
+// HeartbeatPong creates a plugin that replies the heartbeat PULL.
+func HeartbeatPong() tp.Plugin {
+	return new(heartbeatPong)
+}
+
+type (
+	heartbeatPing struct {
+		interval time.Duration
+	}
+	heartbeatPong struct{}
+)
+
+var (
+	_ tp.PostDialPlugin    = new(heartbeatPing)
+	_ tp.PostAcceptPlugin  = new(heartbeatPing)
+	_ tp.PostNewPeerPlugin = new(heartbeatPong)
+)
+
+const heartbeatPingKey = "_plugin_heartbeat_ping"
+
+func (h *heartbeatPing) Name() string {
+	return "heartbeat_ping"
+}
+
+func (h *heartbeatPing) PostDial(sess tp.PreSession) *tp.Rerror {
+	h.start(sess)
+	return nil
+}
+
+func (h *heartbeatPing) PostAccept(sess tp.PreSession) *tp.Rerror {
+	h.start(sess)
+	return nil
+}
+
+// start starts the heartbeat loop of the session,
+// which replaces the previous one, e.g. after redialing.
+func (h *heartbeatPing) start(preSess tp.PreSession) {
+	sess, ok := preSess.(tp.Session)
+	if !ok {
+		return
+	}
+	token := new(struct{ _ byte })
+	sess.Swap().Store(heartbeatPingKey, token)
+	tp.AnywayGo(func() {
+		for {
+			time.Sleep(h.interval)
+			if v, _ := sess.Swap().Load(heartbeatPingKey); v != token {
+				return
+			}
+			if !h.ping(sess) {
+				return
+			}
+		}
+	})
+}
+
+// ping pulls the heartbeat once, and returns false if the session is disconnected.
+func (h *heartbeatPing) ping(sess tp.Session) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	start := time.Now()
+	rerr := sess.Pull(HeartbeatUri, nil, new([]byte), socket.WithContext(ctx)).Rerror()
+	if rerr == nil {
+		sess.Stats().ObserveRTT(time.Since(start))
+		return true
+	}
+	if tp.IsConnRerror(rerr) {
+		return false
+	}
+	sess.Stats().ObserveError()
+	tp.Debugf("heartbeat(%s) fail: %s", sess.Id(), rerr.String())
+	return true
+}
+
+func (h *heartbeatPong) Name() string {
+	return "heartbeat_pong"
+}
+
+func (h *heartbeatPong) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.RoutePullFunc(heartbeat)
+	return nil
+}
+
+// heartbeat replies the heartbeat PULL, whose route is HeartbeatUri.
+func heartbeat(ctx tp.PullCtx, _ *[]byte) ([]byte, *tp.Rerror) {
+	return nil, nil
+}
@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestHeartbeat(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{}, HeartbeatPong())
+	defer srv.Close()
+	cli := tp.NewPeer(tp.PeerConfig{}, HeartbeatPing(20*time.Millisecond))
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+	for i := 0; i < 100 && sess.Stats().RTT() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sess.Stats().RTT() <= 0 || sess.Stats().LastRTT() <= 0 {
+		t.Fatalf("expect the RTT measured, got %v", sess.Stats().RTT())
+	}
+	if n := sess.Stats().RecentErrors(); n != 0 {
+		t.Fatalf("expect no error, got %d", n)
+	}
+
+	// the failed heartbeat is counted as error, without the pong of the remote peer
+	noPong := tp.NewPeer(tp.PeerConfig{})
+	defer noPong.Close()
+	sess = dial(t, cli, serve(t, noPong))
+	for i := 0; i < 100 && sess.Stats().RecentErrors() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sess.Stats().RecentErrors() == 0 || sess.Stats().RTT() != 0 {
+		t.Fatalf("expect the errors counted without RTT, got %d, %v", sess.Stats().RecentErrors(), sess.Stats().RTT())
+	}
+}
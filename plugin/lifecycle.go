@@ -0,0 +1,95 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A lifecycle plugin for observing the coming and going of sessions.
+
+// SessionCallbacks the session lifecycle callbacks, the nil ones are ignored.
+type SessionCallbacks struct {
+	// OnConnect is called after dialing or accepting a connection,
+	// returning error rejects the connection.
+	OnConnect func(sess tp.PreSession) *tp.Rerror
+	// OnDisconnect is called after the session is disconnected.
+	OnDisconnect func(sess tp.BaseSession)
+	// OnChangeId is called after the session id is changed.
+	OnChangeId func(sess tp.BaseSession, oldId string)
+	// OnSlowConsumer is called when the write queue of the session stays full longer than PeerConfig.SlowConsumerAge.
+	OnSlowConsumer func(sess tp.BaseSession)
+}
+
+// SessionLifecycle creates a plugin that calls the callbacks in the lifecycle of every session,
+// so that the applications can maintain presence or registry state.
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin;
+//  OnConnect is called again after redialing, and OnDisconnect is not called while redialing.
+func SessionLifecycle(callbacks SessionCallbacks) tp.Plugin {
+	return &lifecycle{callbacks: callbacks}
+}
+
+type lifecycle struct {
+	callbacks SessionCallbacks
+}
+
+var (
+	_ tp.PostDialPlugin         = new(lifecycle)
+	_ tp.PostAcceptPlugin       = new(lifecycle)
+	_ tp.PostChangeIdPlugin     = new(lifecycle)
+	_ tp.PostDisconnectPlugin   = new(lifecycle)
+	_ tp.PostSlowConsumerPlugin = new(lifecycle)
+)
+
+func (l *lifecycle) Name() string {
+	return "session_lifecycle"
+}
+
+func (l *lifecycle) PostDial(sess tp.PreSession) *tp.Rerror {
+	return l.connect(sess)
+}
+
+func (l *lifecycle) PostAccept(sess tp.PreSession) *tp.Rerror {
+	return l.connect(sess)
+}
+
+func (l *lifecycle) connect(sess tp.PreSession) *tp.Rerror {
+	if l.callbacks.OnConnect == nil {
+		return nil
+	}
+	return l.callbacks.OnConnect(sess)
+}
+
+func (l *lifecycle) PostChangeId(sess tp.BaseSession, oldId string) *tp.Rerror {
+	if l.callbacks.OnChangeId != nil {
+		l.callbacks.OnChangeId(sess, oldId)
+	}
+	return nil
+}
+
+func (l *lifecycle) PostDisconnect(sess tp.BaseSession) *tp.Rerror {
+	if l.callbacks.OnDisconnect != nil {
+		l.callbacks.OnDisconnect(sess)
+	}
+	return nil
+}
+
+func (l *lifecycle) PostSlowConsumer(sess tp.BaseSession) *tp.Rerror {
+	if l.callbacks.OnSlowConsumer != nil {
+		l.callbacks.OnSlowConsumer(sess)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	events := make(chan string, 10)
+	srv := tp.NewPeer(tp.PeerConfig{}, SessionLifecycle(SessionCallbacks{
+		OnConnect: func(sess tp.PreSession) *tp.Rerror {
+			events <- "connect"
+			return nil
+		},
+		OnChangeId: func(sess tp.BaseSession, oldId string) {
+			events <- "change " + oldId + " -> " + sess.Id()
+		},
+		OnDisconnect: func(sess tp.BaseSession) {
+			events <- "disconnect " + sess.Id()
+		},
+	}))
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	expect := func(want string) {
+		select {
+		case have := <-events:
+			if have != want {
+				t.Fatalf("event: want %q, have %q", want, have)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event: want %q, have none", want)
+		}
+	}
+	cli := tp.NewPeer(tp.PeerConfig{}, SessionLifecycle(SessionCallbacks{}))
+	defer cli.Close()
+	sess := dial(t, cli, addr)
+	expect("connect")
+	var srvSess tp.Session
+	srv.RangeSession(func(s tp.Session) bool {
+		srvSess = s
+		return false
+	})
+	oldId := srvSess.Id()
+	srvSess.SetId("user1")
+	expect("change " + oldId + " -> user1")
+	sess.Close()
+	expect("disconnect user1")
+
+	// returning error rejects the connection
+	rejecter := tp.NewPeer(tp.PeerConfig{}, SessionLifecycle(SessionCallbacks{
+		OnConnect: func(sess tp.PreSession) *tp.Rerror {
+			return tp.NewRerror(tp.CodeUnauthorized, "Unauthorized", "closed for maintenance")
+		},
+	}))
+	defer rejecter.Close()
+	sess = dial(t, cli, serve(t, rejecter))
+	for i := 0; i < 100 && sess.Health(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rerr := sess.Pull("/any", "x", new(string)).Rerror(); rerr == nil || rerr.Code != tp.CodeUnauthorized {
+		t.Fatalf("expect CodeUnauthorized, got %v", rerr)
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A metrics plugin for exporting the running state of the peer.
+
+// NewMetrics creates a plugin for exporting the running state of the peer,
+// such as packet counters, handler latencies and reply status codes,
+// and the per-tenant request counters of the sessions whose tenant is set, see tp.PreSession.SetTenant.
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin;
+//  the snapshot can be published to expvar by PublishExpvar();
+//  it implements http.Handler, serving the Prometheus text exposition format.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		latencies:      goutil.AtomicMap(),
+		tenants:        goutil.AtomicMap(),
+		statusSent:     make(map[int32]uint64),
+		statusReceived: make(map[int32]uint64),
+		dialed:         make(map[tp.PreSession]struct{}),
+	}
+}
+
+type (
+	// Metrics the metrics plugin of peer
+	Metrics struct {
+		peer            tp.EarlyPeer
+		packetsSent     [4]uint64
+		packetsReceived [4]uint64
+		redials         uint64
+		// key: route, i.e. the matched route pattern
+		// value: *DurationHistogram
+		latencies goutil.Map
+		// key: tenant
+		// value: *tenantCounters
+		tenants        goutil.Map
+		statusSent     map[int32]uint64
+		statusReceived map[int32]uint64
+		statusMu       sync.Mutex
+		dialed         map[tp.PreSession]struct{}
+		dialedMu       sync.Mutex
+	}
+	// MetricsSnapshot the snapshot of metrics
+	MetricsSnapshot struct {
+		// PacketsSent the number of sent packets per type
+		PacketsSent map[string]uint64 `json:"packets_sent"`
+		// PacketsReceived the number of received packets per type
+		PacketsReceived map[string]uint64 `json:"packets_received"`
+		// StatusSent the distribution of the status codes of sent replies, 0 means OK
+		StatusSent map[int32]uint64 `json:"status_sent"`
+		// StatusReceived the distribution of the status codes of received replies, 0 means OK
+		StatusReceived map[int32]uint64 `json:"status_received"`
+		// HandlerLatency the latency distribution of PULL handlers per route, e.g. "/user/:id" of the param route
+		HandlerLatency map[string]DurationSnapshot `json:"handler_latency"`
+		// ActiveSessions the number of active sessions
+		ActiveSessions int `json:"active_sessions"`
+		// GopoolRunning the number of goroutines running in the go pool
+		GopoolRunning int `json:"gopool_running"`
+		// GopoolMax the maximum amount of the go pool
+		GopoolMax int `json:"gopool_max"`
+		// Redials the number of successful redials
+		Redials uint64 `json:"redials"`
+		// Tenants the request counters per tenant
+		Tenants map[string]TenantSnapshot `json:"tenants"`
+	}
+	// TenantSnapshot the snapshot of the request counters of a tenant
+	TenantSnapshot struct {
+		// Requests the number of received PULL and PUSH packets
+		Requests uint64 `json:"requests"`
+		// ReplyErrors the number of sent replies with error
+		ReplyErrors uint64 `json:"reply_errors"`
+	}
+	tenantCounters struct {
+		requests    uint64
+		replyErrors uint64
+	}
+)
+
+var (
+	_ tp.PostNewPeerPlugin         = new(Metrics)
+	_ tp.PostDialPlugin            = new(Metrics)
+	_ tp.PostDisconnectPlugin      = new(Metrics)
+	_ tp.PostWritePullPlugin       = new(Metrics)
+	_ tp.PostWriteReplyPlugin      = new(Metrics)
+	_ tp.PostWritePushPlugin       = new(Metrics)
+	_ tp.PostReadPullHeaderPlugin  = new(Metrics)
+	_ tp.PostReadPullBodyPlugin    = new(Metrics)
+	_ tp.PostReadPushHeaderPlugin  = new(Metrics)
+	_ tp.PostReadReplyHeaderPlugin = new(Metrics)
+	_ http.Handler                 = new(Metrics)
+)
+
+const metricsStartKey = "_plugin_metrics_start"
+
+// Name returns the plugin name.
+func (m *Metrics) Name() string {
+	return "metrics"
+}
+
+// PostNewPeer keeps the peer for counting sessions.
+func (m *Metrics) PostNewPeer(peer tp.EarlyPeer) error {
+	m.peer = peer
+	return nil
+}
+
+// PostDial counts redials.
+// Note: the session instance of the redial is the same as the first dial.
+func (m *Metrics) PostDial(sess tp.PreSession) *tp.Rerror {
+	m.dialedMu.Lock()
+	if _, ok := m.dialed[sess]; ok {
+		atomic.AddUint64(&m.redials, 1)
+	} else {
+		m.dialed[sess] = struct{}{}
+	}
+	m.dialedMu.Unlock()
+	return nil
+}
+
+// PostDisconnect forgets the dialed session.
+func (m *Metrics) PostDisconnect(sess tp.BaseSession) *tp.Rerror {
+	if preSess, ok := sess.(tp.PreSession); ok {
+		m.dialedMu.Lock()
+		delete(m.dialed, preSess)
+		m.dialedMu.Unlock()
+	}
+	return nil
+}
+
+// PostWritePull counts the sent PULL packet.
+func (m *Metrics) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsSent[tp.TypePull], 1)
+	return nil
+}
+
+// PostWriteReply counts the sent REPLY packet, and records the handler latency.
+func (m *Metrics) PostWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsSent[tp.TypeReply], 1)
+	m.countStatus(m.statusSent, ctx.Rerror())
+	if ctx.Rerror() != nil {
+		if c := m.tenant(ctx.Session()); c != nil {
+			atomic.AddUint64(&c.replyErrors, 1)
+		}
+	}
+	if start, ok := ctx.Values().Load(metricsStartKey); ok {
+		ctx.Values().Delete(metricsStartKey)
+		route := routeOf(ctx)
+		if len(route) == 0 {
+			route = ctx.Output().UriObject().Path
+		}
+		m.latency(route).Observe(time.Since(start.(time.Time)))
+	}
+	return nil
+}
+
+// PostWritePush counts the sent PUSH packet.
+func (m *Metrics) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsSent[tp.TypePush], 1)
+	return nil
+}
+
+// PostReadPullHeader counts the received PULL packet.
+func (m *Metrics) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsReceived[tp.TypePull], 1)
+	m.countTenantRequest(ctx.Session())
+	return nil
+}
+
+// PostReadPullBody marks the start time of the PULL handler.
+func (m *Metrics) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	ctx.Values().Store(metricsStartKey, time.Now())
+	return nil
+}
+
+// PostReadPushHeader counts the received PUSH packet.
+func (m *Metrics) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsReceived[tp.TypePush], 1)
+	m.countTenantRequest(ctx.Session())
+	return nil
+}
+
+// PostReadReplyHeader counts the received REPLY packet.
+func (m *Metrics) PostReadReplyHeader(ctx tp.ReadCtx) *tp.Rerror {
+	atomic.AddUint64(&m.packetsReceived[tp.TypeReply], 1)
+	m.countStatus(m.statusReceived, tp.NewRerrorFromMeta(ctx.Input().Meta()))
+	return nil
+}
+
+func (m *Metrics) countStatus(status map[int32]uint64, rerr *tp.Rerror) {
+	var code int32
+	if rerr != nil {
+		code = rerr.Code
+	}
+	m.statusMu.Lock()
+	status[code]++
+	m.statusMu.Unlock()
+}
+
+func (m *Metrics) countTenantRequest(sess tp.Session) {
+	if c := m.tenant(sess); c != nil {
+		atomic.AddUint64(&c.requests, 1)
+	}
+}
+
+// tenant returns the counters of the tenant of the session, nil if the tenant is not set.
+func (m *Metrics) tenant(sess tp.Session) *tenantCounters {
+	tenant := sess.Tenant()
+	if tenant == "" {
+		return nil
+	}
+	c, ok := m.tenants.Load(tenant)
+	if !ok {
+		c, _ = m.tenants.LoadOrStore(tenant, new(tenantCounters))
+	}
+	return c.(*tenantCounters)
+}
+
+func (m *Metrics) latency(uriPath string) *DurationHistogram {
+	h, ok := m.latencies.Load(uriPath)
+	if !ok {
+		h, _ = m.latencies.LoadOrStore(uriPath, new(DurationHistogram))
+	}
+	return h.(*DurationHistogram)
+}
+
+// Snapshot returns the snapshot of metrics.
+func (m *Metrics) Snapshot() *MetricsSnapshot {
+	s := &MetricsSnapshot{
+		PacketsSent:     make(map[string]uint64, 3),
+		PacketsReceived: make(map[string]uint64, 3),
+		StatusSent:      make(map[int32]uint64),
+		StatusReceived:  make(map[int32]uint64),
+		HandlerLatency:  make(map[string]DurationSnapshot),
+		Redials:         atomic.LoadUint64(&m.redials),
+		Tenants:         make(map[string]TenantSnapshot),
+	}
+	for _, typ := range []byte{tp.TypePull, tp.TypeReply, tp.TypePush} {
+		s.PacketsSent[tp.TypeText(typ)] = atomic.LoadUint64(&m.packetsSent[typ])
+		s.PacketsReceived[tp.TypeText(typ)] = atomic.LoadUint64(&m.packetsReceived[typ])
+	}
+	m.statusMu.Lock()
+	for code, count := range m.statusSent {
+		s.StatusSent[code] = count
+	}
+	for code, count := range m.statusReceived {
+		s.StatusReceived[code] = count
+	}
+	m.statusMu.Unlock()
+	m.latencies.Range(func(key, value interface{}) bool {
+		s.HandlerLatency[key.(string)] = value.(*DurationHistogram).Snapshot()
+		return true
+	})
+	m.tenants.Range(func(key, value interface{}) bool {
+		c := value.(*tenantCounters)
+		s.Tenants[key.(string)] = TenantSnapshot{
+			Requests:    atomic.LoadUint64(&c.requests),
+			ReplyErrors: atomic.LoadUint64(&c.replyErrors),
+		}
+		return true
+	})
+	if m.peer != nil {
+		s.ActiveSessions = m.peer.CountSession()
+	}
+	s.GopoolRunning, s.GopoolMax = tp.GopoolUsage()
+	return s
+}
+
+// PublishExpvar publishes the snapshot of metrics to expvar with the name.
+// Note: like expvar.Publish, panics if the name is already registered.
+func (m *Metrics) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Snapshot()
+	}))
+}
+
+// ServeHTTP serves the snapshot of metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.Snapshot().Prometheus())
+}
+
+// Prometheus returns the snapshot in the Prometheus text exposition format.
+func (s *MetricsSnapshot) Prometheus() []byte {
+	var buf bytes.Buffer
+	writeType := func(name, typ string) {
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+	}
+
+	writeType("teleport_packets_sent_total", "counter")
+	for _, typ := range sortedStringKeys(s.PacketsSent) {
+		fmt.Fprintf(&buf, "teleport_packets_sent_total{type=%s} %d\n", promLabel(typ), s.PacketsSent[typ])
+	}
+	writeType("teleport_packets_received_total", "counter")
+	for _, typ := range sortedStringKeys(s.PacketsReceived) {
+		fmt.Fprintf(&buf, "teleport_packets_received_total{type=%s} %d\n", promLabel(typ), s.PacketsReceived[typ])
+	}
+	writeType("teleport_reply_status_sent_total", "counter")
+	for _, code := range sortedCodeKeys(s.StatusSent) {
+		fmt.Fprintf(&buf, "teleport_reply_status_sent_total{code=\"%d\"} %d\n", code, s.StatusSent[code])
+	}
+	writeType("teleport_reply_status_received_total", "counter")
+	for _, code := range sortedCodeKeys(s.StatusReceived) {
+		fmt.Fprintf(&buf, "teleport_reply_status_received_total{code=\"%d\"} %d\n", code, s.StatusReceived[code])
+	}
+
+	writeType("teleport_handler_duration_seconds", "histogram")
+	uris := make([]string, 0, len(s.HandlerLatency))
+	for uri := range s.HandlerLatency {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	for _, uri := range uris {
+		h := s.HandlerLatency[uri]
+		label := promLabel(uri)
+		var cum uint64
+		for i, bound := range durationBuckets {
+			cum += h.Buckets[i]
+			fmt.Fprintf(&buf, "teleport_handler_duration_seconds_bucket{uri=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(&buf, "teleport_handler_duration_seconds_bucket{uri=%s,le=\"+Inf\"} %d\n", label, h.Count)
+		fmt.Fprintf(&buf, "teleport_handler_duration_seconds_sum{uri=%s} %s\n", label, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&buf, "teleport_handler_duration_seconds_count{uri=%s} %d\n", label, h.Count)
+	}
+
+	writeType("teleport_sessions_active", "gauge")
+	fmt.Fprintf(&buf, "teleport_sessions_active %d\n", s.ActiveSessions)
+	writeType("teleport_gopool_running", "gauge")
+	fmt.Fprintf(&buf, "teleport_gopool_running %d\n", s.GopoolRunning)
+	writeType("teleport_gopool_max", "gauge")
+	fmt.Fprintf(&buf, "teleport_gopool_max %d\n", s.GopoolMax)
+	writeType("teleport_redials_total", "counter")
+	fmt.Fprintf(&buf, "teleport_redials_total %d\n", s.Redials)
+
+	tenants := make([]string, 0, len(s.Tenants))
+	for tenant := range s.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	writeType("teleport_tenant_requests_total", "counter")
+	for _, tenant := range tenants {
+		fmt.Fprintf(&buf, "teleport_tenant_requests_total{tenant=%s} %d\n", promLabel(tenant), s.Tenants[tenant].Requests)
+	}
+	writeType("teleport_tenant_reply_errors_total", "counter")
+	for _, tenant := range tenants {
+		fmt.Fprintf(&buf, "teleport_tenant_reply_errors_total{tenant=%s} %d\n", promLabel(tenant), s.Tenants[tenant].ReplyErrors)
+	}
+	return buf.Bytes()
+}
+
+var promLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(value string) string {
+	return `"` + promLabelReplacer.Replace(value) + `"`
+}
+
+func sortedStringKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCodeKeys(m map[int32]uint64) []int32 {
+	keys := make([]int32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// durationBuckets the upper bounds of DurationHistogram buckets,
+// the same as the Prometheus default buckets.
+var durationBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+type (
+	// DurationHistogram histogram of durations.
+	// Note: concurrent safe, the zero value is ready to use.
+	DurationHistogram struct {
+		buckets [len(durationBuckets)]uint64
+		count   uint64
+		sum     int64
+	}
+	// DurationSnapshot the snapshot of DurationHistogram
+	DurationSnapshot struct {
+		// Buckets the number of durations in each bucket (not cumulative),
+		// the durations greater than the last upper bound are only counted in Count.
+		Buckets []uint64 `json:"buckets"`
+		// Count the number of the recorded durations
+		Count uint64 `json:"count"`
+		// Sum the sum of the recorded durations
+		Sum time.Duration `json:"sum"`
+	}
+)
+
+// Observe records a duration.
+func (h *DurationHistogram) Observe(d time.Duration) {
+	for i, bound := range durationBuckets {
+		if d <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Snapshot returns the snapshot of the histogram.
+func (h *DurationHistogram) Snapshot() DurationSnapshot {
+	s := DurationSnapshot{
+		Buckets: make([]uint64, len(durationBuckets)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	return s
+}
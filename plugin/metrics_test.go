@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	s := &MetricsSnapshot{
+		PacketsSent:     map[string]uint64{"PULL": 2, "PUSH": 1},
+		PacketsReceived: map[string]uint64{"REPLY": 2},
+		StatusSent:      map[int32]uint64{404: 1, 0: 3},
+		StatusReceived:  map[int32]uint64{},
+		HandlerLatency: map[string]DurationSnapshot{
+			"/user/:id": {Buckets: []uint64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Count: 2, Sum: 1500 * time.Millisecond},
+		},
+		ActiveSessions: 3,
+		GopoolRunning:  4,
+		GopoolMax:      100,
+		Redials:        1,
+		Tenants: map[string]TenantSnapshot{
+			"a\"b\\c\nd": {Requests: 5, ReplyErrors: 1},
+		},
+	}
+	const want = `# TYPE teleport_packets_sent_total counter
+teleport_packets_sent_total{type="PULL"} 2
+teleport_packets_sent_total{type="PUSH"} 1
+# TYPE teleport_packets_received_total counter
+teleport_packets_received_total{type="REPLY"} 2
+# TYPE teleport_reply_status_sent_total counter
+teleport_reply_status_sent_total{code="0"} 3
+teleport_reply_status_sent_total{code="404"} 1
+# TYPE teleport_reply_status_received_total counter
+# TYPE teleport_handler_duration_seconds histogram
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.005"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.01"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.025"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.05"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.1"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.25"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="0.5"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="1"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="2.5"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="5"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="10"} 1
+teleport_handler_duration_seconds_bucket{uri="/user/:id",le="+Inf"} 2
+teleport_handler_duration_seconds_sum{uri="/user/:id"} 1.5
+teleport_handler_duration_seconds_count{uri="/user/:id"} 2
+# TYPE teleport_sessions_active gauge
+teleport_sessions_active 3
+# TYPE teleport_gopool_running gauge
+teleport_gopool_running 4
+# TYPE teleport_gopool_max gauge
+teleport_gopool_max 100
+# TYPE teleport_redials_total counter
+teleport_redials_total 1
+# TYPE teleport_tenant_requests_total counter
+teleport_tenant_requests_total{tenant="a\"b\\c\nd"} 5
+# TYPE teleport_tenant_reply_errors_total counter
+teleport_tenant_reply_errors_total{tenant="a\"b\\c\nd"} 1
+`
+	if have := string(s.Prometheus()); have != want {
+		t.Fatalf("want:\n%s\nhave:\n%s", want, have)
+	}
+}
@@ -0,0 +1,27 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// serve serves the peer on a random local port, and returns the address.
+func serve(t *testing.T, peer tp.Peer) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go peer.ServeListener(lis)
+	return lis.Addr().String()
+}
+
+// dial dials the address by the peer, or fails the test.
+func dial(t *testing.T, peer tp.Peer, addr string) tp.Session {
+	sess, rerr := peer.Dial(addr)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return sess
+}
@@ -15,12 +15,36 @@
 package plugin
 
 import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+
 	"github.com/henrylee2cn/goutil"
 	tp "github.com/henrylee2cn/teleport"
 	"github.com/henrylee2cn/teleport/socket"
 )
 
 // A proxy plugin for handling unknown pulling or pushing.
+// Note:
+//  The proxy created by ProxyRelay relays in both directions, the upstream can pull or push the originating session back
+//  through the proxy by setting the MetaProxyTo metadata to the MetaProxyFrom one it received,
+//  if the upstream session is dialed by the same peer as the proxy and trusted;
+//  The MetaProxyFrom metadata of the untrusted sessions is overwritten, so that it can not be forged;
+//  The sequence is rewritten as "<session id>@<seq>", so the concurrent relays do not collide.
+
+// Proxy metadata keys
+const (
+	// MetaProxyFrom the key of the metadata carrying the id of the originating session,
+	// which is set by the first proxy on the way.
+	MetaProxyFrom = "X-Proxy-From"
+	// MetaProxyTo the key of the metadata carrying the id of the destination session,
+	// which is relayed to the session of the proxy peer instead of the upstream.
+	MetaProxyTo = "X-Proxy-To"
+)
+
+func init() {
+	tp.RegisterMetaKey(MetaProxyFrom, MetaProxyTo)
+}
 
 // Proxy creates a proxy plugin for handling unknown pulling and pushing.
 func Proxy(caller Caller) tp.Plugin {
@@ -30,6 +54,20 @@ func Proxy(caller Caller) tp.Plugin {
 	}
 }
 
+// ProxyRelay creates a proxy plugin for handling unknown pulling and pushing,
+// which also relays the ones carrying the MetaProxyTo metadata back to the session of the proxy peer,
+// only if they come from the sessions trusted by trust, e.g. the upstream sessions.
+func ProxyRelay(caller Caller, trust ProxyTrustFunc) tp.Plugin {
+	if trust == nil {
+		tp.Fatalf("proxy relay: trust can not be nil")
+	}
+	return &proxy{
+		pullFunc: caller.Pull,
+		pushFunc: caller.Push,
+		trust:    trust,
+	}
+}
+
 // ProxyPull creates a proxy plugin for handling unknown pulling.
 func ProxyPull(fn PullFunc) tp.Plugin {
 	return &proxy{pullFunc: fn}
@@ -40,6 +78,24 @@ func ProxyPush(fn PushFunc) tp.Plugin {
 	return &proxy{pushFunc: fn}
 }
 
+// ProxyAffinity creates a proxy plugin for handling unknown pulling and pushing,
+// which routes the ones carrying the same affinityMetaKey metadata to the same upstream
+// consistently by the hash ring, so that the stateful upstreams keep the cache locality.
+// Note:
+//  The key of the upstreams map is the unique name of the upstream, e.g. its address;
+//  The ones without the affinityMetaKey metadata are routed by the session id of the requester.
+func ProxyAffinity(affinityMetaKey string, upstreams map[string]Caller) tp.Plugin {
+	if len(upstreams) == 0 {
+		tp.Fatalf("proxy affinity: upstreams can not be empty")
+	}
+	return &proxy{
+		affinity: &affinity{
+			metaKey: affinityMetaKey,
+			ring:    newHashRing(upstreams, affinityReplicas),
+		},
+	}
+}
+
 type (
 	// Caller the object used to pull and push
 	Caller interface {
@@ -50,12 +106,70 @@ type (
 	PullFunc func(uri string, args interface{}, reply interface{}, setting ...socket.PacketSetting) tp.PullCmd
 	// PushFunc the function used to push
 	PushFunc func(uri string, args interface{}, setting ...socket.PacketSetting) *tp.Rerror
-	proxy    struct {
+	// ProxyTrustFunc reports whether the session is trusted to relay by the MetaProxyTo and MetaProxyFrom metadata.
+	ProxyTrustFunc func(sess tp.Session) bool
+	proxy          struct {
 		pullFunc PullFunc
 		pushFunc PushFunc
+		affinity *affinity
+		trust    ProxyTrustFunc
+		peer     tp.EarlyPeer
+	}
+	affinity struct {
+		metaKey string
+		ring    *hashRing
+	}
+	// hashRing the consistent hash ring of the upstreams.
+	hashRing struct {
+		hashes  []uint32 // sorted
+		callers map[uint32]Caller
 	}
 )
 
+// affinityReplicas the number of virtual nodes per upstream.
+const affinityReplicas = 160
+
+func newHashRing(upstreams map[string]Caller, replicas int) *hashRing {
+	r := &hashRing{
+		hashes:  make([]uint32, 0, len(upstreams)*replicas),
+		callers: make(map[uint32]Caller, len(upstreams)*replicas),
+	}
+	for name, caller := range upstreams {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + name))
+			if _, ok := r.callers[h]; ok {
+				continue
+			}
+			r.callers[h] = caller
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns the upstream of the key, which is the first virtual node clockwise.
+func (r *hashRing) get(key string) Caller {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.callers[r.hashes[i]]
+}
+
+// pick returns the upstream for the unknown pulling or pushing.
+func (a *affinity) pick(ctx interface {
+	PeekMeta(key string) []byte
+	Session() tp.Session
+}) Caller {
+	key := ctx.PeekMeta(a.metaKey)
+	if len(key) == 0 {
+		return a.ring.get(ctx.Session().Id())
+	}
+	return a.ring.get(goutil.BytesToString(key))
+}
+
 var (
 	_ tp.PostNewPeerPlugin = new(proxy)
 )
@@ -65,26 +179,30 @@ func (p *proxy) Name() string {
 }
 
 func (p *proxy) PostNewPeer(peer tp.EarlyPeer) error {
-	if p.pullFunc != nil {
+	p.peer = peer
+	if p.pullFunc != nil || p.affinity != nil {
 		peer.SetUnknownPull(p.pull)
 	}
-	if p.pushFunc != nil {
+	if p.pushFunc != nil || p.affinity != nil {
 		peer.SetUnknownPush(p.push)
 	}
 	return nil
 }
 
 func (p *proxy) pull(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
-	var settings = make([]socket.PacketSetting, 1, 8)
-	settings[0] = tp.WithSeq(ctx.Session().Id() + "@" + ctx.Seq())
-	ctx.VisitMeta(func(key, value []byte) {
-		settings = append(settings, tp.WithAddMeta(string(key), string(value)))
-	})
-	if len(ctx.PeekMeta(tp.MetaRealIp)) == 0 {
-		settings = append(settings, tp.WithAddMeta(tp.MetaRealIp, ctx.Ip()))
+	settings := p.forwardSettings(ctx)
+	pullFunc := p.pullFunc
+	if to := ctx.PeekMeta(MetaProxyTo); len(to) > 0 {
+		sess, rerr := p.destination(ctx.Session(), to)
+		if rerr != nil {
+			return nil, rerr
+		}
+		pullFunc = sess.Pull
+	} else if p.affinity != nil {
+		pullFunc = p.affinity.pick(ctx).Pull
 	}
 	var reply []byte
-	pullcmd := p.pullFunc(ctx.Uri(), ctx.InputBodyBytes(), &reply, settings...)
+	pullcmd := pullFunc(ctx.Uri(), ctx.InputBodyBytes(), &reply, settings...)
 	pullcmd.InputMeta().VisitAll(func(key, value []byte) {
 		ctx.SetMeta(goutil.BytesToString(key), goutil.BytesToString(value))
 	})
@@ -97,18 +215,73 @@ func (p *proxy) pull(ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
 }
 
 func (p *proxy) push(ctx tp.UnknownPushCtx) *tp.Rerror {
-	var settings = make([]socket.PacketSetting, 1, 8)
+	settings := p.forwardSettings(ctx)
+	pushFunc := p.pushFunc
+	if to := ctx.PeekMeta(MetaProxyTo); len(to) > 0 {
+		sess, rerr := p.destination(ctx.Session(), to)
+		if rerr != nil {
+			return rerr
+		}
+		pushFunc = sess.Push
+	} else if p.affinity != nil {
+		pushFunc = p.affinity.pick(ctx).Push
+	}
+	rerr := pushFunc(ctx.Uri(), ctx.InputBodyBytes(), settings...)
+	if rerr != nil && rerr.Code < 200 && rerr.Code > 99 {
+		rerr.Code = tp.CodeBadGateway
+		rerr.Message = tp.CodeText(tp.CodeBadGateway)
+	}
+	return rerr
+}
+
+// forwardSettings returns the settings of the forwarded packet,
+// which carries the metadata of the input one except MetaProxyTo,
+// and MetaProxyFrom unless the input session is trusted.
+func (p *proxy) forwardSettings(ctx interface {
+	Seq() string
+	Ip() string
+	Session() tp.Session
+	PeekMeta(key string) []byte
+	VisitMeta(f func(key, value []byte))
+}) []socket.PacketSetting {
+	var (
+		settings = make([]socket.PacketSetting, 1, 8)
+		trusted  = p.trusted(ctx.Session())
+	)
 	settings[0] = tp.WithSeq(ctx.Session().Id() + "@" + ctx.Seq())
 	ctx.VisitMeta(func(key, value []byte) {
-		settings = append(settings, tp.WithAddMeta(string(key), string(value)))
+		switch string(key) {
+		case MetaProxyTo:
+		case MetaProxyFrom:
+			if trusted {
+				settings = append(settings, tp.WithAddMeta(string(key), string(value)))
+			}
+		default:
+			settings = append(settings, tp.WithAddMeta(string(key), string(value)))
+		}
 	})
 	if len(ctx.PeekMeta(tp.MetaRealIp)) == 0 {
 		settings = append(settings, tp.WithAddMeta(tp.MetaRealIp, ctx.Ip()))
 	}
-	rerr := p.pushFunc(ctx.Uri(), ctx.InputBodyBytes(), settings...)
-	if rerr != nil && rerr.Code < 200 && rerr.Code > 99 {
-		rerr.Code = tp.CodeBadGateway
-		rerr.Message = tp.CodeText(tp.CodeBadGateway)
+	if !trusted || len(ctx.PeekMeta(MetaProxyFrom)) == 0 {
+		settings = append(settings, tp.WithAddMeta(MetaProxyFrom, ctx.Session().Id()))
 	}
-	return rerr
+	return settings
+}
+
+// trusted reports whether the session is trusted to relay.
+func (p *proxy) trusted(sess tp.Session) bool {
+	return p.trust != nil && p.trust(sess)
+}
+
+// destination returns the session of the proxy peer, to which the packet from the session from is relayed back.
+func (p *proxy) destination(from tp.Session, to []byte) (tp.Session, *tp.Rerror) {
+	if !p.trusted(from) {
+		return nil, tp.NewRerror(tp.CodeUnauthorized, tp.CodeText(tp.CodeUnauthorized), "untrusted session to relay by "+MetaProxyTo)
+	}
+	sess, ok := p.peer.GetSession(string(to))
+	if !ok {
+		return nil, tp.NewRerror(tp.CodeBadGateway, tp.CodeText(tp.CodeBadGateway), "proxy destination session not found: "+string(to))
+	}
+	return sess, nil
 }
@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+type namedCaller string
+
+func (namedCaller) Pull(uri string, args interface{}, reply interface{}, setting ...socket.PacketSetting) tp.PullCmd {
+	return nil
+}
+
+func (namedCaller) Push(uri string, args interface{}, setting ...socket.PacketSetting) *tp.Rerror {
+	return nil
+}
+
+func TestHashRing(t *testing.T) {
+	upstreams := map[string]Caller{}
+	for _, name := range []string{"a", "b", "c"} {
+		upstreams[name] = namedCaller(name)
+	}
+	ring := newHashRing(upstreams, affinityReplicas)
+	picked := map[string]string{}
+	counts := map[Caller]int{}
+	for i := 0; i < 3000; i++ {
+		key := "user" + strconv.Itoa(i)
+		caller := ring.get(key)
+		if ring.get(key) != caller {
+			t.Fatalf("key %q: inconsistent upstream", key)
+		}
+		picked[key] = string(caller.(namedCaller))
+		counts[caller]++
+	}
+	for caller, n := range counts {
+		if n < 500 {
+			t.Fatalf("upstream %v: unbalanced count %d", caller, n)
+		}
+	}
+	// only the keys of the removed upstream are remapped
+	delete(upstreams, "c")
+	ring = newHashRing(upstreams, affinityReplicas)
+	for key, name := range picked {
+		if name != "c" && string(ring.get(key).(namedCaller)) != name {
+			t.Fatalf("key %q: moved from %s", key, name)
+		}
+	}
+}
+
+// lazyCaller the caller of the session dialed after the proxy peer is created.
+type lazyCaller struct {
+	sess tp.Session
+}
+
+func (c *lazyCaller) Pull(uri string, args interface{}, reply interface{}, setting ...socket.PacketSetting) tp.PullCmd {
+	return c.sess.Pull(uri, args, reply, setting...)
+}
+
+func (c *lazyCaller) Push(uri string, args interface{}, setting ...socket.PacketSetting) *tp.Rerror {
+	return c.sess.Push(uri, args, setting...)
+}
+
+func TestProxyRelay(t *testing.T) {
+	// upstream: replies the originating session id, or pulls it back through the proxy
+	upstream := tp.NewPeer(tp.PeerConfig{})
+	defer upstream.Close()
+	upstream.RoutePullFuncAt("/from", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return string(ctx.PeekMeta(MetaProxyFrom)), nil
+	})
+	upstream.RoutePullFuncAt("/call_back", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		var reply string
+		rerr := ctx.Session().Pull("/echo", *arg, &reply,
+			tp.WithAddMeta(MetaProxyTo, string(ctx.PeekMeta(MetaProxyFrom))),
+		).Rerror()
+		return reply, rerr
+	})
+	upstreamAddr := serve(t, upstream)
+
+	caller := new(lazyCaller)
+	proxyPeer := tp.NewPeer(tp.PeerConfig{}, ProxyRelay(caller, func(sess tp.Session) bool {
+		return sess == caller.sess
+	}))
+	defer proxyPeer.Close()
+	caller.sess = dial(t, proxyPeer, upstreamAddr)
+	proxyAddr := serve(t, proxyPeer)
+
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	cli.RoutePullFuncAt("/echo", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return "echo:" + *arg, nil
+	})
+	sess := dial(t, cli, proxyAddr)
+
+	// relayed back to the originating session through the trusted upstream session
+	var reply string
+	if rerr := sess.Pull("/call_back", "a", &reply).Rerror(); rerr != nil || reply != "echo:a" {
+		t.Fatalf("reply: %q, rerr: %v", reply, rerr)
+	}
+
+	// the forged MetaProxyFrom of the downstream is overwritten
+	if rerr := sess.Pull("/from", "a", &reply, tp.WithAddMeta(MetaProxyFrom, "forged")).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply == "forged" || reply == "" {
+		t.Fatalf("expect the originating session id, got %q", reply)
+	}
+
+	// the downstream can not relay to another session by MetaProxyTo
+	other := dial(t, cli, proxyAddr)
+	rerr := other.Pull("/echo", "a", &reply, tp.WithAddMeta(MetaProxyTo, reply)).Rerror()
+	if rerr == nil || rerr.Code != tp.CodeUnauthorized {
+		t.Fatalf("expect CodeUnauthorized, got %v", rerr)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"golang.org/x/time/rate"
+)
+
+// A rate limit plugin for capping the request rate of PULL and PUSH by token bucket.
+
+// RateLimit creates a plugin for capping the request rate of every key by token bucket,
+// which allows rate requests per second on average, and bursts of at most burst requests.
+// If keyFunc is nil, RateLimitBySession is used.
+// Note:
+//  The excess PULL is replied with tp.CodeTooManyRequests, and the excess PUSH is dropped;
+//  register it with the routes that need to be limited, e.g.
+//  peer.RoutePull(new(Report), plugin.RateLimit(100, 10, plugin.RateLimitByUri))
+func RateLimit(rate float64, burst int, keyFunc RateLimitKeyFunc) tp.Plugin {
+	if rate <= 0 || burst <= 0 {
+		tp.Fatalf("rate_limit: rate and burst must be greater than 0, but have %v and %d", rate, burst)
+	}
+	if keyFunc == nil {
+		keyFunc = RateLimitBySession
+	}
+	return &rateLimit{
+		rate:    rate,
+		burst:   float64(burst),
+		keyFunc: keyFunc,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// RateLimitKeyFunc returns the key of the token bucket used by the request.
+type RateLimitKeyFunc func(ctx tp.ReadCtx) string
+
+// RateLimitBySession limits the requests of every session.
+// Note: it is keyed by the authenticated identity, if the auth plugin sets it as the session id.
+func RateLimitBySession(ctx tp.ReadCtx) string {
+	return ctx.Session().Id()
+}
+
+// RateLimitByUri limits the requests of every URI path.
+func RateLimitByUri(ctx tp.ReadCtx) string {
+	return ctx.Path()
+}
+
+type (
+	rateLimit struct {
+		rate      float64
+		burst     float64
+		keyFunc   RateLimitKeyFunc
+		buckets   map[string]*tokenBucket
+		lastSweep time.Time
+		mu        sync.Mutex
+	}
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+var (
+	_ tp.PostReadPullBodyPlugin = new(rateLimit)
+	_ tp.PostReadPushBodyPlugin = new(rateLimit)
+)
+
+// rateLimitSweepInterval the interval of removing the full buckets,
+// which are the same as the new ones.
+const rateLimitSweepInterval = time.Minute
+
+func (r *rateLimit) Name() string {
+	return "rate_limit"
+}
+
+func (r *rateLimit) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	return r.take(ctx)
+}
+
+func (r *rateLimit) PostReadPushBody(ctx tp.ReadCtx) *tp.Rerror {
+	return r.take(ctx)
+}
+
+func (r *rateLimit) take(ctx tp.ReadCtx) *tp.Rerror {
+	key := r.keyFunc(ctx)
+	now := time.Now()
+	r.mu.Lock()
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.fill(now, r.rate, r.burst)
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	r.mu.Unlock()
+	if allowed {
+		return nil
+	}
+	return rateLimitExceeded(ctx)
+}
+
+func rateLimitExceeded(ctx tp.ReadCtx) *tp.Rerror {
+	return tp.NewRerror(
+		tp.CodeTooManyRequests,
+		tp.CodeText(tp.CodeTooManyRequests),
+		"rate limit exceeded: "+ctx.Path(),
+	)
+}
+
+// sweep removes the full buckets.
+func (r *rateLimit) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if b.fill(now, r.rate, r.burst); b.tokens >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func (b *tokenBucket) fill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// RateLimitByLimiter creates a plugin for capping the request rate by the externally constructed limiter
+// of golang.org/x/time/rate, which can be shared by multiple peers in one process as a global budget, e.g.
+//  limiter := rate.NewLimiter(1000, 100)
+//  peer1.RoutePull(new(Report), plugin.RateLimitByLimiter(limiter))
+//  peer2.RoutePull(new(Report), plugin.RateLimitByLimiter(limiter))
+// Note: The excess PULL is replied with tp.CodeTooManyRequests, and the excess PUSH is dropped.
+func RateLimitByLimiter(limiter *rate.Limiter) tp.Plugin {
+	if limiter == nil {
+		tp.Fatalf("rate_limit: limiter can not be nil")
+	}
+	return RateLimitByLimiterFunc(func(tp.ReadCtx) *rate.Limiter {
+		return limiter
+	})
+}
+
+// RateLimiterFunc returns the limiter of golang.org/x/time/rate used by the request, nil means not limited.
+type RateLimiterFunc func(ctx tp.ReadCtx) *rate.Limiter
+
+// RateLimitByLimiterFunc creates a plugin for capping the request rate by the externally constructed limiters
+// of golang.org/x/time/rate, which are chosen per request, e.g. by tenant, and can be shared by multiple peers.
+// Note: The excess PULL is replied with tp.CodeTooManyRequests, and the excess PUSH is dropped.
+func RateLimitByLimiterFunc(limiterFunc RateLimiterFunc) tp.Plugin {
+	if limiterFunc == nil {
+		tp.Fatalf("rate_limit: limiterFunc can not be nil")
+	}
+	return &sharedRateLimit{limiterFunc: limiterFunc}
+}
+
+type sharedRateLimit struct {
+	limiterFunc RateLimiterFunc
+}
+
+var (
+	_ tp.PostReadPullBodyPlugin = new(sharedRateLimit)
+	_ tp.PostReadPushBodyPlugin = new(sharedRateLimit)
+)
+
+func (r *sharedRateLimit) Name() string {
+	return "rate_limit"
+}
+
+func (r *sharedRateLimit) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	return r.take(ctx)
+}
+
+func (r *sharedRateLimit) PostReadPushBody(ctx tp.ReadCtx) *tp.Rerror {
+	return r.take(ctx)
+}
+
+func (r *sharedRateLimit) take(ctx tp.ReadCtx) *tp.Rerror {
+	if limiter := r.limiterFunc(ctx); limiter != nil && !limiter.Allow() {
+		return rateLimitExceeded(ctx)
+	}
+	return nil
+}
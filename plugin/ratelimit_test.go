@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+	"golang.org/x/time/rate"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	r := RateLimit(10, 2, nil).(*rateLimit)
+	b := &tokenBucket{tokens: 0, last: now}
+	b.fill(now.Add(100*time.Millisecond), r.rate, r.burst)
+	if b.tokens < 0.99 || b.tokens > 1.01 {
+		t.Fatalf("expect 1 token after 100ms, got %v", b.tokens)
+	}
+	// never beyond the burst
+	b.fill(now.Add(time.Hour), r.rate, r.burst)
+	if b.tokens != 2 {
+		t.Fatalf("expect 2 tokens, got %v", b.tokens)
+	}
+	// the full buckets are swept
+	r.buckets["full"] = b
+	r.buckets["used"] = &tokenBucket{tokens: 0, last: now.Add(time.Hour)}
+	r.sweep(now.Add(time.Hour))
+	if _, ok := r.buckets["full"]; ok || len(r.buckets) != 1 {
+		t.Fatalf("expect only the used bucket kept, got %v", r.buckets)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var pushed int32
+	srv := tp.NewPeer(tp.PeerConfig{})
+	defer srv.Close()
+	limit := RateLimit(10, 2, RateLimitByUri)
+	for _, uri := range []string{"/a", "/b"} {
+		srv.RoutePullFuncAt(uri, func(ctx tp.PullCtx, arg *int) (int, *tp.Rerror) {
+			return *arg, nil
+		}, limit)
+	}
+	srv.RoutePushFuncAt("/push", func(ctx tp.PushCtx, arg *int) *tp.Rerror {
+		atomic.AddInt32(&pushed, 1)
+		return nil
+	}, RateLimit(10, 1, nil))
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+
+	var reply int
+	// bursts of at most 2 requests
+	for i := 0; i < 2; i++ {
+		if rerr := sess.Pull("/a", i, &reply).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	if rerr := sess.Pull("/a", 2, &reply).Rerror(); rerr == nil || rerr.Code != tp.CodeTooManyRequests {
+		t.Fatalf("expect CodeTooManyRequests, got %v", rerr)
+	}
+	// keyed by the URI path
+	if rerr := sess.Pull("/b", 3, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	// refilled at 10 per second
+	time.Sleep(150 * time.Millisecond)
+	if rerr := sess.Pull("/a", 4, &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	// the excess PUSH is dropped
+	for i := 0; i < 3; i++ {
+		if rerr := sess.Push("/push", i); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&pushed); n != 1 {
+		t.Fatalf("expect 1 handled push, got %d", n)
+	}
+}
+
+func TestRateLimitByLimiter(t *testing.T) {
+	echo := func(ctx tp.PullCtx, arg *int) (int, *tp.Rerror) {
+		return *arg, nil
+	}
+	// the budget is shared by the peers
+	shared := RateLimitByLimiter(rate.NewLimiter(rate.Every(time.Hour), 2))
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	var sessions []tp.Session
+	for i := 0; i < 2; i++ {
+		srv := tp.NewPeer(tp.PeerConfig{})
+		defer srv.Close()
+		srv.RoutePullFuncAt("/shared", echo, shared)
+		sessions = append(sessions, dial(t, cli, serve(t, srv)))
+	}
+	var reply int
+	for i, sess := range sessions {
+		if rerr := sess.Pull("/shared", i, &reply).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	for _, sess := range sessions {
+		if rerr := sess.Pull("/shared", 2, &reply).Rerror(); rerr == nil || rerr.Code != tp.CodeTooManyRequests {
+			t.Fatalf("expect CodeTooManyRequests, got %v", rerr)
+		}
+	}
+
+	// chosen per request, and nil means not limited
+	limited := rate.NewLimiter(rate.Every(time.Hour), 1)
+	srv := tp.NewPeer(tp.PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/tenant", echo, RateLimitByLimiterFunc(func(ctx tp.ReadCtx) *rate.Limiter {
+		if string(ctx.PeekMeta("tenant")) == "limited" {
+			return limited
+		}
+		return nil
+	}))
+	sess := dial(t, cli, serve(t, srv))
+	for i := 0; i < 5; i++ {
+		if rerr := sess.Pull("/tenant", i, &reply).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	withTenant := tp.WithAddMeta("tenant", "limited")
+	if rerr := sess.Pull("/tenant", 5, &reply, withTenant).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if rerr := sess.Pull("/tenant", 6, &reply, withTenant).Rerror(); rerr == nil || rerr.Code != tp.CodeTooManyRequests {
+		t.Fatalf("expect CodeTooManyRequests, got %v", rerr)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A request log plugin for exporting the structured log entry of every handled PULL and PUSH
+// to the external sinks, e.g. file, syslog or HTTP collector, instead of the console run logs.
+
+// The fields of the request log entry.
+const (
+	LogFieldTime      = "time"
+	LogFieldSessionId = "session_id"
+	LogFieldTenant    = "tenant"
+	LogFieldRealIp    = "real_ip"
+	LogFieldPtype     = "ptype"
+	LogFieldSeq       = "seq"
+	LogFieldUri       = "uri"
+	LogFieldMeta      = "meta"
+	LogFieldInputSize = "input_size"
+	LogFieldCode      = "code"
+	LogFieldMessage   = "message"
+	LogFieldCost      = "cost"
+)
+
+// defaultLogFields the fields logged if none is selected, all but the metadata.
+var defaultLogFields = []string{
+	LogFieldTime, LogFieldSessionId, LogFieldTenant, LogFieldRealIp, LogFieldPtype, LogFieldSeq,
+	LogFieldUri, LogFieldInputSize, LogFieldCode, LogFieldMessage, LogFieldCost,
+}
+
+// RequestLog creates a plugin that exports the selected fields of every handled PULL and PUSH to the exporter.
+// If no field is selected, all but LogFieldMeta are exported.
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin,
+//  since the entries are made by the router middleware added in PostNewPeer;
+//  The exporter is called synchronously in the handling goroutine,
+//  so the slow sinks should buffer the entries, as LogHTTPExporter does.
+func RequestLog(exporter LogExporter, fields ...string) tp.Plugin {
+	if exporter == nil {
+		tp.Fatalf("request_log: exporter can not be nil")
+	}
+	if len(fields) == 0 {
+		fields = defaultLogFields
+	}
+	return &requestLog{exporter: exporter, fields: fields}
+}
+
+type (
+	// LogEntry the request log entry, keyed by the selected fields.
+	LogEntry map[string]interface{}
+	// LogExporter exports the request log entries to an external sink.
+	LogExporter interface {
+		// Export exports the entry.
+		Export(LogEntry)
+		// Close flushes the pending entries, and closes the sink.
+		Close() error
+	}
+	requestLog struct {
+		exporter LogExporter
+		fields   []string
+	}
+)
+
+var (
+	_ tp.PostNewPeerPlugin = new(requestLog)
+)
+
+func (r *requestLog) Name() string {
+	return "request_log"
+}
+
+func (r *requestLog) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.Router().Use(r.log)
+	return nil
+}
+
+// log is the middleware exporting the request log entry.
+func (r *requestLog) log(ctx tp.HandleCtx, next func() *tp.Rerror) *tp.Rerror {
+	start := time.Now()
+	rerr := next()
+	cost := time.Since(start)
+	input := ctx.Input()
+	entry := make(LogEntry, len(r.fields))
+	for _, field := range r.fields {
+		switch field {
+		case LogFieldTime:
+			entry[field] = start
+		case LogFieldSessionId:
+			entry[field] = ctx.Session().Id()
+		case LogFieldTenant:
+			entry[field] = ctx.Session().Tenant()
+		case LogFieldRealIp:
+			entry[field] = ctx.RealIp()
+		case LogFieldPtype:
+			entry[field] = tp.TypeText(input.Ptype())
+		case LogFieldSeq:
+			entry[field] = input.Seq()
+		case LogFieldUri:
+			entry[field] = input.Uri()
+		case LogFieldMeta:
+			entry[field] = input.Meta().String()
+		case LogFieldInputSize:
+			entry[field] = input.Size()
+		case LogFieldCode:
+			if rerr != nil {
+				entry[field] = rerr.Code
+			} else {
+				entry[field] = 0
+			}
+		case LogFieldMessage:
+			if rerr != nil {
+				entry[field] = rerr.Message
+			} else {
+				entry[field] = ""
+			}
+		case LogFieldCost:
+			entry[field] = cost
+		}
+	}
+	r.exporter.Export(entry)
+	return rerr
+}
+
+// LogFileExporter the exporter appending the entries to a file, one JSON per line.
+// Note: It is concurrent safe.
+type LogFileExporter struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// OpenLogFileExporter opens the log file for appending, and creates it if it does not exist.
+func OpenLogFileExporter(name string) (*LogFileExporter, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFileExporter{file: f}, nil
+}
+
+// Export appends the entry to the file.
+func (e *LogFileExporter) Export(entry LogEntry) {
+	b, _ := json.Marshal(entry)
+	b = append(b, '\n')
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.file.Write(b); err != nil {
+		tp.Errorf("request_log: %s", err.Error())
+	}
+}
+
+// Close closes the log file.
+func (e *LogFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// LogHTTPExporter the exporter posting the entries to an HTTP collector in batches,
+// as the body of JSON lines.
+// Note:
+//  The entries are buffered up to bufferSize, beyond which the new ones are dropped;
+//  It is concurrent safe.
+type LogHTTPExporter struct {
+	url      string
+	client   *http.Client
+	batch    int
+	interval time.Duration
+	entries  chan LogEntry
+	closed   chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	dropped  uint64
+	mu       sync.Mutex
+}
+
+// NewLogHTTPExporter creates the exporter posting to the url,
+// once batchSize entries are buffered or every interval.
+func NewLogHTTPExporter(url string, batchSize, bufferSize int, interval time.Duration) *LogHTTPExporter {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if bufferSize < batchSize {
+		bufferSize = batchSize
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	e := &LogHTTPExporter{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		batch:    batchSize,
+		interval: interval,
+		entries:  make(chan LogEntry, bufferSize),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	tp.AnywayGo(e.loop)
+	return e
+}
+
+// Export buffers the entry, or drops it if the buffer is full.
+func (e *LogHTTPExporter) Export(entry LogEntry) {
+	select {
+	case e.entries <- entry:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of the entries dropped due to the full buffer.
+func (e *LogHTTPExporter) Dropped() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// Close posts the buffered entries, and stops the exporter.
+func (e *LogHTTPExporter) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+	})
+	<-e.done
+	return nil
+}
+
+func (e *LogHTTPExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	var count int
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		e.post(buf.Bytes())
+		buf.Reset()
+		count = 0
+	}
+	add := func(entry LogEntry) {
+		b, _ := json.Marshal(entry)
+		buf.Write(b)
+		buf.WriteByte('\n')
+		if count++; count >= e.batch {
+			flush()
+		}
+	}
+	for {
+		select {
+		case entry := <-e.entries:
+			add(entry)
+		case <-ticker.C:
+			flush()
+		case <-e.closed:
+			for {
+				select {
+				case entry := <-e.entries:
+					add(entry)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *LogHTTPExporter) post(body []byte) {
+	resp, err := e.client.Post(e.url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		tp.Errorf("request_log: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		tp.Errorf("request_log: post %s: %s", e.url, resp.Status)
+	}
+}
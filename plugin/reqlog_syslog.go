@@ -0,0 +1,53 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows,!nacl,!plan9
+
+package plugin
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// LogSyslogExporter the exporter writing the entries to the syslog, one JSON per message.
+// Note: It is concurrent safe.
+type LogSyslogExporter struct {
+	writer *syslog.Writer
+}
+
+// DialLogSyslogExporter connects to the syslog daemon at raddr on network, e.g. "udp" and "localhost:514",
+// or the local one if network is empty, and writes the entries at the info level with the tag.
+func DialLogSyslogExporter(network, raddr, tag string) (*LogSyslogExporter, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &LogSyslogExporter{writer: w}, nil
+}
+
+// Export writes the entry to the syslog.
+func (e *LogSyslogExporter) Export(entry LogEntry) {
+	b, _ := json.Marshal(entry)
+	if err := e.writer.Info(string(b)); err != nil {
+		tp.Errorf("request_log: %s", err.Error())
+	}
+}
+
+// Close closes the connection to the syslog daemon.
+func (e *LogSyslogExporter) Close() error {
+	return e.writer.Close()
+}
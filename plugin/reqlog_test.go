@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestRequestLog(t *testing.T) {
+	var (
+		lines []string
+		mu    sync.Mutex
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		lines = append(lines, strings.Split(strings.TrimSpace(string(b)), "\n")...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	exporter := NewLogHTTPExporter(collector.URL, 10, 100, time.Minute)
+
+	srv := tp.NewPeer(tp.PeerConfig{}, RequestLog(exporter, LogFieldUri, LogFieldCode))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		if *arg == "bad" {
+			return "", tp.NewRerror(400, "Bad Arg", "")
+		}
+		return *arg, nil
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(lis)
+
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess, rerr := cli.Dial(lis.Addr().String())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	var reply string
+	sess.Pull("/echo", "ok", &reply)
+	sess.Pull("/echo", "bad", &reply)
+	// flushes the buffered entries
+	exporter.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 entries, got %q", lines)
+	}
+	var entry map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(entry) != 2 || entry[LogFieldUri] != "/echo" || entry[LogFieldCode] != float64(400) {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/utils"
+)
+
+// A sign plugin for the lightweight request authentication,
+// by signing the timestamp, identity, URI and selected metadata of every PULL and PUSH with HMAC-SHA256.
+
+// The metadata keys carrying the signature.
+const (
+	SignTimeMetaKey     = "X-Sign-Time"
+	SignIdentityMetaKey = "X-Sign-Identity"
+	SignKeysMetaKey     = "X-Sign-Keys"
+	SignMetaKey         = "X-Sign"
+)
+
+func init() {
+	tp.RegisterMetaKey(SignTimeMetaKey, SignIdentityMetaKey, SignKeysMetaKey, SignMetaKey)
+}
+
+// SignMeta creates a plugin for signing the outbound PULL and PUSH by the key of the identity,
+// covering the unix timestamp, the identity, the URI and the values of metaKeys.
+func SignMeta(identity string, key []byte, metaKeys ...string) tp.Plugin {
+	return &signMeta{
+		identity: identity,
+		key:      key,
+		metaKeys: strings.Join(metaKeys, ","),
+	}
+}
+
+// VerifyMetaSign creates a plugin for verifying the signature of the inbound PULL and PUSH,
+// which are rejected with tp.CodeUnauthorized if unsigned, badly signed,
+// or signed more than maxSkew away from the local time.
+// Note:
+//  keyFunc returns the key of the identity, ok=false means the identity is unknown;
+//  The verified identity of the handler is got by SignedIdentity(ctx);
+//  It should be passed to tp.NewPeer() as a global plugin.
+func VerifyMetaSign(keyFunc SignKeyFunc, maxSkew time.Duration) tp.Plugin {
+	if keyFunc == nil {
+		tp.Fatalf("sign: keyFunc can not be nil")
+	}
+	return &verifyMetaSign{
+		keyFunc: keyFunc,
+		maxSkew: maxSkew,
+	}
+}
+
+type (
+	// SignKeyFunc returns the signing key of the identity.
+	SignKeyFunc func(identity string) (key []byte, ok bool)
+	signMeta    struct {
+		identity string
+		key      []byte
+		metaKeys string
+	}
+	verifyMetaSign struct {
+		keyFunc SignKeyFunc
+		maxSkew time.Duration
+	}
+)
+
+var (
+	_ tp.PreWritePullPlugin       = new(signMeta)
+	_ tp.PreWritePushPlugin       = new(signMeta)
+	_ tp.PostReadPullHeaderPlugin = new(verifyMetaSign)
+	_ tp.PostReadPushHeaderPlugin = new(verifyMetaSign)
+)
+
+const signIdentityKey = "_plugin_sign_identity"
+
+// SignedIdentity returns the verified identity of the handler context.
+func SignedIdentity(ctx interface{ Values() goutil.Map }) (string, bool) {
+	identity, ok := ctx.Values().Load(signIdentityKey)
+	if !ok {
+		return "", false
+	}
+	return identity.(string), true
+}
+
+func (s *signMeta) Name() string {
+	return "sign"
+}
+
+func (s *signMeta) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	s.sign(ctx.Output())
+	return nil
+}
+
+func (s *signMeta) PreWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	s.sign(ctx.Output())
+	return nil
+}
+
+func (s *signMeta) sign(output *socket.Packet) {
+	meta := output.Meta()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	meta.Set(SignTimeMetaKey, timestamp)
+	meta.Set(SignIdentityMetaKey, s.identity)
+	if len(s.metaKeys) > 0 {
+		meta.Set(SignKeysMetaKey, s.metaKeys)
+	}
+	meta.Set(SignMetaKey, signature(s.key, timestamp, s.identity, output.Uri(), s.metaKeys, meta))
+}
+
+func (v *verifyMetaSign) Name() string {
+	return "verify_sign"
+}
+
+func (v *verifyMetaSign) PostReadPullHeader(ctx tp.ReadCtx) *tp.Rerror {
+	return v.verify(ctx)
+}
+
+func (v *verifyMetaSign) PostReadPushHeader(ctx tp.ReadCtx) *tp.Rerror {
+	return v.verify(ctx)
+}
+
+func (v *verifyMetaSign) verify(ctx tp.ReadCtx) *tp.Rerror {
+	input := ctx.Input()
+	meta := input.Meta()
+	timestamp := string(meta.Peek(SignTimeMetaKey))
+	identity := string(meta.Peek(SignIdentityMetaKey))
+	sig := meta.Peek(SignMetaKey)
+	if len(sig) == 0 {
+		return signUnauthorized("unsigned packet: " + input.Uri())
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return signUnauthorized("invalid sign time: " + timestamp)
+	}
+	if v.maxSkew > 0 {
+		skew := time.Since(time.Unix(unix, 0))
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > v.maxSkew {
+			return signUnauthorized("sign time out of the allowed skew: " + timestamp)
+		}
+	}
+	key, ok := v.keyFunc(identity)
+	if !ok {
+		return signUnauthorized("unknown sign identity: " + identity)
+	}
+	want := signature(key, timestamp, identity, input.Uri(), string(meta.Peek(SignKeysMetaKey)), meta)
+	if !hmac.Equal(sig, []byte(want)) {
+		return signUnauthorized("bad signature: " + input.Uri())
+	}
+	ctx.Values().Store(signIdentityKey, identity)
+	return nil
+}
+
+func signUnauthorized(detail string) *tp.Rerror {
+	return tp.NewRerror(tp.CodeUnauthorized, tp.CodeText(tp.CodeUnauthorized), detail)
+}
+
+// signature returns the base64 HMAC-SHA256 of the timestamp, identity, URI and
+// the values of the comma separated metaKeys, each on its own line.
+func signature(key []byte, timestamp, identity, uri, metaKeys string, meta *utils.Args) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + identity + "\n" + uri + "\n" + metaKeys))
+	if len(metaKeys) > 0 {
+		for _, k := range strings.Split(metaKeys, ",") {
+			mac.Write([]byte("\n"))
+			mac.Write(meta.Peek(k))
+		}
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
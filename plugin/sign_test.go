@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestSign(t *testing.T) {
+	keys := map[string][]byte{"alice": []byte("alice-key")}
+	srv := tp.NewPeer(tp.PeerConfig{}, VerifyMetaSign(func(identity string) ([]byte, bool) {
+		key, ok := keys[identity]
+		return key, ok
+	}, time.Minute))
+	defer srv.Close()
+	srv.RoutePullFuncAt("/whoami", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		identity, _ := SignedIdentity(ctx)
+		return identity + ":" + string(ctx.PeekMeta("tenant")), nil
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(lis)
+
+	pull := func(plugins ...tp.Plugin) (string, *tp.Rerror) {
+		cli := tp.NewPeer(tp.PeerConfig{}, plugins...)
+		defer cli.Close()
+		sess, rerr := cli.Dial(lis.Addr().String())
+		if rerr != nil {
+			return "", rerr
+		}
+		var reply string
+		rerr = sess.Pull("/whoami", "", &reply, tp.WithAddMeta("tenant", "acme")).Rerror()
+		return reply, rerr
+	}
+
+	reply, rerr := pull(SignMeta("alice", keys["alice"], "tenant"))
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if reply != "alice:acme" {
+		t.Fatalf("expect alice:acme, got %q", reply)
+	}
+	for _, plugins := range [][]tp.Plugin{
+		nil,
+		{SignMeta("alice", []byte("guess"))},
+		{SignMeta("bob", keys["alice"])},
+	} {
+		if _, rerr = pull(plugins...); rerr == nil || rerr.Code != tp.CodeUnauthorized {
+			t.Fatalf("expect CodeUnauthorized, got %v", rerr)
+		}
+	}
+}
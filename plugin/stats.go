@@ -0,0 +1,243 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// A stats plugin for recording the statistics of every route.
+
+// NewStats creates a plugin for recording the statistics of every route.
+// Note:
+//  The body size distributions are recorded by exponential histograms,
+//  which helps identify routes that should enable compression or switch to streaming;
+//  The handled packets are recorded by the matched route, e.g. "/user/:id" of the param route,
+//  and the others by the URI path, up to MaxStatsRoutes paths, beyond which by StatsOtherRoute.
+func NewStats() *Stats {
+	return &Stats{
+		routes: goutil.AtomicMap(),
+	}
+}
+
+// The limit of the unmatched URI paths recorded by Stats.
+const (
+	// MaxStatsRoutes the max number of the recorded unmatched URI paths, e.g. of the sent PULL
+	MaxStatsRoutes = 1024
+	// StatsOtherRoute the route recording the unmatched URI paths beyond MaxStatsRoutes
+	StatsOtherRoute = "*"
+)
+
+type (
+	// Stats the statistics plugin of routes
+	Stats struct {
+		// key: route
+		// value: *RouteStats
+		routes goutil.Map
+		paths  int32 // the number of the recorded unmatched URI paths
+	}
+	// RouteStats the statistics of a route
+	RouteStats struct {
+		// Request the body size distribution of PULL or PUSH packets
+		Request SizeHistogram
+		// Reply the body size distribution of REPLY packets
+		Reply SizeHistogram
+	}
+)
+
+var (
+	_ tp.PostReadPullBodyPlugin  = new(Stats)
+	_ tp.PostWriteReplyPlugin    = new(Stats)
+	_ tp.PostReadPushBodyPlugin  = new(Stats)
+	_ tp.PostWritePullPlugin     = new(Stats)
+	_ tp.PostReadReplyBodyPlugin = new(Stats)
+	_ tp.PostWritePushPlugin     = new(Stats)
+)
+
+// Name returns the plugin name.
+func (s *Stats) Name() string {
+	return "stats"
+}
+
+// Route returns the statistics of the route, i.e. the matched route pattern or the URI path.
+// If second returned arg is false, mean the route has not been recorded.
+func (s *Stats) Route(route string) (*RouteStats, bool) {
+	rs, ok := s.routes.Load(route)
+	if !ok {
+		return nil, false
+	}
+	return rs.(*RouteStats), true
+}
+
+// Range calls fn sequentially for each recorded route.
+// If fn returns false, stop traversing.
+func (s *Stats) Range(fn func(route string, rs *RouteStats) bool) {
+	s.routes.Range(func(key, value interface{}) bool {
+		return fn(key.(string), value.(*RouteStats))
+	})
+}
+
+func (s *Stats) route(ctx interface{}, packet *socket.Packet) *RouteStats {
+	route := routeOf(ctx)
+	matched := len(route) > 0
+	if !matched {
+		route = packet.UriObject().Path
+	}
+	rs, ok := s.routes.Load(route)
+	if ok {
+		return rs.(*RouteStats)
+	}
+	if !matched && atomic.LoadInt32(&s.paths) >= MaxStatsRoutes {
+		route = StatsOtherRoute
+	}
+	rs, loaded := s.routes.LoadOrStore(route, new(RouteStats))
+	if !loaded && !matched && route != StatsOtherRoute {
+		atomic.AddInt32(&s.paths, 1)
+	}
+	return rs.(*RouteStats)
+}
+
+// routeOf returns the matched route of the handler context, or empty string if not matched.
+func routeOf(ctx interface{}) string {
+	if c, ok := ctx.(interface{ Route() string }); ok {
+		return c.Route()
+	}
+	return ""
+}
+
+// PostReadPullBody records the body size of the received PULL packet.
+func (s *Stats) PostReadPullBody(ctx tp.ReadCtx) *tp.Rerror {
+	s.route(ctx, ctx.Input()).Request.Observe(ctx.Input().BodySize())
+	return nil
+}
+
+// PostWriteReply records the body size of the sent REPLY packet.
+func (s *Stats) PostWriteReply(ctx tp.WriteCtx) *tp.Rerror {
+	s.route(ctx, ctx.Output()).Reply.Observe(ctx.Output().BodySize())
+	return nil
+}
+
+// PostReadPushBody records the body size of the received PUSH packet.
+func (s *Stats) PostReadPushBody(ctx tp.ReadCtx) *tp.Rerror {
+	s.route(ctx, ctx.Input()).Request.Observe(ctx.Input().BodySize())
+	return nil
+}
+
+// PostWritePull records the body size of the sent PULL packet.
+func (s *Stats) PostWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	s.route(ctx, ctx.Output()).Request.Observe(ctx.Output().BodySize())
+	return nil
+}
+
+// PostReadReplyBody records the body size of the received REPLY packet.
+func (s *Stats) PostReadReplyBody(ctx tp.ReadCtx) *tp.Rerror {
+	s.route(ctx, ctx.Input()).Reply.Observe(ctx.Input().BodySize())
+	return nil
+}
+
+// PostWritePush records the body size of the sent PUSH packet.
+func (s *Stats) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	s.route(ctx, ctx.Output()).Request.Observe(ctx.Output().BodySize())
+	return nil
+}
+
+// sizeBucketCount the number of buckets: [0,1), [1,2), [2,4) ... [2^31,2^32)
+const sizeBucketCount = 33
+
+type (
+	// SizeHistogram exponential histogram of sizes, whose bucket upper bounds are powers of 2.
+	// Note: concurrent safe, the zero value is ready to use.
+	SizeHistogram struct {
+		buckets [sizeBucketCount]uint64
+		count   uint64
+		sum     uint64
+	}
+	// SizeBucket a bucket of SizeHistogram
+	SizeBucket struct {
+		// UpperBound the exclusive upper bound of the sizes in the bucket
+		UpperBound uint64
+		// Count the number of the sizes in the bucket
+		Count uint64
+	}
+)
+
+// Observe records a size.
+func (h *SizeHistogram) Observe(size uint32) {
+	atomic.AddUint64(&h.buckets[bits.Len32(size)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(size))
+}
+
+// Count returns the number of the recorded sizes.
+func (h *SizeHistogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of the recorded sizes.
+func (h *SizeHistogram) Sum() uint64 {
+	return atomic.LoadUint64(&h.sum)
+}
+
+// Mean returns the mean of the recorded sizes.
+func (h *SizeHistogram) Mean() float64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	return float64(h.Sum()) / float64(count)
+}
+
+// Buckets returns the non-empty buckets, in ascending order of upper bound.
+func (h *SizeHistogram) Buckets() []SizeBucket {
+	var buckets []SizeBucket
+	for i := range h.buckets {
+		count := atomic.LoadUint64(&h.buckets[i])
+		if count == 0 {
+			continue
+		}
+		buckets = append(buckets, SizeBucket{
+			UpperBound: uint64(1) << uint(i),
+			Count:      count,
+		})
+	}
+	return buckets
+}
+
+// Quantile returns the upper bound of the bucket containing the q-quantile, 0<=q<=1.
+// If there is no recorded size, returns 0.
+func (h *SizeHistogram) Quantile(q float64) uint64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var cum uint64
+	for i := range h.buckets {
+		cum += atomic.LoadUint64(&h.buckets[i])
+		if cum >= rank {
+			return uint64(1) << uint(i)
+		}
+	}
+	return uint64(1) << (sizeBucketCount - 1)
+}
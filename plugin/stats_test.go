@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"strconv"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	var h SizeHistogram
+	for _, size := range []uint32{0, 1, 3, 3, 100, 1024, 5000} {
+		h.Observe(size)
+	}
+	if h.Count() != 7 {
+		t.Fatalf("count: want 7, have %d", h.Count())
+	}
+	if h.Sum() != 6131 {
+		t.Fatalf("sum: want 6131, have %d", h.Sum())
+	}
+	want := []SizeBucket{{1, 1}, {2, 1}, {4, 2}, {128, 1}, {2048, 1}, {8192, 1}}
+	have := h.Buckets()
+	if len(have) != len(want) {
+		t.Fatalf("buckets: want %v, have %v", want, have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("buckets: want %v, have %v", want, have)
+		}
+	}
+	if q := h.Quantile(0.5); q != 4 {
+		t.Fatalf("p50: want 4, have %d", q)
+	}
+	if q := h.Quantile(1); q != 8192 {
+		t.Fatalf("p100: want 8192, have %d", q)
+	}
+	t.Logf("mean: %f, buckets: %v", h.Mean(), have)
+}
+
+func TestStatsRoute(t *testing.T) {
+	stats := NewStats()
+	srv := tp.NewPeer(tp.PeerConfig{}, stats)
+	defer srv.Close()
+	srv.RoutePullFuncAt("/user/:id", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return ctx.Param("id"), nil
+	})
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, srv))
+	for i := 0; i < 3; i++ {
+		var reply string
+		if rerr := sess.Pull("/user/"+strconv.Itoa(i), "a", &reply).Rerror(); rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	// keyed by the route pattern, instead of the URI path carrying the id
+	rs, ok := stats.Route("/user/:id")
+	if !ok || rs.Request.Count() != 3 || rs.Reply.Count() != 3 {
+		t.Fatalf("expect 3 requests and replies of the route pattern, got %+v", rs)
+	}
+	if _, ok = stats.Route("/user/1"); ok {
+		t.Fatal("expect no statistics of the URI path")
+	}
+
+	// the unmatched URI paths are bounded
+	stats = NewStats()
+	for i := 0; i < MaxStatsRoutes+10; i++ {
+		packet := socket.GetPacket(socket.WithUri("/path/" + strconv.Itoa(i)))
+		stats.route(nil, packet).Request.Observe(1)
+		socket.PutPacket(packet)
+	}
+	var routes int
+	stats.Range(func(string, *RouteStats) bool {
+		routes++
+		return true
+	})
+	if routes != MaxStatsRoutes+1 {
+		t.Fatalf("expect %d routes, got %d", MaxStatsRoutes+1, routes)
+	}
+	if rs, ok = stats.Route(StatsOtherRoute); !ok || rs.Request.Count() != 10 {
+		t.Fatalf("expect 10 requests of the other route, got %+v", rs)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+)
+
+// A time sync plugin for estimating the clock offset to the remote peer, as NTP does,
+// so that the clients, e.g. of mobile or game, can correct the clock skew used by TTL and anti-replay.
+
+// TimeSyncUri the URI of time sync PULL.
+const TimeSyncUri = "/time_sync"
+
+// TimeSyncServer creates a plugin that replies the time sync PULL with the server time.
+func TimeSyncServer() tp.Plugin {
+	return new(timeSyncServer)
+}
+
+type (
+	// TimeOffset the estimated clock offset to the remote peer.
+	TimeOffset struct {
+		// Offset the remote clock minus the local clock, i.e. the local time plus it is the remote time
+		Offset time.Duration
+		// RTT the round-trip time of the sample that the offset is estimated by
+		RTT time.Duration
+	}
+	timeSyncServer struct{}
+	// TimeSyncStamps the unix nanoseconds when the server receives the PULL and sends the reply.
+	TimeSyncStamps struct {
+		Receive  int64 `json:"receive"`
+		Transmit int64 `json:"transmit"`
+	}
+)
+
+var _ tp.PostNewPeerPlugin = new(timeSyncServer)
+
+const timeOffsetKey = "_plugin_time_offset"
+
+func (t *timeSyncServer) Name() string {
+	return "time_sync_server"
+}
+
+func (t *timeSyncServer) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.RoutePullFuncAt(TimeSyncUri, timeSync)
+	return nil
+}
+
+// timeSync replies the time sync PULL, whose route is TimeSyncUri.
+func timeSync(ctx tp.PullCtx, _ *[]byte) (*TimeSyncStamps, *tp.Rerror) {
+	stamps := &TimeSyncStamps{Receive: time.Now().UnixNano()}
+	stamps.Transmit = time.Now().UnixNano()
+	return stamps, nil
+}
+
+// SyncTime pulls TimeSyncUri samples times, and estimates the clock offset to the remote peer
+// by the sample of the smallest RTT, which is the least affected by the asymmetric network delay.
+// The result is also stored into the session, and got by SessionTimeOffset(sess).
+// Note: The remote peer needs the TimeSyncServer plugin.
+func SyncTime(sess tp.Session, samples int) (*TimeOffset, *tp.Rerror) {
+	if samples <= 0 {
+		samples = 1
+	}
+	var best *TimeOffset
+	for i := 0; i < samples; i++ {
+		var stamps TimeSyncStamps
+		send := time.Now()
+		rerr := sess.Pull(TimeSyncUri, nil, &stamps).Rerror()
+		receive := time.Now()
+		if rerr != nil {
+			return nil, rerr
+		}
+		// t0: send, t1: stamps.Receive, t2: stamps.Transmit, t3: receive
+		t0, t3 := send.UnixNano(), receive.UnixNano()
+		o := &TimeOffset{
+			Offset: time.Duration((stamps.Receive - t0 + stamps.Transmit - t3) / 2),
+			RTT:    time.Duration((t3 - t0) - (stamps.Transmit - stamps.Receive)),
+		}
+		if best == nil || o.RTT < best.RTT {
+			best = o
+		}
+	}
+	sess.Swap().Store(timeOffsetKey, best)
+	return best, nil
+}
+
+// SessionTimeOffset returns the clock offset of the session estimated by the latest SyncTime.
+func SessionTimeOffset(sess interface{ Swap() goutil.Map }) (*TimeOffset, bool) {
+	o, ok := sess.Swap().Load(timeOffsetKey)
+	if !ok {
+		return nil, false
+	}
+	return o.(*TimeOffset), true
+}
+
+// RemoteNow returns the current time of the remote clock.
+func (o *TimeOffset) RemoteNow() time.Time {
+	return time.Now().Add(o.Offset)
+}
@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestSyncTime(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{}, TimeSyncServer())
+	defer srv.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeListener(lis)
+
+	cli := tp.NewPeer(tp.PeerConfig{})
+	defer cli.Close()
+	sess, rerr := cli.Dial(lis.Addr().String())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	o, rerr := SyncTime(sess, 5)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	// the same clock: the offset is bounded by the half RTT
+	if o.RTT < 0 || o.Offset > o.RTT || -o.Offset > o.RTT {
+		t.Fatalf("unexpected time offset: %+v", o)
+	}
+	if stored, ok := SessionTimeOffset(sess); !ok || stored != o {
+		t.Fatalf("expect the offset stored into the session, got %+v", stored)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/henrylee2cn/goutil"
+	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// A tracing plugin for propagating the trace context through the packet metadata.
+
+// TraceparentMetaKey the metadata key carrying the trace context,
+// in the W3C Trace Context format: 00-<trace id>-<parent span id>-<flags>
+const TraceparentMetaKey = "traceparent"
+
+// Tracing creates a plugin that traces every PULL and PUSH,
+// starting a server span per handled one and a client span per launched one,
+// and passes the ended spans to the exporter, e.g. for bridging to OpenTelemetry.
+// Note:
+//  It should be passed to tp.NewPeer() as a global plugin,
+//  since the server spans are started by the router middleware added in PostNewPeer;
+//  The span of the handler is got by TracingSpan(ctx),
+//  and passed to the PULL or PUSH launched in the handler by ChildOf(span);
+//  The client span of a PULL is not exported if no reply is received.
+func Tracing(exporter SpanExporter) tp.Plugin {
+	if exporter == nil {
+		tp.Fatalf("tracing: exporter can not be nil")
+	}
+	return &tracing{exporter: exporter}
+}
+
+type (
+	// Span a traced PULL or PUSH.
+	Span struct {
+		// TraceId the 32 hex characters trace id
+		TraceId string
+		// SpanId the 16 hex characters span id
+		SpanId string
+		// ParentId the span id of the parent, empty for the root span
+		ParentId string
+		// Name e.g. "PULL /home/test"
+		Name string
+		// Kind SpanKindServer or SpanKindClient
+		Kind string
+		// Remote the remote address
+		Remote string
+		Start  time.Time
+		End    time.Time
+		// Code the code of the reply error, 0 means OK
+		Code int32
+	}
+	// SpanExporter exports the ended span.
+	SpanExporter func(*Span)
+	tracing      struct {
+		exporter SpanExporter
+	}
+)
+
+// Span kinds
+const (
+	SpanKindServer = "server"
+	SpanKindClient = "client"
+)
+
+var (
+	_ tp.PostNewPeerPlugin         = new(tracing)
+	_ tp.PreWritePullPlugin        = new(tracing)
+	_ tp.PreWritePushPlugin        = new(tracing)
+	_ tp.PostWritePushPlugin       = new(tracing)
+	_ tp.PostReadReplyHeaderPlugin = new(tracing)
+)
+
+const (
+	tracingServerKey = "_plugin_tracing_server"
+	tracingClientKey = "_plugin_tracing_client"
+)
+
+// TracingSpan returns the server span of the handler context.
+func TracingSpan(ctx interface{ Values() goutil.Map }) (*Span, bool) {
+	span, ok := ctx.Values().Load(tracingServerKey)
+	if !ok {
+		return nil, false
+	}
+	return span.(*Span), true
+}
+
+// ChildOf sets the span as the parent of the span of the PULL or PUSH to launch, e.g.
+//  span, _ := plugin.TracingSpan(ctx)
+//  ctx.Session().Pull("/aaa", args, reply, plugin.ChildOf(span))
+func ChildOf(span *Span) socket.PacketSetting {
+	return func(p *socket.Packet) {
+		if span != nil {
+			p.Meta().Set(TraceparentMetaKey, span.traceparent())
+		}
+	}
+}
+
+func (t *tracing) Name() string {
+	return "tracing"
+}
+
+func (t *tracing) PostNewPeer(peer tp.EarlyPeer) error {
+	peer.Router().Use(t.serve)
+	return nil
+}
+
+// serve is the middleware tracing the handler.
+func (t *tracing) serve(ctx tp.HandleCtx, next func() *tp.Rerror) *tp.Rerror {
+	span := newSpan(ctx.Input(), SpanKindServer, ctx.Session().RemoteAddr().String())
+	ctx.Values().Store(tracingServerKey, span)
+	rerr := next()
+	if rerr != nil {
+		span.Code = rerr.Code
+	}
+	span.End = time.Now()
+	t.exporter(span)
+	return rerr
+}
+
+func (t *tracing) PreWritePull(ctx tp.WriteCtx) *tp.Rerror {
+	t.startClient(ctx)
+	return nil
+}
+
+func (t *tracing) PostReadReplyHeader(ctx tp.ReadCtx) *tp.Rerror {
+	span, ok := ctx.Values().Load(tracingClientKey)
+	if !ok {
+		return nil
+	}
+	ctx.Values().Delete(tracingClientKey)
+	if rerr := tp.NewRerrorFromMeta(ctx.Input().Meta()); rerr != nil {
+		span.(*Span).Code = rerr.Code
+	}
+	t.endClient(span.(*Span))
+	return nil
+}
+
+func (t *tracing) PreWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	t.startClient(ctx)
+	return nil
+}
+
+func (t *tracing) PostWritePush(ctx tp.WriteCtx) *tp.Rerror {
+	if span, ok := ctx.Values().Load(tracingClientKey); ok {
+		ctx.Values().Delete(tracingClientKey)
+		t.endClient(span.(*Span))
+	}
+	return nil
+}
+
+// startClient starts the client span, and propagates it through the output metadata.
+func (t *tracing) startClient(ctx tp.WriteCtx) {
+	output := ctx.Output()
+	span := newSpan(output, SpanKindClient, ctx.Session().RemoteAddr().String())
+	output.Meta().Set(TraceparentMetaKey, span.traceparent())
+	ctx.Values().Store(tracingClientKey, span)
+}
+
+func (t *tracing) endClient(span *Span) {
+	span.End = time.Now()
+	t.exporter(span)
+}
+
+// newSpan starts a span, whose parent is carried by the packet metadata.
+func newSpan(packet *socket.Packet, kind, remote string) *Span {
+	span := &Span{
+		SpanId: randomHex(8),
+		Name:   tp.TypeText(packet.Ptype()) + " " + packet.Uri(),
+		Kind:   kind,
+		Remote: remote,
+		Start:  time.Now(),
+	}
+	if traceId, parentId, ok := parseTraceparent(string(packet.Meta().Peek(TraceparentMetaKey))); ok {
+		span.TraceId, span.ParentId = traceId, parentId
+	} else {
+		span.TraceId = randomHex(16)
+	}
+	return span
+}
+
+func (s *Span) traceparent() string {
+	return "00-" + s.TraceId + "-" + s.SpanId + "-01"
+}
+
+func parseTraceparent(s string) (traceId, parentId string, ok bool) {
+	a := strings.Split(s, "-")
+	if len(a) != 4 || len(a[1]) != 32 || len(a[2]) != 16 {
+		return "", "", false
+	}
+	return a[1], a[2], true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	tp "github.com/henrylee2cn/teleport"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, parentId, ok := parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !ok || traceId != "0af7651916cd43dd8448eb211c80319c" || parentId != "b7ad6b7169203331" {
+		t.Fatalf("unexpected %q, %q, %v", traceId, parentId, ok)
+	}
+	for _, s := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71-01",
+	} {
+		if _, _, ok := parseTraceparent(s); ok {
+			t.Fatalf("%q: expect invalid", s)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := make(chan *Span, 10)
+	exporter := func(span *Span) {
+		spans <- span
+	}
+	back := tp.NewPeer(tp.PeerConfig{}, Tracing(exporter))
+	defer back.Close()
+	back.RoutePullFuncAt("/back", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		return "", tp.NewRerror(100, "back error", "")
+	})
+	front := tp.NewPeer(tp.PeerConfig{}, Tracing(exporter))
+	defer front.Close()
+	backSess := dial(t, front, serve(t, back))
+	front.RoutePullFuncAt("/front", func(ctx tp.PullCtx, arg *string) (string, *tp.Rerror) {
+		span, ok := TracingSpan(ctx)
+		if !ok {
+			return "", tp.NewRerror(101, "no span", "")
+		}
+		var reply string
+		backSess.Pull("/back", *arg, &reply, ChildOf(span))
+		return *arg, nil
+	})
+	cli := tp.NewPeer(tp.PeerConfig{}, Tracing(exporter))
+	defer cli.Close()
+	sess := dial(t, cli, serve(t, front))
+	var reply string
+	if rerr := sess.Pull("/front", "a", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	have := make(map[string]*Span)
+	for i := 0; i < 4; i++ {
+		select {
+		case span := <-spans:
+			have[span.Kind+" "+span.Name] = span
+		case <-time.After(time.Second):
+			t.Fatalf("expect 4 spans, got %d", i)
+		}
+	}
+	root := have["client PULL /front"]
+	if root == nil || root.ParentId != "" || len(root.TraceId) != 32 || len(root.SpanId) != 16 {
+		t.Fatalf("unexpected root span: %+v", root)
+	}
+	// every span is the child of the previous one in the same trace
+	parent := root
+	for _, name := range []string{"server PULL /front", "client PULL /back", "server PULL /back"} {
+		span := have[name]
+		if span == nil || span.TraceId != root.TraceId || span.ParentId != parent.SpanId || span.End.Before(span.Start) {
+			t.Fatalf("%s: unexpected span %+v, parent: %+v", name, span, parent)
+		}
+		parent = span
+	}
+	if have["client PULL /back"].Code != 100 || have["server PULL /back"].Code != 100 || root.Code != 0 {
+		t.Fatal("expect the reply error code recorded")
+	}
+
+	// the PUSH span ends after writing
+	if rerr := sess.Push("/unknown", "b"); rerr != nil {
+		t.Fatal(rerr)
+	}
+	select {
+	case span := <-spans:
+		if span.Kind != SpanKindClient || span.Name != "PUSH /unknown" || span.ParentId != "" {
+			t.Fatalf("unexpected push span: %+v", span)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the push span")
+	}
+}
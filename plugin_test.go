@@ -0,0 +1,75 @@
+package tp
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// vetoPlugin vetoes the outgoing packets whose URI path starts with the prefix.
+type vetoPlugin struct {
+	prefix string
+}
+
+func (vetoPlugin) Name() string {
+	return "veto"
+}
+
+func (v vetoPlugin) veto(ctx WriteCtx) *Rerror {
+	if strings.HasPrefix(ctx.Output().Uri(), v.prefix) {
+		return NewRerror(CodeWriteRejected, CodeText(CodeWriteRejected), "vetoed")
+	}
+	return nil
+}
+
+func (v vetoPlugin) PreWritePull(ctx WriteCtx) *Rerror {
+	return v.veto(ctx)
+}
+
+func (v vetoPlugin) PreWritePush(ctx WriteCtx) *Rerror {
+	return v.veto(ctx)
+}
+
+func (v vetoPlugin) PreWriteReply(ctx WriteCtx) *Rerror {
+	return v.veto(ctx)
+}
+
+func TestPreWriteVeto(t *testing.T) {
+	var calls int32
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	handle := func(ctx PullCtx, arg *string) (string, *Rerror) {
+		atomic.AddInt32(&calls, 1)
+		return *arg, nil
+	}
+	srv.RoutePullFuncAt("/echo", handle)
+	srv.RoutePullFuncAt("/veto_reply", handle, vetoPlugin{"/veto_reply"})
+	srv.RoutePullFuncAt("/veto_pull", handle)
+	srv.RoutePushFuncAt("/veto_push", func(ctx PushCtx, arg *string) *Rerror {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{}, vetoPlugin{"/veto_p"})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply string
+	// the vetoed PULL and PUSH are never sent
+	if rerr := sess.Pull("/veto_pull", "a", &reply).Rerror(); rerr == nil || rerr.Code != CodeWriteRejected {
+		t.Fatalf("expect CodeWriteRejected, got %v", rerr)
+	}
+	if rerr := sess.Push("/veto_push", "a"); rerr == nil || rerr.Code != CodeWriteRejected {
+		t.Fatalf("expect CodeWriteRejected, got %v", rerr)
+	}
+	// the body of the vetoed reply is dropped, and the error is replied instead
+	if rerr := sess.Pull("/veto_reply", "b", &reply).Rerror(); rerr == nil || rerr.Code != CodeWriteRejected || reply != "" {
+		t.Fatalf("expect CodeWriteRejected without body, got %q, %v", reply, rerr)
+	}
+	if rerr := sess.Pull("/echo", "c", &reply).Rerror(); rerr != nil || reply != "c" {
+		t.Fatalf("expect c, got %q, %v", reply, rerr)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expect 2 handler calls, got %d", n)
+	}
+}
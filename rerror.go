@@ -1,9 +1,11 @@
 package tp
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"reflect"
 	"strconv"
+	"sync"
 	"unsafe"
 
 	"github.com/tidwall/gjson"
@@ -29,10 +31,8 @@ var (
 	_ json.Unmarshaler = new(Rerror)
 
 	reA = []byte(`{"code":`)
-	reB = []byte(`,"message":"`)
-	reC = []byte(`,"detail":"`)
-	reD = []byte(`"`)
-	reE = []byte(`\"`)
+	reB = []byte(`,"message":`)
+	reC = []byte(`,"detail":`)
 )
 
 // NewRerror creates a *Rerror.
@@ -82,6 +82,24 @@ func (r *Rerror) SetDetail(detail string) *Rerror {
 	return r
 }
 
+// SetDetailObject sets the detail field to the JSON of v, e.g. the field validation errors or the retry hints,
+// which can be decoded by DecodeDetail on the pulling side.
+// Note: If v can not be marshalled, the detail is set to the marshalling error text.
+func (r *Rerror) SetDetailObject(v interface{}) *Rerror {
+	b, err := json.Marshal(v)
+	if err != nil {
+		r.Detail = err.Error()
+	} else {
+		r.Detail = goutil.BytesToString(b)
+	}
+	return r
+}
+
+// DecodeDetail decodes the detail field set by SetDetailObject into v.
+func (r *Rerror) DecodeDetail(v interface{}) error {
+	return json.Unmarshal(goutil.StringToBytes(r.Detail), v)
+}
+
 // String prints error info.
 func (r *Rerror) String() string {
 	if r == nil {
@@ -99,18 +117,41 @@ func (r *Rerror) MarshalJSON() ([]byte, error) {
 	var b = append(reA, strconv.FormatInt(int64(r.Code), 10)...)
 	if len(r.Message) > 0 {
 		b = append(b, reB...)
-		b = append(b, bytes.Replace(goutil.StringToBytes(r.Message), reD, reE, -1)...)
-		b = append(b, '"')
+		b = appendJSONString(b, r.Message)
 	}
 	if len(r.Detail) > 0 {
 		b = append(b, reC...)
-		b = append(b, bytes.Replace(goutil.StringToBytes(r.Detail), reD, reE, -1)...)
-		b = append(b, '"')
+		b = appendJSONString(b, r.Detail)
 	}
 	b = append(b, '}')
 	return b, nil
 }
 
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as the JSON string,
+// escaping the double quotes, backslashes and control characters.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\n':
+			b = append(b, '\\', 'n')
+		case c == '\r':
+			b = append(b, '\\', 'r')
+		case c == '\t':
+			b = append(b, '\\', 't')
+		case c < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
 // UnmarshalJSON unmarshals a JSON description of self.
 func (r *Rerror) UnmarshalJSON(b []byte) error {
 	if r == nil {
@@ -139,7 +180,9 @@ func (r *Rerror) ToError() error {
 	return (*rerror)(unsafe.Pointer(r))
 }
 
-// ToRerror converts error to *Rerror
+// ToRerror converts error to *Rerror.
+// Note: the error value registered by RegisterErrorCode is converted to its code and message,
+// and the other ones are converted to CodeUnknownError.
 func ToRerror(err error) *Rerror {
 	if err == nil {
 		return nil
@@ -148,10 +191,54 @@ func ToRerror(err error) *Rerror {
 	if ok {
 		return r.toRerror()
 	}
+	if rerr := lookupErrorCode(err); rerr != nil {
+		return rerr.SetDetail(err.Error())
+	}
 	rerr := rerrUnknownError.Copy().SetDetail(err.Error())
 	return rerr
 }
 
+var errorCodes = struct {
+	m  map[error]Rerror
+	mu sync.RWMutex
+}{
+	m: map[error]Rerror{
+		context.DeadlineExceeded: {Code: CodeHandleTimeout, Message: CodeText(CodeHandleTimeout)},
+	},
+}
+
+// RegisterErrorCode registers the code and message of the error value, which are used by ToRerror, e.g.
+//  tp.RegisterErrorCode(sql.ErrNoRows, tp.CodeNotFound, "")
+// Note:
+//  If the message is empty, CodeText(code) is used;
+//  The error is matched by the equality, so it should be a comparable value, e.g. the one created by errors.New;
+//  context.DeadlineExceeded is registered as CodeHandleTimeout by default.
+func RegisterErrorCode(err error, code int32, message string) {
+	if err == nil || !reflect.TypeOf(err).Comparable() {
+		Fatalf("RegisterErrorCode: the error must be a comparable non-nil value, but have %T", err)
+	}
+	if len(message) == 0 {
+		message = CodeText(code)
+	}
+	errorCodes.mu.Lock()
+	errorCodes.m[err] = Rerror{Code: code, Message: message}
+	errorCodes.mu.Unlock()
+}
+
+// lookupErrorCode returns the copy of the Rerror registered for err, or nil if not registered.
+func lookupErrorCode(err error) *Rerror {
+	if !reflect.TypeOf(err).Comparable() {
+		return nil
+	}
+	errorCodes.mu.RLock()
+	r, ok := errorCodes.m[err]
+	errorCodes.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return &r
+}
+
 type rerror Rerror
 
 func (r *rerror) Error() string {
@@ -1,7 +1,10 @@
 package tp
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/henrylee2cn/teleport/utils"
@@ -34,3 +37,44 @@ func TestRerror(t *testing.T) {
 	newRerr = ToRerror(errors.New("text error"))
 	t.Logf("test ToRerror 3: %s", newRerr)
 }
+
+func TestRerrorDetailObject(t *testing.T) {
+	type fieldError struct {
+		Field  string `json:"field"`
+		Reason string `json:"reason"`
+	}
+	in := []fieldError{{Field: "name", Reason: "must not contain \"\\\" or\nnewlines"}}
+	rerr := NewRerror(422, "Invalid \"Args\"", "").SetDetailObject(in)
+	b, _ := rerr.MarshalJSON()
+	if !json.Valid(b) {
+		t.Fatalf("invalid JSON: %s", b)
+	}
+	meta := new(utils.Args)
+	rerr.SetToMeta(meta)
+	newRerr := NewRerrorFromMeta(meta)
+	if newRerr.Code != 422 || newRerr.Message != rerr.Message {
+		t.Fatalf("got %v", newRerr)
+	}
+	var out []fieldError
+	if err := newRerr.DecodeDetail(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("expect %v, got %v", in, out)
+	}
+}
+
+func TestRegisterErrorCode(t *testing.T) {
+	errNoUser := errors.New("no user")
+	RegisterErrorCode(errNoUser, CodeNotFound, "")
+	rerr := ToRerror(errNoUser)
+	if rerr.Code != CodeNotFound || rerr.Message != CodeText(CodeNotFound) || rerr.Detail != "no user" {
+		t.Fatalf("got %v", rerr)
+	}
+	if rerr = ToRerror(context.DeadlineExceeded); rerr.Code != CodeHandleTimeout {
+		t.Fatalf("got %v", rerr)
+	}
+	if rerr = ToRerror(errors.New("no user")); rerr.Code != CodeUnknownError {
+		t.Fatalf("got %v", rerr)
+	}
+}
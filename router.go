@@ -15,15 +15,19 @@
 package tp
 
 import (
+	"context"
+	"fmt"
 	"path"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/goutil/errors"
+	"github.com/henrylee2cn/teleport/codec"
 )
 
 /**
@@ -59,6 +63,9 @@ import (
  *  // register the pull route: /xx_zz
  *  peer.RoutePullFunc(XxZz)
  *
+ *  // or register the pull route by the specified URI path: /aaa/:id
+ *  peer.RoutePullFuncAt("/aaa/:id", XxZz)
+ *
  * 3. Push-Controller-Struct API template
  *
  *  type Bbb struct {
@@ -90,6 +97,9 @@ import (
  *  // register the push route: /yy_zz
  *  peer.RoutePushFunc(YyZz)
  *
+ *  // or register the push route by the specified URI path: /bbb/:id
+ *  peer.RoutePushFuncAt("/bbb/:id", YyZz)
+ *
  * 5. Unknown-Pull-Handler-Function API template
  *
  *  func XxxUnknownPull (ctx tp.UnknownPullCtx) (interface{}, *tp.Rerror) {
@@ -114,7 +124,55 @@ import (
  *  // register the unknown push route: /*
  *  peer.SetUnknownPush(XxxUnknownPush)
  *
- * 7. The mapping rule of struct(func) name to URI path:
+ * 7. Path parameters and wildcards:
+ *
+ * - `:name` matches one path segment, e.g. `/user/:id/profile/get`
+ * - `*name` matches one or more path segments, e.g. `/files/*filepath/get`
+ * - priority: static > param > wildcard, segment by segment
+ * - get the value by ctx.Param(name)
+ *
+ *  // register the pull route: /user/:id/profile/get
+ *  peer.SubRoute("/user/:id").RoutePull(new(Profile))
+ *
+ * 8. Middleware:
+ *
+ *  func Auth(ctx tp.HandleCtx, next func() *tp.Rerror) *tp.Rerror {
+ *      if len(ctx.PeekMeta("token")) == 0 {
+ *          return tp.NewRerror(401, "Unauthorized", "")
+ *      }
+ *      return next()
+ *  }
+ *
+ * - use it for the handlers registered later:
+ *
+ *  // for all handlers of the group
+ *  group := peer.SubRoute("/admin")
+ *  group.Use(Auth)
+ *
+ *  // only for the handlers of this registration
+ *  peer.Router().With(Auth).RoutePull(new(Aaa))
+ *
+ * - bound the execution time of the handlers, replying CodeHandleTimeout after the timeout:
+ *
+ *  peer.Router().With(tp.HandleTimeout(time.Second)).RoutePull(new(Aaa))
+ *
+ * - only accept the specified body codecs, replying CodeUnsupportedCodecType for the others before decoding:
+ *
+ *  peer.Router().RequireBodyCodec(codec.ID_PROTOBUF).RoutePull(new(Aaa))
+ *
+ * - limit the packet size lower than PeerConfig.MaxPacketSize, replying CodeBadPacket for the larger ones before decoding:
+ *
+ *  peer.Router().LimitPacketSize(4 << 10).RoutePull(new(Aaa))
+ *
+ * - execute the handlers on a dedicated goroutine pool, isolated from the shared one:
+ *
+ *  peer.Router().RunOn(tp.NewWorkerPool(64, time.Minute)).RoutePull(new(Aaa))
+ *
+ * - mark the handlers as deprecated, replying the X-Deprecated metadata with the sunset date and counting the callers:
+ *
+ *  peer.Router().Deprecate(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)).RoutePull(new(Aaa))
+ *
+ * 9. The mapping rule of struct(func) name to URI path:
  *
  * - `AaBb` -> `/aa_bb`
  * - `Aa_Bb` -> `/aa/bb`
@@ -130,16 +188,24 @@ type (
 	// Router the router of pull or push handlers.
 	Router struct {
 		subRouter *SubRouter
+		events    *EventBus // publishes EventRouteRegistered, nil if not created by a peer
 	}
 	// SubRouter without the SetUnknownPull and SetUnknownPush methods
 	SubRouter struct {
 		root        *Router
 		handlers    map[string]*Handler
+		patterns    *routePatterns
 		unknownPull **Handler
 		unknownPush **Handler
 		// only for register router
 		pathPrefix      string
 		pluginContainer *PluginContainer
+		middlewares     []Middleware
+		bodyCodecs      []byte
+		maxPacketSize   uint32
+		workerPool      *WorkerPool
+		deprecated      bool
+		sunset          time.Time
 	}
 	// Handler pull or push handler type info
 	Handler struct {
@@ -151,9 +217,20 @@ type (
 		unknownHandleFunc func(*handlerCtx)
 		pluginContainer   *PluginContainer
 		routerTypeName    string
+		middlewares       []Middleware
+		bodyCodecs        []byte            // the accepted body codecs, if empty, all are accepted
+		maxPacketSize     uint32            // the max size of the packet, if 0, no limit other than PeerConfig.MaxPacketSize
+		workerPool        *WorkerPool       // the dedicated goroutine pool, if nil, uses the shared one
+		deprecation       *routeDeprecation // nil means not deprecated
 	}
 	// HandlersMaker makes []*Handler
 	HandlersMaker func(string, interface{}, *PluginContainer) ([]*Handler, error)
+	// Middleware wraps the handler invocation, like HTTP middleware.
+	// Note:
+	//  Calling next invokes the next middleware or the handler at most once, and returns its error;
+	//  Returning error without calling next short-circuits the handling;
+	//  The returned error is the final handling error, and is replied for PULL.
+	Middleware func(ctx HandleCtx, next func() *Rerror) *Rerror
 )
 
 const (
@@ -169,6 +246,7 @@ func newRouter(rootGroup string, pluginContainer *PluginContainer) *Router {
 	root := &Router{
 		subRouter: &SubRouter{
 			handlers:        make(map[string]*Handler),
+			patterns:        new(routePatterns),
 			unknownPull:     new(*Handler),
 			unknownPush:     new(*Handler),
 			pathPrefix:      rootGroup,
@@ -201,11 +279,186 @@ func (r *SubRouter) SubRoute(pathPrefix string, plugin ...Plugin) *SubRouter {
 	return &SubRouter{
 		root:            r.root,
 		handlers:        r.handlers,
+		patterns:        r.patterns,
 		unknownPull:     r.unknownPull,
 		unknownPush:     r.unknownPush,
 		pathPrefix:      path.Join(r.pathPrefix, pathPrefix),
 		pluginContainer: pluginContainer,
+		middlewares:     r.copyMiddlewares(),
+		bodyCodecs:      r.bodyCodecs,
+		maxPacketSize:   r.maxPacketSize,
+		workerPool:      r.workerPool,
+		deprecated:      r.deprecated,
+		sunset:          r.sunset,
+	}
+}
+
+// Use appends middlewares for the handlers registered later.
+func (r *Router) Use(mw ...Middleware) {
+	r.subRouter.Use(mw...)
+}
+
+// Use appends middlewares for the handlers registered later, including those of sub routers created later.
+func (r *SubRouter) Use(mw ...Middleware) {
+	r.middlewares = append(r.middlewares, mw...)
+}
+
+// With returns a router with the same path prefix and the appended middlewares,
+// e.g. peer.Router().With(mw).RoutePull(new(Aaa))
+func (r *Router) With(mw ...Middleware) *SubRouter {
+	return r.subRouter.With(mw...)
+}
+
+// With returns a router with the same path prefix and the appended middlewares,
+// e.g. group.With(mw).RoutePull(new(Aaa))
+func (r *SubRouter) With(mw ...Middleware) *SubRouter {
+	sub := *r
+	sub.middlewares = append(r.copyMiddlewares(), mw...)
+	return &sub
+}
+
+// HandleTimeout returns a middleware bounding the execution time of the handlers, e.g.
+//  peer.Router().With(tp.HandleTimeout(time.Second)).RoutePull(new(Aaa))
+// Note:
+//  After the timeout, the context of the handler is canceled,
+//  and the PULL is replied with CodeHandleTimeout immediately, without the PreWriteReply plugins;
+//  The result of the handler returned after the timeout is discarded;
+//  A deferred reply is not bounded, once the handler has returned DeferReply,
+//  and its context is kept alive until the context is released after replying.
+func HandleTimeout(timeout time.Duration) Middleware {
+	return func(ctx HandleCtx, next func() *Rerror) *Rerror {
+		c, ok := ctx.(*handlerCtx)
+		if !ok {
+			return next()
+		}
+		if c.input.Ptype() != TypePull {
+			timeoutCtx, cancel := context.WithTimeout(c.Context(), timeout)
+			defer cancel()
+			c.setContext(timeoutCtx)
+			return next()
+		}
+		// the context is canceled at the timeout, or when released if the reply is deferred
+		handleCtx, cancel := context.WithCancel(c.Context())
+		c.setContext(handleCtx)
+		c.cancel = cancel
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		done := make(chan *Rerror, 1)
+		AnywayGo(func() {
+			defer func() {
+				if p := recover(); p != nil {
+					Errorf("panic:\n%v\n%s", p, goutil.PanicTrace(2))
+					done <- rerrInternalServerError
+				}
+			}()
+			done <- next()
+		})
+		select {
+		case rerr := <-done:
+			if rerr != DeferReply {
+				cancel()
+			}
+			return rerr
+		case <-timer.C:
+		}
+		cancel()
+		rerr := rerrHandleTimeout.Copy().SetDetail(fmt.Sprintf("exceeded %v", timeout))
+		c.abandon(rerr)
+		AnywayGo(func() {
+			<-done
+			c.abandonedReturned()
+		})
+		return rerr
+	}
+}
+
+// RequireBodyCodec returns a router with the same path prefix, whose handlers registered later
+// only accept the specified body codecs, e.g. peer.Router().RequireBodyCodec(codec.ID_PROTOBUF).RoutePull(new(Aaa))
+func (r *Router) RequireBodyCodec(codecId ...byte) *SubRouter {
+	return r.subRouter.RequireBodyCodec(codecId...)
+}
+
+// RequireBodyCodec returns a router with the same path prefix, whose handlers registered later
+// only accept the specified body codecs, e.g. group.RequireBodyCodec(codec.ID_PROTOBUF).RoutePull(new(Aaa))
+// Note:
+//  The packet with the other body codecs is rejected with CodeUnsupportedCodecType before decoding the body;
+//  If no codec is specified, all are accepted.
+func (r *SubRouter) RequireBodyCodec(codecId ...byte) *SubRouter {
+	sub := *r
+	sub.bodyCodecs = append([]byte(nil), codecId...)
+	return &sub
+}
+
+// LimitPacketSize returns a router with the same path prefix, whose handlers registered later
+// only accept the packets not larger than maxSize, e.g. peer.Router().LimitPacketSize(4 << 10).RoutePull(new(Aaa))
+func (r *Router) LimitPacketSize(maxSize uint32) *SubRouter {
+	return r.subRouter.LimitPacketSize(maxSize)
+}
+
+// LimitPacketSize returns a router with the same path prefix, whose handlers registered later
+// only accept the packets not larger than maxSize, e.g. group.LimitPacketSize(4 << 10).RoutePull(new(Aaa))
+// Note:
+//  The larger packet is replied with CodeBadPacket before decoding the body, and the session is kept;
+//  Since the route is unknown until the packet is read, it can only lower PeerConfig.MaxPacketSize;
+//  If maxSize is 0, no limit other than PeerConfig.MaxPacketSize.
+func (r *SubRouter) LimitPacketSize(maxSize uint32) *SubRouter {
+	sub := *r
+	sub.maxPacketSize = maxSize
+	return &sub
+}
+
+// RunOn returns a router with the same path prefix, whose handlers registered later
+// are executed on the dedicated goroutine pool, e.g. peer.Router().RunOn(reportPool).RoutePull(new(Report))
+func (r *Router) RunOn(workerPool *WorkerPool) *SubRouter {
+	return r.subRouter.RunOn(workerPool)
+}
+
+// RunOn returns a router with the same path prefix, whose handlers registered later
+// are executed on the dedicated goroutine pool, e.g. group.RunOn(reportPool).RoutePull(new(Report))
+// Note:
+//  It isolates the CPU-heavy handlers from the latency-sensitive ones, preventing the head-of-line blocking in the shared pool;
+//  If workerPool is nil, the shared pool set by SetGopool is used.
+func (r *SubRouter) RunOn(workerPool *WorkerPool) *SubRouter {
+	sub := *r
+	sub.workerPool = workerPool
+	return &sub
+}
+
+// Deprecate returns a router with the same path prefix, whose handlers registered later
+// are deprecated, e.g. peer.Router().Deprecate(sunset).RoutePull(new(OldApi))
+func (r *Router) Deprecate(sunset time.Time) *SubRouter {
+	return r.subRouter.Deprecate(sunset)
+}
+
+// Deprecate returns a router with the same path prefix, whose handlers registered later
+// are deprecated, e.g. group.Deprecate(sunset).RoutePull(new(OldApi))
+// Note:
+//  Every reply of the deprecated PULL carries the MetaDeprecated metadata with the sunset date, see GetDeprecatedSunset;
+//  The remaining callers are counted by the real IP, see Handler.Deprecation;
+//  If sunset is zero, the route is deprecated without a sunset date.
+func (r *SubRouter) Deprecate(sunset time.Time) *SubRouter {
+	sub := *r
+	sub.deprecated = true
+	sub.sunset = sunset
+	return &sub
+}
+
+// newDeprecation returns the deprecation of a handler registered by the router, nil if not deprecated.
+func (r *SubRouter) newDeprecation() *routeDeprecation {
+	if !r.deprecated {
+		return nil
+	}
+	return &routeDeprecation{
+		sunset:  r.sunset,
+		callers: make(map[string]uint64),
+	}
+}
+
+func (r *SubRouter) copyMiddlewares() []Middleware {
+	if len(r.middlewares) == 0 {
+		return nil
 	}
+	return append(make([]Middleware, 0, len(r.middlewares)), r.middlewares...)
 }
 
 // RoutePull registers PULL handlers, and returns the paths.
@@ -228,6 +481,17 @@ func (r *SubRouter) RoutePullFunc(pullHandleFunc interface{}, plugin ...Plugin)
 	return r.reg(pnPull, makePullHandlersFromFunc, pullHandleFunc, plugin)[0]
 }
 
+// RoutePullFuncAt registers PULL handler by the specified URI path, and returns the path.
+func (r *Router) RoutePullFuncAt(uriPath string, pullHandleFunc interface{}, plugin ...Plugin) string {
+	return r.subRouter.RoutePullFuncAt(uriPath, pullHandleFunc, plugin...)
+}
+
+// RoutePullFuncAt registers PULL handler by the specified URI path, and returns the path.
+// Note: the signature of pullHandleFunc is validated, as RoutePullFunc does.
+func (r *SubRouter) RoutePullFuncAt(uriPath string, pullHandleFunc interface{}, plugin ...Plugin) string {
+	return r.reg(pnPull, atUriPath(uriPath, makePullHandlersFromFunc), pullHandleFunc, plugin)[0]
+}
+
 // RoutePush registers PUSH handlers, and returns the paths.
 func (r *Router) RoutePush(pushCtrlStruct interface{}, plugin ...Plugin) []string {
 	return r.subRouter.RoutePush(pushCtrlStruct, plugin...)
@@ -248,6 +512,31 @@ func (r *SubRouter) RoutePushFunc(pushHandleFunc interface{}, plugin ...Plugin)
 	return r.reg(pnPush, makePushHandlersFromFunc, pushHandleFunc, plugin)[0]
 }
 
+// RoutePushFuncAt registers PUSH handler by the specified URI path, and returns the path.
+func (r *Router) RoutePushFuncAt(uriPath string, pushHandleFunc interface{}, plugin ...Plugin) string {
+	return r.subRouter.RoutePushFuncAt(uriPath, pushHandleFunc, plugin...)
+}
+
+// RoutePushFuncAt registers PUSH handler by the specified URI path, and returns the path.
+// Note: the signature of pushHandleFunc is validated, as RoutePushFunc does.
+func (r *SubRouter) RoutePushFuncAt(uriPath string, pushHandleFunc interface{}, plugin ...Plugin) string {
+	return r.reg(pnPush, atUriPath(uriPath, makePushHandlersFromFunc), pushHandleFunc, plugin)[0]
+}
+
+// atUriPath wraps the handler maker, replacing the path mapped from the function name with uriPath.
+func atUriPath(uriPath string, handlerMaker HandlersMaker) HandlersMaker {
+	return func(pathPrefix string, handleFunc interface{}, pluginContainer *PluginContainer) ([]*Handler, error) {
+		handlers, err := handlerMaker(pathPrefix, handleFunc, pluginContainer)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range handlers {
+			h.name = path.Join(pathPrefix, uriPath)
+		}
+		return handlers, nil
+	}
+}
+
 func (r *SubRouter) reg(
 	routerTypeName string,
 	handlerMaker func(string, interface{}, *PluginContainer) ([]*Handler, error),
@@ -266,12 +555,26 @@ func (r *SubRouter) reg(
 	}
 	var names []string
 	for _, h := range handlers {
-		if _, ok := r.handlers[h.name]; ok {
-			Fatalf("there is a handler conflict: %s", h.name)
-		}
 		h.routerTypeName = routerTypeName
-		r.handlers[h.name] = h
+		h.middlewares = r.copyMiddlewares()
+		h.bodyCodecs = r.bodyCodecs
+		h.maxPacketSize = r.maxPacketSize
+		h.workerPool = r.workerPool
+		h.deprecation = r.newDeprecation()
+		if isRoutePattern(h.name) {
+			if err = r.patterns.add(h); err != nil {
+				Fatalf("%v", err)
+			}
+		} else {
+			if _, ok := r.handlers[h.name]; ok {
+				Fatalf("there is a handler conflict: %s", h.name)
+			}
+			r.handlers[h.name] = h
+		}
 		pluginContainer.postReg(h)
+		if events := r.root.events; events != nil {
+			events.Publish(&Event{Type: EventRouteRegistered, Handler: h})
+		}
 		Printf("register %s handler: %s", routerTypeName, h.name)
 		names = append(names, h.name)
 	}
@@ -300,6 +603,12 @@ func (r *Router) SetUnknownPull(fn func(UnknownPullCtx) (interface{}, *Rerror),
 		},
 	}
 
+	h.middlewares = r.subRouter.copyMiddlewares()
+	h.bodyCodecs = r.subRouter.bodyCodecs
+	h.maxPacketSize = r.subRouter.maxPacketSize
+	h.workerPool = r.subRouter.workerPool
+	h.deprecation = r.subRouter.newDeprecation()
+
 	if *r.subRouter.unknownPull == nil {
 		Printf("set %s handler", h.name)
 	} else {
@@ -324,6 +633,12 @@ func (r *Router) SetUnknownPush(fn func(UnknownPushCtx) *Rerror, plugin ...Plugi
 		},
 	}
 
+	h.middlewares = r.subRouter.copyMiddlewares()
+	h.bodyCodecs = r.subRouter.bodyCodecs
+	h.maxPacketSize = r.subRouter.maxPacketSize
+	h.workerPool = r.subRouter.workerPool
+	h.deprecation = r.subRouter.newDeprecation()
+
 	if *r.subRouter.unknownPush == nil {
 		Printf("set %s handler", h.name)
 	} else {
@@ -332,26 +647,36 @@ func (r *Router) SetUnknownPush(fn func(UnknownPushCtx) *Rerror, plugin ...Plugi
 	r.subRouter.unknownPush = &h
 }
 
-func (r *SubRouter) getPull(uriPath string) (*Handler, bool) {
+// getPull gets the PULL handler by the URI path,
+// and appends the path parameters of the matched route pattern to params.
+func (r *SubRouter) getPull(uriPath string, params []routeParam) (*Handler, []routeParam, bool) {
 	t, ok := r.handlers[uriPath]
 	if ok {
-		return t, true
+		return t, params, true
+	}
+	if t, params, ok = r.patterns.match(uriPath, params); ok {
+		return t, params, true
 	}
 	if unknown := *r.unknownPull; unknown != nil {
-		return unknown, true
+		return unknown, params, true
 	}
-	return nil, false
+	return nil, params, false
 }
 
-func (r *SubRouter) getPush(uriPath string) (*Handler, bool) {
+// getPush gets the PUSH handler by the URI path,
+// and appends the path parameters of the matched route pattern to params.
+func (r *SubRouter) getPush(uriPath string, params []routeParam) (*Handler, []routeParam, bool) {
 	t, ok := r.handlers[uriPath]
 	if ok {
-		return t, true
+		return t, params, true
+	}
+	if t, params, ok = r.patterns.match(uriPath, params); ok {
+		return t, params, true
 	}
 	if unknown := *r.unknownPush; unknown != nil {
-		return unknown, true
+		return unknown, params, true
 	}
-	return nil, false
+	return nil, params, false
 }
 
 // Note: pullCtrlStruct needs to implement PullCtx interface.
@@ -873,6 +1198,94 @@ func (h *Handler) ReplyType() reflect.Type {
 	return h.reply
 }
 
+// BodyCodecs returns the accepted body codecs, if empty, all are accepted.
+func (h *Handler) BodyCodecs() []byte {
+	return h.bodyCodecs
+}
+
+// MaxPacketSize returns the max size of the packet, if 0, no limit other than PeerConfig.MaxPacketSize.
+func (h *Handler) MaxPacketSize() uint32 {
+	return h.maxPacketSize
+}
+
+// Deprecation returns the snapshot of the deprecation, nil if the handler is not deprecated.
+func (h *Handler) Deprecation() *RouteDeprecation {
+	if h.deprecation == nil {
+		return nil
+	}
+	return h.deprecation.snapshot()
+}
+
+// checkPacketSize checks whether the packet size exceeds the limit of the handler.
+func (h *Handler) checkPacketSize(size uint32) *Rerror {
+	if h.maxPacketSize == 0 || size <= h.maxPacketSize {
+		return nil
+	}
+	return rerrBadPacket.Copy().SetDetail(fmt.Sprintf("packet size %d exceeds the limit %d of %s", size, h.maxPacketSize, h.name))
+}
+
+// checkBodyCodec checks whether the body codec is accepted.
+func (h *Handler) checkBodyCodec(bodyCodec byte) *Rerror {
+	if len(h.bodyCodecs) == 0 {
+		return nil
+	}
+	for _, id := range h.bodyCodecs {
+		if id == bodyCodec {
+			return nil
+		}
+	}
+	name := fmt.Sprintf("%d", bodyCodec)
+	if c, err := codec.Get(bodyCodec); err == nil {
+		name = c.Name()
+	}
+	return rerrUnsupportedCodecType.Copy().SetDetail(fmt.Sprintf("body codec %s is not accepted by %s", name, h.name))
+}
+
+// invoke calls the handler wrapped by its middlewares.
+func (h *Handler) invoke(ctx *handlerCtx) {
+	if len(h.middlewares) == 0 {
+		h.call(ctx)
+		return
+	}
+	var (
+		i    int
+		next func() *Rerror
+	)
+	next = func() *Rerror {
+		if i == len(h.middlewares) {
+			i++
+			h.call(ctx)
+			return ctx.handleErr
+		}
+		if i > len(h.middlewares) {
+			return ctx.handleErr
+		}
+		mw := h.middlewares[i]
+		i++
+		return mw(ctx, next)
+	}
+	rerr := next()
+	if ctx.abandoned {
+		return
+	}
+	ctx.handleErr = rerr
+	if ctx.input.Ptype() == TypePull {
+		if rerr != nil {
+			rerr.SetToMeta(ctx.output.Meta())
+		} else {
+			ctx.output.Meta().Del(MetaRerror)
+		}
+	}
+}
+
+func (h *Handler) call(ctx *handlerCtx) {
+	if h.isUnknown {
+		h.unknownHandleFunc(ctx)
+	} else {
+		h.handleFunc(ctx, ctx.arg)
+	}
+}
+
 // IsPull checks if it is pull handler or not.
 func (h *Handler) IsPull() bool {
 	return h.routerTypeName == pnPull || h.routerTypeName == pnUnknownPull
@@ -892,3 +1305,270 @@ func (h *Handler) IsUnknown() bool {
 func (h *Handler) RouterTypeName() string {
 	return h.routerTypeName
 }
+
+type (
+	// routePatterns the handlers registered with path parameters or wildcards,
+	// in order of priority.
+	routePatterns struct {
+		list []*routePattern
+	}
+	routePattern struct {
+		handler  *Handler
+		segments []string
+		kinds    []byte
+		wildcard int // index of the wildcard segment, -1 means none
+		shape    string
+	}
+	routeParam struct {
+		key   string
+		value string
+	}
+)
+
+// the kinds of route pattern segments, in order of priority
+const (
+	segStatic byte = iota
+	segParam
+	segWildcard
+)
+
+func isRoutePattern(uriPath string) bool {
+	return strings.Contains(uriPath, "/:") || strings.Contains(uriPath, "/*")
+}
+
+func newRoutePattern(h *Handler) (*routePattern, error) {
+	p := &routePattern{
+		handler:  h,
+		segments: strings.Split(strings.TrimPrefix(h.name, "/"), "/"),
+		wildcard: -1,
+	}
+	p.kinds = make([]byte, len(p.segments))
+	shape := make([]string, len(p.segments))
+	keys := make(map[string]bool, len(p.segments))
+	for i, seg := range p.segments {
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			p.kinds[i] = segParam
+			shape[i] = ":"
+		case strings.HasPrefix(seg, "*"):
+			if p.wildcard >= 0 {
+				return nil, errors.Errorf("only one wildcard is allowed in the route: %s", h.name)
+			}
+			p.wildcard = i
+			p.kinds[i] = segWildcard
+			shape[i] = "*"
+		default:
+			shape[i] = seg
+			continue
+		}
+		key := seg[1:]
+		if len(key) == 0 {
+			return nil, errors.Errorf("the path parameter must have a name in the route: %s", h.name)
+		}
+		if keys[key] {
+			return nil, errors.Errorf("duplicate path parameter %q in the route: %s", key, h.name)
+		}
+		keys[key] = true
+		p.segments[i] = key
+	}
+	p.shape = "/" + strings.Join(shape, "/")
+	return p, nil
+}
+
+// add registers the handler whose name is a route pattern.
+func (r *routePatterns) add(h *Handler) error {
+	p, err := newRoutePattern(h)
+	if err != nil {
+		return err
+	}
+	i := len(r.list)
+	for j, q := range r.list {
+		if q.shape == p.shape {
+			return errors.Errorf("there is a handler conflict: %s, %s", h.name, q.handler.name)
+		}
+		if i == len(r.list) && p.before(q) {
+			i = j
+		}
+	}
+	r.list = append(r.list, nil)
+	copy(r.list[i+1:], r.list[i:])
+	r.list[i] = p
+	return nil
+}
+
+// before reports whether p takes precedence over q.
+func (p *routePattern) before(q *routePattern) bool {
+	for i := 0; i < len(p.kinds) && i < len(q.kinds); i++ {
+		if p.kinds[i] != q.kinds[i] {
+			return p.kinds[i] < q.kinds[i]
+		}
+	}
+	// the longer one is more specific, e.g. /files/*filepath/stat before /files/*filepath
+	return len(p.kinds) > len(q.kinds)
+}
+
+// match returns the handler of the first matched route pattern,
+// and appends its path parameters to params.
+func (r *routePatterns) match(uriPath string, params []routeParam) (*Handler, []routeParam, bool) {
+	if len(r.list) == 0 {
+		return nil, params, false
+	}
+	segments := strings.Split(strings.TrimPrefix(uriPath, "/"), "/")
+	n := len(params)
+	for _, p := range r.list {
+		var ok bool
+		if params, ok = p.match(segments, params[:n]); ok {
+			return p.handler, params, true
+		}
+	}
+	return nil, params[:n], false
+}
+
+func (p *routePattern) match(segments []string, params []routeParam) ([]routeParam, bool) {
+	if p.wildcard < 0 {
+		if len(segments) != len(p.segments) {
+			return params, false
+		}
+		return p.matchSegments(p.segments, p.kinds, segments, params)
+	}
+	w := p.wildcard
+	tail := len(p.segments) - w - 1
+	if len(segments) < len(p.segments) {
+		return params, false
+	}
+	var ok bool
+	if params, ok = p.matchSegments(p.segments[:w], p.kinds[:w], segments[:w], params); !ok {
+		return params, false
+	}
+	if params, ok = p.matchSegments(p.segments[w+1:], p.kinds[w+1:], segments[len(segments)-tail:], params); !ok {
+		return params, false
+	}
+	return append(params, routeParam{
+		key:   p.segments[w],
+		value: strings.Join(segments[w:len(segments)-tail], "/"),
+	}), true
+}
+
+func (p *routePattern) matchSegments(patterns []string, kinds []byte, segments []string, params []routeParam) ([]routeParam, bool) {
+	for i, seg := range segments {
+		if kinds[i] == segStatic {
+			if seg != patterns[i] {
+				return params, false
+			}
+			continue
+		}
+		if len(seg) == 0 {
+			return params, false
+		}
+		params = append(params, routeParam{key: patterns[i], value: seg})
+	}
+	return params, true
+}
+
+// UriFilter filters the inbound PULL and PUSH by URI path patterns,
+// before plugins, routing and body decoding, see Peer.SetUriFilter.
+type UriFilter struct {
+	allow []*routePattern
+	deny  []*routePattern
+}
+
+// NewUriFilter creates a filter of the inbound PULL and PUSH by URI path patterns,
+// in the same syntax as the routes, e.g. "/debug/*path", "/user/:id/delete".
+// Note:
+//  The path matching any deny pattern is dropped;
+//  if allow is not empty, the path matching no allow pattern is dropped too.
+func NewUriFilter(allow, deny []string) (*UriFilter, error) {
+	var (
+		f   UriFilter
+		err error
+	)
+	if f.allow, err = newUriPatterns(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = newUriPatterns(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func newUriPatterns(patterns []string) ([]*routePattern, error) {
+	list := make([]*routePattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := newRoutePattern(&Handler{name: path.Clean("/" + pattern)})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// Allow reports whether the inbound PULL or PUSH of the URI path is allowed.
+func (f *UriFilter) Allow(uriPath string) bool {
+	if f == nil {
+		return true
+	}
+	segments := strings.Split(strings.TrimPrefix(uriPath, "/"), "/")
+	for _, p := range f.deny {
+		if _, ok := p.match(segments, nil); ok {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if _, ok := p.match(segments, nil); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteDeprecation the snapshot of the deprecation of a route, see SubRouter.Deprecate.
+type RouteDeprecation struct {
+	// Sunset the date after which the route is retired, zero means unknown
+	Sunset time.Time `json:"sunset"`
+	// Calls the number of the calls since the peer started
+	Calls uint64 `json:"calls"`
+	// Callers the number of the calls by the real IP of the remaining callers
+	Callers map[string]uint64 `json:"callers"`
+}
+
+// routeDeprecation the deprecation of a route, counting the remaining callers.
+type routeDeprecation struct {
+	sunset  time.Time
+	calls   uint64
+	callers map[string]uint64
+	mu      sync.Mutex
+}
+
+// meta returns the value of the MetaDeprecated metadata.
+func (d *routeDeprecation) meta() string {
+	if d.sunset.IsZero() {
+		return "true"
+	}
+	return d.sunset.UTC().Format(time.RFC3339)
+}
+
+// observe counts the call of the caller.
+func (d *routeDeprecation) observe(realIp string) {
+	d.mu.Lock()
+	d.calls++
+	d.callers[realIp]++
+	d.mu.Unlock()
+}
+
+func (d *routeDeprecation) snapshot() *RouteDeprecation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	callers := make(map[string]uint64, len(d.callers))
+	for k, v := range d.callers {
+		callers[k] = v
+	}
+	return &RouteDeprecation{
+		Sunset:  d.sunset,
+		Calls:   d.calls,
+		Callers: callers,
+	}
+}
@@ -0,0 +1,344 @@
+package tp
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/codec"
+)
+
+func TestRoutePatterns(t *testing.T) {
+	var r routePatterns
+	for _, name := range []string{
+		"/files/*filepath",
+		"/user/:id/profile",
+		"/user/:id/:field",
+		"/user/admin/:field",
+		"/files/*filepath/stat",
+	} {
+		if err := r.add(&Handler{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.add(&Handler{name: "/user/:uid/profile"}); err == nil {
+		t.Fatal("expect conflict error")
+	}
+	if err := r.add(&Handler{name: "/a/:x/:x"}); err == nil {
+		t.Fatal("expect duplicate parameter error")
+	}
+	cases := []struct {
+		uriPath string
+		handler string
+		params  map[string]string
+	}{
+		{"/user/1/profile", "/user/:id/profile", map[string]string{"id": "1"}},
+		{"/user/1/email", "/user/:id/:field", map[string]string{"id": "1", "field": "email"}},
+		{"/user/admin/profile", "/user/admin/:field", map[string]string{"field": "profile"}},
+		{"/files/a/b.txt", "/files/*filepath", map[string]string{"filepath": "a/b.txt"}},
+		{"/files/a/b.txt/stat", "/files/*filepath/stat", map[string]string{"filepath": "a/b.txt"}},
+		{"/files", "", nil},
+		{"/user/1", "", nil},
+	}
+	for _, c := range cases {
+		h, params, ok := r.match(c.uriPath, nil)
+		if !ok {
+			if c.handler != "" {
+				t.Errorf("%s: not matched", c.uriPath)
+			}
+			continue
+		}
+		if h.name != c.handler {
+			t.Errorf("%s: matched %s, expect %s", c.uriPath, h.name, c.handler)
+			continue
+		}
+		if len(params) != len(c.params) {
+			t.Errorf("%s: params %v, expect %v", c.uriPath, params, c.params)
+		}
+		for _, p := range params {
+			if c.params[p.key] != p.value {
+				t.Errorf("%s: param %s=%s, expect %s", c.uriPath, p.key, p.value, c.params[p.key])
+			}
+		}
+	}
+}
+
+func testPullFuncAt(ctx PullCtx, _ *[]byte) ([]byte, *Rerror) {
+	return nil, nil
+}
+
+func TestRoutePullFuncAt(t *testing.T) {
+	r := newRouter("/", newPluginContainer())
+	g := r.SubRoute("group")
+	if name := g.RoutePullFuncAt("files/*filepath", testPullFuncAt); name != "/group/files/*filepath" {
+		t.Fatalf("registered %s, expect /group/files/*filepath", name)
+	}
+	h, params, ok := r.subRouter.getPull("/group/files/a/b.txt", nil)
+	if !ok || h.name != "/group/files/*filepath" {
+		t.Fatalf("not matched: %v", h)
+	}
+	if len(params) != 1 || params[0].value != "a/b.txt" {
+		t.Fatalf("params %v, expect filepath=a/b.txt", params)
+	}
+}
+
+func TestUriFilter(t *testing.T) {
+	f, err := NewUriFilter([]string{"/api/*path", "/health"}, []string{"/api/v1/*path", "/api/user/:id/delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		uriPath string
+		allow   bool
+	}{
+		{"/health", true},
+		{"/api/user/1", true},
+		{"/api/user/1/delete", false},
+		{"/api/v1/user", false},
+		{"/wp-login.php", false},
+	}
+	for _, c := range cases {
+		if allow := f.Allow(c.uriPath); allow != c.allow {
+			t.Fatalf("%s: expect %v, got %v", c.uriPath, c.allow, allow)
+		}
+	}
+	if _, err = NewUriFilter(nil, []string{"/a/*"}); err == nil {
+		t.Fatal("expect unnamed wildcard error")
+	}
+	if !(*UriFilter)(nil).Allow("/any") {
+		t.Fatal("expect the nil filter allows all")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+	checkTrace := func(want string) {
+		mu.Lock()
+		have := strings.Join(trace, ",")
+		trace = nil
+		mu.Unlock()
+		if have != want {
+			t.Fatalf("trace: want %q, have %q", want, have)
+		}
+	}
+	mark := func(name string) Middleware {
+		return func(ctx HandleCtx, next func() *Rerror) *Rerror {
+			record(name)
+			return next()
+		}
+	}
+	auth := func(ctx HandleCtx, next func() *Rerror) *Rerror {
+		if len(ctx.PeekMeta("token")) == 0 {
+			return NewRerror(CodeUnauthorized, "Unauthorized", "")
+		}
+		return next()
+	}
+	handle := func(ctx PullCtx, arg *int) (int, *Rerror) {
+		record("handler")
+		if *arg < 0 {
+			return 0, NewRerror(100, "negative", "")
+		}
+		return *arg, nil
+	}
+	pushed := make(chan struct{}, 1)
+
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	group := srv.SubRoute("/group")
+	group.Use(mark("group"))
+	group.With(mark("with"), auth).RoutePullFuncAt("/auth", handle)
+	group.RoutePullFuncAt("/plain", handle)
+	group.With(func(ctx HandleCtx, next func() *Rerror) *Rerror {
+		// calling next again never invokes the handler twice
+		next()
+		if rerr := next(); rerr != nil {
+			return NewRerror(CodeServiceUnavailable, "mapped", rerr.Message)
+		}
+		return nil
+	}).RoutePullFuncAt("/map", handle)
+	group.RoutePushFuncAt("/push", func(ctx PushCtx, arg *int) *Rerror {
+		record("push")
+		pushed <- struct{}{}
+		return nil
+	})
+	// only for the handlers registered later
+	group.Use(mark("late"))
+	group.RoutePullFuncAt("/late", handle)
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply int
+	if rerr := sess.Pull("/group/auth", 1, &reply, WithAddMeta("token", "t")).Rerror(); rerr != nil || reply != 1 {
+		t.Fatalf("expect 1, got %d, %v", reply, rerr)
+	}
+	checkTrace("group,with,handler")
+	// short-circuited without calling next
+	if rerr := sess.Pull("/group/auth", 1, &reply).Rerror(); rerr == nil || rerr.Code != CodeUnauthorized {
+		t.Fatalf("expect CodeUnauthorized, got %v", rerr)
+	}
+	checkTrace("group,with")
+	// With never changes the group
+	if rerr := sess.Pull("/group/plain", 2, &reply).Rerror(); rerr != nil || reply != 2 {
+		t.Fatalf("expect 2, got %d, %v", reply, rerr)
+	}
+	checkTrace("group,handler")
+	// the returned error is the final handling error
+	if rerr := sess.Pull("/group/map", -1, &reply).Rerror(); rerr == nil || rerr.Code != CodeServiceUnavailable || rerr.Detail != "negative" {
+		t.Fatalf("expect the mapped error, got %v", rerr)
+	}
+	checkTrace("group,handler")
+	if rerr := sess.Pull("/group/late", 3, &reply).Rerror(); rerr != nil || reply != 3 {
+		t.Fatalf("expect 3, got %d, %v", reply, rerr)
+	}
+	checkTrace("group,late,handler")
+	if rerr := sess.Push("/group/push", 4); rerr != nil {
+		t.Fatal(rerr)
+	}
+	<-pushed
+	checkTrace("group,push")
+}
+
+func TestHandleTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	returned := make(chan struct{})
+	pushDeadline := make(chan bool, 1)
+	deferErr := make(chan error, 1)
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	group := srv.Router().With(HandleTimeout(100 * time.Millisecond))
+	group.RoutePullFuncAt("/slow", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		defer close(returned)
+		<-ctx.Context().Done()
+		close(canceled)
+		time.Sleep(50 * time.Millisecond)
+		return *arg, nil
+	})
+	group.RoutePullFuncAt("/fast", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		return *arg, nil
+	})
+	group.RoutePullFuncAt("/defer", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			deferErr <- ctx.Context().Err()
+			ctx.Reply(*arg, nil)
+		}()
+		return 0, DeferReply
+	})
+	group.RoutePushFuncAt("/push", func(ctx PushCtx, arg *int) *Rerror {
+		_, ok := ctx.Context().Deadline()
+		pushDeadline <- ok
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply int
+	start := time.Now()
+	rerr := sess.Pull("/slow", 1, &reply).Rerror()
+	if rerr == nil || rerr.Code != CodeHandleTimeout {
+		t.Fatalf("expect CodeHandleTimeout, got %v", rerr)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("expect replied at the timeout, got %v", cost)
+	}
+	<-canceled
+	// the result of the abandoned handler is discarded
+	<-returned
+	if rerr = sess.Pull("/fast", 2, &reply).Rerror(); rerr != nil || reply != 2 {
+		t.Fatalf("expect 2, got %d, %v", reply, rerr)
+	}
+	// the deferred reply is not bounded
+	if rerr = sess.Pull("/defer", 3, &reply).Rerror(); rerr != nil || reply != 3 {
+		t.Fatalf("expect 3, got %d, %v", reply, rerr)
+	}
+	if err := <-deferErr; err != nil {
+		t.Fatalf("expect the context of the deferred reply alive, got %v", err)
+	}
+	// the PUSH handler is bounded by the context only
+	if rerr = sess.Push("/push", 4); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if !<-pushDeadline {
+		t.Fatal("expect the deadline of the PUSH context")
+	}
+}
+
+func TestRequireBodyCodec(t *testing.T) {
+	var pushed int32
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	strict := srv.SubRoute("/strict").RequireBodyCodec(codec.ID_PROTOBUF, codec.ID_PLAIN)
+	strict.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	strict.RoutePushFuncAt("/notify", func(ctx PushCtx, arg *string) *Rerror {
+		atomic.AddInt32(&pushed, 1)
+		return nil
+	})
+	// the codecs of the parent router are not changed
+	srv.SubRoute("/strict").RoutePullFuncAt("/any", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	strict.RequireBodyCodec().RoutePullFuncAt("/all", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	for _, c := range []struct {
+		uri       string
+		bodyCodec byte
+		accepted  bool
+	}{
+		{"/strict/echo", codec.ID_PLAIN, true},
+		{"/strict/echo", codec.ID_JSON, false},
+		{"/strict/any", codec.ID_JSON, true},
+		{"/strict/all", codec.ID_JSON, true},
+	} {
+		var reply string
+		rerr := sess.Pull(c.uri, "a", &reply, WithBodyCodec(c.bodyCodec)).Rerror()
+		if c.accepted {
+			if rerr != nil || reply != "a" {
+				t.Fatalf("%s %c: expect accepted, got %q, %v", c.uri, c.bodyCodec, reply, rerr)
+			}
+			continue
+		}
+		if rerr == nil || rerr.Code != CodeUnsupportedCodecType || !strings.Contains(rerr.Detail, "/strict/echo") {
+			t.Fatalf("%s %c: expect CodeUnsupportedCodecType, got %v", c.uri, c.bodyCodec, rerr)
+		}
+	}
+
+	// the rejected push is not handled, but counted
+	if rerr := sess.Push("/strict/notify", "a", WithBodyCodec(codec.ID_JSON)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if rerr := sess.Push("/strict/notify", "a", WithBodyCodec(codec.ID_PLAIN)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	var stats ProtocolStats
+	for i := 0; i < 100; i++ {
+		if stats = srv.ProtocolStats(); stats.CodecMismatches == 2 && atomic.LoadInt32(&pushed) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.CodecMismatches != 2 || atomic.LoadInt32(&pushed) != 1 {
+		t.Fatalf("expect 2 mismatches and 1 handled push, got %d and %d", stats.CodecMismatches, atomic.LoadInt32(&pushed))
+	}
+}
@@ -15,16 +15,19 @@
 package tp
 
 import (
-	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/goutil/coarsetime"
@@ -76,6 +79,9 @@ type (
 		SetSessionAge(duration time.Duration)
 		// SetContextAge sets PULL or PUSH context max age.
 		SetContextAge(duration time.Duration)
+		// SetTenant sets the tenant identity extracted at handshake, e.g. in the auth plugin,
+		// which tags the run logs, metrics and stats of the session.
+		SetTenant(tenant string)
 	}
 	// BaseSession a connection session with the common method set.
 	BaseSession interface {
@@ -89,6 +95,8 @@ type (
 		RemoteAddr() net.Addr
 		// Swap returns custom data swap of the session(socket).
 		Swap() goutil.Map
+		// Tenant returns the tenant identity, empty if not set.
+		Tenant() string
 	}
 	// Session a connection session.
 	Session interface {
@@ -99,6 +107,9 @@ type (
 		Close() error
 		// Health checks if the session is usable.
 		Health() bool
+		// Draining reports whether the remote peer has notified that it is draining, by pushing DrainUri.
+		// Note: The draining session is still usable until the deadline, but the new calls should go elsewhere.
+		Draining() bool
 		// AsyncPull sends a packet and receives reply asynchronously.
 		// If the args is []byte or *[]byte type, it can automatically fill in the body codec name.
 		AsyncPull(
@@ -118,10 +129,45 @@ type (
 		// If the args is []byte or *[]byte type, it can automatically fill in the body codec name;
 		// If the session is a client role and PeerConfig.RedialTimes>0, it is automatically re-called once after a failure.
 		Push(uri string, args interface{}, setting ...socket.PacketSetting) *Rerror
+		// PushAck sends a packet, and waits for the acknowledgement carrying the status,
+		// which is sent back by the remote peer after its push handler returns.
+		// Note:
+		// If the timeout<=0, waits until acknowledged or disconnected;
+		// If no acknowledgement is received within the timeout, returns the CodeAckTimeout error.
+		PushAck(uri string, args interface{}, timeout time.Duration, setting ...socket.PacketSetting) *Rerror
+		// AsyncPushAck sends a packet, and returns the receipt tracking its delivery status.
+		// Note: the receipt is finished when acknowledged or disconnected, see PushReceipt.
+		AsyncPushAck(uri string, args interface{}, setting ...socket.PacketSetting) *PushReceipt
+		// Ping sends a protocol-level ping frame, and returns the round-trip time when the pong is received,
+		// which is also recorded into Stats().
+		// Note:
+		// The remote peer replies the ping without any handler or plugin;
+		// If the ctx is done before the pong, returns the CodePullTimeout error.
+		Ping(ctx context.Context) (time.Duration, *Rerror)
 		// SessionAge returns the session max age.
 		SessionAge() time.Duration
 		// ContextAge returns PULL or PUSH context max age.
 		ContextAge() time.Duration
+		// Stats returns the network quality statistics of the session.
+		Stats() *SessionStats
+		// WriteQueueLen returns the number of the pending writes,
+		// including the one being written.
+		// Note: it is always 0 if PeerConfig.MaxWriteQueue<=0.
+		WriteQueueLen() int
+		// Pause stops dispatching the inbound PULL and PUSH to the handlers until Resume,
+		// e.g. to quiesce the processing during a hot data migration without dropping the connection.
+		// Note:
+		// The paused ones are buffered up to PeerConfig.MaxPausedPackets, beyond which the reading blocks;
+		// The replies, acknowledgements and pings are still processed;
+		// Closing the session resumes it.
+		Pause()
+		// Resume dispatches the buffered PULL and PUSH in order, and continues dispatching the new ones.
+		Resume()
+		// Paused reports whether the session is paused.
+		Paused() bool
+		// DebugDump returns a structured snapshot of the session for diagnosing the stuck one,
+		// including the pending pulls with age, the queue depths, the recent packets and the timers.
+		DebugDump() *SessionDump
 	}
 )
 
@@ -132,18 +178,24 @@ var (
 )
 
 type session struct {
+	seq                            uint64 // the first field for the 64-bit atomic alignment
+	queueFullSince                 int64  // the unix nano time since when the write queue is full, 0 means not full
 	peer                           *peer
-	getPullHandler, getPushHandler func(uriPath string) (*Handler, bool)
+	getPullHandler, getPushHandler func(uriPath string, params []routeParam) (*Handler, []routeParam, bool)
 	timeSince                      func(time.Time) time.Duration
 	timeNow                        func() time.Time
-	seq                            uint64
-	seqLock                        sync.Mutex
 	pullCmdMap                     goutil.Map
+	pushAckMap                     goutil.Map // seq -> *PushReceipt
+	pingMap                        goutil.Map // seq -> chan *Rerror
 	protoFuncs                     []socket.ProtoFunc
 	socket                         socket.Socket
 	status                         int32 // 0:ok, 1:active closed, 2:disconnect
 	statusLock                     sync.Mutex
-	writeLock                      sync.Mutex
+	writeLock                      chan struct{} // held while writing, a channel so that the waiting PUSH can be dropped
+	writeQueue                     chan struct{} // the tokens of the pending writes, nil means no limit
+	queuedPushes                   *list.List    // the PUSHs waiting in the write queue, only for SlowConsumerDropOldestPush
+	queuedPushesLock               sync.Mutex
+	slowConsumer                   int32 // 1 means the slow consumer has been handled in the current full period
 	graceCtxWaitGroup              sync.WaitGroup
 	gracePullCmdWaitGroup          sync.WaitGroup
 	sessionAge                     time.Duration
@@ -154,21 +206,51 @@ type session struct {
 	lock                           sync.RWMutex
 	// only for client role
 	redialForClientLocked func(oldConn net.Conn) bool
+	rejected              atomic.Value // *Rerror, the reason why the remote peer rejects the connection
+	stats                 SessionStats
+	startTime             time.Time
+	tenant                atomic.Value // string
+	draining              int32        // 1 if the remote peer has pushed DrainUri
+	readDeadline          int64        // the unix nano time of the read deadline set by SessionAge, 0 means none
+	recentPackets         packetTraces
+	dispatch              func(func()) bool // executes the handlers, Go by default
+	orderedWriting        chan struct{}     // closed when the last ordered packet is written
+	orderedWritingLock    sync.Mutex
+	orderedHandling       chan struct{} // closed when the last ordered packet is handled, only for the reading goroutine
+	paused                bool
+	pausedDispatches      []func()      // the dispatches of the PULL and PUSH read while paused
+	resumed               chan struct{} // closed when resumed
+	pauseLock             sync.Mutex
 }
 
 func newSession(peer *peer, conn net.Conn, protoFuncs []socket.ProtoFunc) *session {
+	protoFuncs = peer.withDefaultProtoFunc(protoFuncs)
 	var s = &session{
 		peer:           peer,
-		getPullHandler: peer.router.subRouter.getPull,
-		getPushHandler: peer.router.subRouter.getPush,
+		getPullHandler: peer.getPull,
+		getPushHandler: peer.getPush,
 		timeSince:      peer.timeSince,
 		timeNow:        peer.timeNow,
 		conn:           conn,
 		protoFuncs:     protoFuncs,
 		socket:         socket.NewSocket(conn, protoFuncs...),
 		pullCmdMap:     goutil.AtomicMap(),
+		pushAckMap:     goutil.AtomicMap(),
+		pingMap:        goutil.AtomicMap(),
+		writeLock:      make(chan struct{}, 1),
 		sessionAge:     peer.defaultSessionAge,
 		contextAge:     peer.defaultContextAge,
+		startTime:      time.Now(),
+	}
+	s.dispatch = Go
+	if peer.dispatch != nil {
+		s.dispatch = peer.dispatch.shard()
+	}
+	if peer.maxWriteQueue > 0 {
+		s.writeQueue = make(chan struct{}, peer.maxWriteQueue)
+		if peer.slowConsumerAge > 0 && peer.slowConsumerPolicy == SlowConsumerDropOldestPush {
+			s.queuedPushes = list.New()
+		}
 	}
 	return s
 }
@@ -194,6 +276,7 @@ func (s *session) SetId(newId string) {
 	hub.Set(s)
 	hub.Delete(oldId)
 	Tracef("session changes id: %s -> %s", oldId, newId)
+	s.peer.pluginContainer.postChangeId(s, oldId)
 }
 
 // ControlFD invokes f on the underlying connection's file
@@ -272,6 +355,18 @@ func (s *session) RemoteAddr() net.Addr {
 	return s.socket.RemoteAddr()
 }
 
+// SetTenant sets the tenant identity extracted at handshake, e.g. in the auth plugin,
+// which tags the run logs, metrics and stats of the session.
+func (s *session) SetTenant(tenant string) {
+	s.tenant.Store(tenant)
+}
+
+// Tenant returns the tenant identity, empty if not set.
+func (s *session) Tenant() string {
+	tenant, _ := s.tenant.Load().(string)
+	return tenant
+}
+
 // SessionAge returns the session max age.
 func (s *session) SessionAge() time.Duration {
 	s.sessionAgeLock.RLock()
@@ -314,10 +409,7 @@ func (s *session) SetContextAge(duration time.Duration) {
 func (s *session) Send(uri string, body interface{}, rerr *Rerror, setting ...socket.PacketSetting) *Rerror {
 	output := socket.GetPacket(setting...)
 	if len(output.Seq()) == 0 {
-		s.seqLock.Lock()
-		output.SetSeq(strconv.FormatUint(s.seq, 10))
-		s.seq++
-		s.seqLock.Unlock()
+		output.SetSeq(s.nextSeq())
 	}
 	if output.BodyCodec() == codec.NilCodecId {
 		output.SetBodyCodec(s.peer.defaultBodyCodec)
@@ -397,11 +489,8 @@ func (s *session) AsyncPull(
 
 	seq := output.Seq()
 	if len(seq) == 0 {
-		s.seqLock.Lock()
-		seq = strconv.FormatUint(s.seq, 10)
+		seq = s.nextSeq()
 		output.SetSeq(seq)
-		s.seq++
-		s.seqLock.Unlock()
 	}
 
 	if output.BodyCodec() == codec.NilCodecId {
@@ -419,20 +508,15 @@ func (s *session) AsyncPull(
 		pullCmdChan: pullCmdChan,
 		doneChan:    make(chan struct{}),
 		start:       s.peer.timeNow(),
-		swap:        goutil.RwMap(),
+		deadline:    s.pullDeadline(),
 		inputMeta:   utils.AcquireArgs(),
 	}
+	cmd.swapCow.reset(s.socket.Swap())
+	cmd.swap = &cmd.swapCow
 
 	// count pull-launch
 	s.gracePullCmdWaitGroup.Add(1)
 
-	if s.socket.SwapLen() > 0 {
-		s.socket.Swap().Range(func(key, value interface{}) bool {
-			cmd.swap.Store(key, value)
-			return true
-		})
-	}
-
 	cmd.mu.Lock()
 	defer cmd.mu.Unlock()
 
@@ -451,18 +535,45 @@ func (s *session) AsyncPull(
 	}
 	var usedConn net.Conn
 W:
-	if usedConn, cmd.rerr = s.write(output); cmd.rerr != nil {
+	if usedConn, cmd.rerr = s.writeTraced(output, &cmd.writeLocked); cmd.rerr != nil {
 		if cmd.rerr == rerrConnClosed && s.redialForClient(usedConn) {
 			goto W
 		}
 		cmd.done()
 		return cmd
 	}
+	cmd.written = s.timeNow()
 
 	s.peer.pluginContainer.postWritePull(cmd)
 	return cmd
 }
 
+// pullDeadline returns the time after which the waiting PULL is swept,
+// or zero time if PeerConfig.MaxPullAge is not set.
+func (s *session) pullDeadline() time.Time {
+	if s.peer.maxPullAge <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.peer.maxPullAge)
+}
+
+// sweepPullCmds fails the PULLs that are still waiting for the reply after the deadline.
+func (s *session) sweepPullCmds(now time.Time) {
+	s.pullCmdMap.Range(func(_, v interface{}) bool {
+		pullCmd := v.(*pullCmd)
+		if pullCmd.deadline.IsZero() || now.Before(pullCmd.deadline) {
+			return true
+		}
+		pullCmd.mu.Lock()
+		if pullCmd.isPending() {
+			Warnf("pull timeout (addr:%s, seq:%s, uri:%s)", s.RemoteAddr().String(), pullCmd.output.Seq(), pullCmd.output.Uri())
+			pullCmd.timeout()
+		}
+		pullCmd.mu.Unlock()
+		return true
+	})
+}
+
 // Pull sends a packet and receives reply.
 // Note:
 // If the args is []byte or *[]byte type, it can automatically fill in the body codec name;
@@ -492,10 +603,7 @@ func (s *session) Push(uri string, args interface{}, setting ...socket.PacketSet
 	}
 
 	if len(output.Seq()) == 0 {
-		s.seqLock.Lock()
-		output.SetSeq(strconv.FormatUint(s.seq, 10))
-		s.seq++
-		s.seqLock.Unlock()
+		output.SetSeq(s.nextSeq())
 	}
 
 	if output.BodyCodec() == codec.NilCodecId {
@@ -531,6 +639,231 @@ W:
 	return nil
 }
 
+// PushAck sends a packet, and waits for the acknowledgement carrying the status,
+// which is sent back by the remote peer after its push handler returns.
+// Note:
+// If the timeout<=0, waits until acknowledged or disconnected;
+// If no acknowledgement is received within the timeout, returns the CodeAckTimeout error.
+func (s *session) PushAck(uri string, args interface{}, timeout time.Duration, setting ...socket.PacketSetting) *Rerror {
+	receipt := s.AsyncPushAck(uri, args, setting...)
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	select {
+	case <-receipt.done:
+		return receipt.rerr
+	case <-timeoutChan:
+		s.pushAckMap.Delete(receipt.seq)
+		return rerrAckTimeout.Copy().SetDetail(fmt.Sprintf("no acknowledgement after %v", timeout))
+	}
+}
+
+// AsyncPushAck sends a packet, and returns the receipt tracking its delivery status.
+// Note:
+// The receipt is finished when acknowledged or disconnected,
+// if the remote peer never acknowledges, it is tracked until the session is disconnected.
+func (s *session) AsyncPushAck(uri string, args interface{}, setting ...socket.PacketSetting) *PushReceipt {
+	seq := s.nextSeq()
+	receipt := &PushReceipt{
+		seq:    seq,
+		status: int32(DeliverySent),
+		done:   make(chan struct{}),
+	}
+	s.pushAckMap.Store(seq, receipt)
+
+	setting = append(setting, socket.WithSeq(seq), WithPushAck())
+	if rerr := s.Push(uri, args, setting...); rerr != nil {
+		s.pushAckMap.Delete(seq)
+		receipt.finish(rerr)
+	}
+	return receipt
+}
+
+// ackPush sends the acknowledgement of the push back to the remote peer.
+func (s *session) ackPush(seq string, rerr *Rerror) {
+	output := socket.GetPacket(socket.WithPtype(TypePushAck), socket.WithSeq(seq))
+	if rerr != nil {
+		rerr.SetToMeta(output.Meta())
+	}
+	if _, werr := s.write(output); werr != nil {
+		Debugf("ack push(%s, seq:%s) fail: %s", s.RemoteAddr().String(), seq, werr.String())
+	}
+	socket.PutPacket(output)
+}
+
+// receivePushAck finishes the receipt of the acknowledged push.
+func (s *session) receivePushAck(seq string, rerr *Rerror) {
+	v, ok := s.pushAckMap.Load(seq)
+	if !ok {
+		return
+	}
+	s.pushAckMap.Delete(seq)
+	v.(*PushReceipt).finish(rerr)
+}
+
+// failPushAcks fails the pushes that are waiting for the acknowledgement after disconnection.
+func (s *session) failPushAcks() {
+	s.pushAckMap.Range(func(k, _ interface{}) bool {
+		s.receivePushAck(k.(string), rerrConnClosed)
+		return true
+	})
+}
+
+// Ping sends a protocol-level ping frame, and returns the round-trip time when the pong is received,
+// which is also recorded into Stats().
+// Note:
+// The remote peer replies the ping without any handler or plugin;
+// If the ctx is done before the pong, returns the CodePullTimeout error.
+func (s *session) Ping(ctx context.Context) (time.Duration, *Rerror) {
+	seq := s.nextSeq()
+	pongChan := make(chan *Rerror, 1)
+	s.pingMap.Store(seq, pongChan)
+	defer s.pingMap.Delete(seq)
+
+	output := socket.GetPacket(socket.WithPtype(TypePing), socket.WithSeq(seq), socket.WithContext(ctx))
+	defer socket.PutPacket(output)
+	start := time.Now()
+	if _, rerr := s.write(output); rerr != nil {
+		return 0, rerr
+	}
+	select {
+	case rerr := <-pongChan:
+		if rerr != nil {
+			return 0, rerr
+		}
+		rtt := time.Since(start)
+		s.stats.ObserveRTT(rtt)
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, rerrPullTimeout.Copy().SetDetail(ctx.Err().Error())
+	}
+}
+
+// pong replies the ping of the remote peer.
+func (s *session) pong(seq string) {
+	output := socket.GetPacket(socket.WithPtype(TypePong), socket.WithSeq(seq))
+	if _, werr := s.write(output); werr != nil {
+		Debugf("pong(%s, seq:%s) fail: %s", s.RemoteAddr().String(), seq, werr.String())
+	}
+	socket.PutPacket(output)
+}
+
+// receivePong finishes the ping waiting for the pong.
+func (s *session) receivePong(seq string, rerr *Rerror) {
+	v, ok := s.pingMap.Load(seq)
+	if !ok {
+		return
+	}
+	s.pingMap.Delete(seq)
+	select {
+	case v.(chan *Rerror) <- rerr:
+	default:
+	}
+}
+
+// failPings fails the pings that are waiting for the pong after disconnection.
+func (s *session) failPings() {
+	s.pingMap.Range(func(k, _ interface{}) bool {
+		s.receivePong(k.(string), rerrConnClosed)
+		return true
+	})
+}
+
+type (
+	// PushReceipt the receipt tracking the delivery status of an acknowledged push.
+	// Note: It is concurrent safe.
+	PushReceipt struct {
+		seq    string
+		status int32
+		rerr   *Rerror
+		done   chan struct{}
+		once   sync.Once
+	}
+	// DeliveryStatus the delivery status of an acknowledged push.
+	DeliveryStatus int32
+)
+
+// Delivery statuses
+const (
+	// DeliverySent the push is sent, and is waiting for the acknowledgement
+	DeliverySent DeliveryStatus = iota
+	// DeliveryDelivered the push is acknowledged, and its handler returned OK
+	DeliveryDelivered
+	// DeliveryFailed the push failed to be written, the remote handler returned error,
+	// or the session is disconnected before the acknowledgement
+	DeliveryFailed
+)
+
+// String returns the text of the delivery status.
+func (d DeliveryStatus) String() string {
+	switch d {
+	case DeliverySent:
+		return "sent"
+	case DeliveryDelivered:
+		return "delivered"
+	case DeliveryFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Seq returns the packet sequence of the push.
+func (r *PushReceipt) Seq() string {
+	return r.seq
+}
+
+// Status returns the current delivery status.
+func (r *PushReceipt) Status() DeliveryStatus {
+	return DeliveryStatus(atomic.LoadInt32(&r.status))
+}
+
+// Done returns the channel that is closed when the delivery status is final.
+func (r *PushReceipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Rerror returns the error of the failed delivery, only valid after Done.
+func (r *PushReceipt) Rerror() *Rerror {
+	select {
+	case <-r.done:
+		return r.rerr
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the final delivery status, and returns the error of the failed delivery.
+// If the ctx is done first, returns the CodeAckTimeout error, and the receipt is still tracked.
+func (r *PushReceipt) Wait(ctx context.Context) *Rerror {
+	select {
+	case <-r.done:
+		return r.rerr
+	case <-ctx.Done():
+		return rerrAckTimeout.Copy().SetDetail(ctx.Err().Error())
+	}
+}
+
+func (r *PushReceipt) finish(rerr *Rerror) {
+	r.once.Do(func() {
+		r.rerr = rerr
+		if rerr == nil {
+			atomic.StoreInt32(&r.status, int32(DeliveryDelivered))
+		} else {
+			atomic.StoreInt32(&r.status, int32(DeliveryFailed))
+		}
+		close(r.done)
+	})
+}
+
+// nextSeq returns the next packet sequence of the session, which is concurrent safe.
+func (s *session) nextSeq() string {
+	return strconv.FormatUint(atomic.AddUint64(&s.seq, 1)-1, 10)
+}
+
 // Swap returns custom data swap of the session(socket).
 func (s *session) Swap() goutil.Map {
 	return s.socket.Swap()
@@ -543,6 +876,21 @@ const (
 	statusPassiveClosed int32 = 3
 )
 
+// Stats returns the network quality statistics of the session.
+func (s *session) Stats() *SessionStats {
+	return &s.stats
+}
+
+// Draining reports whether the remote peer has notified that it is draining, by pushing DrainUri.
+// Note: The draining session is still usable until the deadline, but the new calls should go elsewhere.
+func (s *session) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *session) setDraining() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
 // Health checks if the session is usable.
 func (s *session) Health() bool {
 	status := s.getStatus()
@@ -607,12 +955,18 @@ func (s *session) Close() error {
 	}
 	s.activelyClosing()
 	s.statusLock.Unlock()
+	// the closing session is never redialed, so the connection is not replaced during waiting,
+	// and the lock is released for the replies of the handlers being waited for
+	s.lock.Unlock()
 
 	s.peer.sessHub.Delete(s.Id())
 
+	// the buffered packets are handled before closing, and the blocked reading continues
+	s.Resume()
 	s.graceCtxWaitGroup.Wait()
 	s.gracePullCmdWaitGroup.Wait()
 
+	s.lock.Lock()
 	s.statusLock.Lock()
 	// Notice actively closed
 	if !s.IsPassiveClosed() {
@@ -623,10 +977,57 @@ func (s *session) Close() error {
 	err := s.socket.Close()
 	s.lock.Unlock()
 
+	s.failPushAcks()
+	s.failPings()
 	s.peer.pluginContainer.postDisconnect(s)
+	s.peer.events.Publish(&Event{Type: EventSessionClosed, Session: s})
 	return err
 }
 
+// reject sends the reason why the connection is rejected to the remote peer,
+// and then closes the session.
+func (s *session) reject(rerr *Rerror) {
+	output := socket.GetPacket(socket.WithPtype(TypeReject))
+	ctxTimout, cancel := context.WithTimeout(output.Context(), rejectWriteTimeout)
+	socket.WithContext(ctxTimout)(output)
+	rerr.SetToMeta(output.Meta())
+	if _, werr := s.write(output); werr != nil {
+		Debugf("reject(%s) fail: %s", s.RemoteAddr().String(), werr.String())
+	}
+	cancel()
+	socket.PutPacket(output)
+	s.Close()
+}
+
+// rejectWriteTimeout the timeout for sending the rejection reason.
+const rejectWriteTimeout = 3 * time.Second
+
+// closeWithNotice pushes DrainUri with the reason to the remote peer,
+// and then closes the session.
+func (s *session) closeWithNotice(reason string) {
+	notice := &DrainNotice{
+		Reason:   reason,
+		Deadline: time.Now(),
+	}
+	ctxTimout, cancel := context.WithTimeout(context.Background(), rejectWriteTimeout)
+	if rerr := s.Push(DrainUri, notice, socket.WithContext(ctxTimout)); rerr != nil {
+		Debugf("close notice(%s) fail: %s", s.RemoteAddr().String(), rerr.String())
+	}
+	cancel()
+	s.Close()
+}
+
+func (s *session) setRejected(rerr *Rerror) {
+	s.rejected.Store(rerr)
+}
+
+// rejectedRerror returns the reason why the remote peer rejects the connection.
+// If the connection is not rejected, returns nil.
+func (s *session) rejectedRerror() *Rerror {
+	rerr, _ := s.rejected.Load().(*Rerror)
+	return rerr
+}
+
 func (s *session) readDisconnected(oldConn net.Conn, err error) {
 	s.statusLock.Lock()
 	status := s.getStatus()
@@ -643,18 +1044,30 @@ func (s *session) readDisconnected(oldConn net.Conn, err error) {
 	if err != nil && err != io.EOF && err != socket.ErrProactivelyCloseSocket {
 		Debugf("disconnect(%s) when reading: %s", s.RemoteAddr().String(), err.Error())
 	}
+	s.Resume()
 	s.graceCtxWaitGroup.Wait()
 
-	// cancel the pullCmd that is waiting for a reply
+	// cancel the pullCmd that is waiting for a reply,
+	// except the retryable ones, which are re-pulled after redialing
+	var (
+		canRepull = status != statusActiveClosing && s.redialForClientLocked != nil
+		repulls   []*pullCmd
+	)
 	s.pullCmdMap.Range(func(_, v interface{}) bool {
 		pullCmd := v.(*pullCmd)
 		pullCmd.mu.Lock()
-		if !pullCmd.hasReply() && pullCmd.rerr == nil {
-			pullCmd.cancel()
+		if pullCmd.isPending() {
+			if canRepull && pullCmd.retryable() {
+				repulls = append(repulls, pullCmd)
+			} else {
+				pullCmd.cancel()
+			}
 		}
 		pullCmd.mu.Unlock()
 		return true
 	})
+	s.failPushAcks()
+	s.failPings()
 
 	if status == statusActiveClosing {
 		return
@@ -663,12 +1076,34 @@ func (s *session) readDisconnected(oldConn net.Conn, err error) {
 	s.socket.Close()
 
 	if !s.redialForClient(oldConn) {
+		s.repull(repulls, false)
 		s.peer.pluginContainer.postDisconnect(s)
+		s.peer.events.Publish(&Event{Type: EventSessionClosed, Session: s})
+		return
+	}
+	s.repull(repulls, true)
+}
+
+// repull re-sends the retryable PULLs that were waiting for the reply on the broken connection,
+// or cancels them if the redialing fails.
+func (s *session) repull(pullCmds []*pullCmd, redialed bool) {
+	for _, pullCmd := range pullCmds {
+		pullCmd.mu.Lock()
+		if pullCmd.isPending() {
+			if !redialed {
+				pullCmd.cancel()
+			} else if _, rerr := s.write(pullCmd.output); rerr != nil {
+				pullCmd.abort(rerr)
+			} else {
+				Debugf("repull(%s, seq:%s) after redialing: %s", s.RemoteAddr().String(), pullCmd.output.Seq(), pullCmd.output.Uri())
+			}
+		}
+		pullCmd.mu.Unlock()
 	}
 }
 
 func (s *session) redialForClient(oldConn net.Conn) bool {
-	if s.redialForClientLocked == nil {
+	if s.redialForClientLocked == nil || s.rejectedRerror() != nil {
 		return false
 	}
 	s.lock.Lock()
@@ -683,10 +1118,13 @@ func (s *session) redialForClient(oldConn net.Conn) bool {
 func (s *session) startReadAndHandle() {
 	var withContext socket.PacketSetting
 	if readTimeout := s.SessionAge(); readTimeout > 0 {
-		s.socket.SetReadDeadline(coarsetime.CeilingTimeNow().Add(readTimeout))
+		readDeadline := coarsetime.CeilingTimeNow().Add(readTimeout)
+		atomic.StoreInt64(&s.readDeadline, readDeadline.UnixNano())
+		s.socket.SetReadDeadline(readDeadline)
 		ctxTimout, _ := context.WithTimeout(context.Background(), readTimeout)
 		withContext = socket.WithContext(ctxTimout)
 	} else {
+		atomic.StoreInt64(&s.readDeadline, 0)
 		s.socket.SetReadDeadline(time.Time{})
 		withContext = socket.WithContext(nil)
 	}
@@ -706,35 +1144,154 @@ func (s *session) startReadAndHandle() {
 	for s.goonRead() {
 		var ctx = s.peer.getContext(s, false)
 		withContext(ctx.input)
+		if s.peer.maxPacketSize > 0 {
+			socket.WithSizeLimit(s.peer.maxPacketSize)(ctx.input)
+		}
 		if s.peer.pluginContainer.preReadHeader(ctx) != nil {
 			s.peer.putContext(ctx, false)
 			return
 		}
 		err = s.socket.ReadPacket(ctx.input)
 		if err != nil || !s.goonRead() {
+			if err != nil {
+				s.observeProtocolError(ctx.input, err)
+			}
 			s.peer.putContext(ctx, false)
+			if err == socket.ErrExceedPacketSizeLimit || err == socket.ErrMalformedPacket {
+				// the rest of the stream can not be framed, so tell the remote peer why and close
+				Warnf("disconnect(%s) due to bad packet: %s", s.RemoteAddr().String(), err.Error())
+				s.reject(rerrBadPacket.Copy().SetDetail(err.Error()))
+			}
 			return
 		}
+		s.recentPackets.add(false, ctx.input)
+		if ctx.pullCmd != nil {
+			// the reply body is decoded, and the pull cmd is locked by bindReply
+			ctx.pullCmd.decoded = s.timeNow()
+		}
+		s.stats.observeCompression(false, ctx.input)
+		// only the handlers are sharded, and the others, e.g. the replies, are never queued behind them,
+		// since the handler waiting for the reply of a nested pull would deadlock its shard
+		goFunc := Go
+		if ptype := ctx.input.Ptype(); ptype == TypePull || ptype == TypePush {
+			goFunc = s.dispatch
+		}
+		if ctx.handler != nil && ctx.handler.workerPool != nil {
+			goFunc = ctx.handler.workerPool.Go
+		}
+		// the ordered packets are handled one by one, by chaining each one after the previous
+		var prevHandled <-chan struct{}
+		var handled chan struct{}
+		if ptype := ctx.input.Ptype(); (ptype == TypePull || ptype == TypePush) && isOrdered(ctx.input) {
+			prevHandled, handled = s.orderedHandling, make(chan struct{})
+			s.orderedHandling = handled
+		}
 		s.graceCtxWaitGroup.Add(1)
-		if !Go(func() {
-			defer func() {
-				s.peer.putContext(ctx, true)
-				if p := recover(); p != nil {
-					Debugf("panic:\n%v\n%s", p, goutil.PanicTrace(1))
+		dispatch := func() {
+			if !goFunc(func() {
+				defer func() {
+					if p := recover(); p != nil {
+						Debugf("panic:\n%v\n%s", p, goutil.PanicTrace(1))
+					}
+					if handled != nil {
+						close(handled)
+					}
+					if ctx.handleDone() {
+						s.peer.putContext(ctx, true)
+					}
+				}()
+				if prevHandled != nil {
+					<-prevHandled
 				}
-			}()
-			ctx.handle()
-		}) {
-			s.peer.putContext(ctx, true)
+				ctx.handle()
+			}) {
+				if handled != nil {
+					close(handled)
+				}
+				s.peer.putContext(ctx, true)
+			}
+		}
+		if !s.holdIfPaused(ctx.input.Ptype(), dispatch) {
+			dispatch()
 		}
 	}
 }
 
+// defaultMaxPausedPackets the default of PeerConfig.MaxPausedPackets
+const defaultMaxPausedPackets = 1024
+
+// Pause stops dispatching the inbound PULL and PUSH to the handlers until Resume,
+// e.g. to quiesce the processing during a hot data migration without dropping the connection.
+// Note:
+//  The paused ones are buffered up to PeerConfig.MaxPausedPackets, beyond which the reading blocks;
+//  The replies, acknowledgements and pings are still processed;
+//  Closing the session resumes it.
+func (s *session) Pause() {
+	s.pauseLock.Lock()
+	if !s.paused {
+		s.paused = true
+		s.resumed = make(chan struct{})
+	}
+	s.pauseLock.Unlock()
+}
+
+// Resume dispatches the buffered PULL and PUSH in order, and continues dispatching the new ones.
+func (s *session) Resume() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if !s.paused {
+		return
+	}
+	s.paused = false
+	close(s.resumed)
+	// dispatched with the lock held, so that the new ones are not dispatched before them
+	for _, dispatch := range s.pausedDispatches {
+		dispatch()
+	}
+	s.pausedDispatches = nil
+}
+
+// Paused reports whether the session is paused.
+func (s *session) Paused() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	return s.paused
+}
+
+// holdIfPaused buffers the dispatch of the inbound PULL or PUSH while the session is paused,
+// blocking if the buffer is full, and returns false if not paused.
+func (s *session) holdIfPaused(ptype byte, dispatch func()) bool {
+	if ptype != TypePull && ptype != TypePush {
+		return false
+	}
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	for s.paused && len(s.pausedDispatches) >= s.peer.maxPausedPackets {
+		resumed := s.resumed
+		s.pauseLock.Unlock()
+		<-resumed
+		s.pauseLock.Lock()
+	}
+	if !s.paused {
+		return false
+	}
+	s.pausedDispatches = append(s.pausedDispatches, dispatch)
+	return true
+}
+
 func (s *session) write(packet *socket.Packet) (net.Conn, *Rerror) {
+	return s.writeTraced(packet, nil)
+}
+
+// writeTraced writes the packet, and records the time when the write lock is acquired into lockedAt if not nil.
+func (s *session) writeTraced(packet *socket.Packet, lockedAt *time.Time) (net.Conn, *Rerror) {
 	conn := s.getConn()
 	status := s.getStatus()
 	if status != statusOk &&
-		!(status == statusActiveClosing && packet.Ptype() == TypeReply) {
+		!(status == statusActiveClosing && (packet.Ptype() == TypeReply || packet.Ptype() == TypePushAck || packet.Ptype() == TypePong)) {
+		if rerr := s.rejectedRerror(); rerr != nil {
+			return conn, rerr
+		}
 		return conn, rerrConnClosed
 	}
 
@@ -743,6 +1300,7 @@ func (s *session) write(packet *socket.Packet) (net.Conn, *Rerror) {
 		err         error
 		ctx         = packet.Context()
 		deadline, _ = ctx.Deadline()
+		queued      *list.Element
 	)
 	select {
 	case <-ctx.Done():
@@ -751,8 +1309,41 @@ func (s *session) write(packet *socket.Packet) (net.Conn, *Rerror) {
 	default:
 	}
 
-	s.writeLock.Lock()
-	defer s.writeLock.Unlock()
+	if isOrdered(packet) {
+		prevWritten, written := s.orderedTurn()
+		defer close(written)
+		if prevWritten != nil {
+			select {
+			case <-prevWritten:
+			case <-ctx.Done():
+				err = ctx.Err()
+				goto ERR
+			}
+		}
+	}
+
+	if s.writeQueue != nil {
+		if rerr = s.enterWriteQueue(packet); rerr != nil {
+			return conn, rerr
+		}
+		defer func() { <-s.writeQueue }()
+		queued = s.queuePush(packet)
+	}
+
+	select {
+	case s.writeLock <- struct{}{}:
+		s.unqueuePush(queued)
+		if lockedAt != nil {
+			*lockedAt = s.timeNow()
+		}
+	case <-queuedDropped(queued):
+		return conn, rerrWriteFailed.Copy().SetDetail("slow consumer, drop the oldest push")
+	case <-ctx.Done():
+		s.unqueuePush(queued)
+		err = ctx.Err()
+		goto ERR
+	}
+	defer func() { <-s.writeLock }()
 
 	select {
 	case <-ctx.Done():
@@ -764,10 +1355,17 @@ func (s *session) write(packet *socket.Packet) (net.Conn, *Rerror) {
 	}
 
 	if err == nil {
+		s.recentPackets.add(true, packet)
+		s.stats.observeCompression(true, packet)
 		return conn, nil
 	}
 
+	s.stats.ObserveError()
+
 	if err == io.EOF || err == socket.ErrProactivelyCloseSocket {
+		if rerr := s.rejectedRerror(); rerr != nil {
+			return conn, rerr
+		}
 		return conn, rerrConnClosed
 	}
 
@@ -778,6 +1376,514 @@ ERR:
 	return conn, rerr
 }
 
+// orderedTurn takes the turn of writing the ordered packet,
+// returns the channel closed when the previous one is written, and the one to close for the next.
+func (s *session) orderedTurn() (prevWritten <-chan struct{}, written chan struct{}) {
+	written = make(chan struct{})
+	s.orderedWritingLock.Lock()
+	prevWritten, s.orderedWriting = s.orderedWriting, written
+	s.orderedWritingLock.Unlock()
+	return
+}
+
+// enterWriteQueue takes a place in the write queue,
+// and handles by PeerConfig.WriteQueuePolicy if it is full.
+func (s *session) enterWriteQueue(packet *socket.Packet) *Rerror {
+	select {
+	case s.writeQueue <- struct{}{}:
+		if atomic.LoadInt64(&s.queueFullSince) != 0 {
+			atomic.StoreInt64(&s.queueFullSince, 0)
+			atomic.StoreInt32(&s.slowConsumer, 0)
+		}
+		return nil
+	default:
+	}
+	if rerr := s.checkSlowConsumer(); rerr != nil {
+		return rerr
+	}
+	switch s.peer.writeQueuePolicy {
+	case WriteQueueDropPush:
+		if packet.Ptype() == TypePush && !isOrdered(packet) {
+			return rerrWriteFailed.Copy().SetDetail("write queue is full, drop the push")
+		}
+	case WriteQueueCloseSession:
+		Warnf("close session(%s) due to the full write queue", s.RemoteAddr().String())
+		// closes the socket only, instead of the graceful Close waiting for the stuck writers,
+		// then the reading goroutine cleans up the session as disconnected.
+		s.socket.Close()
+		return rerrConnClosed.Copy().SetDetail("write queue is full")
+	}
+	// rechecks the slow consumer while waiting, even if no more writes come
+	var slowTimer <-chan time.Time
+	if age := s.peer.slowConsumerAge; age > 0 {
+		timer := time.NewTimer(age)
+		defer timer.Stop()
+		slowTimer = timer.C
+	}
+	ctx := packet.Context()
+	for {
+		select {
+		case s.writeQueue <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return rerrWriteFailed.Copy().SetDetail(ctx.Err().Error())
+		case <-slowTimer:
+			slowTimer = nil
+			if rerr := s.checkSlowConsumer(); rerr != nil {
+				return rerr
+			}
+		}
+	}
+}
+
+// checkSlowConsumer handles by PeerConfig.SlowConsumerPolicy,
+// if the write queue has been full longer than PeerConfig.SlowConsumerAge.
+func (s *session) checkSlowConsumer() *Rerror {
+	age := s.peer.slowConsumerAge
+	if age <= 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&s.queueFullSince, 0, now) {
+		return nil
+	}
+	since := atomic.LoadInt64(&s.queueFullSince)
+	if since == 0 || time.Duration(now-since) < age {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&s.slowConsumer, 0, 1) {
+		Warnf("session(%s) is a slow consumer, whose write queue has been full for %v", s.RemoteAddr().String(), time.Duration(now-since))
+		s.peer.pluginContainer.postSlowConsumer(s)
+	}
+	switch s.peer.slowConsumerPolicy {
+	case SlowConsumerDropOldestPush:
+		s.dropOldestPush()
+	case SlowConsumerCloseSession:
+		Warnf("close session(%s) due to the slow consumer", s.RemoteAddr().String())
+		// the same as WriteQueueCloseSession
+		s.socket.Close()
+		return rerrConnClosed.Copy().SetDetail("slow consumer")
+	}
+	return nil
+}
+
+// queuePush records the PUSH waiting in the write queue,
+// so that it can be dropped by SlowConsumerDropOldestPush.
+func (s *session) queuePush(packet *socket.Packet) *list.Element {
+	if s.queuedPushes == nil || packet.Ptype() != TypePush || isOrdered(packet) {
+		return nil
+	}
+	s.queuedPushesLock.Lock()
+	e := s.queuedPushes.PushBack(make(chan struct{}))
+	s.queuedPushesLock.Unlock()
+	return e
+}
+
+func (s *session) unqueuePush(e *list.Element) {
+	if e == nil {
+		return
+	}
+	s.queuedPushesLock.Lock()
+	s.queuedPushes.Remove(e)
+	s.queuedPushesLock.Unlock()
+}
+
+// dropOldestPush fails the oldest PUSH waiting in the write queue, to make room for the new write.
+func (s *session) dropOldestPush() {
+	s.queuedPushesLock.Lock()
+	e := s.queuedPushes.Front()
+	if e != nil {
+		s.queuedPushes.Remove(e)
+	}
+	s.queuedPushesLock.Unlock()
+	if e != nil {
+		close(e.Value.(chan struct{}))
+	}
+}
+
+// queuedDropped returns the channel closed when the queued PUSH is dropped,
+// nil if it is not queued.
+func queuedDropped(e *list.Element) <-chan struct{} {
+	if e == nil {
+		return nil
+	}
+	return e.Value.(chan struct{})
+}
+
+// WriteQueueLen returns the number of the pending writes,
+// including the one being written.
+// Note: it is always 0 if PeerConfig.MaxWriteQueue<=0.
+func (s *session) WriteQueueLen() int {
+	return len(s.writeQueue)
+}
+
+// sessionErrorWindow the window of counting the recent errors of session.
+const (
+	sessionErrorSlots     = 6
+	sessionErrorSlotWidth = 10 // seconds
+)
+
+// SessionStats the network quality statistics of a session.
+// Note: concurrent safe.
+type SessionStats struct {
+	mu         sync.Mutex
+	srtt       time.Duration
+	lastRTT    time.Duration
+	rttCount   uint64
+	errorSlots [sessionErrorSlots]struct {
+		slot  int64
+		count int
+	}
+	compression CompressionStats
+	protocol    ProtocolStats
+}
+
+// ProtocolStats the counts of the protocol errors of the read packets of a session,
+// to diagnose the framing and codec problems, e.g. of the interop with third-party implementations.
+type ProtocolStats struct {
+	// MalformedFrames the frames which are truncated, have the invalid field lengths or exceed the size limit
+	MalformedFrames uint64 `json:"malformed_frames"`
+	// ChecksumFailures the frames which fail the transfer filters, e.g. the gzip checksum
+	ChecksumFailures uint64 `json:"checksum_failures"`
+	// UnknownTypes the packets of the unknown packet type
+	UnknownTypes uint64 `json:"unknown_types"`
+	// CodecMismatches the bodies which fail to be decoded by their codec, or are not accepted by the handler
+	CodecMismatches uint64 `json:"codec_mismatches"`
+	// UnknownMeta the packets rejected for carrying the unregistered reserved metadata key, see PeerConfig.StrictMeta
+	UnknownMeta uint64 `json:"unknown_meta"`
+}
+
+// CompressionStats the byte counts of the transfer-filtered packets of a session, e.g. compressed by gzip,
+// to verify whether the compression of a link is paying for its CPU.
+type CompressionStats struct {
+	InPackets uint64 `json:"in_packets"`
+	// InBytes the size of the read packets on the wire
+	InBytes uint64 `json:"in_bytes"`
+	// InUncompressedBytes the size of the read packets after the transfer filtering
+	InUncompressedBytes uint64 `json:"in_uncompressed_bytes"`
+	OutPackets          uint64 `json:"out_packets"`
+	// OutBytes the size of the written packets on the wire
+	OutBytes uint64 `json:"out_bytes"`
+	// OutUncompressedBytes the size of the written packets before the transfer filtering
+	OutUncompressedBytes uint64 `json:"out_uncompressed_bytes"`
+}
+
+// InRatio returns the ratio of the wire size to the uncompressed size of the read packets,
+// the smaller the better, 0 if there is no compressed packet.
+func (c CompressionStats) InRatio() float64 {
+	if c.InUncompressedBytes == 0 {
+		return 0
+	}
+	return float64(c.InBytes) / float64(c.InUncompressedBytes)
+}
+
+// OutRatio returns the ratio of the wire size to the uncompressed size of the written packets,
+// the smaller the better, 0 if there is no compressed packet.
+func (c CompressionStats) OutRatio() float64 {
+	if c.OutUncompressedBytes == 0 {
+		return 0
+	}
+	return float64(c.OutBytes) / float64(c.OutUncompressedBytes)
+}
+
+// ObserveRTT records a round-trip time sample, e.g. measured by heartbeat.
+// Note: the smoothed RTT is computed as TCP does, SRTT = 7/8*SRTT + 1/8*RTT.
+func (ss *SessionStats) ObserveRTT(rtt time.Duration) {
+	ss.mu.Lock()
+	if ss.rttCount == 0 {
+		ss.srtt = rtt
+	} else {
+		ss.srtt += (rtt - ss.srtt) / 8
+	}
+	ss.lastRTT = rtt
+	ss.rttCount++
+	ss.mu.Unlock()
+}
+
+// RTT returns the smoothed round-trip time.
+// If there is no sample, returns 0.
+func (ss *SessionStats) RTT() time.Duration {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.srtt
+}
+
+// LastRTT returns the latest round-trip time sample.
+func (ss *SessionStats) LastRTT() time.Duration {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.lastRTT
+}
+
+// ObserveError records a network error, e.g. write failure or lost reply.
+func (ss *SessionStats) ObserveError() {
+	slot := time.Now().Unix() / sessionErrorSlotWidth
+	ss.mu.Lock()
+	e := &ss.errorSlots[slot%sessionErrorSlots]
+	if e.slot != slot {
+		e.slot = slot
+		e.count = 0
+	}
+	e.count++
+	ss.mu.Unlock()
+}
+
+// observeCompression records the sizes of the transfer-filtered packet.
+func (ss *SessionStats) observeCompression(outbound bool, p *socket.Packet) {
+	unfiltered := p.UnfilteredSize()
+	if unfiltered == 0 {
+		return
+	}
+	ss.mu.Lock()
+	c := &ss.compression
+	if outbound {
+		c.OutPackets++
+		c.OutBytes += uint64(p.Size())
+		c.OutUncompressedBytes += uint64(unfiltered)
+	} else {
+		c.InPackets++
+		c.InBytes += uint64(p.Size())
+		c.InUncompressedBytes += uint64(unfiltered)
+	}
+	ss.mu.Unlock()
+}
+
+// Compression returns the byte counts of the transfer-filtered packets, e.g. compressed by gzip.
+func (ss *SessionStats) Compression() CompressionStats {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.compression
+}
+
+// Protocol returns the counts of the protocol errors of the read packets.
+func (ss *SessionStats) Protocol() ProtocolStats {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.protocol
+}
+
+// observeProtocol increases the protocol error counter chosen by field.
+func (ss *SessionStats) observeProtocol(field func(*ProtocolStats) *uint64) {
+	ss.mu.Lock()
+	*field(&ss.protocol)++
+	ss.mu.Unlock()
+}
+
+// observeProtocol increases the protocol error counter chosen by field,
+// of both the session and the peer, which outlives the closed sessions.
+func (s *session) observeProtocol(field func(*ProtocolStats) *uint64) {
+	s.stats.observeProtocol(field)
+	s.peer.observeProtocol(field)
+}
+
+// observeProtocolError counts the protocol error of reading the input packet,
+// and logs it with the session and packet header, ignoring the other errors, e.g. io.EOF.
+func (s *session) observeProtocolError(input *socket.Packet, err error) {
+	switch err.(type) {
+	case *socket.FilterError:
+		s.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.ChecksumFailures })
+	case *socket.BodyCodecError:
+		s.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.CodecMismatches })
+	default:
+		if err != socket.ErrMalformedPacket && err != socket.ErrExceedPacketSizeLimit {
+			return
+		}
+		s.observeProtocol(func(p *ProtocolStats) *uint64 { return &p.MalformedFrames })
+	}
+	Warnf("protocol error (addr:%s, id:%s, type:%s, seq:%s, uri:%s): %s",
+		s.RemoteAddr().String(), s.Id(), TypeText(input.Ptype()), input.Seq(), input.Uri(), err.Error())
+}
+
+// RecentErrors returns the number of the network errors in the last minute.
+func (ss *SessionStats) RecentErrors() int {
+	slot := time.Now().Unix() / sessionErrorSlotWidth
+	var count int
+	ss.mu.Lock()
+	for _, e := range ss.errorSlots {
+		if slot-e.slot < sessionErrorSlots {
+			count += e.count
+		}
+	}
+	ss.mu.Unlock()
+	return count
+}
+
+type (
+	// SessionDump the structured snapshot of a session for diagnosing, see Session.DebugDump.
+	SessionDump struct {
+		Id         string `json:"id"`
+		LocalAddr  string `json:"local_addr"`
+		RemoteAddr string `json:"remote_addr"`
+		Tenant     string `json:"tenant,omitempty"`
+		// Status ok, active_closing, active_closed or passive_closed
+		Status   string        `json:"status"`
+		Draining bool          `json:"draining"`
+		Paused   bool          `json:"paused"`
+		Uptime   time.Duration `json:"uptime"`
+		// SessionAge the session max age, 0 means no time limit
+		SessionAge time.Duration `json:"session_age"`
+		// ContextAge the PULL or PUSH context max age, 0 means no time limit
+		ContextAge time.Duration `json:"context_age"`
+		// ReadDeadline the read deadline set by SessionAge, zero means none
+		ReadDeadline time.Time `json:"read_deadline"`
+		// WriteQueueLen the number of the pending writes, always 0 if PeerConfig.MaxWriteQueue<=0
+		WriteQueueLen int `json:"write_queue_len"`
+		// QueuedPushes the number of the PUSHs waiting in the write queue, only for SlowConsumerDropOldestPush
+		QueuedPushes int `json:"queued_pushes"`
+		// PendingPulls the PULLs waiting for the reply, the oldest first if PeerConfig.CountTime=true
+		PendingPulls []PendingPull `json:"pending_pulls"`
+		// PendingPushAcks the number of the pushes waiting for the acknowledgement
+		PendingPushAcks int `json:"pending_push_acks"`
+		// PendingPings the number of the pings waiting for the pong
+		PendingPings int `json:"pending_pings"`
+		// RecentPackets the recently read or written packets, the oldest first
+		RecentPackets []PacketTrace    `json:"recent_packets"`
+		RTT           time.Duration    `json:"rtt"`
+		RecentErrors  int              `json:"recent_errors"`
+		Compression   CompressionStats `json:"compression"`
+		Protocol      ProtocolStats    `json:"protocol"`
+	}
+	// PendingPull the PULL waiting for the reply.
+	PendingPull struct {
+		Seq string `json:"seq"`
+		Uri string `json:"uri"`
+		// Age the time since the PULL is sent, always 0 if PeerConfig.CountTime=false
+		Age time.Duration `json:"age"`
+		// Deadline the time after which the PULL fails with timeout, zero means none
+		Deadline time.Time `json:"deadline"`
+	}
+	// PacketTrace the header of a read or written packet.
+	PacketTrace struct {
+		// Outbound is true if written by this peer, false if read.
+		Outbound bool      `json:"outbound"`
+		Type     string    `json:"type"`
+		Seq      string    `json:"seq"`
+		Uri      string    `json:"uri"`
+		Size     uint32    `json:"size"`
+		Time     time.Time `json:"time"`
+	}
+	// packetTraces the ring of the recent packets of a session.
+	packetTraces struct {
+		mu    sync.Mutex
+		ring  [recentPacketsSize]packetTrace
+		next  int
+		count int
+	}
+	packetTrace struct {
+		outbound bool
+		ptype    byte
+		seq      string
+		uri      string
+		size     uint32
+		time     int64
+	}
+)
+
+// recentPacketsSize the number of the recent packets kept per session for DebugDump
+const recentPacketsSize = 16
+
+// add records the header of the packet, without allocation.
+func (t *packetTraces) add(outbound bool, packet *socket.Packet) {
+	now := coarsetime.FloorTimeNow().UnixNano()
+	t.mu.Lock()
+	t.ring[t.next] = packetTrace{
+		outbound: outbound,
+		ptype:    packet.Ptype(),
+		seq:      packet.Seq(),
+		uri:      packet.Uri(),
+		size:     packet.Size(),
+		time:     now,
+	}
+	t.next = (t.next + 1) % recentPacketsSize
+	if t.count < recentPacketsSize {
+		t.count++
+	}
+	t.mu.Unlock()
+}
+
+// list returns the recent packets, the oldest first.
+func (t *packetTraces) list() []PacketTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]PacketTrace, 0, t.count)
+	for i := t.next - t.count; i < t.next; i++ {
+		r := &t.ring[(i+recentPacketsSize)%recentPacketsSize]
+		list = append(list, PacketTrace{
+			Outbound: r.outbound,
+			Type:     TypeText(r.ptype),
+			Seq:      r.seq,
+			Uri:      r.uri,
+			Size:     r.size,
+			Time:     time.Unix(0, r.time),
+		})
+	}
+	return list
+}
+
+// DebugDump returns a structured snapshot of the session for diagnosing the stuck one,
+// including the pending pulls with age, the queue depths, the recent packets and the timers.
+func (s *session) DebugDump() *SessionDump {
+	now := time.Now()
+	d := &SessionDump{
+		Id:              s.Id(),
+		LocalAddr:       s.LocalAddr().String(),
+		RemoteAddr:      s.RemoteAddr().String(),
+		Tenant:          s.Tenant(),
+		Status:          statusText(s.getStatus()),
+		Draining:        s.Draining(),
+		Paused:          s.Paused(),
+		Uptime:          now.Sub(s.startTime),
+		SessionAge:      s.SessionAge(),
+		ContextAge:      s.ContextAge(),
+		WriteQueueLen:   s.WriteQueueLen(),
+		PendingPushAcks: s.pushAckMap.Len(),
+		PendingPings:    s.pingMap.Len(),
+		RecentPackets:   s.recentPackets.list(),
+		RTT:             s.stats.RTT(),
+		RecentErrors:    s.stats.RecentErrors(),
+		Compression:     s.stats.Compression(),
+		Protocol:        s.stats.Protocol(),
+	}
+	if readDeadline := atomic.LoadInt64(&s.readDeadline); readDeadline > 0 {
+		d.ReadDeadline = time.Unix(0, readDeadline)
+	}
+	if s.queuedPushes != nil {
+		s.queuedPushesLock.Lock()
+		d.QueuedPushes = s.queuedPushes.Len()
+		s.queuedPushesLock.Unlock()
+	}
+	s.pullCmdMap.Range(func(_, v interface{}) bool {
+		cmd := v.(*pullCmd)
+		d.PendingPulls = append(d.PendingPulls, PendingPull{
+			Seq:      cmd.output.Seq(),
+			Uri:      cmd.output.Uri(),
+			Age:      s.timeSince(cmd.start),
+			Deadline: cmd.deadline,
+		})
+		return true
+	})
+	sort.Slice(d.PendingPulls, func(i, j int) bool {
+		return d.PendingPulls[i].Age > d.PendingPulls[j].Age
+	})
+	return d
+}
+
+// statusText returns the text of the session status.
+func statusText(status int32) string {
+	switch status {
+	case statusOk:
+		return "ok"
+	case statusActiveClosing:
+		return "active_closing"
+	case statusActiveClosed:
+		return "active_closed"
+	case statusPassiveClosed:
+		return "passive_closed"
+	default:
+		return "unknown"
+	}
+}
+
 // SessionHub sessions hub
 type SessionHub struct {
 	// key: session id (ip, name and so on)
@@ -858,72 +1964,239 @@ const (
 	logFormatPullHandle = "PULL<- %s %s %s %q\nRECV(%s)\nSEND(%s)"
 )
 
+type (
+	// RunLog the record of a completed PULL or PUSH.
+	RunLog struct {
+		// Ptype TypePull or TypePush
+		Ptype byte
+		// Outbound is true if launched by this peer, false if handled by this peer.
+		Outbound bool
+		// Addr the remote address
+		Addr string
+		// RealIp the real IP of the remote, empty if it is the same as Addr
+		RealIp string
+		// Tenant the tenant identity of the session, see PreSession.SetTenant
+		Tenant string
+		Uri    string
+		Seq    string
+		// Code the code of the reply error, 0 means OK, always 0 for PUSH
+		Code int32
+		// Cost the cost time, always 0 if PeerConfig.CountTime=false
+		Cost time.Duration
+		// Slow is true if the cost time exceeds PeerConfig.SlowCometDuration
+		Slow       bool
+		InputSize  uint32
+		OutputSize uint32
+		// Input the received packet, nil for launched PUSH
+		// Note: only valid during the RunLogger call
+		Input *socket.Packet
+		// Output the sent packet, nil for handled PUSH
+		// Note: only valid during the RunLogger call
+		Output *socket.Packet
+	}
+	// RunLogger logs the record of a completed PULL or PUSH, instead of the default text format.
+	// Note: the body is not rendered, unless it is done in the RunLogger.
+	RunLogger func(*RunLog)
+)
+
+func newRunLog(addr, realIp string, costTime time.Duration, slow bool, input, output *socket.Packet, logType int8) *RunLog {
+	r := &RunLog{
+		Addr:   addr,
+		Cost:   costTime,
+		Slow:   slow,
+		Input:  input,
+		Output: output,
+	}
+	if realIp != addr {
+		r.RealIp = realIp
+	}
+	var reply *socket.Packet
+	switch logType {
+	case typePushLaunch:
+		r.Ptype, r.Outbound, r.Uri, r.Seq = TypePush, true, output.Uri(), output.Seq()
+	case typePushHandle:
+		r.Ptype, r.Uri, r.Seq = TypePush, input.Uri(), input.Seq()
+	case typePullLaunch:
+		r.Ptype, r.Outbound, r.Uri, r.Seq = TypePull, true, output.Uri(), output.Seq()
+		reply = input
+	case typePullHandle:
+		r.Ptype, r.Uri, r.Seq = TypePull, input.Uri(), input.Seq()
+		reply = output
+	}
+	if input != nil {
+		r.InputSize = input.Size()
+	}
+	if output != nil {
+		r.OutputSize = output.Size()
+	}
+	if reply != nil {
+		if rerr := NewRerrorFromMeta(reply.Meta()); rerr != nil {
+			r.Code = rerr.Code
+		}
+	}
+	return r
+}
+
 func (s *session) runlog(realIp string, costTime time.Duration, input, output *socket.Packet, logType int8) {
+	var slow = s.peer.countTime && costTime >= s.peer.slowCometDuration
+	if !slow && !s.peer.sampleRunLog() {
+		return
+	}
+	if s.peer.runLogger != nil {
+		r := newRunLog(s.RemoteAddr().String(), realIp, costTime, slow, input, output, logType)
+		r.Tenant = s.Tenant()
+		s.peer.runLogger(r)
+		return
+	}
 	var addr = s.RemoteAddr().String()
 	if realIp != "" && realIp != addr {
 		addr += "(real: " + realIp + ")"
 	}
+	if tenant := s.Tenant(); tenant != "" {
+		addr += "(tenant: " + tenant + ")"
+	}
 	var (
 		costTimeStr string
-		printFunc   = Infof
+		logger      = s.peer.Logger()
+		printFunc   = logger.Infof
+		level       = "INFO"
+		renderBody  = s.peer.getBodyLogRenderer()
 	)
 	if s.peer.countTime {
 		costTimeStr = costTime.String()
-		if costTime >= s.peer.slowCometDuration {
+		if slow {
 			costTimeStr += "(slow)"
-			printFunc = Warnf
+			printFunc, level = logger.Warnf, "WARNING"
 		}
 	} else {
 		costTimeStr = "-"
 	}
+	if !logEnabled(logger, level) {
+		return
+	}
 
 	switch logType {
 	case typePushLaunch:
-		printFunc(logFormatPushLaunch, addr, costTimeStr, output.Uri(), output.Seq(), packetLogBytes(output, s.peer.printBody))
+		printFunc(logFormatPushLaunch, addr, costTimeStr, output.Uri(), output.Seq(), packetLogBytes(output, renderBody))
 	case typePushHandle:
-		printFunc(logFormatPushHandle, addr, costTimeStr, input.Uri(), input.Seq(), packetLogBytes(input, s.peer.printBody))
+		printFunc(logFormatPushHandle, addr, costTimeStr, input.Uri(), input.Seq(), packetLogBytes(input, renderBody))
 	case typePullLaunch:
-		printFunc(logFormatPullLaunch, addr, costTimeStr, output.Uri(), output.Seq(), packetLogBytes(output, s.peer.printBody), packetLogBytes(input, s.peer.printBody))
+		printFunc(logFormatPullLaunch, addr, costTimeStr, output.Uri(), output.Seq(), packetLogBytes(output, renderBody), packetLogBytes(input, renderBody))
 	case typePullHandle:
-		printFunc(logFormatPullHandle, addr, costTimeStr, input.Uri(), input.Seq(), packetLogBytes(input, s.peer.printBody), packetLogBytes(output, s.peer.printBody))
+		printFunc(logFormatPullHandle, addr, costTimeStr, input.Uri(), input.Seq(), packetLogBytes(input, renderBody), packetLogBytes(output, renderBody))
 	}
 }
 
-func packetLogBytes(packet *socket.Packet, printBody bool) []byte {
-	var b = make([]byte, 0, 32)
-	b = append(b, '{')
-	b = append(b, '"', 's', 'i', 'z', 'e', '"', ':')
-	b = append(b, strconv.FormatUint(uint64(packet.Size()), 10)...)
+// packetLogBytes renders the packet as the indented JSON for the run logs.
+func packetLogBytes(packet *socket.Packet, renderBody BodyLogRenderer) []byte {
+	var b = make([]byte, 0, 64)
+	b = append(b, "{\n  \"size\": "...)
+	b = strconv.AppendUint(b, uint64(packet.Size()), 10)
 	if rerrBytes := getRerrorBytes(packet.Meta()); len(rerrBytes) > 0 {
-		b = append(b, ',', '"', 'e', 'r', 'r', 'o', 'r', '"', ':', '"')
-		rerrBytes = bytes.Replace(rerrBytes, []byte{'"'}, []byte{'\\', '"'}, -1)
-		b = append(b, rerrBytes...)
+		b = append(b, ",\n  \"error\": \""...)
+		b = appendLogEscaped(b, rerrBytes)
 		b = append(b, '"')
 	}
-	if printBody {
-		if bodyBytes := bodyLogBytes(packet); len(bodyBytes) > 0 {
-			b = append(b, ',', '"', 'b', 'o', 'd', 'y', '"', ':', '"')
-			bodyBytes = bytes.Replace(bodyBytes, []byte{'"'}, []byte{'\\', '"'}, -1)
-			b = append(b, bodyBytes...)
+	if renderBody != nil {
+		if bodyBytes := renderBody(packet); len(bodyBytes) > 0 {
+			b = append(b, ",\n  \"body\": \""...)
+			b = appendLogEscaped(b, bodyBytes)
 			b = append(b, '"')
 		}
 	}
-	b = append(b, '}')
-	buf := bytes.NewBuffer(nil)
-	err := json.Indent(buf, b, "", "  ")
-	if err != nil {
+	b = append(b, "\n}"...)
+	return b
+}
+
+// appendLogEscaped appends s with the double quotes escaped.
+func appendLogEscaped(b, s []byte) []byte {
+	for _, c := range s {
+		if c == '"' {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// BodyLogRenderer renders the packet body for the run logs.
+type BodyLogRenderer func(packet *socket.Packet) []byte
+
+// defaultBodyLogRenderer renders the body without redaction and truncation.
+var defaultBodyLogRenderer = NewBodyLogRenderer(0)
+
+// NewBodyLogRenderer creates a renderer that prints the body as JSON,
+// replaces the values of the redactFields(case insensitive, at any depth) with "***",
+// and truncates the result to maxSize bytes if maxSize>0.
+// Note:
+//  The raw bytes body is printed as is, except JSON codec one, which can be redacted;
+//  The raw bytes body of protobuf codec or invalid UTF-8 is printed as its size, e.g. <binary 1024 bytes>.
+func NewBodyLogRenderer(maxSize int, redactFields ...string) BodyLogRenderer {
+	redact := make(map[string]bool, len(redactFields))
+	for _, field := range redactFields {
+		redact[strings.ToLower(field)] = true
+	}
+	return func(packet *socket.Packet) []byte {
+		b := renderBodyLogBytes(packet, redact)
+		if maxSize > 0 && len(b) > maxSize {
+			b = append(b[:maxSize:maxSize], "..."...)
+		}
 		return b
 	}
-	return buf.Bytes()
 }
 
-func bodyLogBytes(packet *socket.Packet) []byte {
+func renderBodyLogBytes(packet *socket.Packet, redact map[string]bool) []byte {
+	var b []byte
 	switch v := packet.Body().(type) {
+	case nil:
+		return nil
 	case []byte:
-		return v
+		b = v
 	case *[]byte:
-		return *v
+		b = *v
+	default:
+		b, _ = json.Marshal(v)
+		return redactJSON(b, redact)
+	}
+	if packet.BodyCodec() == codec.ID_PROTOBUF || !utf8.Valid(b) {
+		return []byte(fmt.Sprintf("<binary %d bytes>", len(b)))
+	}
+	if packet.BodyCodec() == codec.ID_JSON {
+		return redactJSON(b, redact)
 	}
-	b, _ := json.Marshal(packet.Body())
 	return b
 }
+
+// redactJSON replaces the values of the redacted fields in the JSON b.
+func redactJSON(b []byte, redact map[string]bool) []byte {
+	if len(redact) == 0 {
+		return b
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return b
+	}
+	redactValue(v, redact)
+	r, err := json.Marshal(v)
+	if err != nil {
+		return b
+	}
+	return r
+}
+
+func redactValue(v interface{}, redact map[string]bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			if redact[strings.ToLower(k)] {
+				x[k] = "***"
+			} else {
+				redactValue(e, redact)
+			}
+		}
+	case []interface{}:
+		for _, e := range x {
+			redactValue(e, redact)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package tp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRedialRemoteAddr(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &connsListener{Listener: lis}
+	srvA := NewPeer(PeerConfig{})
+	defer srvA.Close()
+	go srvA.ServeListener(cl)
+	srvB := NewPeer(PeerConfig{})
+	defer srvB.Close()
+	addrB := serveTest(t, srvB)
+	for _, srv := range []Peer{srvA, srvB} {
+		srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+			return *arg, nil
+		})
+	}
+
+	logs := make(chan string, 10)
+	defer SetLogger(GetLogger())
+	SetLogger(NewFuncLogger("INFO", func(level, msg string) {
+		if strings.HasPrefix(msg, "redial ok") {
+			select {
+			case logs <- msg:
+			default:
+			}
+		}
+	}))
+
+	// the resolved address of the host name changes, like DNS-based failover
+	var target atomic.Value
+	target.Store(lis.Addr().String())
+	cli := NewPeer(PeerConfig{RedialTimes: 3})
+	defer cli.Close()
+	sess, rerr := cli.(*peer).newSessionForClient(func() (net.Conn, error) {
+		return net.Dial("tcp", target.Load().(string))
+	}, "example.com:9090", nil)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	var reply string
+	if rerr = sess.Pull("/echo", "a", &reply).Rerror(); rerr != nil {
+		t.Fatal(rerr)
+	}
+	target.Store(addrB)
+	cl.closeConns()
+	if rerr = sess.Pull("/echo", "b", &reply, WithRetryable()).Rerror(); rerr != nil || reply != "b" {
+		t.Fatalf("expect b, got %q, %v", reply, rerr)
+	}
+	if sess.RemoteAddr().String() != addrB {
+		t.Fatalf("expect the redialed remote address %s, got %s", addrB, sess.RemoteAddr())
+	}
+	select {
+	case msg := <-logs:
+		if !strings.Contains(msg, "remote address changed from "+lis.Addr().String()) {
+			t.Fatalf("expect the remote address change logged, got %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the redial logged")
+	}
+}
+
+type rejectPlugin struct{}
+
+func (rejectPlugin) Name() string {
+	return "reject"
+}
+
+func (rejectPlugin) PostAccept(sess PreSession) *Rerror {
+	return NewRerror(CodeUnauthorized, "Unauthorized", "banned")
+}
+
+func TestRejectReason(t *testing.T) {
+	srv := NewPeer(PeerConfig{}, rejectPlugin{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{RedialTimes: 3})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	// the rejected session is never redialed
+	for i := 0; i < 100 && cli.CountSession() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cli.CountSession(); n != 0 {
+		t.Fatalf("expect the rejected session removed, got %d sessions", n)
+	}
+	// the reason is kept, instead of CodeConnClosed
+	var reply string
+	rerr := sess.Pull("/echo", "a", &reply).Rerror()
+	if rerr == nil || rerr.Code != CodeUnauthorized || rerr.Detail != "banned" {
+		t.Fatalf("expect the rejection reason, got %v", rerr)
+	}
+	if n := srv.CountSession(); n != 0 {
+		t.Fatalf("expect no accepted session, got %d", n)
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	var ss SessionStats
+	if ss.RTT() != 0 || ss.LastRTT() != 0 || ss.RecentErrors() != 0 {
+		t.Fatal("expect zero statistics without samples")
+	}
+	// the first sample is the smoothed RTT
+	ss.ObserveRTT(80 * time.Millisecond)
+	if ss.RTT() != 80*time.Millisecond {
+		t.Fatalf("srtt: want 80ms, have %v", ss.RTT())
+	}
+	// SRTT = 7/8*SRTT + 1/8*RTT
+	ss.ObserveRTT(160 * time.Millisecond)
+	if ss.RTT() != 90*time.Millisecond || ss.LastRTT() != 160*time.Millisecond {
+		t.Fatalf("srtt: want 90ms, have %v, last: %v", ss.RTT(), ss.LastRTT())
+	}
+	for i := 0; i < 3; i++ {
+		ss.ObserveError()
+	}
+	if n := ss.RecentErrors(); n != 3 {
+		t.Fatalf("recent errors: want 3, have %d", n)
+	}
+	// the errors out of the window are not counted
+	for i := range ss.errorSlots {
+		ss.errorSlots[i].slot -= sessionErrorSlots
+	}
+	if n := ss.RecentErrors(); n != 0 {
+		t.Fatalf("recent errors: want 0 after the window, have %d", n)
+	}
+	ss.ObserveError()
+	if n := ss.RecentErrors(); n != 1 {
+		t.Fatalf("recent errors: want 1 in the reused slot, have %d", n)
+	}
+}
+
+func TestMaxPullAge(t *testing.T) {
+	release := make(chan struct{})
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *int) (int, *Rerror) {
+		if *arg < 0 {
+			<-release
+		}
+		return *arg, nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{MaxPullAge: 100 * time.Millisecond})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	var reply int
+	start := time.Now()
+	rerr := sess.Pull("/echo", -1, &reply).Rerror()
+	if rerr == nil || rerr.Code != CodePullTimeout {
+		t.Fatalf("expect CodePullTimeout, got %v", rerr)
+	}
+	if cost := time.Since(start); cost < 100*time.Millisecond || cost > time.Second {
+		t.Fatalf("expect swept after about 100ms-150ms, got %v", cost)
+	}
+	var pending int
+	sess.(*session).pullCmdMap.Range(func(_, _ interface{}) bool {
+		pending++
+		return true
+	})
+	if pending != 0 {
+		t.Fatalf("expect the swept pull removed, got %d pending", pending)
+	}
+	// the late reply is discarded
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if rerr = sess.Pull("/echo", 1, &reply).Rerror(); rerr != nil || reply != 1 {
+		t.Fatalf("expect 1, got %d, %v", reply, rerr)
+	}
+}
+
+func TestPushAck(t *testing.T) {
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePushFuncAt("/push", func(ctx PushCtx, arg *int) *Rerror {
+		if *arg < 0 {
+			return NewRerror(100, "negative", "")
+		}
+		time.Sleep(time.Duration(*arg) * time.Millisecond)
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	// waits until the handler returns, without timeout
+	start := time.Now()
+	if rerr := sess.PushAck("/push", 100, 0); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if cost := time.Since(start); cost < 100*time.Millisecond {
+		t.Fatalf("expect acknowledged after handling, got %v", cost)
+	}
+	// carries the status of the handler
+	if rerr := sess.PushAck("/push", -1, time.Second); rerr == nil || rerr.Code != 100 {
+		t.Fatalf("expect the handler error, got %v", rerr)
+	}
+	if rerr := sess.PushAck("/unknown", 0, time.Second); rerr == nil || rerr.Code != CodeNotFound {
+		t.Fatalf("expect CodeNotFound, got %v", rerr)
+	}
+	if rerr := sess.PushAck("/push", 300, 50*time.Millisecond); rerr == nil || rerr.Code != CodeAckTimeout {
+		t.Fatalf("expect CodeAckTimeout, got %v", rerr)
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	if err := (&PeerConfig{WriteQueuePolicy: "unknown"}).check(); err == nil {
+		t.Fatal("expect the invalid policy rejected")
+	}
+	body := strings.Repeat("a", 1<<20)
+	// pushes to the client that never reads, until the write queue is full
+	fill := func(policy string) []*Rerror {
+		srv := NewPeer(PeerConfig{MaxWriteQueue: 2, WriteQueuePolicy: policy})
+		addr := serveTest(t, srv)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess := waitSession(t, srv)
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			rerrs []*Rerror
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				defer cancel()
+				if rerr := sess.Push("/notify", body, WithContext(ctx)); rerr != nil {
+					mu.Lock()
+					rerrs = append(rerrs, rerr)
+					mu.Unlock()
+				}
+			}()
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := sess.WriteQueueLen(); policy == WriteQueueBlock && n != 2 {
+			t.Errorf("expect the full write queue, got %d", n)
+		}
+		wg.Wait()
+		conn.Close()
+		srv.Close()
+		return rerrs
+	}
+
+	// the blocked writers fail after the context is done
+	rerrs := fill(WriteQueueBlock)
+	if len(rerrs) == 0 {
+		t.Fatal("expect the blocked pushes failed")
+	}
+	for _, rerr := range rerrs {
+		if rerr.Code != CodeWriteFailed || strings.Contains(rerr.Detail, "write queue is full") {
+			t.Fatalf("expect failed by the context, got %v", rerr)
+		}
+	}
+
+	rerrs = fill(WriteQueueDropPush)
+	var dropped int
+	for _, rerr := range rerrs {
+		if rerr.Code == CodeWriteFailed && strings.Contains(rerr.Detail, "write queue is full, drop the push") {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatalf("expect the pushes dropped, got %v", rerrs)
+	}
+
+	rerrs = fill(WriteQueueCloseSession)
+	var closed bool
+	for _, rerr := range rerrs {
+		if rerr.Code == CodeConnClosed && rerr.Detail == "write queue is full" {
+			closed = true
+		}
+	}
+	if !closed {
+		t.Fatalf("expect the session closed, got %v", rerrs)
+	}
+}
+
+func TestPushReceipt(t *testing.T) {
+	release := make(chan struct{})
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePushFuncAt("/push", func(ctx PushCtx, arg *int) *Rerror {
+		if *arg < 0 {
+			return NewRerror(100, "negative", "")
+		}
+		return nil
+	})
+	srv.RoutePushFuncAt("/block", func(ctx PushCtx, arg *int) *Rerror {
+		<-release
+		return nil
+	})
+	addr := serveTest(t, srv)
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	sess := dialTest(t, cli, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// delivered
+	receipt := sess.AsyncPushAck("/push", 1)
+	if rerr := receipt.Wait(ctx); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if receipt.Status() != DeliveryDelivered || receipt.Rerror() != nil {
+		t.Fatalf("expect delivered, got %s, %v", receipt.Status(), receipt.Rerror())
+	}
+	// failed by the handler, with its own sequence
+	failed := sess.AsyncPushAck("/push", -1)
+	if failed.Seq() == receipt.Seq() {
+		t.Fatalf("expect different sequences, got %s", failed.Seq())
+	}
+	<-failed.Done()
+	if failed.Status() != DeliveryFailed || failed.Rerror() == nil || failed.Rerror().Code != 100 {
+		t.Fatalf("expect failed by the handler, got %s, %v", failed.Status(), failed.Rerror())
+	}
+
+	// still tracked after the wait times out
+	blocked := sess.AsyncPushAck("/block", 1)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	if rerr := blocked.Wait(shortCtx); rerr == nil || rerr.Code != CodeAckTimeout {
+		t.Fatalf("expect CodeAckTimeout, got %v", rerr)
+	}
+	if blocked.Status() != DeliverySent || blocked.Rerror() != nil {
+		t.Fatalf("expect still sent, got %s, %v", blocked.Status(), blocked.Rerror())
+	}
+	// failed when disconnected before the acknowledgement
+	sess.Close()
+	close(release)
+	if rerr := blocked.Wait(ctx); rerr == nil || rerr.Code != CodeConnClosed {
+		t.Fatalf("expect CodeConnClosed, got %v", rerr)
+	}
+	if blocked.Status() != DeliveryFailed {
+		t.Fatalf("expect failed, got %s", blocked.Status())
+	}
+	// failed immediately when not written
+	notWritten := sess.AsyncPushAck("/push", 1)
+	select {
+	case <-notWritten.Done():
+	default:
+		t.Fatal("expect finished without writing")
+	}
+	if notWritten.Status() != DeliveryFailed || notWritten.Rerror() == nil {
+		t.Fatalf("expect failed, got %s, %v", notWritten.Status(), notWritten.Rerror())
+	}
+	if s := DeliveryStatus(9).String(); s != "unknown" {
+		t.Fatalf("expect unknown, got %s", s)
+	}
+}
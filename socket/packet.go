@@ -57,6 +57,16 @@ type (
 		xferPipe *xfer.XferPipe
 		// packet size
 		size uint32
+		// the size limit of the packet to read, if 0, only PacketSizeLimit() is checked
+		sizeLimit uint32
+		// encoded body size, before transfer filtering
+		bodySize uint32
+		// packet size before transfer filtering, 0 means not filtered
+		unfilteredSize uint32
+		// whether to allocate the raw bytes body by the BodyAllocator
+		useBodyAllocator bool
+		// the raw bytes body allocated by the BodyAllocator, freed when reset
+		allocatedBody []byte
 		// ctx is the packet handling context,
 		// carries a deadline, a cancelation signal,
 		// and other values across API boundaries.
@@ -166,6 +176,11 @@ func NewPacket(settings ...PacketSetting) *Packet {
 //  newBodyFunc is only for reading form connection;
 //  settings are only for writing to connection.
 func (p *Packet) Reset(settings ...PacketSetting) {
+	if p.allocatedBody != nil {
+		bodyAllocator.Free(p.allocatedBody)
+		p.allocatedBody = nil
+	}
+	p.useBodyAllocator = false
 	p.next = nil
 	p.body = nil
 	p.meta.Reset()
@@ -176,6 +191,9 @@ func (p *Packet) Reset(settings ...PacketSetting) {
 	p.uri = ""
 	p.uriObject = nil
 	p.size = 0
+	p.sizeLimit = 0
+	p.bodySize = 0
+	p.unfilteredSize = 0
 	p.ctx = nil
 	p.bodyCodec = codec.NilCodecId
 	p.doSetting(settings...)
@@ -306,7 +324,9 @@ func (p *Packet) MarshalBody() ([]byte, error) {
 // Note:
 //  seq, ptype, uri must be setted already;
 //  if body=nil, try to use newBodyFunc to create a new one;
-//  when the body is a stream of bytes, no unmarshalling is done.
+//  when the body is a stream of bytes, no unmarshalling is done;
+//  if failed, tries the codecs set by SetBodyCodecFallback in order,
+//  and the first succeeded one becomes the body codec of the packet.
 func (p *Packet) UnmarshalBody(bodyBytes []byte) error {
 	if p.body == nil && p.newBodyFunc != nil {
 		p.body = p.newBodyFunc(p)
@@ -317,21 +337,50 @@ func (p *Packet) UnmarshalBody(bodyBytes []byte) error {
 	switch body := p.body.(type) {
 	default:
 		c, err := codec.Get(p.bodyCodec)
-		if err != nil {
-			return err
+		if err == nil {
+			err = c.Unmarshal(bodyBytes, p.body)
+			if err == nil {
+				return nil
+			}
+		}
+		for _, id := range bodyCodecFallback {
+			if id == p.bodyCodec {
+				continue
+			}
+			c, _err := codec.Get(id)
+			if _err != nil {
+				continue
+			}
+			if c.Unmarshal(bodyBytes, p.body) == nil {
+				p.bodyCodec = id
+				return nil
+			}
 		}
-		return c.Unmarshal(bodyBytes, p.body)
+		return err
 	case nil:
 		return nil
 	case *[]byte:
 		if body != nil {
-			*body = make([]byte, len(bodyBytes))
+			// only the first one is allocated, since bodyBytes may be the allocated one, e.g. rebinding
+			if p.useBodyAllocator && p.allocatedBody == nil {
+				p.allocatedBody = bodyAllocator.Alloc(len(bodyBytes))
+				*body = p.allocatedBody
+			} else {
+				*body = make([]byte, len(bodyBytes))
+			}
 			copy(*body, bodyBytes)
 		}
 		return nil
 	}
 }
 
+// UseBodyAllocator makes the raw bytes body be allocated by the BodyAllocator when unmarshalling,
+// and freed when the packet is reset.
+// Note: the body must not be retained after the packet is reset.
+func (p *Packet) UseBodyAllocator() {
+	p.useBodyAllocator = true
+}
+
 // XferPipe returns transfer filter pipe, handlers from outer-most to inner-most.
 // Note: the length can not be bigger than 255!
 func (p *Packet) XferPipe() *xfer.XferPipe {
@@ -346,7 +395,7 @@ func (p *Packet) Size() uint32 {
 // SetSize sets the size of packet.
 // If the size is too big, returns error.
 func (p *Packet) SetSize(size uint32) error {
-	err := checkPacketSize(size)
+	err := p.CheckSize(size)
 	if err != nil {
 		return err
 	}
@@ -354,6 +403,42 @@ func (p *Packet) SetSize(size uint32) error {
 	return nil
 }
 
+// CheckSize checks whether the size exceeds the limit of the packet,
+// which is the smaller one of PacketSizeLimit() and the one set by WithSizeLimit.
+// Note: the protocols should check the size of the transfer-filtered data by it, e.g. the decompressed one.
+func (p *Packet) CheckSize(size uint32) error {
+	if err := checkPacketSize(size); err != nil {
+		return err
+	}
+	if p.sizeLimit > 0 && size > p.sizeLimit {
+		return ErrExceedPacketSizeLimit
+	}
+	return nil
+}
+
+// BodySize returns the size of the encoded body, before transfer filtering.
+// Note: it is set by the protocol when packing or unpacking.
+func (p *Packet) BodySize() uint32 {
+	return p.bodySize
+}
+
+// SetBodySize sets the size of the encoded body.
+func (p *Packet) SetBodySize(bodySize uint32) {
+	p.bodySize = bodySize
+}
+
+// UnfilteredSize returns the size of packet as if it were not transfer-filtered, e.g. uncompressed,
+// 0 if the transfer pipe is empty.
+// Note: it is set by the protocol when packing or unpacking.
+func (p *Packet) UnfilteredSize() uint32 {
+	return p.unfilteredSize
+}
+
+// SetUnfilteredSize sets the size of packet as if it were not transfer-filtered.
+func (p *Packet) SetUnfilteredSize(unfilteredSize uint32) {
+	p.unfilteredSize = unfilteredSize
+}
+
 const packetFormat = `
 {
   "seq": %q,
@@ -474,6 +559,13 @@ func WithNewBody(newBodyFunc NewBodyFunc) PacketSetting {
 	}
 }
 
+// WithSizeLimit sets the size limit of the packet to read, if 0, only PacketSizeLimit() is checked.
+func WithSizeLimit(maxSize uint32) PacketSetting {
+	return func(p *Packet) {
+		p.sizeLimit = maxSize
+	}
+}
+
 // WithXferPipe sets transfer filter pipe.
 func WithXferPipe(filterId ...byte) PacketSetting {
 	return func(p *Packet) {
@@ -502,6 +594,60 @@ func SetPacketSizeLimit(maxPacketSize uint32) {
 	}
 }
 
+// BodyAllocator allocates the buffers of the raw bytes bodies read from the connection,
+// e.g. an arena or off-heap allocator for the extremely high-throughput relays.
+// Note: It must be concurrent safe.
+type BodyAllocator interface {
+	// Alloc returns a buffer whose length is n.
+	Alloc(n int) []byte
+	// Free releases the buffer returned by Alloc, which is no longer used.
+	Free(b []byte)
+}
+
+// heapAllocator the default BodyAllocator allocating on the heap, and leaving the freeing to GC.
+type heapAllocator struct{}
+
+func (heapAllocator) Alloc(n int) []byte {
+	return make([]byte, n)
+}
+
+func (heapAllocator) Free([]byte) {}
+
+var bodyAllocator BodyAllocator = heapAllocator{}
+
+// GetBodyAllocator returns the allocator of the raw bytes bodies.
+func GetBodyAllocator() BodyAllocator {
+	return bodyAllocator
+}
+
+// SetBodyAllocator sets the allocator of the raw bytes bodies, if nil, uses the default one allocating on the heap.
+// Note:
+//  It should be called before reading any packet;
+//  Only the packets calling UseBodyAllocator are allocated by it, e.g. the input of the unknown handlers.
+func SetBodyAllocator(allocator BodyAllocator) {
+	if allocator == nil {
+		allocator = heapAllocator{}
+	}
+	bodyAllocator = allocator
+}
+
+var bodyCodecFallback []byte
+
+// BodyCodecFallback returns the body codecs tried in order when unmarshalling the body fails.
+func BodyCodecFallback() []byte {
+	return bodyCodecFallback
+}
+
+// SetBodyCodecFallback sets the body codecs tried in order when unmarshalling the body fails,
+// e.g. SetBodyCodecFallback(codec.ID_PROTOBUF, codec.ID_JSON) during the migration period
+// when the mixed-version peers coexist.
+// Note:
+//  It should be called before reading any packet;
+//  the unregistered codecs are skipped.
+func SetBodyCodecFallback(codecIds ...byte) {
+	bodyCodecFallback = append([]byte(nil), codecIds...)
+}
+
 func checkPacketSize(packetSize uint32) error {
 	if packetSize > packetSizeLimit {
 		return ErrExceedPacketSizeLimit
@@ -2,11 +2,13 @@ package socket
 
 import (
 	"testing"
+
+	"github.com/henrylee2cn/teleport/codec"
 )
 
 func TestPacketString(t *testing.T) {
 	var p = NewPacket()
-	p.SetSeq(21)
+	p.SetSeq("21")
 	p.XferPipe().Append('g')
 	p.SetPtype(3)
 	p.SetSize(300)
@@ -19,3 +21,62 @@ func TestPacketString(t *testing.T) {
 	t.Logf("%%#v:%#v", p)
 	t.Logf("%%+v:%+v", p)
 }
+
+func TestBodyCodecFallback(t *testing.T) {
+	defer SetBodyCodecFallback()
+	var body map[string]int
+	p := NewPacket()
+	p.SetBody(&body)
+	p.SetBodyCodec(codec.ID_PROTOBUF)
+	if err := p.UnmarshalBody([]byte(`{"a":1}`)); err == nil {
+		t.Fatal("expect an error without fallback")
+	}
+	SetBodyCodecFallback(codec.ID_PROTOBUF, codec.ID_JSON)
+	if err := p.UnmarshalBody([]byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if body["a"] != 1 || p.BodyCodec() != codec.ID_JSON {
+		t.Fatalf("body: %v, codec: %c", body, p.BodyCodec())
+	}
+}
+
+type countingAllocator struct {
+	allocs, frees int
+}
+
+func (a *countingAllocator) Alloc(n int) []byte {
+	a.allocs++
+	return make([]byte, n)
+}
+
+func (a *countingAllocator) Free([]byte) {
+	a.frees++
+}
+
+func TestBodyAllocator(t *testing.T) {
+	a := new(countingAllocator)
+	SetBodyAllocator(a)
+	defer SetBodyAllocator(nil)
+	var body []byte
+	p := NewPacket()
+	p.SetBody(&body)
+	p.UseBodyAllocator()
+	if err := p.UnmarshalBody([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "abc" || a.allocs != 1 || a.frees != 0 {
+		t.Fatalf("body: %q, allocs: %d, frees: %d", body, a.allocs, a.frees)
+	}
+	p.Reset()
+	if a.frees != 1 {
+		t.Fatalf("expect freed when reset, frees: %d", a.frees)
+	}
+	// not used unless UseBodyAllocator is called
+	p.SetBody(&body)
+	if err := p.UnmarshalBody([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if a.allocs != 1 {
+		t.Fatalf("allocs: %d", a.allocs)
+	}
+}
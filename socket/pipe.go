@@ -0,0 +1,122 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/henrylee2cn/goutil/errors"
+)
+
+// PipeListener an in-memory listener whose connections are net.Pipe-backed.
+// Note:
+//  It is useful for tests that do not want to occupy real ports, e.g.
+//  lis := socket.NewPipeListener("test")
+//  go srv.ServeListener(lis)
+//  conn, _ := lis.Dial()
+//  sess, _ := cli.ServeConn(conn)
+type PipeListener struct {
+	addr      pipeAddr
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	seq       uint64
+}
+
+// ErrPipeListenerClosed the pipe listener is closed error.
+var ErrPipeListenerClosed = errors.New("pipe listener is closed")
+
+// NewPipeListener creates an in-memory listener with the address name.
+func NewPipeListener(name string) *PipeListener {
+	return &PipeListener{
+		addr:    pipeAddr(name),
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, ErrPipeListenerClosed
+	}
+}
+
+// Close closes the listener.
+// Note: The connections that have been accepted are not closed.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+	return nil
+}
+
+// Addr returns the listener's network address.
+func (l *PipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects with the listener, and returns the client side of the connection.
+// Note:
+//  Every connection has a unique client address, e.g. "test:1",
+//  so the sessions accepted by the server side are distinguishable.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	clientAddr := pipeAddr(string(l.addr) + ":" + strconv.FormatUint(atomic.AddUint64(&l.seq, 1), 10))
+	c1, c2 := net.Pipe()
+	serverConn := &pipeConn{Conn: c1, localAddr: l.addr, remoteAddr: clientAddr}
+	clientConn := &pipeConn{Conn: c2, localAddr: clientAddr, remoteAddr: l.addr}
+	select {
+	case l.connCh <- serverConn:
+		return clientConn, nil
+	case <-l.closeCh:
+		c1.Close()
+		c2.Close()
+		return nil, ErrPipeListenerClosed
+	}
+}
+
+type pipeAddr string
+
+// Network returns the network name "pipe".
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String returns the address name.
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// LocalAddr returns the local network address.
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
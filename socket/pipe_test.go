@@ -0,0 +1,51 @@
+package socket
+
+import (
+	"testing"
+)
+
+func TestPipeListener(t *testing.T) {
+	lis := NewPipeListener("test")
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s := NewSocket(conn)
+		var body string
+		p := NewPacket(WithNewBody(func(Header) interface{} { return &body }))
+		if err = s.ReadPacket(p); err != nil {
+			t.Error(err)
+			return
+		}
+		p.SetUri(p.Uri() + "/reply")
+		if err = s.WritePacket(p); err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := lis.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.LocalAddr().String() != "test:1" || conn.RemoteAddr().String() != "test" {
+		t.Fatalf("addr: local=%s, remote=%s", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	s := NewSocket(conn)
+	p := NewPacket(WithSeq("1"), WithUri("/a"), WithBody("hello"), WithBodyCodec('s'))
+	if err = s.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	p = NewPacket(WithNewBody(func(Header) interface{} { return &body }))
+	if err = s.ReadPacket(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Uri() != "/a/reply" || body != "hello" {
+		t.Fatalf("uri=%s, body=%s", p.Uri(), body)
+	}
+	lis.Close()
+	if _, err = lis.Dial(); err != ErrPipeListenerClosed {
+		t.Fatalf("dial closed listener: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
 
@@ -123,6 +124,7 @@ func (f *fastProto) Pack(p *Packet) error {
 	}
 
 	// do transfer pipe
+	unfilteredLen := bb.Len()
 	payload, err := p.XferPipe().OnPack(bb.B[prefixLen:])
 	if err != nil {
 		return err
@@ -134,6 +136,9 @@ func (f *fastProto) Pack(p *Packet) error {
 	if err != nil {
 		return err
 	}
+	if p.XferPipe().Len() > 0 {
+		p.SetUnfilteredSize(uint32(unfilteredLen))
+	}
 
 	// reset real size
 	binary.BigEndian.PutUint32(bb.B, p.Size())
@@ -170,6 +175,7 @@ func (f *fastProto) writeBody(bb *utils.ByteBuffer, p *Packet) error {
 	if err != nil {
 		return err
 	}
+	p.SetBodySize(uint32(len(bodyBytes)))
 	bb.Write(bodyBytes)
 	return nil
 }
@@ -188,16 +194,51 @@ func (f *fastProto) Unpack(p *Packet) error {
 	// do transfer pipe
 	data, err := p.XferPipe().OnUnpack(bb.B)
 	if err != nil {
-		return err
+		return &FilterError{Err: err}
+	}
+	if p.XferPipe().Len() > 0 {
+		if err = p.CheckSize(uint32(len(data))); err != nil {
+			return err
+		}
+		p.SetUnfilteredSize(p.Size() - uint32(len(bb.B)) + uint32(len(data)))
 	}
 	// header
-	data = f.readHeader(data, p)
+	data, err = f.readHeader(data, p)
+	if err != nil {
+		return err
+	}
 	// body
 	return f.readBody(data, p)
 }
 
 var errProtoUnmatch = errors.New("mismatched protocol")
 
+// ErrMalformedPacket the packet is truncated or has the invalid field lengths.
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// FilterError the error of the transfer filters on unpacking,
+// e.g. the checksum failure or the corrupt data of gzip.
+type FilterError struct {
+	Err error
+}
+
+// Error implements error interface.
+func (e *FilterError) Error() string {
+	return "transfer filter: " + e.Err.Error()
+}
+
+// BodyCodecError the error of decoding the body by its codec,
+// e.g. the remote peer encodes it by another codec than the declared one.
+type BodyCodecError struct {
+	BodyCodec byte
+	Err       error
+}
+
+// Error implements error interface.
+func (e *BodyCodecError) Error() string {
+	return fmt.Sprintf("body codec %d: %s", e.BodyCodec, e.Err.Error())
+}
+
 func (f *fastProto) readPacket(bb *utils.ByteBuffer, p *Packet) error {
 	f.rMu.Lock()
 	defer f.rMu.Unlock()
@@ -237,34 +278,64 @@ func (f *fastProto) readPacket(bb *utils.ByteBuffer, p *Packet) error {
 	}
 	// read last all
 	var lastLen = int(size) - 4 - 1 - 1 - int(xferLen)
+	if lastLen < 0 {
+		return ErrMalformedPacket
+	}
 	bb.ChangeLen(lastLen)
 	_, err = io.ReadFull(f.r, bb.B)
 	return err
 }
 
-func (f *fastProto) readHeader(data []byte, p *Packet) []byte {
+func (f *fastProto) readHeader(data []byte, p *Packet) ([]byte, error) {
+	var (
+		field []byte
+		ok    bool
+	)
 	// seq
-	seqLen := binary.BigEndian.Uint32(data)
-	data = data[4:]
-	p.SetSeq(string(data[:seqLen]))
-	data = data[seqLen:]
+	if field, data, ok = cutLenPrefixed(data); !ok {
+		return nil, ErrMalformedPacket
+	}
+	p.SetSeq(string(field))
 	// type
+	if len(data) == 0 {
+		return nil, ErrMalformedPacket
+	}
 	p.SetPtype(data[0])
 	data = data[1:]
 	// uri
-	uriLen := binary.BigEndian.Uint32(data)
-	data = data[4:]
-	p.SetUri(string(data[:uriLen]))
-	data = data[uriLen:]
+	if field, data, ok = cutLenPrefixed(data); !ok {
+		return nil, ErrMalformedPacket
+	}
+	p.SetUri(string(field))
 	// meta
-	metaLen := binary.BigEndian.Uint32(data)
+	if field, data, ok = cutLenPrefixed(data); !ok {
+		return nil, ErrMalformedPacket
+	}
+	p.Meta().ParseBytes(field)
+	return data, nil
+}
+
+// cutLenPrefixed cuts the field prefixed with the 4-byte length from the front of data.
+func cutLenPrefixed(data []byte) (field, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, data, false
+	}
+	n := binary.BigEndian.Uint32(data)
 	data = data[4:]
-	p.Meta().ParseBytes(data[:metaLen])
-	data = data[metaLen:]
-	return data
+	if uint64(n) > uint64(len(data)) {
+		return nil, data, false
+	}
+	return data[:n], data[n:], true
 }
 
 func (f *fastProto) readBody(data []byte, p *Packet) error {
+	if len(data) == 0 {
+		return ErrMalformedPacket
+	}
 	p.SetBodyCodec(data[0])
-	return p.UnmarshalBody(data[1:])
+	p.SetBodySize(uint32(len(data) - 1))
+	if err := p.UnmarshalBody(data[1:]); err != nil {
+		return &BodyCodecError{BodyCodec: data[0], Err: err}
+	}
+	return nil
 }
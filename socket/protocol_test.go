@@ -0,0 +1,124 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFastProtoMeta(t *testing.T) {
+	var buf bytes.Buffer
+	proto := NewFastProtoFunc(&buf)
+	out := GetPacket(
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/a/b"),
+		WithSetMeta("token", "abc"),
+		WithAddMeta("hint", "x"),
+		WithAddMeta("hint", "y"),
+		WithBody("body"),
+		WithBodyCodec('s'),
+	)
+	if err := proto.Pack(out); err != nil {
+		t.Fatal(err)
+	}
+	in := GetPacket(WithNewBody(func(Header) interface{} { return new(string) }))
+	if err := proto.Unpack(in); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(in.Meta().Peek("token")); v != "abc" {
+		t.Fatalf("meta token: %q", v)
+	}
+	if hints := in.Meta().PeekMulti("hint"); len(hints) != 2 || string(hints[0]) != "x" || string(hints[1]) != "y" {
+		t.Fatalf("meta hint: %q", hints)
+	}
+	if body := *in.Body().(*string); body != "body" {
+		t.Fatalf("body: %q", body)
+	}
+}
+
+func packFast(t *testing.T, settings ...PacketSetting) []byte {
+	var buf bytes.Buffer
+	out := GetPacket(append([]PacketSetting{
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/a/b"),
+		WithSetMeta("token", "abc"),
+		WithBody("body"),
+		WithBodyCodec('s'),
+	}, settings...)...)
+	defer PutPacket(out)
+	if err := NewFastProtoFunc(&buf).Pack(out); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func unpackFast(frame []byte, settings ...PacketSetting) error {
+	in := GetPacket(append([]PacketSetting{WithNewBody(func(Header) interface{} { return new(string) })}, settings...)...)
+	defer PutPacket(in)
+	return NewFastProtoFunc(bytes.NewBuffer(frame)).Unpack(in)
+}
+
+func TestFastProtoTruncated(t *testing.T) {
+	frame := packFast(t)
+	if err := unpackFast(frame); err != nil {
+		t.Fatal(err)
+	}
+	// cut the frame at every length before the body, keeping the declared size consistent
+	for n := 6; n < len(frame)-len("body"); n++ {
+		b := append([]byte(nil), frame[:n]...)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		if err := unpackFast(b); err == nil {
+			t.Fatalf("truncated to %d bytes: expect error", n)
+		}
+	}
+	// declare more than the stream has
+	if err := unpackFast(frame[:len(frame)-1]); err == nil {
+		t.Fatal("short stream: expect error")
+	}
+	// declare a field longer than the frame
+	b := append([]byte(nil), frame...)
+	binary.BigEndian.PutUint32(b[6:], math.MaxUint32)
+	if err := unpackFast(b); err != ErrMalformedPacket {
+		t.Fatalf("seq length overflow: %v", err)
+	}
+}
+
+func TestFastProtoFuzz(t *testing.T) {
+	frame := packFast(t)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := append([]byte(nil), frame...)
+		for j := r.Intn(4); j >= 0; j-- {
+			b[4+r.Intn(len(b)-4)] = byte(r.Intn(256))
+		}
+		unpackFast(b) // must not panic
+		noise := make([]byte, 4+r.Intn(64))
+		r.Read(noise)
+		binary.BigEndian.PutUint32(noise, uint32(len(noise)))
+		unpackFast(noise)
+	}
+}
+
+func TestFastProtoSizeLimit(t *testing.T) {
+	frame := packFast(t)
+	if err := unpackFast(frame, WithSizeLimit(uint32(len(frame)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackFast(frame, WithSizeLimit(uint32(len(frame)-1))); err != ErrExceedPacketSizeLimit {
+		t.Fatalf("expect ErrExceedPacketSizeLimit, got %v", err)
+	}
+	// the decompressed data is also limited
+	big := strings.Repeat("a", 1<<16)
+	frame = packFast(t, WithBody(big), WithXferPipe('g'))
+	if err := unpackFast(frame, WithSizeLimit(uint32(len(frame))+1024)); err != ErrExceedPacketSizeLimit {
+		t.Fatalf("gzip: expect ErrExceedPacketSizeLimit, got %v", err)
+	}
+	if err := unpackFast(frame, WithSizeLimit(1<<17)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// NewWebsocketSocket wraps a websocket connection as a Socket.
+// Note:
+//  Every packet is written as a binary frame, so that browsers can act as peers;
+//  The protocol is the same as that of the TCP socket.
+func NewWebsocketSocket(ws *websocket.Conn, protoFunc ...ProtoFunc) Socket {
+	return newSocket(NewWebsocketConn(ws), protoFunc)
+}
+
+// NewWebsocketConn adapts the server-side websocket connection to a net.Conn that writes binary frames.
+// Note:
+//  The addresses are those of the underlying TCP connection,
+//  rather than the origin and location of the websocket.
+func NewWebsocketConn(ws *websocket.Conn) net.Conn {
+	c := &websocketConn{
+		Conn:       ws,
+		localAddr:  ws.LocalAddr(),
+		remoteAddr: ws.RemoteAddr(),
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	if req := ws.Request(); req != nil {
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			c.localAddr = addr
+		}
+		if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+			c.remoteAddr = addr
+		}
+	}
+	return c
+}
+
+// NewWebsocketClientConn does the client-side websocket handshake on conn,
+// and returns a net.Conn that writes binary frames.
+// Note:
+//  The addresses are those of conn;
+//  If the handshake fails, conn is closed.
+func NewWebsocketClientConn(config *websocket.Config, conn net.Conn) (net.Conn, error) {
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &websocketConn{
+		Conn:       ws,
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+	}, nil
+}
+
+type websocketConn struct {
+	*websocket.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// LocalAddr returns the local network address.
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
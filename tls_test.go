@@ -0,0 +1,113 @@
+package tp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestTlsConfig returns the TLS config with a self-signed certificate for 127.0.0.1.
+func newTestTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"teleport"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// freeAddr returns a free local address.
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// dialRetry dials the address until the listener is ready.
+func dialRetry(t *testing.T, cli Peer, addr string) Session {
+	var (
+		sess Session
+		rerr *Rerror
+	)
+	for i := 0; i < 100; i++ {
+		if sess, rerr = cli.Dial(addr); rerr == nil {
+			return sess
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(rerr)
+	return nil
+}
+
+func TestPlaintextAddress(t *testing.T) {
+	echo := func(ctx PullCtx, arg *string) (string, *Rerror) {
+		_, isTls := ctx.Session().(*session).getConn().(*tls.Conn)
+		if isTls {
+			return "tls:" + *arg, nil
+		}
+		return "plain:" + *arg, nil
+	}
+	tlsAddr, plainAddr := freeAddr(t), freeAddr(t)
+	srv := NewPeer(PeerConfig{ListenAddress: tlsAddr, PlaintextAddress: plainAddr})
+	defer srv.Close()
+	srv.SetTlsConfig(newTestTlsConfig(t))
+	srv.RoutePullFuncAt("/echo", echo)
+	go srv.ListenAndServe()
+
+	// both ports are served with the same routers
+	tlsCli := NewPeer(PeerConfig{})
+	defer tlsCli.Close()
+	tlsCli.SetTlsConfig(&tls.Config{InsecureSkipVerify: true})
+	plainCli := NewPeer(PeerConfig{})
+	defer plainCli.Close()
+	for _, c := range []struct {
+		cli    Peer
+		addr   string
+		expect string
+	}{
+		{tlsCli, tlsAddr, "tls:a"},
+		{plainCli, plainAddr, "plain:a"},
+	} {
+		var reply string
+		rerr := dialRetry(t, c.cli, c.addr).Pull("/echo", "a", &reply).Rerror()
+		if rerr != nil || reply != c.expect {
+			t.Fatalf("%s: expect %s, got %q, %v", c.addr, c.expect, reply, rerr)
+		}
+	}
+
+	// the plaintext port is not served without the TLS config
+	tlsAddr, plainAddr = freeAddr(t), freeAddr(t)
+	plainOnly := NewPeer(PeerConfig{ListenAddress: tlsAddr, PlaintextAddress: plainAddr})
+	defer plainOnly.Close()
+	plainOnly.RoutePullFuncAt("/echo", echo)
+	go plainOnly.ListenAndServe()
+	var reply string
+	if rerr := dialRetry(t, plainCli, tlsAddr).Pull("/echo", "b", &reply).Rerror(); rerr != nil || reply != "plain:b" {
+		t.Fatalf("expect plain:b, got %q, %v", reply, rerr)
+	}
+	if _, rerr := plainCli.Dial(plainAddr); rerr == nil {
+		t.Fatal("expect the plaintext port not served")
+	}
+}
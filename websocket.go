@@ -0,0 +1,126 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+	"golang.org/x/net/websocket"
+)
+
+// ListenAndServeWebsocket turns on the websocket listening service at the path,
+// e.g. ListenAndServeWebsocket(":8080", "/ws").
+// Note:
+//  Every packet is carried by a binary frame, and the router and session semantics are unchanged;
+//  If the TLS config is set, serves wss.
+func (p *peer) ListenAndServeWebsocket(addr, path string, protoFunc ...socket.ProtoFunc) error {
+	if len(addr) == 0 {
+		Fatalf("websocket listen address can not be empty")
+	}
+	lis, err := NewInheritListener("tcp", addr, p.tlsConfig)
+	if err != nil {
+		Fatalf("%v", err)
+	}
+	defer lis.Close()
+
+	Printf("listen and serve websocket (network:%s, addr:%s, path:%s)", lis.Addr().Network(), lis.Addr().String(), path)
+
+	p.pluginContainer.postListen(lis.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Handler(func(ws *websocket.Conn) {
+		p.serveWebsocket(ws, protoFunc)
+	}))
+	err = (&http.Server{Handler: mux}).Serve(lis)
+	select {
+	case <-p.closeCh:
+		return ErrListenClosed
+	default:
+		return err
+	}
+}
+
+// serveWebsocket serves the accepted websocket connection until it is closed.
+func (p *peer) serveWebsocket(ws *websocket.Conn, protoFuncs []socket.ProtoFunc) {
+	var sess = newSession(p, socket.NewWebsocketConn(ws), protoFuncs)
+	if rerr := p.checkAccept(sess); rerr != nil {
+		sess.reject(rerr)
+		return
+	}
+	Tracef("accept websocket ok (addr:%s, id:%s)", sess.RemoteAddr().String(), sess.Id())
+	p.addSession(sess)
+	sess.startReadAndHandle()
+}
+
+// DialWebsocket connects with the websocket peer of the url,
+// e.g. DialWebsocket("ws://127.0.0.1:8080/ws").
+// Note:
+//  For wss, the TLS config of the peer is used if set;
+//  Supports automatically redials after disconnection, the same as Dial.
+func (p *peer) DialWebsocket(rawurl string, protoFunc ...socket.ProtoFunc) (Session, *Rerror) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, rerrDialFailed.Copy().SetDetail(err.Error())
+	}
+	var (
+		addr   = u.Host
+		origin = "http://" + u.Host
+	)
+	switch u.Scheme {
+	case "ws":
+		if len(u.Port()) == 0 {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if len(u.Port()) == 0 {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		origin = "https://" + u.Host
+	default:
+		return nil, rerrDialFailed.Copy().SetDetail("invalid websocket url scheme: " + u.Scheme)
+	}
+	config, err := websocket.NewConfig(rawurl, origin)
+	if err != nil {
+		return nil, rerrDialFailed.Copy().SetDetail(err.Error())
+	}
+	return p.newSessionForClient(func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addr, p.defaultDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "wss" {
+			var tlsConfig *tls.Config
+			if p.tlsConfig != nil {
+				tlsConfig = p.tlsConfig.Clone()
+			} else {
+				tlsConfig = new(tls.Config)
+			}
+			if len(tlsConfig.ServerName) == 0 {
+				tlsConfig.ServerName = u.Hostname()
+			}
+			conn = tls.Client(conn, tlsConfig)
+		}
+		if p.defaultDialTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(p.defaultDialTimeout))
+			defer conn.SetDeadline(time.Time{})
+		}
+		return socket.NewWebsocketClientConn(config, conn)
+	}, rawurl, protoFunc)
+}
@@ -0,0 +1,58 @@
+package tp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebsocket(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	srv := NewPeer(PeerConfig{})
+	defer srv.Close()
+	srv.RoutePullFuncAt("/echo", func(ctx PullCtx, arg *string) (string, *Rerror) {
+		return *arg, nil
+	})
+	go srv.ListenAndServeWebsocket(addr, "/ws")
+
+	cli := NewPeer(PeerConfig{})
+	defer cli.Close()
+	var (
+		sess Session
+		rerr *Rerror
+	)
+	for i := 0; i < 100; i++ {
+		if sess, rerr = cli.DialWebsocket("ws://" + addr + "/ws"); rerr == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	var reply string
+	if rerr = sess.Pull("/echo", "hello", &reply).Rerror(); rerr != nil || reply != "hello" {
+		t.Fatalf("expect hello, got %q, %v", reply, rerr)
+	}
+	// the addresses are those of the underlying TCP connection
+	srvSess := waitSession(t, srv)
+	if _, ok := srvSess.RemoteAddr().(*net.TCPAddr); !ok || srvSess.RemoteAddr().String() != sess.LocalAddr().String() {
+		t.Fatalf("expect the remote TCP address %s, got %v", sess.LocalAddr(), srvSess.RemoteAddr())
+	}
+
+	for _, rawurl := range []string{
+		"http://" + addr + "/ws",
+		"ws://" + addr + "/unknown",
+		"://",
+	} {
+		if _, rerr = cli.DialWebsocket(rawurl); rerr == nil || rerr.Code != CodeDialFailed {
+			t.Fatalf("%s: expect CodeDialFailed, got %v", rawurl, rerr)
+		}
+	}
+}
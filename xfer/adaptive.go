@@ -0,0 +1,188 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xfer
+
+import (
+	"compress/gzip"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func init() {
+	Reg(newAdaptive('a'))
+}
+
+// The compression methods chosen by the adaptive filter per packet,
+// written as the first byte of the filtered data.
+const (
+	adaptiveNone byte = iota
+	adaptiveSnappy
+	adaptiveGzip
+)
+
+// the window of measuring the CPU time spent on the adaptive compression
+const adaptiveBudgetWindow = int64(time.Second)
+
+var (
+	adaptiveMinSize     int64 = 512
+	adaptiveGzipMinSize int64 = 32 << 10
+	adaptiveCPUBudget   float64
+)
+
+// ErrAdaptiveMethod error
+var ErrAdaptiveMethod = errors.New("adaptive: unknown compression method")
+
+// SetAdaptiveCompression configures the adaptive compression filter 'a',
+// which chooses the compression per packet by its size and the CPU budget:
+// no compression if smaller than minSize, snappy if smaller than gzipMinSize, otherwise gzip of level.
+// Note:
+//  If cpuBudget>0, it is the max ratio of one CPU spent on compressing,
+//  beyond which gzip falls back to snappy and snappy falls back to no compression, until the next second;
+//  The data is sent uncompressed if the compression does not make it smaller;
+//  The receiver decodes any choice without the configuration;
+//  It should be called before serving.
+func SetAdaptiveCompression(minSize, gzipMinSize int64, level int, cpuBudget float64) {
+	adaptiveMinSize = minSize
+	adaptiveGzipMinSize = gzipMinSize
+	adaptiveCPUBudget = cpuBudget
+	a, _ := Get('a')
+	a.(*Adaptive).gzip = newGzip('a', level)
+}
+
+// Adaptive the compression filter choosing none, snappy or gzip per packet.
+type Adaptive struct {
+	id          byte
+	gzip        *Gzip
+	windowStart int64 // unix nano
+	spent       int64 // nanoseconds spent on compressing in the current window
+}
+
+func newAdaptive(id byte) *Adaptive {
+	return &Adaptive{
+		id:   id,
+		gzip: newGzip(id, gzip.BestSpeed),
+	}
+}
+
+// Id returns transfer filter id.
+func (a *Adaptive) Id() byte {
+	return a.id
+}
+
+// OnPack performs filtering on packing.
+func (a *Adaptive) OnPack(src []byte) ([]byte, error) {
+	method := a.choose(int64(len(src)))
+	if method == adaptiveNone {
+		return a.raw(src), nil
+	}
+	start := time.Now()
+	var (
+		dest []byte
+		err  error
+	)
+	switch method {
+	case adaptiveSnappy:
+		dest = make([]byte, 1+snappy.MaxEncodedLen(len(src)))
+		dest = dest[:1+len(snappy.Encode(dest[1:], src))]
+	case adaptiveGzip:
+		var b []byte
+		b, err = a.gzip.OnPack(src)
+		if err == nil {
+			dest = make([]byte, 1+len(b))
+			copy(dest[1:], b)
+		}
+	}
+	a.spend(int64(time.Since(start)))
+	if err != nil {
+		return nil, err
+	}
+	if len(dest) > len(src) {
+		return a.raw(src), nil
+	}
+	dest[0] = method
+	return dest, nil
+}
+
+// OnUnpack performs filtering on unpacking.
+func (a *Adaptive) OnUnpack(src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return src, nil
+	}
+	switch src[0] {
+	case adaptiveNone:
+		return src[1:], nil
+	case adaptiveSnappy:
+		n, err := snappy.DecodedLen(src[1:])
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > gzipUnpackLimit(len(src)) {
+			return nil, ErrGzipUnpackTooLarge
+		}
+		return snappy.Decode(nil, src[1:])
+	case adaptiveGzip:
+		return a.gzip.OnUnpack(src[1:])
+	}
+	return nil, ErrAdaptiveMethod
+}
+
+func (a *Adaptive) raw(src []byte) []byte {
+	dest := make([]byte, 1+len(src))
+	dest[0] = adaptiveNone
+	copy(dest[1:], src)
+	return dest
+}
+
+// choose chooses the compression method by the size and the CPU budget.
+func (a *Adaptive) choose(size int64) byte {
+	var method byte
+	switch {
+	case size < adaptiveMinSize:
+		return adaptiveNone
+	case size < adaptiveGzipMinSize:
+		method = adaptiveSnappy
+	default:
+		method = adaptiveGzip
+	}
+	if a.overBudget() {
+		method--
+	}
+	return method
+}
+
+// overBudget checks whether the CPU time spent in the current window exceeds the budget.
+func (a *Adaptive) overBudget() bool {
+	if adaptiveCPUBudget <= 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	start := atomic.LoadInt64(&a.windowStart)
+	if now-start >= adaptiveBudgetWindow {
+		if atomic.CompareAndSwapInt64(&a.windowStart, start, now) {
+			atomic.StoreInt64(&a.spent, 0)
+		}
+		return false
+	}
+	return float64(atomic.LoadInt64(&a.spent)) > adaptiveCPUBudget*float64(adaptiveBudgetWindow)
+}
+
+func (a *Adaptive) spend(d int64) {
+	if adaptiveCPUBudget > 0 {
+		atomic.AddInt64(&a.spent, d)
+	}
+}
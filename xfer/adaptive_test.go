@@ -0,0 +1,62 @@
+package xfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestAdaptive(t *testing.T) {
+	defer SetAdaptiveCompression(512, 32<<10, gzip.BestSpeed, 0)
+	SetAdaptiveCompression(512, 32<<10, gzip.BestSpeed, 0)
+	a, err := Get('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		size   int
+		method byte
+	}{
+		{100, adaptiveNone},
+		{4 << 10, adaptiveSnappy},
+		{64 << 10, adaptiveGzip},
+	}
+	for _, c := range cases {
+		src := bytes.Repeat([]byte("a"), c.size)
+		b, err := a.OnPack(src)
+		if err != nil {
+			t.Fatalf("%d: nopack: %v", c.size, err)
+		}
+		if b[0] != c.method {
+			t.Fatalf("%d: want method %d, have %d", c.size, c.method, b[0])
+		}
+		dest, err := a.OnUnpack(b)
+		if err != nil {
+			t.Fatalf("%d: nounpack: %v", c.size, err)
+		}
+		if !bytes.Equal(dest, src) {
+			t.Fatalf("%d: unpacked data mismatched", c.size)
+		}
+	}
+	if _, err = a.OnUnpack([]byte{9, 1}); err != ErrAdaptiveMethod {
+		t.Fatalf("want %v, have %v", ErrAdaptiveMethod, err)
+	}
+}
+
+func TestAdaptiveCPUBudget(t *testing.T) {
+	defer SetAdaptiveCompression(512, 32<<10, gzip.BestSpeed, 0)
+	// a tiny budget is exhausted by the first compression
+	SetAdaptiveCompression(512, 32<<10, gzip.BestSpeed, 1e-9)
+	a, _ := Get('a')
+	src := bytes.Repeat([]byte("teleport"), 8<<10)
+	b, err := a.OnPack(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != adaptiveGzip {
+		t.Fatalf("want gzip within the budget, have %d", b[0])
+	}
+	if b, _ = a.OnPack(src); b[0] != adaptiveSnappy {
+		t.Fatalf("want snappy beyond the budget, have %d", b[0])
+	}
+}
@@ -1,6 +1,7 @@
 package xfer
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -19,3 +20,24 @@ func TestGzip(t *testing.T) {
 	}
 	t.Logf("gunzip ok: want \"src\", have %q", string(src))
 }
+
+func TestGzipUnpackLimit(t *testing.T) {
+	defer SetGzipUnpackLimit(0, 0)
+	gzip := newGzip('g', 5)
+	b, err := gzip.OnPack(bytes.Repeat([]byte("a"), 1<<20))
+	if err != nil {
+		t.Fatalf("nopack: %v", err)
+	}
+	SetGzipUnpackLimit(1<<20, 0)
+	if _, err = gzip.OnUnpack(b); err != nil {
+		t.Fatalf("unpack within the size limit: %v", err)
+	}
+	SetGzipUnpackLimit(1<<20-1, 0)
+	if _, err = gzip.OnUnpack(b); err != ErrGzipUnpackTooLarge {
+		t.Fatalf("unpack beyond the size limit: want %v, have %v", ErrGzipUnpackTooLarge, err)
+	}
+	SetGzipUnpackLimit(0, 100)
+	if _, err = gzip.OnUnpack(b); err != ErrGzipUnpackTooLarge {
+		t.Fatalf("unpack beyond the ratio limit: want %v, have %v", ErrGzipUnpackTooLarge, err)
+	}
+}
@@ -17,15 +17,72 @@ package xfer
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"sync"
 
 	"github.com/henrylee2cn/teleport/utils"
 )
 
 func init() {
-	Reg(newGzip('g', 5))
+	g := newGzip('g', 5)
+	Reg(g)
+	for level := gzip.HuffmanOnly; level <= gzip.BestCompression; level++ {
+		if level == g.level {
+			gzipLevels[level-gzip.HuffmanOnly] = g
+		} else {
+			gzipLevels[level-gzip.HuffmanOnly] = newGzip('g', level)
+		}
+	}
+}
+
+// the gzip filters 'g' of every compression level
+var gzipLevels [gzip.BestCompression - gzip.HuffmanOnly + 1]*Gzip
+
+var (
+	gzipMaxUnpackSize  int64 = math.MaxUint32
+	gzipMaxUnpackRatio float64
+)
+
+// ErrGzipUnpackTooLarge error
+var ErrGzipUnpackTooLarge = errors.New("gzip: decompressed size exceeds the limit")
+
+// SetGzipUnpackLimit sets the limit of the decompressed size,
+// which is the smaller one of maxSize and maxRatio times of the compressed size,
+// otherwise the unpacking fails with ErrGzipUnpackTooLarge, so as to defend against the decompression bomb.
+// Note:
+//  If maxSize<=0, set it to max uint32, the same as the default;
+//  If maxRatio<=0, there is no ratio limit, the same as the default;
+//  It should be called before serving.
+func SetGzipUnpackLimit(maxSize int64, maxRatio float64) {
+	if maxSize <= 0 {
+		maxSize = math.MaxUint32
+	}
+	gzipMaxUnpackSize = maxSize
+	gzipMaxUnpackRatio = maxRatio
+}
+
+// GzipLevel returns the gzip filter 'g' compressing at the level,
+// whose packets are decoded by the registered filter 'g' regardless of the level.
+func GzipLevel(level int) *Gzip {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		panic(fmt.Sprintf("gzip: invalid compression level: %d", level))
+	}
+	return gzipLevels[level-gzip.HuffmanOnly]
+}
+
+// gzipUnpackLimit returns the limit of the decompressed size of src.
+func gzipUnpackLimit(srcSize int) int64 {
+	limit := gzipMaxUnpackSize
+	if gzipMaxUnpackRatio > 0 {
+		if r := float64(srcSize) * gzipMaxUnpackRatio; r < float64(limit) {
+			limit = int64(r)
+		}
+	}
+	return limit
 }
 
 func newGzip(id byte, level int) *Gzip {
@@ -92,6 +149,10 @@ func (g *Gzip) OnUnpack(src []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	dest, _ := ioutil.ReadAll(gr)
+	limit := gzipUnpackLimit(len(src))
+	dest, _ := ioutil.ReadAll(io.LimitReader(gr, limit+1))
+	if int64(len(dest)) > limit {
+		return nil, ErrGzipUnpackTooLarge
+	}
 	return dest, nil
 }
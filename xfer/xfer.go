@@ -63,6 +63,34 @@ func (x *XferPipe) AppendFrom(src *XferPipe) {
 	}
 }
 
+// Remove removes the transfer filters of the id.
+func (x *XferPipe) Remove(filterId byte) {
+	filters := x.filters[:0]
+	for _, filter := range x.filters {
+		if filter.Id() != filterId {
+			filters = append(filters, filter)
+		}
+	}
+	x.filters = filters
+}
+
+// Put replaces the transfer filters of the same id with the filter, or appends it if absent,
+// e.g. the gzip filter of another compression level.
+func (x *XferPipe) Put(filter XferFilter) error {
+	var found bool
+	for i, f := range x.filters {
+		if f.Id() == filter.Id() {
+			x.filters[i] = filter
+			found = true
+		}
+	}
+	if found {
+		return nil
+	}
+	x.filters = append(x.filters, filter)
+	return x.check()
+}
+
 func (x *XferPipe) check() error {
 	if x.Len() > math.MaxUint8 {
 		return ErrXferPipeTooLong